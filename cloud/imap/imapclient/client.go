@@ -70,6 +70,10 @@ type Options struct {
 	// Raw ingress and egress data will be written to this writer, if any.
 	// Note, this may include sensitive information such as credentials used
 	// during authentication.
+	//
+	// If DebugWriter also provides IngressWriter and EgressWriter methods
+	// (see mailtest.Recorder), ingress and egress data are written to the
+	// writers they return instead.
 	DebugWriter io.Writer
 	// Unilateral data handler.
 	UnilateralDataHandler *UnilateralDataHandler
@@ -84,15 +88,27 @@ func (options *Options) wrapReadWriter(rw io.ReadWriter) io.ReadWriter {
 	if options.DebugWriter == nil {
 		return rw
 	}
+	ingress, egress := options.DebugWriter, options.DebugWriter
+	if dw, ok := options.DebugWriter.(directionalDebugWriter); ok {
+		ingress, egress = dw.IngressWriter(), dw.EgressWriter()
+	}
 	return struct {
 		io.Reader
 		io.Writer
 	}{
-		Reader: io.TeeReader(rw, options.DebugWriter),
-		Writer: io.MultiWriter(rw, options.DebugWriter),
+		Reader: io.TeeReader(rw, ingress),
+		Writer: io.MultiWriter(rw, egress),
 	}
 }
 
+// directionalDebugWriter is implemented by debug writers which need to tell
+// ingress data apart from egress data.
+type directionalDebugWriter interface {
+	io.Writer
+	IngressWriter() io.Writer
+	EgressWriter() io.Writer
+}
+
 func (options *Options) decodeText(s string) (string, error) {
 	wordDecoder := options.WordDecoder
 	if wordDecoder == nil {
@@ -155,6 +171,7 @@ type Client struct {
 	decErr error
 
 	mutex        sync.Mutex
+	tlsConn      *tls.Conn
 	state        imap.ConnState
 	caps         imap.CapSet
 	enabled      imap.CapSet
@@ -291,6 +308,22 @@ func (c *Client) setWriteTimeout(dur time.Duration) {
 	}
 }
 
+// TLSConnectionState returns the client's TLS connection state. The return
+// values are their zero values if the connection doesn't use TLS.
+func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	c.mutex.Lock()
+	tc := c.tlsConn
+	c.mutex.Unlock()
+
+	if tc == nil {
+		tc, ok = c.conn.(*tls.Conn)
+		if !ok {
+			return
+		}
+	}
+	return tc.ConnectionState(), true
+}
+
 // State returns the current connection state of the client.
 func (c *Client) State() imap.ConnState {
 	c.mutex.Lock()
@@ -32,7 +32,15 @@ func (c *Client) startTLS(config *tls.Config) error {
 	// The decoder goroutine will invoke Client.upgradeStartTLS
 	<-upgradeDone
 
-	return cmd.tlsConn.Handshake()
+	if err := cmd.tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	c.tlsConn = cmd.tlsConn
+	c.mutex.Unlock()
+
+	return nil
 }
 
 // upgradeStartTLS finishes the STARTTLS upgrade after the server has sent an
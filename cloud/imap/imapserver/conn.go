@@ -72,6 +72,16 @@ func (c *Conn) NetConn() net.Conn {
 	return c.conn
 }
 
+// TLSConnectionState returns the connection's TLS connection state.
+// Zero values are returned if the connection doesn't use TLS.
+func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.NetConn().(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tc.ConnectionState(), true
+}
+
 // Bye terminates the IMAP connection.
 func (c *Conn) Bye(text string) error {
 	respErr := c.writeStatusResp("", &imap.StatusResponse{
@@ -0,0 +1,109 @@
+package imapmemserver_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/imap"
+	"github.com/unix-world/smartgoplus/cloud/imap/imapclient"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+	"github.com/unix-world/smartgoplus/cloud/smtp/imapdelivery"
+)
+
+func TestDelivery(t *testing.T) {
+	user, dial := newTestServer(t)
+
+	be := imapdelivery.New(imapdelivery.DirectoryFunc(func(rcpt string) (imapdelivery.User, error) {
+		if rcpt == testUsername+"@example.com" {
+			return user, nil
+		}
+		return nil, imapdelivery.ErrUnknownUser
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	numMessages := make(chan uint32, 1)
+	c := dial(&imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					numMessages <- *data.NumMessages
+				}
+			},
+		},
+	})
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+	idleCmd, err := c.Idle()
+	if err != nil {
+		t.Fatalf("Idle() = %v", err)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := smtp.NewClientLMTP(conn)
+	defer lc.Close()
+	if err := lc.Hello("localhost"); err != nil {
+		t.Fatalf("Hello() = %v", err)
+	}
+	if err := lc.Mail("sender@example.org", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := lc.Rcpt(testUsername+"@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	w, err := lc.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	if _, err := io.WriteString(w, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.CloseWithLMTPResponse(); err != nil {
+		t.Fatalf("CloseWithLMTPResponse() = %v", err)
+	}
+
+	select {
+	case n := <-numMessages:
+		if n != 1 {
+			t.Errorf("EXISTS = %v, want 1", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for EXISTS during IDLE")
+	}
+	if err := idleCmd.Close(); err != nil {
+		t.Fatalf("Idle.Close() = %v", err)
+	}
+	if err := idleCmd.Wait(); err != nil {
+		t.Fatalf("Idle.Wait() = %v", err)
+	}
+
+	// The IDLE-ing session selected the mailbox first, the delivered message
+	// is recent there
+	if l := recentSeqNums(t, c); len(l) != 1 || l[0] != 1 {
+		t.Errorf("recent messages = %v, want [1]", l)
+	}
+	fetchOptions := &imap.FetchOptions{
+		BodySection: []*imap.FetchItemBodySection{{Peek: true}},
+	}
+	msgs, err := c.Fetch(imap.SeqSetNum(1), fetchOptions).Collect()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	want := "Return-Path: <sender@example.org>\r\nDelivered-To: " + testUsername + "@example.com\r\n" + testMessage
+	if len(msgs) != 1 || len(msgs[0].BodySection) != 1 || string(msgs[0].BodySection[0].Bytes) != want {
+		t.Errorf("delivered message = %v, want %q", msgs, want)
+	}
+}
@@ -0,0 +1,233 @@
+package imapmemserver_test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/unix-world/smartgoplus/cloud/imap"
+	"github.com/unix-world/smartgoplus/cloud/imap/imapclient"
+	"github.com/unix-world/smartgoplus/cloud/imap/imapserver"
+	"github.com/unix-world/smartgoplus/cloud/imap/imapserver/imapmemserver"
+)
+
+const (
+	testUsername = "alice"
+	testPassword = "secret"
+)
+
+const testMessage = "From: sender@example.org\r\n" +
+	"To: alice@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi!\r\n"
+
+// newTestServer starts an IMAP server with a single user, and returns a
+// function to connect and log in.
+func newTestServer(t *testing.T) (*imapmemserver.User, func(options *imapclient.Options) *imapclient.Client) {
+	memServer := imapmemserver.New()
+	user := imapmemserver.NewUser(testUsername, testPassword)
+	if err := user.Create("INBOX", nil); err != nil {
+		t.Fatalf("Create() = %v", err)
+	}
+	memServer.AddUser(user)
+
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return memServer.NewSession(), nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapIdle:      {},
+		},
+		Logger:       log.New(io.Discard, "", 0),
+		InsecureAuth: true,
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	dial := func(options *imapclient.Options) *imapclient.Client {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := imapclient.New(conn, options)
+		t.Cleanup(func() { c.Close() })
+		if err := c.Login(testUsername, testPassword).Wait(); err != nil {
+			t.Fatalf("Login() = %v", err)
+		}
+		return c
+	}
+	return user, dial
+}
+
+func appendMessage(t *testing.T, user *imapmemserver.User) {
+	if _, err := user.Append("INBOX", strings.NewReader(testMessage), &imap.AppendOptions{}); err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+}
+
+// recentSeqNums returns the messages with the \Recent flag, as seen by the
+// client.
+func recentSeqNums(t *testing.T, c *imapclient.Client) []uint32 {
+	msgs, err := c.Fetch(imap.SeqSet{{Start: 1, Stop: 0}}, &imap.FetchOptions{Flags: true}).Collect()
+	if err != nil {
+		t.Fatalf("Fetch() = %v", err)
+	}
+	var l []uint32
+	for _, msg := range msgs {
+		for _, flag := range msg.Flags {
+			if flag == "\\Recent" {
+				l = append(l, msg.SeqNum)
+			}
+		}
+	}
+	return l
+}
+
+func numRecent(t *testing.T, user *imapmemserver.User) uint32 {
+	data, err := user.Status("INBOX", &imap.StatusOptions{NumRecent: true})
+	if err != nil {
+		t.Fatalf("Status() = %v", err)
+	}
+	return *data.NumRecent
+}
+
+func equalSeqNums(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecent(t *testing.T) {
+	user, dial := newTestServer(t)
+	appendMessage(t, user)
+	if n := numRecent(t, user); n != 1 {
+		t.Errorf("STATUS RECENT = %v, want 1", n)
+	}
+
+	// EXAMINE doesn't claim the recent messages
+	examiner := dial(nil)
+	if _, err := examiner.Select("INBOX", &imap.SelectOptions{ReadOnly: true}).Wait(); err != nil {
+		t.Fatalf("Examine() = %v", err)
+	}
+	if l := recentSeqNums(t, examiner); !equalSeqNums(l, []uint32{1}) {
+		t.Errorf("recent messages after EXAMINE = %v, want [1]", l)
+	}
+	if n := numRecent(t, user); n != 1 {
+		t.Errorf("STATUS RECENT after EXAMINE = %v, want 1", n)
+	}
+
+	// The first session selecting the mailbox sees the recent messages, and
+	// keeps seeing them after changing their flags
+	first := dial(nil)
+	if _, err := first.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+	if l := recentSeqNums(t, first); !equalSeqNums(l, []uint32{1}) {
+		t.Errorf("recent messages after SELECT = %v, want [1]", l)
+	}
+	storeFlags := &imap.StoreFlags{Op: imap.StoreFlagsSet, Flags: []imap.Flag{imap.FlagSeen}, Silent: true}
+	if err := first.Store(imap.SeqSetNum(1), storeFlags, nil).Close(); err != nil {
+		t.Fatalf("Store() = %v", err)
+	}
+	if l := recentSeqNums(t, first); !equalSeqNums(l, []uint32{1}) {
+		t.Errorf("recent messages after STORE = %v, want [1]", l)
+	}
+	data, err := first.Search(&imap.SearchCriteria{Flag: []imap.Flag{"\\Recent"}}, nil).Wait()
+	if err != nil {
+		t.Fatalf("Search() = %v", err)
+	}
+	if l := data.AllSeqNums(); !equalSeqNums(l, []uint32{1}) {
+		t.Errorf("SEARCH RECENT = %v, want [1]", l)
+	}
+
+	// Other sessions don't
+	if l := recentSeqNums(t, examiner); len(l) != 0 {
+		t.Errorf("recent messages in EXAMINE session = %v, want none", l)
+	}
+	second := dial(nil)
+	if _, err := second.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+	if l := recentSeqNums(t, second); len(l) != 0 {
+		t.Errorf("recent messages in second session = %v, want none", l)
+	}
+
+	// New messages are recent in the first session only
+	appendMessage(t, user)
+	if err := first.Noop().Wait(); err != nil {
+		t.Fatalf("Noop() = %v", err)
+	}
+	if err := second.Noop().Wait(); err != nil {
+		t.Fatalf("Noop() = %v", err)
+	}
+	if l := recentSeqNums(t, first); !equalSeqNums(l, []uint32{1, 2}) {
+		t.Errorf("recent messages in first session = %v, want [1 2]", l)
+	}
+	if l := recentSeqNums(t, second); len(l) != 0 {
+		t.Errorf("recent messages in second session = %v, want none", l)
+	}
+	if n := numRecent(t, user); n != 2 {
+		t.Errorf("STATUS RECENT = %v, want 2", n)
+	}
+
+	// Messages are no longer recent once the session is done with them
+	if err := first.Unselect().Wait(); err != nil {
+		t.Fatalf("Unselect() = %v", err)
+	}
+	if n := numRecent(t, user); n != 0 {
+		t.Errorf("STATUS RECENT after UNSELECT = %v, want 0", n)
+	}
+	if _, err := first.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatalf("Select() = %v", err)
+	}
+	if l := recentSeqNums(t, first); len(l) != 0 {
+		t.Errorf("recent messages after re-SELECT = %v, want none", l)
+	}
+}
+
+func TestStorageLimit(t *testing.T) {
+	user, dial := newTestServer(t)
+	user.SetStorageLimit(int64(len(testMessage)) + 1)
+	c := dial(nil)
+
+	appendCmd := func() error {
+		cmd := c.Append("INBOX", int64(len(testMessage)), nil)
+		if _, err := io.WriteString(cmd, testMessage); err != nil {
+			return err
+		}
+		if err := cmd.Close(); err != nil {
+			return err
+		}
+		_, err := cmd.Wait()
+		return err
+	}
+
+	if err := appendCmd(); err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	var imapErr *imap.Error
+	if err := appendCmd(); !errors.As(err, &imapErr) || imapErr.Code != imap.ResponseCodeOverQuota {
+		t.Errorf("Append() over quota = %v, want OVERQUOTA", err)
+	}
+
+	user.SetStorageLimit(0)
+	if err := appendCmd(); err != nil {
+		t.Errorf("Append() without limit = %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/unix-world/smartgoplus/cloud/imap"
 	"github.com/unix-world/smartgoplus/cloud/imap/imapserver"
+	"github.com/unix-world/smartgoplus/cloud/imap/internal"
 )
 
 // Mailbox is an in-memory mailbox.
@@ -24,6 +25,8 @@ type Mailbox struct {
 	specialUse []imap.MailboxAttr
 	l          []*message
 	uidNext    imap.UID
+	// Views selected read-write, oldest first
+	views []*MailboxView
 }
 
 // NewMailbox creates a new mailbox.
@@ -95,7 +98,12 @@ func (mbox *Mailbox) statusDataLocked(options *imap.StatusOptions) *imap.StatusD
 		data.Size = &size
 	}
 	if options.NumRecent {
-		num := uint32(0)
+		var num uint32
+		for _, msg := range mbox.l {
+			if msg.recent || msg.recentView != nil {
+				num++
+			}
+		}
 		data.NumRecent = &num
 	}
 	return &data
@@ -146,8 +154,11 @@ func (mbox *Mailbox) appendBytes(buf []byte, options *imap.AppendOptions) *imap.
 		msg.t = options.Time
 	}
 
+	// \Recent is managed by the server: all new messages are recent
 	for _, flag := range options.Flags {
-		msg.flags[canonicalFlag(flag)] = struct{}{}
+		if flag := canonicalFlag(flag); flag != canonicalFlag(internal.FlagRecent) {
+			msg.flags[flag] = struct{}{}
+		}
 	}
 
 	mbox.mutex.Lock()
@@ -156,6 +167,12 @@ func (mbox *Mailbox) appendBytes(buf []byte, options *imap.AppendOptions) *imap.
 	msg.uid = mbox.uidNext
 	mbox.uidNext++
 
+	if len(mbox.views) > 0 {
+		msg.recentView = mbox.views[0]
+	} else {
+		msg.recent = true
+	}
+
 	mbox.l = append(mbox.l, msg)
 	mbox.tracker.QueueNumMessages(uint32(len(mbox.l)))
 
@@ -302,13 +319,58 @@ type MailboxView struct {
 	*Mailbox
 	tracker   *imapserver.SessionTracker
 	searchRes imap.UIDSet
+	readOnly  bool
 }
 
 // Close releases the resources allocated for the mailbox view.
 func (mbox *MailboxView) Close() {
+	mbox.mutex.Lock()
+	for i, view := range mbox.views {
+		if view == mbox {
+			mbox.views = append(mbox.views[:i:i], mbox.views[i+1:]...)
+			break
+		}
+	}
+	// Messages are only recent for the duration of the session
+	for _, msg := range mbox.l {
+		if msg.recentView == mbox {
+			msg.recentView = nil
+		}
+	}
+	mbox.mutex.Unlock()
+
 	mbox.tracker.Close()
 }
 
+// selectLocked selects the mailbox view. A read-write view claims the new
+// messages: they're recent in this view only, like the messages delivered
+// while it is selected.
+func (mbox *MailboxView) selectLocked(readOnly bool) *imap.SelectData {
+	mbox.readOnly = readOnly
+	if !readOnly {
+		mbox.views = append(mbox.views, mbox)
+		for _, msg := range mbox.l {
+			if msg.recent {
+				msg.recent = false
+				msg.recentView = mbox
+			}
+		}
+	}
+
+	data := mbox.selectDataLocked()
+	for _, msg := range mbox.l {
+		if mbox.isRecentLocked(msg) {
+			data.NumRecent++
+		}
+	}
+	return data
+}
+
+// isRecentLocked checks whether a message is recent in this view.
+func (mbox *MailboxView) isRecentLocked(msg *message) bool {
+	return msg.recentView == mbox || (mbox.readOnly && msg.recent)
+}
+
 func (mbox *MailboxView) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
 	markSeen := false
 	for _, bs := range options.BodySection {
@@ -330,7 +392,7 @@ func (mbox *MailboxView) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, op
 		}
 
 		respWriter := w.CreateMessage(mbox.tracker.EncodeSeqNum(seqNum))
-		err = msg.fetch(respWriter, options)
+		err = msg.fetch(respWriter, options, mbox.isRecentLocked(msg))
 	})
 	return err
 }
@@ -349,7 +411,7 @@ func (mbox *MailboxView) Search(numKind imapserver.NumKind, criteria *imap.Searc
 	for i, msg := range mbox.l {
 		seqNum := mbox.tracker.EncodeSeqNum(uint32(i) + 1)
 
-		if !msg.search(seqNum, criteria) {
+		if !msg.search(seqNum, mbox.isRecentLocked(msg), criteria) {
 			continue
 		}
 
@@ -10,6 +10,7 @@ import (
 
 	"github.com/unix-world/smartgoplus/cloud/imap"
 	"github.com/unix-world/smartgoplus/cloud/imap/imapserver"
+	"github.com/unix-world/smartgoplus/cloud/imap/internal"
 
 	gomessage "github.com/unix-world/smartgoext/cloud/message"
 	"github.com/unix-world/smartgoext/cloud/message/mail"
@@ -24,13 +25,22 @@ type message struct {
 
 	// mutable, protected by Mailbox.mutex
 	flags map[imap.Flag]struct{}
+	// \Recent state (RFC 3501 section 2.3.2): recent is set until a session
+	// selects the mailbox read-write, recentView is the session which then
+	// sees the message as recent
+	recent     bool
+	recentView *MailboxView
 }
 
-func (msg *message) fetch(w *imapserver.FetchResponseWriter, options *imap.FetchOptions) error {
+func (msg *message) fetch(w *imapserver.FetchResponseWriter, options *imap.FetchOptions, recent bool) error {
 	w.WriteUID(msg.uid)
 
 	if options.Flags {
-		w.WriteFlags(msg.flagList())
+		flags := msg.flagList()
+		if recent {
+			flags = append(flags, internal.FlagRecent)
+		}
+		w.WriteFlags(flags)
 	}
 	if options.InternalDate {
 		w.WriteInternalDate(msg.t)
@@ -97,17 +107,24 @@ func (msg *message) flagList() []imap.Flag {
 }
 
 func (msg *message) store(store *imap.StoreFlags) {
+	// \Recent cannot be altered by clients
+	recentFlag := canonicalFlag(internal.FlagRecent)
+
 	switch store.Op {
 	case imap.StoreFlagsSet:
 		msg.flags = make(map[imap.Flag]struct{})
 		fallthrough
 	case imap.StoreFlagsAdd:
 		for _, flag := range store.Flags {
-			msg.flags[canonicalFlag(flag)] = struct{}{}
+			if flag := canonicalFlag(flag); flag != recentFlag {
+				msg.flags[flag] = struct{}{}
+			}
 		}
 	case imap.StoreFlagsDel:
 		for _, flag := range store.Flags {
-			delete(msg.flags, canonicalFlag(flag))
+			if flag := canonicalFlag(flag); flag != recentFlag {
+				delete(msg.flags, flag)
+			}
 		}
 	default:
 		panic(fmt.Errorf("unknown STORE flag operation: %v", store.Op))
@@ -122,7 +139,16 @@ func (msg *message) reader() *gomessage.Entity {
 	return r
 }
 
-func (msg *message) search(seqNum uint32, criteria *imap.SearchCriteria) bool {
+func (msg *message) hasFlag(flag imap.Flag, recent bool) bool {
+	flag = canonicalFlag(flag)
+	if flag == canonicalFlag(internal.FlagRecent) {
+		return recent
+	}
+	_, ok := msg.flags[flag]
+	return ok
+}
+
+func (msg *message) search(seqNum uint32, recent bool, criteria *imap.SearchCriteria) bool {
 	for _, seqSet := range criteria.SeqNum {
 		if seqNum == 0 || !seqSet.Contains(seqNum) {
 			return false
@@ -138,12 +164,12 @@ func (msg *message) search(seqNum uint32, criteria *imap.SearchCriteria) bool {
 	}
 
 	for _, flag := range criteria.Flag {
-		if _, ok := msg.flags[canonicalFlag(flag)]; !ok {
+		if !msg.hasFlag(flag, recent) {
 			return false
 		}
 	}
 	for _, flag := range criteria.NotFlag {
-		if _, ok := msg.flags[canonicalFlag(flag)]; ok {
+		if msg.hasFlag(flag, recent) {
 			return false
 		}
 	}
@@ -184,12 +210,12 @@ func (msg *message) search(seqNum uint32, criteria *imap.SearchCriteria) bool {
 	}
 
 	for _, not := range criteria.Not {
-		if msg.search(seqNum, &not) {
+		if msg.search(seqNum, recent, &not) {
 			return false
 		}
 	}
 	for _, or := range criteria.Or {
-		if !msg.search(seqNum, &or[0]) && !msg.search(seqNum, &or[1]) {
+		if !msg.search(seqNum, recent, &or[0]) && !msg.search(seqNum, recent, &or[1]) {
 			return false
 		}
 	}
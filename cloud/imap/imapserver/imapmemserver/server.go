@@ -27,7 +27,9 @@ func (s *Server) NewSession() imapserver.Session {
 	return &serverSession{server: s}
 }
 
-func (s *Server) user(username string) *User {
+// User returns the user with the specified username, or nil if there is no
+// such user.
+func (s *Server) User(username string) *User {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	return s.users[username]
@@ -49,7 +51,7 @@ type serverSession struct {
 var _ imapserver.Session = (*serverSession)(nil)
 
 func (sess *serverSession) Login(username, password string) error {
-	u := sess.server.user(username)
+	u := sess.server.User(username)
 	if u == nil {
 		return imapserver.ErrAuthFailed
 	}
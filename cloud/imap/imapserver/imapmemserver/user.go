@@ -18,6 +18,7 @@ type User struct {
 	mutex           sync.Mutex
 	mailboxes       map[string]*Mailbox
 	prevUidValidity uint32
+	storageLimit    int64
 }
 
 func NewUser(username, password string) *User {
@@ -118,9 +119,44 @@ func (u *User) Append(mailbox string, r imap.LiteralReader, options *imap.Append
 			Text: "No such mailbox",
 		}
 	}
+	if limit := u.StorageLimit(); limit > 0 && u.size()+r.Size() > limit {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeOverQuota,
+			Text: "Storage quota exceeded",
+		}
+	}
 	return mbox.appendLiteral(r, options)
 }
 
+// SetStorageLimit sets the maximum total size of the messages in the user's
+// mailboxes, in bytes. Zero means no limit.
+func (u *User) SetStorageLimit(limit int64) {
+	u.mutex.Lock()
+	u.storageLimit = limit
+	u.mutex.Unlock()
+}
+
+// StorageLimit returns the storage limit set with SetStorageLimit.
+func (u *User) StorageLimit() int64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.storageLimit
+}
+
+func (u *User) size() int64 {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	var size int64
+	for _, mbox := range u.mailboxes {
+		mbox.mutex.Lock()
+		size += mbox.sizeLocked()
+		mbox.mutex.Unlock()
+	}
+	return size
+}
+
 func (u *User) Create(name string, options *imap.CreateOptions) error {
 	u.mutex.Lock()
 	defer u.mutex.Unlock()
@@ -0,0 +1,267 @@
+package mailtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type backend struct{}
+
+func (be *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &session{}, nil
+}
+
+type session struct{}
+
+func (s *session) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+func (s *session) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if username != "username" || password != "password" {
+			return errors.New("Invalid username or password")
+		}
+		return nil
+	}), nil
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (s *session) Reset()                                         {}
+func (s *session) Logout() error                                  { return nil }
+
+func (s *session) Data(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+const testMsg = "From: root@nsa.gov\r\n" +
+	"To: root@gchq.gov.uk\r\n" +
+	"\r\n" +
+	"Hey <3\r\n"
+
+func sendTestMail(c *smtp.Client, password, to string) error {
+	if err := c.Auth(sasl.NewPlainClient("", "username", password)); err != nil {
+		return err
+	}
+	if err := c.SendMail("root@nsa.gov", []string{to}, strings.NewReader(testMsg)); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func recordTestMail(t *testing.T) Transcript {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := smtp.NewServer(&backend{})
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecorder()
+	c.DebugWriter = rec
+
+	if err := sendTestMail(c, "password", "root@gchq.gov.uk"); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Transcript()
+}
+
+func TestRecordReplay(t *testing.T) {
+	script := recordTestMail(t)
+
+	var buf bytes.Buffer
+	if _, err := script.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "password") {
+		t.Fatalf("Transcript contains credentials:\n%v", buf.String())
+	}
+	if !strings.Contains(buf.String(), "C: AUTH PLAIN "+Redacted+"\n") {
+		t.Fatalf("Transcript doesn't contain redacted AUTH command:\n%v", buf.String())
+	}
+
+	script, err := ReadTranscript(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := Replay(t, script, nil)
+	if err := sendTestMail(smtp.NewClient(conn), "another password", "root@gchq.gov.uk"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	script := recordTestMail(t)
+
+	conn := NewReplayConn(script, nil)
+	if err := sendTestMail(smtp.NewClient(conn), "password", "root@mi6.gov.uk"); err == nil {
+		t.Fatal("Expected an error")
+	}
+
+	var mismatchErr *MismatchError
+	if !errors.As(conn.Verify(), &mismatchErr) {
+		t.Fatalf("Expected a MismatchError, got %v", conn.Verify())
+	}
+	if mismatchErr.Want != "RCPT TO:<root@gchq.gov.uk>" {
+		t.Errorf("Unexpected mismatching line: %q", mismatchErr.Want)
+	}
+}
+
+func TestReplayTags(t *testing.T) {
+	script, err := ReadTranscript(strings.NewReader(`
+# IMAP session recorded with another client
+S: * OK IMAP4rev1 Service Ready
+C: a001 LOGIN [redacted]
+S: a001 OK LOGIN completed
+C: a002 LOGOUT
+S: * BYE
+S: a002 OK LOGOUT completed
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := Replay(t, script, &ReplayOptions{NormalizeTags: true})
+	buf := make([]byte, 1024)
+	expect := func(want string) {
+		t.Helper()
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want+"\r\n" {
+			t.Fatalf("Read() = %q, want %q", got, want)
+		}
+	}
+
+	expect("* OK IMAP4rev1 Service Ready")
+	io.WriteString(conn, "T1 LOGIN \"user\" \"pass\"\r\n")
+	expect("T1 OK LOGIN completed")
+	io.WriteString(conn, "T2 LOGOUT\r\n")
+	expect("* BYE")
+	expect("T2 OK LOGOUT completed")
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("Read() = %v, want EOF", err)
+	}
+}
+
+func TestRecorderRedact(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// Lines prefixed with "C: " or "S: ", without CRLF
+		conv []string
+		want []string
+	}{
+		{
+			name: "login",
+			conv: []string{"C: a1 LOGIN alice secret", "S: a1 OK"},
+			want: []string{"C: a1 LOGIN " + Redacted, "S: a1 OK"},
+		},
+		{
+			name: "login literals",
+			conv: []string{
+				"C: a1 LOGIN {5}",
+				"S: + Ready",
+				"C: alice {6}",
+				"S: + Ready",
+				"C: secret",
+				"S: a1 OK",
+				"C: a2 NOOP",
+			},
+			want: []string{
+				"C: a1 LOGIN " + Redacted,
+				"S: + Ready",
+				"C: " + Redacted,
+				"S: + Ready",
+				"C: " + Redacted,
+				"S: a1 OK",
+				"C: a2 NOOP",
+			},
+		},
+		{
+			name: "login non-synchronizing literal",
+			conv: []string{"C: a1 LOGIN alice {6+}", "C: secret", "S: a1 OK", "C: a2 NOOP"},
+			want: []string{"C: a1 LOGIN " + Redacted, "C: " + Redacted, "S: a1 OK", "C: a2 NOOP"},
+		},
+		{
+			name: "authenticate",
+			conv: []string{
+				"C: a1 AUTHENTICATE PLAIN",
+				"S: + ",
+				"C: AGFsaWNlAHNlY3JldA==",
+				"S: a1 OK",
+				"C: a2 NOOP",
+			},
+			want: []string{
+				"C: a1 AUTHENTICATE PLAIN",
+				"S: + ",
+				"C: " + Redacted,
+				"S: a1 OK",
+				"C: a2 NOOP",
+			},
+		},
+		{
+			name: "authenticate multiple steps",
+			conv: []string{
+				"C: a1 AUTHENTICATE LOGIN",
+				"S: + VXNlcm5hbWU6",
+				"C: YWxpY2U=",
+				"S: + UGFzc3dvcmQ6",
+				"C: c2VjcmV0",
+				"S: a1 OK",
+			},
+			want: []string{
+				"C: a1 AUTHENTICATE LOGIN",
+				"S: + VXNlcm5hbWU6",
+				"C: " + Redacted,
+				"S: + UGFzc3dvcmQ6",
+				"C: " + Redacted,
+				"S: a1 OK",
+			},
+		},
+		{
+			name: "authenticate cancelled",
+			conv: []string{"C: a1 AUTHENTICATE PLAIN", "S: + ", "C: *", "S: a1 BAD", "C: a2 NOOP"},
+			want: []string{"C: a1 AUTHENTICATE PLAIN", "S: + ", "C: *", "S: a1 BAD", "C: a2 NOOP"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := NewRecorder()
+			for _, l := range tc.conv {
+				w := rec.EgressWriter()
+				if strings.HasPrefix(l, "S: ") {
+					w = rec.IngressWriter()
+				}
+				io.WriteString(w, l[3:]+"\r\n")
+			}
+
+			var buf bytes.Buffer
+			if _, err := rec.Transcript().WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Join(tc.want, "\n") + "\n"
+			if got := buf.String(); got != want {
+				t.Errorf("Transcript() =\n%v\nwant:\n%v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package mailtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errUndirectedWrite = errors.New("mailtest: Recorder needs a client with direction-aware DebugWriter support")
+
+// Recorder records a protocol conversation. It is meant to be used as the
+// DebugWriter of an smtp.Client or of imapclient.Options:
+//
+//	rec := mailtest.NewRecorder()
+//	c.DebugWriter = rec
+//	// ... use c ...
+//	rec.Transcript().Save("testdata/send.txt")
+//
+// Credentials sent by the client (SMTP AUTH, IMAP LOGIN and AUTHENTICATE,
+// and the literals or SASL responses which follow) are replaced with
+// Redacted.
+//
+// The client must write to the IngressWriter and EgressWriter methods, as
+// smtp.Client and imapclient.Client do. Data written to the Recorder itself
+// has no direction and is rejected.
+type Recorder struct {
+	mutex   sync.Mutex
+	lines   Transcript
+	pending [2][]byte
+	inAuth  bool
+	// IMAP LOGIN command continued with literals
+	inLogin      bool
+	literalBytes int64
+}
+
+var _ io.Writer = (*Recorder)(nil)
+
+// NewRecorder creates a new recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Write implements io.Writer. It always fails: data written without a
+// direction cannot be recorded, use IngressWriter and EgressWriter instead.
+func (rec *Recorder) Write(b []byte) (int, error) {
+	return 0, errUndirectedWrite
+}
+
+// IngressWriter returns a writer recording data received from the server.
+func (rec *Recorder) IngressWriter() io.Writer {
+	return recorderWriter{rec, FromServer}
+}
+
+// EgressWriter returns a writer recording data sent by the client.
+func (rec *Recorder) EgressWriter() io.Writer {
+	return recorderWriter{rec, FromClient}
+}
+
+// Transcript returns the conversation recorded so far. Incomplete lines are
+// included as-is.
+func (rec *Recorder) Transcript() Transcript {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	t := make(Transcript, len(rec.lines), len(rec.lines)+2)
+	copy(t, rec.lines)
+	for _, dir := range []Direction{FromServer, FromClient} {
+		if b := rec.pending[dir]; len(b) > 0 {
+			t = append(t, Line{From: dir, Data: bytes.Clone(b)})
+		}
+	}
+	return t
+}
+
+func (rec *Recorder) write(dir Direction, b []byte) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+
+	buf := append(rec.pending[dir], b...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.Clone(buf[:i+1])
+		buf = buf[i+1:]
+
+		if dir == FromClient {
+			line = rec.redact(line)
+		} else if rec.inAuth && !isSASLChallenge(line) {
+			rec.inAuth = false
+		}
+		rec.lines = append(rec.lines, Line{From: dir, Data: line})
+	}
+	rec.pending[dir] = bytes.Clone(buf)
+}
+
+// redact strips credentials from a client line.
+func (rec *Recorder) redact(line []byte) []byte {
+	text := strings.TrimRight(string(line), "\r\n")
+	eol := string(line[len(text):])
+
+	if rec.inLogin {
+		// The line starts with literal data, possibly followed by another
+		// literal
+		n := int64(len(line))
+		if n > rec.literalBytes {
+			n = rec.literalBytes
+		}
+		rec.literalBytes -= n
+		// If the literal data ends the line, the command continues on the
+		// next one
+		if rec.literalBytes == 0 && n < int64(len(line)) {
+			rec.literalBytes, rec.inLogin = literalSize(strings.TrimRight(string(line[n:]), "\r\n"))
+		}
+		return []byte(Redacted + eol)
+	}
+
+	if rec.inAuth {
+		if text == "*" {
+			// SASL exchange cancelled by the client
+			return line
+		}
+		return []byte(Redacted + eol)
+	}
+
+	fields := strings.Fields(text)
+	switch {
+	case len(fields) >= 2 && strings.EqualFold(fields[0], "AUTH"):
+		// SMTP: AUTH <mechanism> [initial-response]
+		rec.inAuth = true
+		if len(fields) > 2 {
+			return []byte(fields[0] + " " + fields[1] + " " + Redacted + eol)
+		}
+	case len(fields) >= 3 && strings.EqualFold(fields[1], "AUTHENTICATE"):
+		// IMAP: <tag> AUTHENTICATE <mechanism> [initial-response]
+		rec.inAuth = true
+		if len(fields) > 3 {
+			return []byte(fields[0] + " " + fields[1] + " " + fields[2] + " " + Redacted + eol)
+		}
+	case len(fields) >= 3 && strings.EqualFold(fields[1], "LOGIN"):
+		// IMAP: <tag> LOGIN <username> <password>, the username and
+		// password may be sent as literals
+		rec.literalBytes, rec.inLogin = literalSize(text)
+		return []byte(fields[0] + " " + fields[1] + " " + Redacted + eol)
+	}
+	return line
+}
+
+// literalSize parses the IMAP literal announced at the end of a line, e.g.
+// "{5}" or "{5+}".
+func literalSize(text string) (int64, bool) {
+	if !strings.HasSuffix(text, "}") {
+		return 0, false
+	}
+	i := strings.LastIndexByte(text, '{')
+	if i < 0 {
+		return 0, false
+	}
+	s := strings.TrimRight(text[i+1:len(text)-1], "+-")
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// isSASLChallenge checks whether a server line continues a SASL exchange.
+func isSASLChallenge(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("334")) || bytes.HasPrefix(line, []byte("+"))
+}
+
+type recorderWriter struct {
+	rec *Recorder
+	dir Direction
+}
+
+func (w recorderWriter) Write(b []byte) (int, error) {
+	w.rec.write(w.dir, b)
+	return len(b), nil
+}
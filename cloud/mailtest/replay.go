@@ -0,0 +1,339 @@
+package mailtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ReplayOptions contains options for ReplayConn.
+type ReplayOptions struct {
+	// Normalize IMAP command tags: the tags sent by the client don't need to
+	// match the recorded ones, and tagged server responses are rewritten to
+	// use the client's tags.
+	NormalizeTags bool
+}
+
+// MismatchError is returned when the client sends a line which doesn't match
+// the transcript.
+type MismatchError struct {
+	// Index of the expected line in the transcript.
+	Index int
+	Want  string
+	Got   string
+}
+
+func (err *MismatchError) Error() string {
+	return fmt.Sprintf("mailtest: transcript line %d: client sent %q, want %q", err.Index+1, err.Got, err.Want)
+}
+
+// ReplayConn is a fake net.Conn playing back the server side of a transcript.
+//
+// Server lines are only made available to the client once all client lines
+// recorded before them have been received.
+type ReplayConn struct {
+	script  Transcript
+	options ReplayOptions
+
+	mutex   sync.Mutex
+	changed chan struct{} // closed and replaced on every state change
+	client  int           // index of the next expected client line
+	server  int           // index of the next server line to deliver
+	rbuf    []byte        // unread part of the current server line
+	wbuf    []byte        // incomplete client line
+	tags    map[string]string
+	err     error
+	closed  bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ net.Conn = (*ReplayConn)(nil)
+
+// NewReplayConn creates a new fake connection replaying a transcript.
+//
+// A nil options pointer is equivalent to a zero options value.
+func NewReplayConn(script Transcript, options *ReplayOptions) *ReplayConn {
+	if options == nil {
+		options = &ReplayOptions{}
+	}
+	conn := &ReplayConn{
+		script:  script,
+		options: *options,
+		changed: make(chan struct{}),
+		tags:    make(map[string]string),
+	}
+	conn.client = conn.nextLine(0, FromClient)
+	conn.server = conn.nextLine(0, FromServer)
+	return conn
+}
+
+// Replay creates a new fake connection replaying a transcript, and reports
+// an error to t at the end of the test if the conversation didn't match the
+// transcript.
+func Replay(t testing.TB, script Transcript, options *ReplayOptions) *ReplayConn {
+	t.Helper()
+
+	conn := NewReplayConn(script, options)
+	t.Cleanup(func() {
+		if err := conn.Verify(); err != nil {
+			t.Error(err)
+		}
+	})
+	return conn
+}
+
+// Err returns the first mismatch encountered, if any.
+func (conn *ReplayConn) Err() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.err
+}
+
+// Verify checks that the whole transcript has been played back and that the
+// client didn't deviate from it.
+func (conn *ReplayConn) Verify() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.err != nil {
+		return conn.err
+	}
+	if conn.client < len(conn.script) {
+		return fmt.Errorf("mailtest: transcript line %d: client didn't send %q", conn.client+1, conn.script[conn.client].Text())
+	}
+	if len(conn.rbuf) > 0 {
+		return fmt.Errorf("mailtest: client didn't read %q", conn.rbuf)
+	}
+	if conn.server < len(conn.script) {
+		return fmt.Errorf("mailtest: transcript line %d: client didn't read %q", conn.server+1, conn.script[conn.server].Text())
+	}
+	return nil
+}
+
+func (conn *ReplayConn) nextLine(i int, dir Direction) int {
+	for i < len(conn.script) && conn.script[i].From != dir {
+		i++
+	}
+	return i
+}
+
+// notify wakes up blocked readers. Called with the mutex held.
+func (conn *ReplayConn) notify() {
+	close(conn.changed)
+	conn.changed = make(chan struct{})
+}
+
+// Read implements net.Conn.
+func (conn *ReplayConn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for len(conn.rbuf) == 0 {
+		if conn.closed {
+			return 0, net.ErrClosed
+		}
+		if conn.err != nil {
+			return 0, io.EOF
+		}
+		if conn.server < conn.client {
+			conn.rbuf = conn.rewriteTag(conn.script[conn.server].Data)
+			conn.server = conn.nextLine(conn.server+1, FromServer)
+			break
+		}
+		if conn.server == len(conn.script) && conn.client == len(conn.script) {
+			return 0, io.EOF
+		}
+
+		if err := conn.wait(conn.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, conn.rbuf)
+	conn.rbuf = conn.rbuf[n:]
+	return n, nil
+}
+
+// wait blocks until the state changes or the deadline expires. Called with
+// the mutex held.
+func (conn *ReplayConn) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	changed := conn.changed
+	conn.mutex.Unlock()
+	defer conn.mutex.Lock()
+
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// Write implements net.Conn.
+func (conn *ReplayConn) Write(b []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return 0, net.ErrClosed
+	}
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	if !conn.writeDeadline.IsZero() && time.Now().After(conn.writeDeadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	conn.wbuf = append(conn.wbuf, b...)
+	for {
+		i := bytes.IndexByte(conn.wbuf, '\n')
+		if i < 0 {
+			break
+		}
+		line := conn.wbuf[:i+1]
+		conn.wbuf = conn.wbuf[i+1:]
+
+		if err := conn.match(line); err != nil {
+			conn.err = err
+			conn.notify()
+			return 0, err
+		}
+		conn.client = conn.nextLine(conn.client+1, FromClient)
+		conn.notify()
+	}
+
+	return len(b), nil
+}
+
+// match checks a line sent by the client against the transcript. Called with
+// the mutex held.
+func (conn *ReplayConn) match(line []byte) error {
+	got := string(line)
+	if conn.client >= len(conn.script) {
+		return &MismatchError{Index: conn.client, Got: strings.TrimSuffix(got, "\r\n")}
+	}
+	want := string(conn.script[conn.client].Data)
+
+	if matchLine(want, got) {
+		return nil
+	}
+
+	if conn.options.NormalizeTags {
+		wantTag, wantRest, _ := strings.Cut(want, " ")
+		gotTag, gotRest, _ := strings.Cut(got, " ")
+		if mapped, ok := conn.tags[wantTag]; (!ok || mapped == gotTag) && wantRest != "" && matchLine(wantRest, gotRest) {
+			conn.tags[wantTag] = gotTag
+			return nil
+		}
+	}
+
+	return &MismatchError{
+		Index: conn.client,
+		Want:  strings.TrimSuffix(want, "\r\n"),
+		Got:   strings.TrimSuffix(got, "\r\n"),
+	}
+}
+
+func matchLine(want, got string) bool {
+	if want == got {
+		return true
+	}
+	wantText, ok := strings.CutSuffix(want, "\r\n")
+	if !ok {
+		return false
+	}
+	gotText, ok := strings.CutSuffix(got, "\r\n")
+	if !ok {
+		return false
+	}
+	prefix, ok := strings.CutSuffix(wantText, Redacted)
+	return ok && strings.HasPrefix(gotText, prefix)
+}
+
+// rewriteTag replaces a recorded tag in a server line with the one used by
+// the client. Called with the mutex held.
+func (conn *ReplayConn) rewriteTag(line []byte) []byte {
+	tag, rest, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return bytes.Clone(line)
+	}
+	if mapped, ok := conn.tags[string(tag)]; ok {
+		return append([]byte(mapped+" "), rest...)
+	}
+	return bytes.Clone(line)
+}
+
+// Close implements net.Conn.
+func (conn *ReplayConn) Close() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return net.ErrClosed
+	}
+	conn.closed = true
+	conn.notify()
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (conn *ReplayConn) LocalAddr() net.Addr {
+	return replayAddr("client")
+}
+
+// RemoteAddr implements net.Conn.
+func (conn *ReplayConn) RemoteAddr() net.Addr {
+	return replayAddr("server")
+}
+
+// SetDeadline implements net.Conn.
+func (conn *ReplayConn) SetDeadline(t time.Time) error {
+	conn.SetReadDeadline(t)
+	return conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (conn *ReplayConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = t
+	conn.notify()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (conn *ReplayConn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writeDeadline = t
+	return nil
+}
+
+type replayAddr string
+
+func (addr replayAddr) Network() string {
+	return "mailtest"
+}
+
+func (addr replayAddr) String() string {
+	return string(addr)
+}
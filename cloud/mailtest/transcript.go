@@ -0,0 +1,162 @@
+// Package mailtest implements utilities for testing code built on top of the
+// smtp and imapclient packages without talking to a real server.
+//
+// A Recorder captures the protocol conversation of a real client session via
+// the client's DebugWriter hook, and a ReplayConn plays it back to a client
+// from a fake net.Conn while checking that the client sends the same commands.
+// Recording requires a client which reports the direction of the debug data
+// with the IngressWriter and EgressWriter methods of its DebugWriter, as the
+// smtp and imapclient clients do; plain writes to a Recorder fail.
+//
+// Transcripts are stored in a line-based text format, one protocol line per
+// transcript line, prefixed with the side which sent it:
+//
+//	S: 220 localhost ESMTP Service Ready
+//	C: EHLO localhost
+//	S: 250-Hello localhost
+//	S: 250 AUTH PLAIN
+//	C: AUTH PLAIN [redacted]
+//
+// Lines not terminated by CRLF, or containing other CR or LF characters, use
+// the "C!" or "S!" prefix followed by a Go-quoted string holding the raw data.
+// Empty lines and lines starting with "#" are ignored.
+package mailtest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Redacted replaces credentials in recorded client lines. When replaying, a
+// client line ending with Redacted matches any line with the same prefix.
+const Redacted = "[redacted]"
+
+// Direction indicates which side of the connection sent a Line.
+type Direction int
+
+const (
+	FromClient Direction = iota
+	FromServer
+)
+
+func (dir Direction) String() string {
+	switch dir {
+	case FromClient:
+		return "C"
+	case FromServer:
+		return "S"
+	default:
+		return fmt.Sprintf("Direction(%d)", int(dir))
+	}
+}
+
+// Line is a single line of a protocol conversation.
+type Line struct {
+	From Direction
+	// Raw line data, including the line terminator.
+	Data []byte
+}
+
+// Text returns the line data without the trailing CRLF.
+func (l *Line) Text() string {
+	return string(bytes.TrimSuffix(l.Data, []byte("\r\n")))
+}
+
+// Transcript is a recorded protocol conversation.
+type Transcript []Line
+
+// ReadTranscript parses a transcript.
+func ReadTranscript(r io.Reader) (Transcript, error) {
+	var t Transcript
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		s := strings.TrimSuffix(scanner.Text(), "\r")
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+
+		if len(s) < 3 || s[2] != ' ' {
+			return nil, fmt.Errorf("mailtest: line %d: malformed transcript line", lineno)
+		}
+
+		var l Line
+		switch s[0] {
+		case 'C':
+			l.From = FromClient
+		case 'S':
+			l.From = FromServer
+		default:
+			return nil, fmt.Errorf("mailtest: line %d: unknown direction %q", lineno, s[0])
+		}
+
+		switch s[1] {
+		case ':':
+			l.Data = []byte(s[3:] + "\r\n")
+		case '!':
+			raw, err := strconv.Unquote(s[3:])
+			if err != nil {
+				return nil, fmt.Errorf("mailtest: line %d: malformed quoted data: %v", lineno, err)
+			}
+			l.Data = []byte(raw)
+		default:
+			return nil, fmt.Errorf("mailtest: line %d: malformed transcript line", lineno)
+		}
+
+		t = append(t, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// LoadTranscript reads a transcript from the named file.
+func LoadTranscript(name string) (Transcript, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadTranscript(f)
+}
+
+// WriteTo writes the transcript in its text format.
+func (t Transcript) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, l := range t {
+		var s string
+		text, ok := bytes.CutSuffix(l.Data, []byte("\r\n"))
+		if ok && !bytes.ContainsAny(text, "\r\n") {
+			s = l.From.String() + ": " + string(text) + "\n"
+		} else {
+			s = l.From.String() + "! " + strconv.Quote(string(l.Data)) + "\n"
+		}
+
+		n, err := io.WriteString(w, s)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Save writes the transcript to the named file.
+func (t Transcript) Save(name string) error {
+	var buf bytes.Buffer
+	if _, err := t.WriteTo(&buf); err != nil {
+		return err
+	}
+	return os.WriteFile(name, buf.Bytes(), 0644)
+}
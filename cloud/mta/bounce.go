@@ -0,0 +1,84 @@
+package mta
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/unix-world/smartgoplus/cloud/mta/dsn"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+const maxBounceHeaderBytes = 64 * 1024
+
+// rcptOptions returns the DSN parameters of a recipient.
+func (rcpt *Recipient) rcptOptions() *smtp.RcptOptions {
+	return &smtp.RcptOptions{
+		Notify:                rcpt.Notify,
+		OriginalRecipientType: rcpt.OriginalRecipientType,
+		OriginalRecipient:     rcpt.OriginalRecipient,
+	}
+}
+
+// bounce sends a delivery status notification (RFC 3464) to the sender of a
+// message for failed recipients, except those which asked not to be notified
+// of failures with the NOTIFY parameter.
+func (q *Queue) bounce(msg *Message, failed []*Recipient) error {
+	report := &dsn.Report{
+		OriginalEnvelopeID: msg.EnvelopeID,
+		ReportingMTA:       q.Hostname,
+		ArrivalDate:        msg.CreatedAt,
+	}
+	for _, rcpt := range failed {
+		opts := rcpt.rcptOptions()
+		if !dsn.Requested(opts, dsn.ActionFailed) {
+			continue
+		}
+
+		rcptErr := rcpt.Error
+		if rcptErr == nil {
+			rcptErr = &smtp.SMTPError{Code: 554, Message: "unknown error"}
+		}
+		status := dsn.NewRecipient(rcpt.Address, opts, rcptErr)
+		// Temporary failures are reported as failed once the message expires
+		status.Action = dsn.ActionFailed
+		status.RemoteMTA = rcpt.RemoteMTA
+		status.LastAttemptDate = rcpt.UpdatedAt
+		report.Recipients = append(report.Recipients, status)
+	}
+	if len(report.Recipients) == 0 {
+		return nil
+	}
+
+	id, err := newID()
+	if err != nil {
+		return err
+	}
+
+	f, err := q.openBody(msg.ID)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The full message is only returned if requested with RET=FULL
+	var original io.Reader = f
+	if msg.Return != smtp.DSNReturnFull {
+		original = io.LimitReader(f, maxBounceHeaderBytes)
+	}
+
+	dsnMsg := &dsn.Message{
+		From:      "MAILER-DAEMON@" + q.Hostname,
+		To:        msg.From,
+		Date:      q.now(),
+		MessageID: id + "@" + q.Hostname,
+		Report:    report,
+		Return:    msg.Return,
+	}
+	var buf bytes.Buffer
+	if err := dsnMsg.Write(&buf, original); err != nil {
+		return err
+	}
+
+	_, err = q.Enqueue("", nil, []string{msg.From}, nil, &buf)
+	return err
+}
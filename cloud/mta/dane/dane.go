@@ -0,0 +1,294 @@
+// Package dane implements DANE TLSA verification for SMTP, as defined in
+// RFC 7672.
+//
+// For SMTP, only the DANE-TA(2) and DANE-EE(3) certificate usages are
+// supported. TLSA records must be obtained from a DNSSEC-validating resolver:
+// records from insecure zones must not be used.
+package dane
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Usage is the certificate usage field of a TLSA record.
+type Usage uint8
+
+const (
+	UsagePKIXTA Usage = 0
+	UsagePKIXEE Usage = 1
+	UsageDANETA Usage = 2
+	UsageDANEEE Usage = 3
+)
+
+// Selector is the selector field of a TLSA record.
+type Selector uint8
+
+const (
+	// The full certificate.
+	SelectorCert Selector = 0
+	// The DER-encoded SubjectPublicKeyInfo.
+	SelectorSPKI Selector = 1
+)
+
+// MatchingType is the matching type field of a TLSA record.
+type MatchingType uint8
+
+const (
+	MatchingTypeFull   MatchingType = 0
+	MatchingTypeSHA256 MatchingType = 1
+	MatchingTypeSHA512 MatchingType = 2
+)
+
+var (
+	// ErrNoUsableRecords is returned by Verify when none of the TLSA records
+	// can be used. As per RFC 7672 section 2.2, TLS is still mandatory but
+	// the server isn't authenticated.
+	ErrNoUsableRecords = errors.New("dane: no usable TLSA record")
+	// ErrNoMatch is returned by Verify when the certificate chain doesn't
+	// match any TLSA record.
+	ErrNoMatch = errors.New("dane: certificate chain doesn't match any TLSA record")
+)
+
+// TLSA is a TLSA record.
+type TLSA struct {
+	Usage        Usage
+	Selector     Selector
+	MatchingType MatchingType
+	Data         []byte
+}
+
+// ParseTLSA parses a TLSA record in presentation format, e.g.
+// "3 1 1 0123456789abcdef...".
+func ParseTLSA(s string) (*TLSA, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 4 {
+		return nil, errors.New("dane: malformed TLSA record")
+	}
+
+	var params [3]uint8
+	for i := range params {
+		v, err := strconv.ParseUint(fields[i], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("dane: malformed TLSA record: %v", err)
+		}
+		params[i] = uint8(v)
+	}
+
+	// The data may be split in several fields
+	data, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("dane: malformed TLSA record data: %v", err)
+	}
+
+	return &TLSA{
+		Usage:        Usage(params[0]),
+		Selector:     Selector(params[1]),
+		MatchingType: MatchingType(params[2]),
+		Data:         data,
+	}, nil
+}
+
+// String formats the record in presentation format.
+func (r *TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %x", r.Usage, r.Selector, r.MatchingType, r.Data)
+}
+
+// usable returns true if the record can be used for SMTP.
+func (r *TLSA) usable() bool {
+	switch r.Usage {
+	case UsageDANETA, UsageDANEEE:
+	default:
+		return false
+	}
+	switch r.Selector {
+	case SelectorCert, SelectorSPKI:
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case MatchingTypeFull:
+		return len(r.Data) > 0
+	case MatchingTypeSHA256:
+		return len(r.Data) == sha256.Size
+	case MatchingTypeSHA512:
+		return len(r.Data) == sha512.Size
+	default:
+		return false
+	}
+}
+
+// Match checks whether a certificate matches the selector, matching type and
+// data of the record. The usage isn't checked.
+func (r *TLSA) Match(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case SelectorCert:
+		data = cert.Raw
+	case SelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case MatchingTypeFull:
+		return bytes.Equal(data, r.Data)
+	case MatchingTypeSHA256:
+		sum := sha256.Sum256(data)
+		return bytes.Equal(sum[:], r.Data)
+	case MatchingTypeSHA512:
+		sum := sha512.Sum512(data)
+		return bytes.Equal(sum[:], r.Data)
+	default:
+		return false
+	}
+}
+
+// Resolver looks up TLSA records.
+type Resolver interface {
+	// LookupTLSA returns the TLSA records for a name, e.g.
+	// "_25._tcp.mx.example.com". Only records validated with DNSSEC must be
+	// returned. If there are none, an empty list is returned.
+	LookupTLSA(ctx context.Context, name string) ([]*TLSA, error)
+}
+
+// Name returns the TLSA record name of a host and TCP port.
+func Name(host string, port int) string {
+	return fmt.Sprintf("_%d._tcp.%s", port, strings.TrimSuffix(host, "."))
+}
+
+// Verify checks a certificate chain sent by a server against TLSA records,
+// and returns the matching record.
+//
+// DANE-EE(3) records are matched against the leaf certificate, without any
+// other check. DANE-TA(2) records are matched against the other certificates
+// of the chain, and the leaf certificate must be valid for host and issued by
+// the matching trust anchor. A DANE-TA(2) record with a full certificate may
+// also specify a trust anchor missing from the chain.
+//
+// If no record is usable, ErrNoUsableRecords is returned.
+func Verify(records []*TLSA, host string, certs []*x509.Certificate) (*TLSA, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("dane: no peer certificate")
+	}
+	leaf := certs[0]
+
+	usable := false
+	var lastErr error
+	for _, r := range records {
+		if !r.usable() {
+			continue
+		}
+		usable = true
+
+		switch r.Usage {
+		case UsageDANEEE:
+			if r.Match(leaf) {
+				return r, nil
+			}
+		case UsageDANETA:
+			anchor := findAnchor(r, certs)
+			if anchor == nil {
+				continue
+			}
+			if err := verifyChain(leaf, certs[1:], anchor, host); err != nil {
+				lastErr = err
+				continue
+			}
+			return r, nil
+		}
+	}
+
+	if !usable {
+		return nil, ErrNoUsableRecords
+	} else if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, ErrNoMatch
+}
+
+// findAnchor returns the trust anchor certificate matching a DANE-TA record.
+func findAnchor(r *TLSA, certs []*x509.Certificate) *x509.Certificate {
+	for _, cert := range certs[1:] {
+		if r.Match(cert) {
+			return cert
+		}
+	}
+
+	if r.Selector == SelectorCert && r.MatchingType == MatchingTypeFull {
+		cert, err := x509.ParseCertificate(r.Data)
+		if err == nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+func verifyChain(leaf *x509.Certificate, intermediates []*x509.Certificate, anchor *x509.Certificate, host string) error {
+	opts := x509.VerifyOptions{
+		DNSName:       strings.TrimSuffix(host, "."),
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	opts.Roots.AddCert(anchor)
+	for _, cert := range intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		return fmt.Errorf("dane: invalid certificate chain: %w", err)
+	}
+	return nil
+}
+
+// VerifyConnection returns a function suitable for tls.Config.VerifyConnection,
+// checking the server certificate chain against TLSA records. If matched is
+// not nil, it's called with the matching record after a successful
+// verification.
+//
+// If no record is usable, the connection is accepted without authentication
+// and matched isn't called.
+func VerifyConnection(host string, records []*TLSA, matched func(*TLSA)) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		r, err := Verify(records, host, cs.PeerCertificates)
+		if err == ErrNoUsableRecords {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if matched != nil {
+			matched(r)
+		}
+		return nil
+	}
+}
+
+// Config returns a TLS configuration authenticating the server with DANE
+// instead of WebPKI, suitable for smtp.DialStartTLS and
+// smtp.NewClientStartTLS. base may be nil.
+//
+// See VerifyConnection for the meaning of matched.
+func Config(base *tls.Config, host string, records []*TLSA, matched func(*TLSA)) *tls.Config {
+	var config *tls.Config
+	if base != nil {
+		config = base.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	config.ServerName = strings.TrimSuffix(host, ".")
+	// WebPKI verification is replaced by VerifyConnection
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = nil
+	config.VerifyConnection = VerifyConnection(host, records, matched)
+	return config
+}
@@ -0,0 +1,193 @@
+package dane
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		signer, signerKey = parent.cert, parent.key
+	} else {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func sha256Record(usage Usage, selector Selector, cert *x509.Certificate) *TLSA {
+	data := cert.Raw
+	if selector == SelectorSPKI {
+		data = cert.RawSubjectPublicKeyInfo
+	}
+	sum := sha256.Sum256(data)
+	return &TLSA{usage, selector, MatchingTypeSHA256, sum[:]}
+}
+
+func TestParseTLSA(t *testing.T) {
+	r, err := ParseTLSA("3 1 1 0123456789ABCDEF 0123456789abcdef")
+	if err != nil {
+		t.Fatalf("ParseTLSA() = %v", err)
+	}
+	if r.Usage != UsageDANEEE || r.Selector != SelectorSPKI || r.MatchingType != MatchingTypeSHA256 || len(r.Data) != 16 {
+		t.Errorf("ParseTLSA() = %v", r)
+	}
+	if s := r.String(); s != "3 1 1 0123456789abcdef0123456789abcdef" {
+		t.Errorf("String() = %q", s)
+	}
+
+	for _, s := range []string{"3 1 1", "3 1 256 00", "3 1 1 xyz"} {
+		if _, err := ParseTLSA(s); err == nil {
+			t.Errorf("ParseTLSA(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ca := newTestCert(t, "Test CA", nil)
+	leaf := newTestCert(t, "mx.example.com", ca)
+	other := newTestCert(t, "mx.example.org", ca)
+	chain := []*x509.Certificate{leaf.cert, ca.cert}
+
+	eeRecord := sha256Record(UsageDANEEE, SelectorSPKI, leaf.cert)
+	taRecord := sha256Record(UsageDANETA, SelectorCert, ca.cert)
+	taFullRecord := &TLSA{UsageDANETA, SelectorCert, MatchingTypeFull, ca.cert.Raw}
+	pkixRecord := sha256Record(UsagePKIXEE, SelectorSPKI, leaf.cert)
+	otherRecord := sha256Record(UsageDANEEE, SelectorSPKI, other.cert)
+
+	for _, tc := range []struct {
+		name    string
+		records []*TLSA
+		host    string
+		certs   []*x509.Certificate
+		want    *TLSA
+		wantErr error
+	}{
+		{"DANE-EE", []*TLSA{otherRecord, eeRecord}, "mx.example.com", chain, eeRecord, nil},
+		// DANE-EE doesn't check names
+		{"DANE-EE other name", []*TLSA{eeRecord}, "mx.example.net", chain, eeRecord, nil},
+		{"DANE-TA", []*TLSA{taRecord}, "mx.example.com", chain, taRecord, nil},
+		{"DANE-TA missing from chain", []*TLSA{taFullRecord}, "mx.example.com", chain[:1], taFullRecord, nil},
+		{"no match", []*TLSA{otherRecord}, "mx.example.com", chain, nil, ErrNoMatch},
+		{"unusable", []*TLSA{pkixRecord}, "mx.example.com", chain, nil, ErrNoUsableRecords},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := Verify(tc.records, tc.host, tc.certs)
+			if err != tc.wantErr {
+				t.Fatalf("Verify() = %v, want %v", err, tc.wantErr)
+			}
+			if r != tc.want {
+				t.Errorf("Verify() = %v, want %v", r, tc.want)
+			}
+		})
+	}
+
+	// DANE-TA checks names
+	if _, err := Verify([]*TLSA{taRecord}, "mx.example.net", chain); err == nil {
+		t.Errorf("Verify() succeeded with DANE-TA and wrong host name")
+	}
+}
+
+type backend struct{}
+
+func (backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return session{}, nil
+}
+
+type session struct{}
+
+func (session) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (session) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (session) Data(r io.Reader) error                         { return nil }
+func (session) Reset()                                         {}
+func (session) Logout() error                                  { return nil }
+
+func TestConfig(t *testing.T) {
+	ca := newTestCert(t, "Test CA", nil)
+	leaf := newTestCert(t, "mx.example.com", ca)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(backend{})
+	s.Domain = "mx.example.com"
+	s.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{leaf.cert.Raw, ca.cert.Raw},
+			PrivateKey:  leaf.key,
+		}},
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	taRecord := sha256Record(UsageDANETA, SelectorSPKI, ca.cert)
+	var matched *TLSA
+	config := Config(nil, "mx.example.com", []*TLSA{taRecord}, func(r *TLSA) {
+		matched = r
+	})
+	c, err := smtp.DialStartTLS(l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("DialStartTLS() = %v", err)
+	}
+	// The TLS handshake happens with the next command
+	if err := c.Noop(); err != nil {
+		t.Fatalf("Noop() = %v", err)
+	}
+	c.Close()
+	if matched != taRecord {
+		t.Errorf("matched = %v, want %v", matched, taRecord)
+	}
+
+	other := newTestCert(t, "mx.example.com", nil)
+	config = Config(nil, "mx.example.com", []*TLSA{sha256Record(UsageDANEEE, SelectorSPKI, other.cert)}, nil)
+	c, err = smtp.DialStartTLS(l.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("DialStartTLS() = %v", err)
+	}
+	if err := c.Noop(); err == nil {
+		t.Errorf("Noop() succeeded with mismatching TLSA record")
+	}
+	c.Close()
+}
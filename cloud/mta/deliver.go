@@ -0,0 +1,266 @@
+package mta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/mta/mtasts"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// pooledConn is an idle connection kept for reuse.
+type pooledConn struct {
+	client   *smtp.Client
+	mx       string
+	lastUsed time.Time
+}
+
+func (q *Queue) pruneConns(now time.Time) {
+	for domain, pc := range q.conns {
+		if now.Sub(pc.lastUsed) >= q.MaxIdleTime {
+			pc.client.Quit()
+			delete(q.conns, domain)
+		}
+	}
+}
+
+func (q *Queue) closeConns() {
+	q.deliverMutex.Lock()
+	defer q.deliverMutex.Unlock()
+	for domain, pc := range q.conns {
+		pc.client.Quit()
+		delete(q.conns, domain)
+	}
+}
+
+// lookupMX returns the MX hosts of a domain, most preferred first.
+func (q *Queue) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	records, err := q.Resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		// No MX record: use the domain itself (RFC 5321 section 5.1)
+		return []string{domain}, nil
+	} else if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+			Message:      fmt.Sprintf("MX lookup for %v failed: %v", domain, err),
+		}
+	}
+
+	if len(records) == 1 && (records[0].Host == "." || records[0].Host == "") {
+		// Null MX (RFC 7505)
+		return nil, &smtp.SMTPError{
+			Code:         556,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 10},
+			Message:      fmt.Sprintf("Domain %v does not accept mail (null MX)", domain),
+		}
+	}
+
+	// net.Resolver already sorts records by preference
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
+	}
+	if len(hosts) == 0 {
+		hosts = append(hosts, domain)
+	}
+	return hosts, nil
+}
+
+// connect returns a connection to an MX server of a domain, reusing an idle
+// connection if possible.
+func (q *Queue) connect(ctx context.Context, domain string) (*smtp.Client, string, error) {
+	if pc, ok := q.conns[domain]; ok {
+		delete(q.conns, domain)
+		// The server may have closed the connection in the meantime
+		if err := pc.client.Noop(); err == nil {
+			return pc.client, pc.mx, nil
+		}
+		pc.client.Close()
+	}
+
+	hosts, err := q.lookupMX(ctx, domain)
+	if err != nil {
+		return nil, "", err
+	}
+	sts := q.lookupPolicy(ctx, domain)
+
+	var lastErr error
+	for _, host := range hosts {
+		tlsa, err := q.lookupTLSA(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		policy := &tlsPolicy{domain: domain, sts: sts, tlsa: tlsa}
+		if len(tlsa) == 0 && sts != nil && sts.Mode == mtasts.ModeEnforce && !sts.Match(host) {
+			q.reportTLS(policy, host, mtasts.ErrMXMismatch)
+			lastErr = policyError(mtasts.ErrMXMismatch)
+			continue
+		}
+
+		c, err := q.dialMX(ctx, host, policy, true)
+		if err == nil {
+			return c, host, nil
+		}
+		lastErr = err
+
+		var dnsErr *net.DNSError
+		if len(hosts) == 1 && host == domain && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, host, &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 2},
+				Message:      fmt.Sprintf("Domain %v does not exist", domain),
+			}
+		}
+	}
+	return nil, hosts[len(hosts)-1], lastErr
+}
+
+// dialMX connects to an MX server. If tryTLS is true and the server supports
+// STARTTLS, TLS is used. If the TLS handshake fails, a new connection without
+// TLS is made, unless the TLS policy requires TLS.
+//
+// The TLS session result is reported if tryTLS is true.
+func (q *Queue) dialMX(ctx context.Context, host string, policy *tlsPolicy, tryTLS bool) (*smtp.Client, error) {
+	conn, err := q.Dial(ctx, "tcp", net.JoinHostPort(host, q.Port))
+	if err != nil {
+		return nil, err
+	}
+
+	c := smtp.NewClient(conn)
+	if err := c.Hello(q.Hostname); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); !ok || !tryTLS {
+		if err := q.checkTLS(policy, host, nil, tryTLS); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	if err := c.StartTLS(q.tlsConfig(policy, host)); err != nil {
+		c.Close()
+		q.reportTLS(policy, host, err)
+		if policy.required() {
+			return nil, policy.error(err)
+		}
+		q.ErrorLog.Printf("STARTTLS with %v failed, retrying without TLS: %v", host, err)
+		return q.dialMX(ctx, host, policy, false)
+	}
+
+	cs, _ := c.TLSConnectionState()
+	if err := q.checkTLS(policy, host, &cs, true); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// deliverDomain delivers a message to recipients sharing the same domain.
+func (q *Queue) deliverDomain(ctx context.Context, msg *Message, domain string, rcpts []*Recipient) {
+	c, mx, err := q.connect(ctx, domain)
+	if err != nil {
+		for _, rcpt := range rcpts {
+			q.setError(rcpt, mx, err)
+		}
+		return
+	}
+
+	if err := q.transaction(c, msg, mx, rcpts); err != nil {
+		// Connection-level failure, the connection can't be reused
+		c.Close()
+		return
+	}
+
+	q.conns[domain] = &pooledConn{client: c, mx: mx, lastUsed: q.now()}
+}
+
+// transaction runs a mail transaction on a connection. An error is returned
+// if the connection is unusable afterwards.
+func (q *Queue) transaction(c *smtp.Client, msg *Message, mx string, rcpts []*Recipient) error {
+	f, err := q.openBody(msg.ID)
+	if err != nil {
+		for _, rcpt := range rcpts {
+			q.setError(rcpt, mx, err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	opts := &smtp.MailOptions{}
+	if fi, err := f.Stat(); err == nil {
+		opts.Size = fi.Size()
+	}
+
+	to := make([]string, len(rcpts))
+	for i, rcpt := range rcpts {
+		to[i] = rcpt.Address
+	}
+	w, rejected, err := c.Transaction(msg.From, opts, to, nil)
+
+	var accepted []*Recipient
+	for _, rcpt := range rcpts {
+		if rcptErr, ok := rejected[rcpt.Address]; ok {
+			q.setError(rcpt, mx, rcptErr)
+		} else if err != nil {
+			q.setError(rcpt, mx, err)
+		} else {
+			accepted = append(accepted, rcpt)
+		}
+	}
+	if err != nil {
+		return resetOrFail(c, err)
+	}
+
+	resp, err := copyData(w, f)
+	if err != nil {
+		for _, rcpt := range accepted {
+			q.setError(rcpt, mx, err)
+		}
+		return resetOrFail(c, err)
+	}
+
+	now := q.now()
+	for _, rcpt := range accepted {
+		rcpt.State = RecipientDelivered
+		rcpt.Error = nil
+		rcpt.Response = resp.StatusText
+		rcpt.RemoteMTA = mx
+		rcpt.UpdatedAt = now
+	}
+	return c.Reset()
+}
+
+// copyData writes the message. On failure, the DataCommand isn't closed, to
+// avoid sending a truncated message.
+func copyData(w *smtp.DataCommand, r io.Reader) (*smtp.DataResponse, error) {
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	return w.CloseWithResponse()
+}
+
+func isSMTPError(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr)
+}
+
+// resetOrFail resets the transaction after a server error, or returns the
+// error if it's a connection-level failure.
+func resetOrFail(c *smtp.Client, err error) error {
+	if !isSMTPError(err) {
+		return err
+	}
+	return c.Reset()
+}
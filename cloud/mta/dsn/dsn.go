@@ -0,0 +1,142 @@
+// Package dsn implements delivery status notifications, as defined in
+// RFC 3464.
+//
+// A DSN is a multipart/report message, with a human-readable explanation, a
+// message/delivery-status part with per-recipient status fields and
+// optionally the original message or its header.
+package dsn
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Action indicates the action performed by the reporting MTA for a
+// recipient.
+type Action string
+
+const (
+	ActionFailed    Action = "failed"
+	ActionDelayed   Action = "delayed"
+	ActionDelivered Action = "delivered"
+	ActionRelayed   Action = "relayed"
+	ActionExpanded  Action = "expanded"
+)
+
+// Report contains the fields of a message/delivery-status part.
+type Report struct {
+	// Envelope identifier from the ENVID parameter of the original
+	// transaction.
+	OriginalEnvelopeID string
+	// Host name of the MTA generating the report.
+	ReportingMTA string
+	// Host name of the MTA the original message was received from.
+	ReceivedFromMTA string
+	ArrivalDate     time.Time
+
+	Recipients []*Recipient
+}
+
+// Recipient contains the delivery status of a recipient.
+type Recipient struct {
+	// Value of the ORCPT parameter of the original transaction.
+	OriginalRecipientType smtp.DSNAddressType
+	OriginalRecipient     string
+
+	FinalRecipient string
+	Action         Action
+	Status         smtp.EnhancedCode
+	// Host name of the MTA which returned the diagnostic code.
+	RemoteMTA string
+	// Error returned by the remote MTA. Only SMTP diagnostic codes are
+	// supported.
+	DiagnosticCode  *smtp.SMTPError
+	LastAttemptDate time.Time
+	WillRetryUntil  time.Time
+}
+
+// NewRecipient creates a recipient status from the result of a delivery
+// attempt. A nil error means the message was delivered, a temporary error
+// that the delivery was delayed.
+func NewRecipient(addr string, opts *smtp.RcptOptions, err error) *Recipient {
+	rcpt := &Recipient{
+		FinalRecipient: addr,
+		Action:         ActionDelivered,
+		Status:         smtp.EnhancedCode{2, 0, 0},
+	}
+	if opts != nil && opts.OriginalRecipient != "" {
+		rcpt.OriginalRecipientType = opts.OriginalRecipientType
+		rcpt.OriginalRecipient = opts.OriginalRecipient
+	}
+	if err == nil {
+		return rcpt
+	}
+
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		smtpErr = &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 0, 0},
+			Message:      err.Error(),
+		}
+	}
+	rcpt.DiagnosticCode = smtpErr
+	rcpt.Status = status(smtpErr)
+	if smtpErr.Temporary() {
+		rcpt.Action = ActionDelayed
+	} else {
+		rcpt.Action = ActionFailed
+	}
+	return rcpt
+}
+
+// Requested reports whether the sender asked for a notification for an
+// action with the NOTIFY parameter. If the parameter wasn't specified,
+// failures and delays are reported.
+func Requested(opts *smtp.RcptOptions, action Action) bool {
+	var notify []smtp.DSNNotify
+	if opts != nil {
+		notify = opts.Notify
+	}
+	if len(notify) == 0 {
+		return action == ActionFailed || action == ActionDelayed
+	}
+
+	var want smtp.DSNNotify
+	switch action {
+	case ActionFailed:
+		want = smtp.DSNNotifyFailure
+	case ActionDelayed:
+		want = smtp.DSNNotifyDelayed
+	default:
+		want = smtp.DSNNotifySuccess
+	}
+	for _, n := range notify {
+		if n == want {
+			return true
+		}
+	}
+	return false
+}
+
+// status returns the enhanced status code of an error, deriving it from the
+// basic code if the server didn't provide one.
+func status(err *smtp.SMTPError) smtp.EnhancedCode {
+	code := err.EnhancedCode
+	if code == smtp.EnhancedCodeNotSet || code == smtp.NoEnhancedCode {
+		return smtp.EnhancedCode{err.Code / 100, 0, 0}
+	}
+	return code
+}
+
+func formatStatus(code smtp.EnhancedCode) string {
+	return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+}
+
+func formatDiagnostic(err *smtp.SMTPError) string {
+	text := strings.Join(strings.Fields(err.Message), " ")
+	return fmt.Sprintf("%d %s %s", err.Code, formatStatus(status(err)), text)
+}
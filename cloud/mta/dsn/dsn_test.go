@@ -0,0 +1,190 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+const testOriginal = "From: sender@example.org\n" +
+	"To: rcpt@example.com\n" +
+	"Subject: Hello\n" +
+	"\n" +
+	"Secret body\n"
+
+func TestMessage(t *testing.T) {
+	date := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	orcpt := &smtp.RcptOptions{OriginalRecipientType: smtp.DSNAddressTypeRFC822, OriginalRecipient: "alias@example.com"}
+	report := &Report{
+		OriginalEnvelopeID: "QQ314159",
+		ReportingMTA:       "mx.example.org",
+		ArrivalDate:        date,
+		Recipients: []*Recipient{
+			NewRecipient("bad@example.com", orcpt, &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "No such user",
+			}),
+			NewRecipient("busy@example.com", nil, &smtp.SMTPError{Code: 451, Message: "Try again\nlater"}),
+			NewRecipient("ok@example.com", nil, nil),
+		},
+	}
+	report.Recipients[0].RemoteMTA = "mx.example.com"
+	report.Recipients[0].LastAttemptDate = date
+	report.Recipients[1].WillRetryUntil = date.Add(48 * time.Hour)
+
+	for _, tc := range []struct {
+		ret       smtp.DSNReturn
+		wantBody  bool
+		wantParts []string
+	}{
+		{"", false, []string{"Content-Type: text/rfc822-headers\r\n\r\nFrom: sender@example.org\r\nTo: rcpt@example.com\r\nSubject: Hello\r\n\r\n--"}},
+		{smtp.DSNReturnFull, true, []string{"Content-Type: message/rfc822\r\n\r\nFrom: sender@example.org\r\n"}},
+	} {
+		msg := &Message{
+			From:   "MAILER-DAEMON@mx.example.org",
+			To:     "sender@example.org",
+			Date:   date,
+			Report: report,
+			Return: tc.ret,
+		}
+		var buf bytes.Buffer
+		if err := msg.Write(&buf, strings.NewReader(testOriginal)); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+		s := buf.String()
+
+		for _, part := range append(tc.wantParts,
+			"Subject: Undelivered Mail Returned to Sender\r\n",
+			"Content-Type: multipart/report; report-type=delivery-status;",
+			"<bad@example.com>: 550 5.1.1 No such user\r\n",
+			"Original-Recipient: rfc822; alias@example.com\r\nFinal-Recipient: rfc822; bad@example.com\r\nAction: failed\r\nStatus: 5.1.1\r\n",
+			"Diagnostic-Code: smtp; 451 4.0.0 Try again later\r\n",
+		) {
+			if !strings.Contains(s, part) {
+				t.Errorf("RET=%q: message doesn't contain %q:\n%v", tc.ret, part, s)
+			}
+		}
+		if hasBody := strings.Contains(s, "Secret body"); hasBody != tc.wantBody {
+			t.Errorf("RET=%q: message contains body = %v, want %v", tc.ret, hasBody, tc.wantBody)
+		}
+
+		got, err := Parse(&buf)
+		if err != nil {
+			t.Fatalf("Parse() = %v", err)
+		}
+		if got, want := reportString(t, got), reportString(t, report); got != want {
+			t.Errorf("Parse() = \n%v\nwant:\n%v", got, want)
+		}
+	}
+}
+
+func reportString(t *testing.T, r *Report) string {
+	var buf bytes.Buffer
+	if err := r.Write(&buf); err != nil {
+		t.Fatalf("Report.Write() = %v", err)
+	}
+	return buf.String()
+}
+
+const postfixDSN = `From: MAILER-DAEMON@mail.example.net (Mail Delivery System)
+Subject: Undelivered Mail Returned to Sender
+To: sender@example.org
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="B1A2C3.1700000000/mail.example.net"
+
+This is a MIME-encapsulated message.
+
+--B1A2C3.1700000000/mail.example.net
+Content-Description: Notification
+Content-Type: text/plain; charset=us-ascii
+
+I'm sorry to have to inform you that your message could not
+be delivered to one or more recipients.
+
+--B1A2C3.1700000000/mail.example.net
+Content-Description: Delivery report
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mail.example.net
+X-Postfix-Queue-ID: B1A2C3
+X-Postfix-Sender: rfc822; sender@example.org
+Arrival-Date: Tue, 14 Nov 2023 22:13:20 +0000 (UTC)
+
+Final-Recipient: rfc822; nobody@example.com
+Original-Recipient: rfc822;nobody@example.com
+Action: failed
+Status: 5.1.1
+Remote-MTA: dns; mx.example.com
+Diagnostic-Code: smtp; 550 5.1.1 <nobody@example.com>: Recipient address
+    rejected: User unknown in virtual mailbox table
+
+--B1A2C3.1700000000/mail.example.net
+Content-Description: Undelivered Message Headers
+Content-Type: text/rfc822-headers
+
+Subject: Hello
+
+--B1A2C3.1700000000/mail.example.net--
+`
+
+func TestParse(t *testing.T) {
+	report, err := Parse(strings.NewReader(postfixDSN))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	want := &Report{
+		ReportingMTA: "mail.example.net",
+		ArrivalDate:  time.Date(2023, 11, 14, 22, 13, 20, 0, time.FixedZone("UTC", 0)),
+		Recipients: []*Recipient{{
+			OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+			OriginalRecipient:     "nobody@example.com",
+			FinalRecipient:        "nobody@example.com",
+			Action:                ActionFailed,
+			Status:                smtp.EnhancedCode{5, 1, 1},
+			RemoteMTA:             "mx.example.com",
+			DiagnosticCode: &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "<nobody@example.com>: Recipient address rejected: User unknown in virtual mailbox table",
+			},
+		}},
+	}
+	if !report.ArrivalDate.Equal(want.ArrivalDate) {
+		t.Errorf("ArrivalDate = %v, want %v", report.ArrivalDate, want.ArrivalDate)
+	}
+	report.ArrivalDate = want.ArrivalDate
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Parse() = %+v, want %+v", report, want)
+	}
+
+	if _, err := Parse(strings.NewReader("Subject: Hi\r\n\r\nHi\r\n")); !errors.Is(err, ErrNotDSN) {
+		t.Errorf("Parse() of a regular message = %v, want ErrNotDSN", err)
+	}
+}
+
+func TestRequested(t *testing.T) {
+	for _, tc := range []struct {
+		notify []smtp.DSNNotify
+		action Action
+		want   bool
+	}{
+		{nil, ActionFailed, true},
+		{nil, ActionDelayed, true},
+		{nil, ActionDelivered, false},
+		{[]smtp.DSNNotify{smtp.DSNNotifyNever}, ActionFailed, false},
+		{[]smtp.DSNNotify{smtp.DSNNotifySuccess}, ActionRelayed, true},
+		{[]smtp.DSNNotify{smtp.DSNNotifyFailure}, ActionDelayed, false},
+	} {
+		opts := &smtp.RcptOptions{Notify: tc.notify}
+		if got := Requested(opts, tc.action); got != tc.want {
+			t.Errorf("Requested(%v, %v) = %v, want %v", tc.notify, tc.action, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package dsn
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// ErrNotDSN is returned by Parse if the message isn't a delivery status
+// notification.
+var ErrNotDSN = errors.New("dsn: not a delivery status notification")
+
+// Parse parses a delivery status notification message and returns its
+// delivery status report.
+func Parse(r io.Reader) (*Report, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("dsn: failed to read message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ErrNotDSN
+	}
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, ErrNotDSN
+		} else if err != nil {
+			return nil, fmt.Errorf("dsn: failed to read part: %v", err)
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if mediaType != "message/delivery-status" && mediaType != "message/global-delivery-status" {
+			continue
+		}
+		var body io.Reader = p
+		if strings.EqualFold(p.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		return ParseReport(body)
+	}
+}
+
+// ParseReport parses a message/delivery-status body.
+func ParseReport(r io.Reader) (*Report, error) {
+	tr := textproto.NewReader(bufio.NewReader(r))
+
+	var groups []textproto.MIMEHeader
+	for {
+		h, err := tr.ReadMIMEHeader()
+		if len(h) > 0 {
+			groups = append(groups, h)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("dsn: failed to read fields: %v", err)
+		}
+	}
+	if len(groups) == 0 {
+		return nil, errors.New("dsn: missing per-message fields")
+	}
+
+	h := groups[0]
+	report := &Report{
+		OriginalEnvelopeID: h.Get("Original-Envelope-Id"),
+	}
+	_, report.ReportingMTA = typedValue(h.Get("Reporting-Mta"))
+	if report.ReportingMTA == "" {
+		return nil, errors.New("dsn: missing Reporting-MTA field")
+	}
+	_, report.ReceivedFromMTA = typedValue(h.Get("Received-From-Mta"))
+	report.ArrivalDate = parseDate(h.Get("Arrival-Date"))
+
+	for _, h := range groups[1:] {
+		rcpt, err := parseRecipient(h)
+		if err != nil {
+			return nil, err
+		}
+		report.Recipients = append(report.Recipients, rcpt)
+	}
+	if len(report.Recipients) == 0 {
+		return nil, errors.New("dsn: missing per-recipient fields")
+	}
+	return report, nil
+}
+
+func parseRecipient(h textproto.MIMEHeader) (*Recipient, error) {
+	rcpt := &Recipient{
+		Action: Action(strings.ToLower(strings.TrimSpace(h.Get("Action")))),
+	}
+	if typ, addr := typedValue(h.Get("Original-Recipient")); addr != "" {
+		rcpt.OriginalRecipientType = smtp.DSNAddressType(strings.ToUpper(typ))
+		rcpt.OriginalRecipient = addr
+	}
+	_, rcpt.FinalRecipient = typedValue(h.Get("Final-Recipient"))
+	if rcpt.FinalRecipient == "" {
+		return nil, errors.New("dsn: missing Final-Recipient field")
+	}
+	if rcpt.Action == "" {
+		return nil, fmt.Errorf("dsn: missing Action field for %v", rcpt.FinalRecipient)
+	}
+
+	status, ok := parseStatus(h.Get("Status"))
+	if !ok {
+		return nil, fmt.Errorf("dsn: invalid Status field for %v", rcpt.FinalRecipient)
+	}
+	rcpt.Status = status
+
+	_, rcpt.RemoteMTA = typedValue(h.Get("Remote-Mta"))
+	if typ, diag := typedValue(h.Get("Diagnostic-Code")); strings.EqualFold(typ, "smtp") {
+		rcpt.DiagnosticCode = parseDiagnostic(diag)
+	}
+	rcpt.LastAttemptDate = parseDate(h.Get("Last-Attempt-Date"))
+	rcpt.WillRetryUntil = parseDate(h.Get("Will-Retry-Until"))
+	return rcpt, nil
+}
+
+// typedValue splits a field value of the form "type; value".
+func typedValue(v string) (typ, value string) {
+	typ, value, ok := strings.Cut(v, ";")
+	if !ok {
+		return "", strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(typ), strings.TrimSpace(value)
+}
+
+func parseStatus(s string) (smtp.EnhancedCode, bool) {
+	// Ignore comments, e.g. "5.1.1 (bad destination mailbox address)"
+	s, _, _ = strings.Cut(strings.TrimSpace(s), " ")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return smtp.EnhancedCode{}, false
+	}
+	var code smtp.EnhancedCode
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return smtp.EnhancedCode{}, false
+		}
+		code[i] = n
+	}
+	if code[0] != 2 && code[0] != 4 && code[0] != 5 {
+		return smtp.EnhancedCode{}, false
+	}
+	return code, true
+}
+
+// parseDiagnostic parses an SMTP diagnostic code, e.g. "550 5.1.1 No such
+// user".
+func parseDiagnostic(s string) *smtp.SMTPError {
+	s = strings.Join(strings.Fields(s), " ")
+	err := &smtp.SMTPError{Message: s}
+
+	codeStr, rest, _ := strings.Cut(s, " ")
+	code, convErr := strconv.Atoi(strings.TrimSuffix(codeStr, "-"))
+	if convErr != nil || code < 200 || code > 599 {
+		return err
+	}
+	err.Code = code
+	err.Message = rest
+
+	enhStr, rest, _ := strings.Cut(rest, " ")
+	if enh, ok := parseStatus(enhStr); ok {
+		err.EnhancedCode = enh
+		err.Message = rest
+	}
+	return err
+}
+
+func parseDate(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := mail.ParseDate(s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,246 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Write writes the report as a message/delivery-status body.
+func (r *Report) Write(w io.Writer) error {
+	var buf bytes.Buffer
+	if r.OriginalEnvelopeID != "" {
+		fmt.Fprintf(&buf, "Original-Envelope-Id: %s\r\n", r.OriginalEnvelopeID)
+	}
+	fmt.Fprintf(&buf, "Reporting-MTA: dns; %s\r\n", r.ReportingMTA)
+	if r.ReceivedFromMTA != "" {
+		fmt.Fprintf(&buf, "Received-From-MTA: dns; %s\r\n", r.ReceivedFromMTA)
+	}
+	if !r.ArrivalDate.IsZero() {
+		fmt.Fprintf(&buf, "Arrival-Date: %s\r\n", r.ArrivalDate.Format(time.RFC1123Z))
+	}
+
+	for _, rcpt := range r.Recipients {
+		fmt.Fprintf(&buf, "\r\n")
+		if rcpt.OriginalRecipient != "" {
+			typ := rcpt.OriginalRecipientType
+			if typ == "" {
+				typ = smtp.DSNAddressTypeRFC822
+			}
+			fmt.Fprintf(&buf, "Original-Recipient: %s; %s\r\n", strings.ToLower(string(typ)), rcpt.OriginalRecipient)
+		}
+		fmt.Fprintf(&buf, "Final-Recipient: rfc822; %s\r\n", rcpt.FinalRecipient)
+		fmt.Fprintf(&buf, "Action: %s\r\n", rcpt.Action)
+		fmt.Fprintf(&buf, "Status: %s\r\n", formatStatus(rcpt.Status))
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(&buf, "Remote-MTA: dns; %s\r\n", rcpt.RemoteMTA)
+		}
+		if rcpt.DiagnosticCode != nil {
+			fmt.Fprintf(&buf, "Diagnostic-Code: smtp; %s\r\n", formatDiagnostic(rcpt.DiagnosticCode))
+		}
+		if !rcpt.LastAttemptDate.IsZero() {
+			fmt.Fprintf(&buf, "Last-Attempt-Date: %s\r\n", rcpt.LastAttemptDate.Format(time.RFC1123Z))
+		}
+		if !rcpt.WillRetryUntil.IsZero() {
+			fmt.Fprintf(&buf, "Will-Retry-Until: %s\r\n", rcpt.WillRetryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Message is a delivery status notification message.
+type Message struct {
+	// Address of the reporting mail system, usually MAILER-DAEMON.
+	From string
+	// Address the notification is sent to, usually the envelope sender of
+	// the original message.
+	To string
+	// If empty, a subject is chosen from the recipient actions.
+	Subject string
+	// If zero, the current time is used.
+	Date time.Time
+	// Message-ID field, without angle brackets. Optional.
+	MessageID string
+	// Human-readable explanation. If empty, one is generated from the
+	// report.
+	Text string
+
+	Report *Report
+
+	// Value of the RET parameter of the original transaction. The full
+	// original message is only returned with DSNReturnFull.
+	Return smtp.DSNReturn
+}
+
+// Write writes the notification. If original isn't nil, it's the original
+// message: its header, or the full message if requested, is included in the
+// notification.
+func (msg *Message) Write(w io.Writer, original io.Reader) error {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	boundary := "=_" + hex.EncodeToString(b)
+
+	date := msg.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	subject := msg.Subject
+	if subject == "" {
+		subject = defaultSubject(msg.Report)
+	}
+	text := msg.Text
+	if text == "" {
+		text = defaultText(msg.Report)
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From: Mail Delivery System <%s>\r\n", msg.From)
+	fmt.Fprintf(bw, "To: <%s>\r\n", msg.To)
+	fmt.Fprintf(bw, "Subject: %s\r\n", subject)
+	fmt.Fprintf(bw, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	if msg.MessageID != "" {
+		fmt.Fprintf(bw, "Message-ID: <%s>\r\n", msg.MessageID)
+	}
+	fmt.Fprintf(bw, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(bw, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(bw, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(bw, "\r\n")
+
+	// Human-readable explanation
+	fmt.Fprintf(bw, "--%s\r\n", boundary)
+	fmt.Fprintf(bw, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, line := range strings.Split(strings.TrimRight(text, "\r\n"), "\n") {
+		fmt.Fprintf(bw, "%s\r\n", strings.TrimSuffix(line, "\r"))
+	}
+	fmt.Fprintf(bw, "\r\n")
+
+	// Machine-readable delivery status
+	fmt.Fprintf(bw, "--%s\r\n", boundary)
+	fmt.Fprintf(bw, "Content-Type: message/delivery-status\r\n\r\n")
+	if err := msg.Report.Write(bw); err != nil {
+		return err
+	}
+	fmt.Fprintf(bw, "\r\n")
+
+	// Original message
+	if original != nil {
+		fmt.Fprintf(bw, "--%s\r\n", boundary)
+		if msg.Return == smtp.DSNReturnFull {
+			fmt.Fprintf(bw, "Content-Type: message/rfc822\r\n\r\n")
+			if err := copyLines(bw, original, false); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(bw, "Content-Type: text/rfc822-headers\r\n\r\n")
+			if err := copyLines(bw, original, true); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(bw, "\r\n")
+	}
+	fmt.Fprintf(bw, "--%s--\r\n", boundary)
+
+	return bw.Flush()
+}
+
+// copyLines copies a message, normalizing line endings to CRLF. If
+// headerOnly is set, copyLines stops at the end of the header.
+func copyLines(w io.Writer, r io.Reader, headerOnly bool) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			line = strings.TrimRight(line, "\r\n")
+			if headerOnly && line == "" {
+				return nil
+			}
+			if _, werr := io.WriteString(w, line+"\r\n"); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// summary returns the most important action of a report.
+func summary(r *Report) Action {
+	var action Action
+	for _, rcpt := range r.Recipients {
+		switch rcpt.Action {
+		case ActionFailed:
+			return ActionFailed
+		case ActionDelayed:
+			action = ActionDelayed
+		default:
+			if action == "" {
+				action = rcpt.Action
+			}
+		}
+	}
+	return action
+}
+
+func defaultSubject(r *Report) string {
+	switch summary(r) {
+	case ActionFailed:
+		return "Undelivered Mail Returned to Sender"
+	case ActionDelayed:
+		return "Delayed Mail (still being retried)"
+	default:
+		return "Successful Mail Delivery Report"
+	}
+}
+
+func defaultText(r *Report) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "This is the mail system at host %s.\n", r.ReportingMTA)
+	for _, group := range []struct {
+		actions []Action
+		text    string
+	}{
+		{[]Action{ActionFailed}, "Your message could not be delivered to the following recipients:"},
+		{[]Action{ActionDelayed}, "Delivery to the following recipients has been delayed, it will be retried:"},
+		{[]Action{ActionDelivered, ActionRelayed, ActionExpanded}, "Your message was successfully delivered to the following recipients:"},
+	} {
+		first := true
+		for _, rcpt := range r.Recipients {
+			if !containsAction(group.actions, rcpt.Action) {
+				continue
+			}
+			if first {
+				fmt.Fprintf(&sb, "\n%s\n\n", group.text)
+				first = false
+			}
+			if rcpt.DiagnosticCode != nil {
+				fmt.Fprintf(&sb, "<%s>: %s\n", rcpt.FinalRecipient, formatDiagnostic(rcpt.DiagnosticCode))
+			} else {
+				fmt.Fprintf(&sb, "<%s>\n", rcpt.FinalRecipient)
+			}
+		}
+	}
+	return sb.String()
+}
+
+func containsAction(l []Action, action Action) bool {
+	for _, a := range l {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
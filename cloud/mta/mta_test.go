@@ -0,0 +1,562 @@
+package mta
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/mta/dane"
+	"github.com/unix-world/smartgoplus/cloud/mta/mtasts"
+	"github.com/unix-world/smartgoplus/cloud/mta/tlsrpt"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type message struct {
+	from string
+	to   []string
+	data string
+}
+
+type backend struct {
+	mutex    sync.Mutex
+	messages []*message
+	sessions int
+	// Recipients rejected with a permanent or temporary error
+	rejectPerm map[string]bool
+	rejectTemp map[string]bool
+}
+
+func (be *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	be.mutex.Lock()
+	be.sessions++
+	be.mutex.Unlock()
+	return &session{backend: be}, nil
+}
+
+type session struct {
+	backend *backend
+	msg     *message
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg = &message{from: from}
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.backend.mutex.Lock()
+	defer s.backend.mutex.Unlock()
+	if s.backend.rejectPerm[to] {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	if s.backend.rejectTemp[to] {
+		return &smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 2, 1}, Message: "Mailbox busy"}
+	}
+	s.msg.to = append(s.msg.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = string(b)
+	s.backend.mutex.Lock()
+	s.backend.messages = append(s.backend.messages, s.msg)
+	s.backend.mutex.Unlock()
+	return nil
+}
+
+func (s *session) Reset()        { s.msg = nil }
+func (s *session) Logout() error { return nil }
+
+type resolver map[string][]*net.MX
+
+func (r resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	mx, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mx, nil
+}
+
+const testMsg = "From: sender@example.org\r\n" +
+	"To: rcpt@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func testQueue(t *testing.T, be *backend) (*Queue, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	go s.Serve(l)
+
+	q, err := NewQueue(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Hostname = "mta.example.org"
+	q.Resolver = resolver{
+		"example.com":  {{Host: "mx.example.com.", Pref: 10}},
+		"null.example": {{Host: ".", Pref: 0}},
+	}
+	q.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		if host != "mx.example.com" {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: io.ErrUnexpectedEOF}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, l.Addr().String())
+	}
+	q.ErrorLog = log.New(io.Discard, "", 0)
+
+	return q, func() {
+		q.Close()
+		s.Close()
+	}
+}
+
+func TestQueue_deliver(t *testing.T) {
+	be := &backend{}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	var done *Message
+	q.Done = func(msg *Message) { done = msg }
+
+	id, err := q.Enqueue("sender@example.org", nil, []string{"a@example.com", "b@EXAMPLE.com"}, nil, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatalf("got %v messages, want 1", len(be.messages))
+	}
+	msg := be.messages[0]
+	if msg.from != "sender@example.org" || len(msg.to) != 2 || msg.data != testMsg {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	if done == nil || done.ID != id {
+		t.Fatalf("Done not called")
+	}
+	for _, rcpt := range done.Recipients {
+		if rcpt.State != RecipientDelivered || rcpt.RemoteMTA != "mx.example.com" {
+			t.Errorf("unexpected recipient status: %+v", rcpt)
+		}
+	}
+	if _, err := q.Status(id); err == nil {
+		t.Errorf("message still queued after delivery")
+	}
+
+	// The connection is reused for the next message
+	if _, err := q.Enqueue("sender@example.org", nil, []string{"a@example.com"}, nil, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	if len(be.messages) != 2 {
+		t.Fatalf("got %v messages, want 2", len(be.messages))
+	}
+	if be.sessions != 1 {
+		t.Errorf("got %v sessions, want 1", be.sessions)
+	}
+}
+
+func TestQueue_bounce(t *testing.T) {
+	be := &backend{rejectPerm: map[string]bool{"nobody@example.com": true}}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	to := []string{"a@example.com", "nobody@example.com", "c@null.example"}
+	id, err := q.Enqueue("sender@example.org", nil, to, nil, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+
+	if _, err := q.Status(id); err == nil {
+		t.Errorf("message still queued after delivery")
+	}
+
+	l := q.List()
+	if len(l) != 1 {
+		t.Fatalf("got %v queued messages, want 1 bounce", len(l))
+	}
+	bounce := l[0]
+	if bounce.From != "" || len(bounce.Recipients) != 1 || bounce.Recipients[0].Address != "sender@example.org" {
+		t.Fatalf("unexpected bounce envelope: %+v", bounce)
+	}
+
+	f, err := q.openBody(bounce.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	for _, s := range []string{
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"Reporting-MTA: dns; mta.example.org\r\n",
+		"Final-Recipient: rfc822; nobody@example.com\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx.example.com\r\n",
+		"Final-Recipient: rfc822; c@null.example\r\nAction: failed\r\nStatus: 5.1.10\r\n",
+		"Subject: Test\r\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("bounce doesn't contain %q:\n%v", s, body)
+		}
+	}
+	if strings.Contains(body, "a@example.com") {
+		t.Errorf("bounce contains delivered recipient:\n%v", body)
+	}
+}
+
+func TestQueue_bounceDSN(t *testing.T) {
+	be := &backend{rejectPerm: map[string]bool{"nobody@example.com": true, "never@example.com": true}}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	mailOpts := &smtp.MailOptions{Return: smtp.DSNReturnFull, EnvelopeID: "env1"}
+	to := []string{"nobody@example.com", "never@example.com"}
+	rcptOpts := []*smtp.RcptOptions{
+		{
+			Notify:                []smtp.DSNNotify{smtp.DSNNotifyFailure},
+			OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+			OriginalRecipient:     "alias@example.com",
+		},
+		{Notify: []smtp.DSNNotify{smtp.DSNNotifyNever}},
+	}
+	if _, err := q.Enqueue("sender@example.org", mailOpts, to, rcptOpts, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+
+	l := q.List()
+	if len(l) != 1 {
+		t.Fatalf("got %v queued messages, want 1 bounce", len(l))
+	}
+	f, err := q.openBody(l[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	for _, s := range []string{
+		"Original-Envelope-Id: env1\r\n",
+		"Original-Recipient: rfc822; alias@example.com\r\nFinal-Recipient: rfc822; nobody@example.com\r\n",
+		"Content-Type: message/rfc822\r\n",
+		"\r\nHello\r\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("bounce doesn't contain %q:\n%v", s, body)
+		}
+	}
+	if strings.Contains(body, "never@example.com") {
+		t.Errorf("bounce contains a recipient with NOTIFY=NEVER:\n%v", body)
+	}
+
+	// No bounce if no failed recipient asked for one
+	q, cleanup = testQueue(t, be)
+	defer cleanup()
+	if _, err := q.Enqueue("sender@example.org", nil, to[1:], rcptOpts[1:], strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	if l := q.List(); len(l) != 0 {
+		t.Errorf("got %v queued messages, want no bounce for NOTIFY=NEVER", len(l))
+	}
+}
+
+func TestQueue_retry(t *testing.T) {
+	be := &backend{rejectTemp: map[string]bool{"busy@example.com": true}}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q.Now = func() time.Time { return now }
+
+	id, err := q.Enqueue("sender@example.org", nil, []string{"busy@example.com"}, nil, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	q.deliver(context.Background(), false)
+	msg, err := q.Status(id)
+	if err != nil {
+		t.Fatalf("Status() = %v", err)
+	}
+	rcpt := msg.Recipients[0]
+	if rcpt.State != RecipientPending || rcpt.Error == nil || rcpt.Error.Code != 450 {
+		t.Fatalf("unexpected recipient status: %+v", rcpt)
+	}
+	if want := now.Add(q.RetryInterval); !msg.NextAttempt.Equal(want) {
+		t.Errorf("NextAttempt = %v, want %v", msg.NextAttempt, want)
+	}
+
+	// Not due yet
+	q.deliver(context.Background(), false)
+	if msg, _ := q.Status(id); msg.Attempts != 1 {
+		t.Errorf("Attempts = %v, want 1", msg.Attempts)
+	}
+
+	now = now.Add(q.RetryInterval)
+	q.deliver(context.Background(), false)
+	msg, _ = q.Status(id)
+	if want := now.Add(2 * q.RetryInterval); msg.Attempts != 2 || !msg.NextAttempt.Equal(want) {
+		t.Errorf("Attempts = %v, NextAttempt = %v, want 2, %v", msg.Attempts, msg.NextAttempt, want)
+	}
+
+	// Once expired, the recipient fails and the sender is notified
+	now = now.Add(q.Expiry)
+	q.deliver(context.Background(), false)
+	if _, err := q.Status(id); err == nil {
+		t.Fatalf("message still queued after expiry")
+	}
+	l := q.List()
+	if len(l) != 1 || l[0].Recipients[0].Address != "sender@example.org" {
+		t.Fatalf("expected a bounce, got %+v", l)
+	}
+}
+
+func TestQueue_reload(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir)
+	if err != nil {
+		t.Fatalf("NewQueue() = %v", err)
+	}
+	mailOpts := &smtp.MailOptions{Return: smtp.DSNReturnFull, EnvelopeID: "env1"}
+	rcptOpts := []*smtp.RcptOptions{{
+		Notify:                []smtp.DSNNotify{smtp.DSNNotifyFailure, smtp.DSNNotifyDelayed},
+		OriginalRecipientType: smtp.DSNAddressTypeRFC822,
+		OriginalRecipient:     "alias@example.com",
+	}}
+	id, err := q.Enqueue("sender@example.org", mailOpts, []string{"a@example.com"}, rcptOpts, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	q, err = NewQueue(dir)
+	if err != nil {
+		t.Fatalf("NewQueue() = %v", err)
+	}
+	msg, err := q.Status(id)
+	if err != nil {
+		t.Fatalf("Status() = %v", err)
+	}
+	if msg.From != "sender@example.org" || len(msg.Recipients) != 1 || msg.Recipients[0].State != RecipientPending {
+		t.Fatalf("unexpected message after reload: %+v", msg)
+	}
+	if msg.Return != smtp.DSNReturnFull || msg.EnvelopeID != "env1" {
+		t.Errorf("DSN parameters after reload: RET=%v ENVID=%v", msg.Return, msg.EnvelopeID)
+	}
+	rcpt := msg.Recipients[0]
+	if len(rcpt.Notify) != 2 || rcpt.Notify[1] != smtp.DSNNotifyDelayed || rcpt.OriginalRecipientType != smtp.DSNAddressTypeRFC822 || rcpt.OriginalRecipient != "alias@example.com" {
+		t.Errorf("recipient DSN parameters after reload: %+v", rcpt)
+	}
+
+	if _, err := q.Enqueue("sender@example.org", nil, []string{"a@example.com", "b@example.com"}, rcptOpts, strings.NewReader(testMsg)); err == nil {
+		t.Errorf("Enqueue() succeeded with options for a single recipient out of two")
+	}
+}
+
+func TestQueue_reloadCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir)
+	if err != nil {
+		t.Fatalf("NewQueue() = %v", err)
+	}
+	q.ErrorLog = log.New(io.Discard, "", 0)
+	id, err := q.Enqueue("sender@example.org", nil, []string{"a@example.com"}, nil, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	orphan, err := q.Enqueue("sender@example.org", nil, []string{"b@example.com"}, nil, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+
+	if err := os.WriteFile(q.metaPath(id), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(q.metaPath(orphan)); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = NewQueue(dir)
+	if err != nil {
+		t.Fatalf("NewQueue() = %v", err)
+	}
+	if l := q.List(); len(l) != 0 {
+		t.Errorf("List() = %v, want no message", l)
+	}
+	if b, err := os.ReadFile(q.bodyPath(id) + quarantineSuffix); err != nil || string(b) != testMsg {
+		t.Errorf("quarantined body = %q, %v", b, err)
+	}
+	if _, err := os.Stat(q.metaPath(id) + quarantineSuffix); err != nil {
+		t.Errorf("quarantined status file: %v", err)
+	}
+	if _, err := os.Stat(q.bodyPath(orphan)); !os.IsNotExist(err) {
+		t.Errorf("body without status file wasn't removed: %v", err)
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+type txtResolver map[string][]string
+
+func (r txtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func testMTASTS(mode mtasts.Mode) *mtasts.Cache {
+	policy := "version: STSv1\n" +
+		"mode: " + string(mode) + "\n" +
+		"mx: mx.example.com\n" +
+		"max_age: 86400\n"
+
+	c := mtasts.NewCache()
+	c.Resolver = txtResolver{"_mta-sts.example.com": {"v=STSv1; id=1"}}
+	c.HTTPClient = &http.Client{
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": {"text/plain"}},
+				Body:       io.NopCloser(strings.NewReader(policy)),
+				Request:    req,
+			}, nil
+		}),
+	}
+	return c
+}
+
+func TestQueue_mtasts(t *testing.T) {
+	for _, mode := range []mtasts.Mode{mtasts.ModeEnforce, mtasts.ModeTesting} {
+		be := &backend{}
+		q, cleanup := testQueue(t, be)
+		defer cleanup()
+		// The test server doesn't support STARTTLS
+		q.MTASTS = testMTASTS(mode)
+		q.TLSReports = tlsrpt.NewAggregator()
+
+		id, err := q.Enqueue("sender@example.org", nil, []string{"a@example.com"}, nil, strings.NewReader(testMsg))
+		if err != nil {
+			t.Fatalf("Enqueue() = %v", err)
+		}
+		if err := q.Flush(context.Background()); err != nil {
+			t.Fatalf("Flush() = %v", err)
+		}
+
+		msg, err := q.Status(id)
+		switch mode {
+		case mtasts.ModeEnforce:
+			if err != nil {
+				t.Fatalf("Status() = %v", err)
+			}
+			rcpt := msg.Recipients[0]
+			if rcpt.State != RecipientPending || rcpt.Error == nil || rcpt.Error.EnhancedCode != (smtp.EnhancedCode{4, 7, 5}) {
+				t.Errorf("enforce: unexpected recipient status: %+v", rcpt)
+			}
+			if len(be.messages) != 0 {
+				t.Errorf("enforce: message delivered without TLS")
+			}
+		case mtasts.ModeTesting:
+			if err == nil {
+				t.Errorf("testing: message still queued: %+v", msg.Recipients[0])
+			}
+			if len(be.messages) != 1 {
+				t.Errorf("testing: got %v messages, want 1", len(be.messages))
+			}
+		}
+
+		reports := q.TLSReports.Reports("Example", "tlsrpt@example.org", time.Now(), time.Now())
+		if len(reports) != 1 || len(reports[0].Policies) != 1 {
+			t.Fatalf("%v: unexpected TLS reports: %+v", mode, reports)
+		}
+		result := reports[0].Policies[0]
+		if result.Policy.Type != tlsrpt.PolicyTypeSTS || result.Policy.Domain != "example.com" {
+			t.Errorf("%v: unexpected policy: %+v", mode, result.Policy)
+		}
+		if result.Summary.TotalFailureSessionCount != 1 || len(result.FailureDetails) != 1 || result.FailureDetails[0].ResultType != tlsrpt.ResultSTARTTLSNotSupported {
+			t.Errorf("%v: unexpected policy result: %+v", mode, result)
+		}
+	}
+}
+
+type tlsaResolver map[string][]*dane.TLSA
+
+func (r tlsaResolver) LookupTLSA(ctx context.Context, name string) ([]*dane.TLSA, error) {
+	return r[name], nil
+}
+
+func TestQueue_dane(t *testing.T) {
+	be := &backend{}
+	q, cleanup := testQueue(t, be)
+	defer cleanup()
+
+	record, err := dane.ParseTLSA("3 1 1 0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The test server doesn't support STARTTLS
+	q.DANE = tlsaResolver{"_25._tcp.mx.example.com": {record}}
+
+	id, err := q.Enqueue("sender@example.org", nil, []string{"a@example.com"}, nil, strings.NewReader(testMsg))
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+
+	msg, err := q.Status(id)
+	if err != nil {
+		t.Fatalf("Status() = %v", err)
+	}
+	rcpt := msg.Recipients[0]
+	if rcpt.State != RecipientPending || rcpt.Error == nil || rcpt.Error.EnhancedCode != (smtp.EnhancedCode{4, 7, 5}) {
+		t.Errorf("unexpected recipient status: %+v", rcpt)
+	}
+	if len(be.messages) != 0 {
+		t.Errorf("message delivered without TLS")
+	}
+}
@@ -0,0 +1,180 @@
+package mtasts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoPolicy is returned by Cache.Get when a domain has no MTA-STS policy.
+var ErrNoPolicy = errors.New("mtasts: no policy found for domain")
+
+// maxPolicySize is the maximum size of a policy file.
+const maxPolicySize = 64 * 1024
+
+// Resolver looks up TXT records. net.Resolver implements this interface.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+type cacheEntry struct {
+	id        string
+	policy    *Policy
+	fetchedAt time.Time
+}
+
+// Cache discovers, fetches and caches MTA-STS policies. It's safe for
+// concurrent use. The zero value is an empty cache ready to use.
+type Cache struct {
+	// Resolver used to look up TXT records. Defaults to net.DefaultResolver.
+	Resolver Resolver
+	// HTTP client used to fetch policies. Redirects are never followed.
+	// Defaults to a client with a 60 seconds timeout.
+	HTTPClient *http.Client
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+var defaultHTTPClient = &http.Client{Timeout: 60 * time.Second}
+
+// NewCache creates a new empty policy cache.
+func NewCache() *Cache {
+	return &Cache{
+		Resolver:   net.DefaultResolver,
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (c *Cache) resolver() Resolver {
+	if c.Resolver != nil {
+		return c.Resolver
+	}
+	return net.DefaultResolver
+}
+
+func (c *Cache) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+func (c *Cache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+// Get returns the policy of a domain. ErrNoPolicy is returned if the domain
+// has no policy.
+//
+// As required by RFC 8461, a cached policy is used until it expires, unless
+// the TXT record advertises a new policy ID. If the new policy can't be
+// fetched, or if the TXT record can't be looked up, the cached policy is
+// still used.
+func (c *Cache) Get(ctx context.Context, domain string) (*Policy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := c.now()
+
+	c.mutex.Lock()
+	entry := c.entries[domain]
+	if entry != nil && now.Sub(entry.fetchedAt) >= entry.policy.MaxAge {
+		delete(c.entries, domain)
+		entry = nil
+	}
+	c.mutex.Unlock()
+
+	record, err := c.lookupRecord(ctx, domain)
+	if entry != nil && (err != nil || record.ID == entry.id) {
+		return entry.policy, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	policy, err := c.Fetch(ctx, domain)
+	if err != nil {
+		if entry != nil {
+			return entry.policy, nil
+		}
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]*cacheEntry)
+	}
+	c.entries[domain] = &cacheEntry{
+		id:        record.ID,
+		policy:    policy,
+		fetchedAt: now,
+	}
+	c.mutex.Unlock()
+
+	return policy, nil
+}
+
+func (c *Cache) lookupRecord(ctx context.Context, domain string) (*Record, error) {
+	txts, err := c.resolver().LookupTXT(ctx, "_mta-sts."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, ErrNoPolicy
+	} else if err != nil {
+		return nil, fmt.Errorf("mtasts: failed to lookup TXT record: %v", err)
+	}
+
+	var records []*Record
+	for _, txt := range txts {
+		if !strings.HasPrefix(txt, "v=STSv1") {
+			continue
+		}
+		record, err := ParseRecord(txt)
+		if err != nil {
+			return nil, ErrNoPolicy
+		}
+		records = append(records, record)
+	}
+	// Zero or multiple records mean there is no policy (RFC 8461 section 3.1)
+	if len(records) != 1 {
+		return nil, ErrNoPolicy
+	}
+	return records[0], nil
+}
+
+// Fetch fetches the policy of a domain over HTTPS, bypassing the cache.
+func (c *Cache) Fetch(ctx context.Context, domain string) (*Policy, error) {
+	u := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *c.httpClient()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("mtasts: failed to fetch policy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mtasts: failed to fetch policy: HTTP status %v", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/plain" {
+		return nil, fmt.Errorf("mtasts: unexpected policy media type %q", mediaType)
+	}
+
+	return ParsePolicy(io.LimitReader(resp.Body, maxPolicySize))
+}
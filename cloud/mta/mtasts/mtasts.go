@@ -0,0 +1,213 @@
+// Package mtasts implements SMTP MTA Strict Transport Security, as defined in
+// RFC 8461.
+//
+// Policies are discovered with a TXT record at "_mta-sts.<domain>" and fetched
+// over HTTPS from "https://mta-sts.<domain>/.well-known/mta-sts.txt". A Cache
+// takes care of both, and keeps policies for their max_age.
+package mtasts
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode is the policy mode.
+type Mode string
+
+const (
+	// Sending MTAs must not deliver to MX hosts that fail the policy.
+	ModeEnforce Mode = "enforce"
+	// Sending MTAs deliver regardless of the policy, but report failures.
+	ModeTesting Mode = "testing"
+	// The domain doesn't have an active policy.
+	ModeNone Mode = "none"
+)
+
+// MaxMaxAge is the maximum value of the max_age policy field.
+const MaxMaxAge = 31557600 * time.Second
+
+var (
+	// ErrMXMismatch is returned by Policy.Verify when the MX host name isn't
+	// allowed by the policy.
+	ErrMXMismatch = errors.New("mtasts: MX host doesn't match policy")
+	// ErrNoTLS is returned by Policy.Verify when the connection doesn't use
+	// TLS.
+	ErrNoTLS = errors.New("mtasts: STARTTLS not supported by MX host")
+)
+
+// Record is an MTA-STS TXT record.
+type Record struct {
+	// Policy identifier. A new policy is fetched when it changes.
+	ID string
+}
+
+// ParseRecord parses an MTA-STS TXT record.
+func ParseRecord(txt string) (*Record, error) {
+	params, err := parseParams(txt)
+	if err != nil {
+		return nil, err
+	}
+
+	if params["v"] != "STSv1" {
+		return nil, errors.New("mtasts: unsupported record version")
+	}
+	id := params["id"]
+	if id == "" || len(id) > 32 || !isAlnum(id) {
+		return nil, errors.New("mtasts: invalid record id")
+	}
+	return &Record{ID: id}, nil
+}
+
+func parseParams(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(s, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, errors.New("mtasts: malformed record field")
+		}
+		params[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return params, nil
+}
+
+func isAlnum(s string) bool {
+	for _, ch := range s {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Policy is an MTA-STS policy.
+type Policy struct {
+	Mode Mode
+	// MX host name patterns. A pattern may start with a "*." wildcard
+	// matching a single label.
+	MX     []string
+	MaxAge time.Duration
+}
+
+// ParsePolicy parses an MTA-STS policy file.
+func ParsePolicy(r io.Reader) (*Policy, error) {
+	var p Policy
+	var version string
+	hasMaxAge := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("mtasts: malformed policy line %q", line)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+
+		switch k {
+		case "version":
+			version = v
+		case "mode":
+			switch Mode(v) {
+			case ModeEnforce, ModeTesting, ModeNone:
+				p.Mode = Mode(v)
+			default:
+				return nil, fmt.Errorf("mtasts: unknown policy mode %q", v)
+			}
+		case "max_age":
+			secs, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("mtasts: malformed max_age: %v", err)
+			}
+			p.MaxAge = time.Duration(secs) * time.Second
+			if p.MaxAge > MaxMaxAge {
+				p.MaxAge = MaxMaxAge
+			}
+			hasMaxAge = true
+		case "mx":
+			p.MX = append(p.MX, strings.ToLower(v))
+		}
+		// Unknown fields are ignored
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, errors.New("mtasts: unsupported policy version")
+	}
+	if p.Mode == "" {
+		return nil, errors.New("mtasts: missing policy mode")
+	}
+	if !hasMaxAge {
+		return nil, errors.New("mtasts: missing policy max_age")
+	}
+	if len(p.MX) == 0 && p.Mode != ModeNone {
+		return nil, errors.New("mtasts: missing policy mx")
+	}
+	return &p, nil
+}
+
+// Match checks whether an MX host name is allowed by the policy.
+func (p *Policy) Match(mx string) bool {
+	mx = strings.ToLower(strings.TrimSuffix(mx, "."))
+	for _, pattern := range p.MX {
+		if wildcard, ok := strings.CutPrefix(pattern, "*."); ok {
+			// The wildcard matches exactly one label
+			label, domain, ok := strings.Cut(mx, ".")
+			if ok && label != "" && domain == wildcard {
+				return true
+			}
+		} else if mx == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks whether a connection to an MX host complies with the policy:
+// the host name must match the policy, and the connection must use TLS with
+// a certificate valid for the host name.
+//
+// cs is the TLS connection state, nil if TLS isn't used. roots is the set of
+// root certificate authorities, nil means the system pool.
+//
+// The returned error is ErrMXMismatch, ErrNoTLS, or wraps an x509
+// certificate error.
+func (p *Policy) Verify(mx string, cs *tls.ConnectionState, roots *x509.CertPool) error {
+	if !p.Match(mx) {
+		return ErrMXMismatch
+	}
+	if cs == nil {
+		return ErrNoTLS
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("mtasts: no peer certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       strings.TrimSuffix(mx, "."),
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		return fmt.Errorf("mtasts: invalid certificate: %w", err)
+	}
+	return nil
+}
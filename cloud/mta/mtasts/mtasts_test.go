@@ -0,0 +1,165 @@
+package mtasts
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = "version: STSv1\r\n" +
+	"mode: enforce\r\n" +
+	"mx: mail.example.com\r\n" +
+	"mx: *.example.net\r\n" +
+	"mx: backupmx.example.com\r\n" +
+	"max_age: 604800\r\n"
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+	want := &Policy{
+		Mode:   ModeEnforce,
+		MX:     []string{"mail.example.com", "*.example.net", "backupmx.example.com"},
+		MaxAge: 7 * 24 * time.Hour,
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("ParsePolicy() = %+v, want %+v", p, want)
+	}
+
+	for _, s := range []string{
+		"mode: enforce\nmx: mail.example.com\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmax_age: 86400\n",
+		"version: STSv1\nmode: enforce\nmx: mail.example.com\n",
+		"version: STSv1\nmode: always\nmx: mail.example.com\nmax_age: 86400\n",
+	} {
+		if _, err := ParsePolicy(strings.NewReader(s)); err == nil {
+			t.Errorf("ParsePolicy(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestPolicy_Match(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("ParsePolicy() = %v", err)
+	}
+
+	for mx, want := range map[string]bool{
+		"mail.example.com":     true,
+		"MAIL.example.com.":    true,
+		"mx1.example.net":      true,
+		"example.net":          false,
+		"a.mx1.example.net":    false,
+		"mail2.example.com":    false,
+		"backupmx.example.com": true,
+	} {
+		if got := p.Match(mx); got != want {
+			t.Errorf("Match(%q) = %v, want %v", mx, got, want)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=STSv1; id=20160831085700Z;")
+	if err != nil {
+		t.Fatalf("ParseRecord() = %v", err)
+	}
+	if r.ID != "20160831085700Z" {
+		t.Errorf("ID = %q, want %q", r.ID, "20160831085700Z")
+	}
+
+	for _, s := range []string{"v=STSv2; id=1", "v=STSv1", "v=STSv1; id=a-b"} {
+		if _, err := ParseRecord(s); err == nil {
+			t.Errorf("ParseRecord(%q) succeeded, want error", s)
+		}
+	}
+}
+
+type resolver map[string][]string
+
+func (r resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txts, nil
+}
+
+func TestCache(t *testing.T) {
+	policy := testPolicy
+	fetches := 0
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Host != "mta-sts.example.com" || req.URL.Path != "/.well-known/mta-sts.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		fetches++
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(policy))
+	}))
+	defer ts.Close()
+
+	// Redirect all connections to the test server
+	client := ts.Client()
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+
+	r := resolver{"_mta-sts.example.com": {"v=STSv1; id=1"}}
+	now := time.Now()
+	// The zero value is ready to use
+	c := &Cache{
+		Resolver:   r,
+		HTTPClient: client,
+		Now:        func() time.Time { return now },
+	}
+
+	p, err := c.Get(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if p.Mode != ModeEnforce || fetches != 1 {
+		t.Fatalf("Get() = %+v after %v fetches", p, fetches)
+	}
+
+	// Same ID: the cached policy is used
+	if _, err := c.Get(context.Background(), "example.com"); err != nil || fetches != 1 {
+		t.Errorf("Get() = %v after %v fetches, want cached policy", err, fetches)
+	}
+
+	// The cached policy is used even if the record disappears
+	delete(r, "_mta-sts.example.com")
+	if _, err := c.Get(context.Background(), "example.com"); err != nil || fetches != 1 {
+		t.Errorf("Get() = %v after %v fetches, want cached policy", err, fetches)
+	}
+
+	// New ID: the policy is fetched again
+	r["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	policy = strings.Replace(testPolicy, "enforce", "testing", 1)
+	p, err = c.Get(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	if p.Mode != ModeTesting || fetches != 2 {
+		t.Errorf("Get() = %+v after %v fetches, want new policy", p, fetches)
+	}
+
+	// Expired policy without record
+	delete(r, "_mta-sts.example.com")
+	now = now.Add(p.MaxAge)
+	if _, err := c.Get(context.Background(), "example.com"); err != ErrNoPolicy {
+		t.Errorf("Get() = %v, want ErrNoPolicy", err)
+	}
+
+	// Domain without policy
+	if _, err := c.Get(context.Background(), "example.org"); err != ErrNoPolicy {
+		t.Errorf("Get() = %v, want ErrNoPolicy", err)
+	}
+}
@@ -0,0 +1,500 @@
+// Package mta implements an outbound mail delivery queue.
+//
+// Messages are stored in an on-disk spool and relayed to the MX servers of
+// the recipient domains with smtp.Client. Temporary failures are retried with
+// an exponential backoff until the message expires, and senders are notified
+// of failed recipients with a delivery status notification (RFC 3464), as
+// requested with the DSN parameters of the original transaction (RFC 3461).
+package mta
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/mta/dane"
+	"github.com/unix-world/smartgoplus/cloud/mta/mtasts"
+	"github.com/unix-world/smartgoplus/cloud/mta/tlsrpt"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// RecipientState is the delivery state of a recipient.
+type RecipientState string
+
+const (
+	// The message hasn't been delivered yet.
+	RecipientPending RecipientState = "pending"
+	// The message has been accepted by the recipient's MX server.
+	RecipientDelivered RecipientState = "delivered"
+	// The message couldn't be delivered, either because of a permanent
+	// failure or because it expired.
+	RecipientFailed RecipientState = "failed"
+)
+
+// Recipient contains the delivery status of a recipient.
+type Recipient struct {
+	Address string         `json:"address"`
+	State   RecipientState `json:"state"`
+
+	// Last delivery error, if any. Network and DNS failures are reported as
+	// 4xx errors.
+	Error *smtp.SMTPError `json:"error,omitempty"`
+	// Response of the remote server once delivered.
+	Response string `json:"response,omitempty"`
+	// Host name of the last MX server tried.
+	RemoteMTA string    `json:"remote_mta,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// DSN parameters of the original transaction (RFC 3461).
+	Notify                []smtp.DSNNotify    `json:"notify,omitempty"`
+	OriginalRecipientType smtp.DSNAddressType `json:"original_recipient_type,omitempty"`
+	OriginalRecipient     string              `json:"original_recipient,omitempty"`
+}
+
+// Message is a message in the queue.
+type Message struct {
+	ID          string       `json:"-"`
+	From        string       `json:"from"`
+	Recipients  []*Recipient `json:"recipients"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Attempts    int          `json:"attempts"`
+	NextAttempt time.Time    `json:"next_attempt"`
+
+	// DSN parameters of the original transaction (RFC 3461).
+	Return     smtp.DSNReturn `json:"return,omitempty"`
+	EnvelopeID string         `json:"envelope_id,omitempty"`
+}
+
+func (msg *Message) clone() *Message {
+	clone := *msg
+	clone.Recipients = make([]*Recipient, len(msg.Recipients))
+	for i, rcpt := range msg.Recipients {
+		rcptClone := *rcpt
+		clone.Recipients[i] = &rcptClone
+	}
+	return &clone
+}
+
+// pending returns true if at least one recipient is pending.
+func (msg *Message) pending() bool {
+	for _, rcpt := range msg.Recipients {
+		if rcpt.State == RecipientPending {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver looks up MX records. net.Resolver implements this interface.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Queue is an outbound delivery queue.
+//
+// Fields must not be modified once Run or Flush has been called.
+type Queue struct {
+	// Host name used in EHLO and in bounces. Defaults to "localhost".
+	Hostname string
+	// Resolver used to look up MX records. Defaults to net.DefaultResolver.
+	Resolver Resolver
+	// Dial connects to MX servers. Defaults to net.Dialer.DialContext.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// Port of MX servers. Defaults to "25".
+	Port string
+	// TLS configuration used for STARTTLS. The ServerName is set to the MX
+	// host name. If nil, certificates aren't verified, as is usual for
+	// opportunistic TLS (RFC 7435).
+	TLSConfig *tls.Config
+	// If set, MTA-STS policies (RFC 8461) of recipient domains are applied.
+	// In enforce mode, messages are only delivered to MX hosts matching the
+	// policy with a valid TLS certificate. In testing mode, failures are
+	// logged.
+	MTASTS *mtasts.Cache
+	// If set, MX hosts publishing TLSA records are authenticated with DANE
+	// (RFC 7672), and TLS is mandatory for them. DANE takes precedence over
+	// MTA-STS. The resolver must validate records with DNSSEC.
+	DANE dane.Resolver
+	// If set, the results of TLS sessions are recorded for TLS reporting
+	// (RFC 8460).
+	TLSReports *tlsrpt.Aggregator
+
+	// Delay before the first retry, doubled after each attempt up to
+	// MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// Time after which undelivered recipients are considered failed.
+	Expiry time.Duration
+	// Time during which an idle connection is kept for reuse.
+	MaxIdleTime time.Duration
+
+	ErrorLog smtp.Logger
+	// Called when a message leaves the queue, once all recipients are either
+	// delivered or failed. Optional.
+	Done func(msg *Message)
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	dir   string
+	wake  chan struct{}
+	mutex sync.Mutex
+	msgs  map[string]*Message
+
+	// Held during delivery attempts
+	deliverMutex sync.Mutex
+	conns        map[string]*pooledConn
+}
+
+// NewQueue creates a new queue using dir as spool directory. Messages already
+// present in the spool are loaded.
+func NewQueue(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		Hostname:         "localhost",
+		Resolver:         net.DefaultResolver,
+		Dial:             (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		Port:             "25",
+		RetryInterval:    15 * time.Minute,
+		MaxRetryInterval: 4 * time.Hour,
+		Expiry:           5 * 24 * time.Hour,
+		MaxIdleTime:      30 * time.Second,
+		ErrorLog:         log.New(os.Stderr, "mta/queue ", log.LstdFlags),
+		dir:              dir,
+		wake:             make(chan struct{}, 1),
+		conns:            make(map[string]*pooledConn),
+	}
+
+	msgs, err := q.load()
+	if err != nil {
+		return nil, err
+	}
+	q.msgs = msgs
+	return q, nil
+}
+
+func (q *Queue) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+func newID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Enqueue adds a message to the queue, and returns its ID. An empty from
+// address is used for bounces.
+//
+// mailOpts and rcptOpts are the options of the transaction the message was
+// received with, and may be nil. rcptOpts contains the options of each
+// recipient of to, in the same order. Their DSN parameters are kept for
+// delivery status notifications.
+//
+// The message is written to the spool before Enqueue returns, delivery is
+// performed by Run or Flush.
+func (q *Queue) Enqueue(from string, mailOpts *smtp.MailOptions, to []string, rcptOpts []*smtp.RcptOptions, r io.Reader) (string, error) {
+	if len(to) == 0 {
+		return "", errors.New("mta: no recipient")
+	}
+	if rcptOpts != nil && len(rcptOpts) != len(to) {
+		return "", errors.New("mta: recipient options don't match recipients")
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	now := q.now()
+	msg := &Message{
+		ID:          id,
+		From:        from,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+	if mailOpts != nil {
+		msg.Return = mailOpts.Return
+		msg.EnvelopeID = mailOpts.EnvelopeID
+	}
+	for i, addr := range to {
+		rcpt := &Recipient{
+			Address:   addr,
+			State:     RecipientPending,
+			UpdatedAt: now,
+		}
+		if rcptOpts != nil && rcptOpts[i] != nil {
+			rcpt.Notify = rcptOpts[i].Notify
+			rcpt.OriginalRecipientType = rcptOpts[i].OriginalRecipientType
+			rcpt.OriginalRecipient = rcptOpts[i].OriginalRecipient
+		}
+		msg.Recipients = append(msg.Recipients, rcpt)
+	}
+
+	if err := q.writeBody(id, r); err != nil {
+		return "", err
+	}
+	if err := q.writeMeta(msg); err != nil {
+		q.remove(id)
+		return "", err
+	}
+
+	q.mutex.Lock()
+	q.msgs[id] = msg
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return id, nil
+}
+
+// Status returns the delivery status of a queued message.
+func (q *Queue) Status(id string) (*Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	msg, ok := q.msgs[id]
+	if !ok {
+		return nil, errors.New("mta: no such message")
+	}
+	return msg.clone(), nil
+}
+
+// List returns all queued messages, oldest first.
+func (q *Queue) List() []*Message {
+	q.mutex.Lock()
+	l := make([]*Message, 0, len(q.msgs))
+	for _, msg := range q.msgs {
+		l = append(l, msg.clone())
+	}
+	q.mutex.Unlock()
+
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].CreatedAt.Before(l[j].CreatedAt)
+	})
+	return l
+}
+
+// Run delivers messages as they become due, until the context is cancelled.
+func (q *Queue) Run(ctx context.Context) error {
+	defer q.closeConns()
+
+	for {
+		q.deliver(ctx, false)
+
+		timer := time.NewTimer(q.nextWakeup())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// Flush immediately attempts to deliver all queued messages, regardless of
+// their retry schedule.
+func (q *Queue) Flush(ctx context.Context) error {
+	q.deliver(ctx, true)
+	return ctx.Err()
+}
+
+// Close closes idle connections.
+func (q *Queue) Close() error {
+	q.closeConns()
+	return nil
+}
+
+func (q *Queue) nextWakeup() time.Duration {
+	// Wake up in time to close idle connections
+	wait := time.Hour
+	if q.MaxIdleTime > 0 && q.MaxIdleTime < wait {
+		wait = q.MaxIdleTime
+	}
+
+	now := q.now()
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, msg := range q.msgs {
+		if d := msg.NextAttempt.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// deliver attempts to deliver due messages. If force is true, all messages
+// are attempted.
+func (q *Queue) deliver(ctx context.Context, force bool) {
+	q.deliverMutex.Lock()
+	defer q.deliverMutex.Unlock()
+
+	now := q.now()
+	q.pruneConns(now)
+
+	var due []*Message
+	q.mutex.Lock()
+	for _, msg := range q.msgs {
+		if force || !msg.NextAttempt.After(now) {
+			due = append(due, msg.clone())
+		}
+	}
+	q.mutex.Unlock()
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].CreatedAt.Before(due[j].CreatedAt)
+	})
+
+	for _, msg := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		q.attempt(ctx, msg)
+	}
+}
+
+// attempt performs a delivery attempt for all pending recipients of a
+// message, and updates the spool.
+func (q *Queue) attempt(ctx context.Context, msg *Message) {
+	msg.Attempts++
+
+	var pending []*Recipient
+	for _, rcpt := range msg.Recipients {
+		if rcpt.State == RecipientPending {
+			pending = append(pending, rcpt)
+		}
+	}
+
+	domains := make(map[string][]*Recipient)
+	var domainList []string
+	for _, rcpt := range pending {
+		_, domain, ok := strings.Cut(rcpt.Address, "@")
+		if !ok || domain == "" {
+			q.setError(rcpt, "", &smtp.SMTPError{
+				Code:         553,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+				Message:      "Malformed recipient address",
+			})
+			continue
+		}
+		domain = strings.ToLower(domain)
+		if _, ok := domains[domain]; !ok {
+			domainList = append(domainList, domain)
+		}
+		domains[domain] = append(domains[domain], rcpt)
+	}
+
+	for _, domain := range domainList {
+		q.deliverDomain(ctx, msg, domain, domains[domain])
+	}
+
+	now := q.now()
+	if now.Sub(msg.CreatedAt) >= q.Expiry {
+		for _, rcpt := range pending {
+			if rcpt.State != RecipientPending {
+				continue
+			}
+			text := "Message expired"
+			if rcpt.Error != nil {
+				text += ", last error: " + rcpt.Error.Message
+			}
+			q.setError(rcpt, rcpt.RemoteMTA, &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 4, 7},
+				Message:      text,
+			})
+			rcpt.State = RecipientFailed
+		}
+	}
+
+	var failed []*Recipient
+	for _, rcpt := range pending {
+		if rcpt.State == RecipientFailed {
+			failed = append(failed, rcpt)
+		}
+	}
+	if len(failed) > 0 && msg.From != "" {
+		if err := q.bounce(msg, failed); err != nil {
+			q.ErrorLog.Printf("failed to bounce message %v: %v", msg.ID, err)
+		}
+	}
+
+	if msg.pending() {
+		msg.NextAttempt = now.Add(q.retryDelay(msg.Attempts))
+		if err := q.writeMeta(msg); err != nil {
+			q.ErrorLog.Printf("failed to update message %v: %v", msg.ID, err)
+		}
+		q.mutex.Lock()
+		q.msgs[msg.ID] = msg
+		q.mutex.Unlock()
+		return
+	}
+
+	q.mutex.Lock()
+	delete(q.msgs, msg.ID)
+	q.mutex.Unlock()
+	q.remove(msg.ID)
+
+	if q.Done != nil {
+		q.Done(msg.clone())
+	}
+}
+
+func (q *Queue) retryDelay(attempts int) time.Duration {
+	d := q.RetryInterval
+	for i := 1; i < attempts && d < q.MaxRetryInterval; i++ {
+		d *= 2
+	}
+	if d > q.MaxRetryInterval {
+		d = q.MaxRetryInterval
+	}
+	return d
+}
+
+// setError records a delivery error for a recipient. Permanent errors mark
+// the recipient as failed.
+func (q *Queue) setError(rcpt *Recipient, mx string, err error) {
+	smtpErr := toSMTPError(err)
+	rcpt.Error = smtpErr
+	rcpt.RemoteMTA = mx
+	rcpt.UpdatedAt = q.now()
+	if !smtpErr.Temporary() {
+		rcpt.State = RecipientFailed
+	}
+}
+
+func toSMTPError(err error) *smtp.SMTPError {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 0},
+		Message:      err.Error(),
+	}
+}
@@ -0,0 +1,142 @@
+package mta
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The spool contains two files per message: the message itself ("<id>.eml")
+// and its envelope and delivery status ("<id>.json"). Files are written to a
+// temporary file first, then renamed, so that a crash never leaves a partial
+// file behind. Messages whose status file can't be read are renamed with a
+// ".corrupt" suffix and left for the administrator.
+
+const (
+	bodySuffix       = ".eml"
+	metaSuffix       = ".json"
+	tempPrefix       = ".tmp-"
+	quarantineSuffix = ".corrupt"
+)
+
+func (q *Queue) bodyPath(id string) string {
+	return filepath.Join(q.dir, id+bodySuffix)
+}
+
+func (q *Queue) metaPath(id string) string {
+	return filepath.Join(q.dir, id+metaSuffix)
+}
+
+func (q *Queue) writeFile(name string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(q.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (q *Queue) writeBody(id string, r io.Reader) error {
+	return q.writeFile(q.bodyPath(id), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (q *Queue) writeMeta(msg *Message) error {
+	return q.writeFile(q.metaPath(msg.ID), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(msg)
+	})
+}
+
+func (q *Queue) openBody(id string) (*os.File, error) {
+	return os.Open(q.bodyPath(id))
+}
+
+func (q *Queue) remove(id string) {
+	for _, name := range []string{q.metaPath(id), q.bodyPath(id)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			q.ErrorLog.Printf("failed to remove %v: %v", name, err)
+		}
+	}
+}
+
+// quarantine renames the files of a message which can't be loaded, so that
+// they're kept but ignored.
+func (q *Queue) quarantine(id string) {
+	for _, name := range []string{q.metaPath(id), q.bodyPath(id)} {
+		if err := os.Rename(name, name+quarantineSuffix); err != nil && !os.IsNotExist(err) {
+			q.ErrorLog.Printf("failed to quarantine %v: %v", name, err)
+		}
+	}
+}
+
+// load reads all messages from the spool. Leftover temporary files and
+// messages without a status file are removed, messages with an unreadable
+// status file are quarantined.
+func (q *Queue) load() (map[string]*Message, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make(map[string]*Message)
+	hasMeta := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasPrefix(name, tempPrefix):
+			os.Remove(filepath.Join(q.dir, name))
+		case strings.HasSuffix(name, metaSuffix):
+			id := strings.TrimSuffix(name, metaSuffix)
+			hasMeta[id] = true
+			msg, err := q.loadMeta(id)
+			if err != nil {
+				q.ErrorLog.Printf("failed to load message %v, quarantining it: %v", id, err)
+				q.quarantine(id)
+				continue
+			}
+			msgs[id] = msg
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if id, ok := strings.CutSuffix(name, bodySuffix); ok && !hasMeta[id] {
+			os.Remove(filepath.Join(q.dir, name))
+		}
+	}
+
+	return msgs, nil
+}
+
+func (q *Queue) loadMeta(id string) (*Message, error) {
+	if _, err := os.Stat(q.bodyPath(id)); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(q.metaPath(id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	msg := &Message{ID: id}
+	if err := json.NewDecoder(f).Decode(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
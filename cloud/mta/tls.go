@@ -0,0 +1,206 @@
+package mta
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/mta/dane"
+	"github.com/unix-world/smartgoplus/cloud/mta/mtasts"
+	"github.com/unix-world/smartgoplus/cloud/mta/tlsrpt"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+var errNoSTARTTLS = errors.New("STARTTLS not supported")
+
+// tlsPolicy is the TLS policy applied to an MX host. If TLSA records are
+// present, the host is authenticated with DANE and MTA-STS is ignored.
+type tlsPolicy struct {
+	domain string
+	sts    *mtasts.Policy
+	tlsa   []*dane.TLSA
+}
+
+// required returns true if TLS is mandatory.
+func (p *tlsPolicy) required() bool {
+	return len(p.tlsa) > 0 || (p.sts != nil && p.sts.Mode == mtasts.ModeEnforce)
+}
+
+// error returns the delivery error for a policy failure.
+func (p *tlsPolicy) error(err error) error {
+	if len(p.tlsa) > 0 {
+		return daneError(err)
+	}
+	return policyError(err)
+}
+
+// report returns the policy in the TLS reporting format.
+func (p *tlsPolicy) report() *tlsrpt.Policy {
+	switch {
+	case len(p.tlsa) > 0:
+		records := make([]string, len(p.tlsa))
+		for i, r := range p.tlsa {
+			records[i] = r.String()
+		}
+		return &tlsrpt.Policy{Type: tlsrpt.PolicyTypeTLSA, String: records, Domain: p.domain}
+	case p.sts != nil:
+		lines := []string{"version: STSv1", "mode: " + string(p.sts.Mode)}
+		for _, mx := range p.sts.MX {
+			lines = append(lines, "mx: "+mx)
+		}
+		lines = append(lines, "max_age: "+strconv.FormatInt(int64(p.sts.MaxAge/time.Second), 10))
+		return &tlsrpt.Policy{Type: tlsrpt.PolicyTypeSTS, String: lines, Domain: p.domain, MXHost: p.sts.MX}
+	default:
+		return &tlsrpt.Policy{Type: tlsrpt.PolicyTypeNoPolicyFound, Domain: p.domain}
+	}
+}
+
+// tlsConfig returns the TLS configuration used for an MX host.
+func (q *Queue) tlsConfig(p *tlsPolicy, host string) *tls.Config {
+	var config *tls.Config
+	if len(p.tlsa) > 0 {
+		config = dane.Config(q.TLSConfig, host, p.tlsa, nil)
+	} else if q.TLSConfig != nil {
+		config = q.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{InsecureSkipVerify: true}
+	}
+	config.ServerName = host
+	return config
+}
+
+// lookupTLSA returns the DANE TLSA records of an MX host.
+func (q *Queue) lookupTLSA(ctx context.Context, host string) ([]*dane.TLSA, error) {
+	if q.DANE == nil {
+		return nil, nil
+	}
+
+	port, err := strconv.Atoi(q.Port)
+	if err != nil {
+		port = 25
+	}
+	records, err := q.DANE.LookupTLSA(ctx, dane.Name(host, port))
+	if err != nil {
+		return nil, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+			Message:      fmt.Sprintf("TLSA lookup for %v failed: %v", host, err),
+		}
+	}
+	return records, nil
+}
+
+// lookupPolicy returns the MTA-STS policy of a domain, or nil if there is
+// none.
+func (q *Queue) lookupPolicy(ctx context.Context, domain string) *mtasts.Policy {
+	if q.MTASTS == nil {
+		return nil
+	}
+
+	policy, err := q.MTASTS.Get(ctx, domain)
+	if err == mtasts.ErrNoPolicy {
+		return nil
+	} else if err != nil {
+		q.ErrorLog.Printf("failed to get MTA-STS policy for %v: %v", domain, err)
+		if q.TLSReports != nil {
+			q.TLSReports.Failure(&tlsrpt.Policy{Type: tlsrpt.PolicyTypeSTS, Domain: domain}, &tlsrpt.FailureDetails{
+				ResultType:        tlsrpt.ResultSTSPolicyFetchError,
+				FailureReasonCode: err.Error(),
+			})
+		}
+		return nil
+	}
+	if policy.Mode == mtasts.ModeNone {
+		return nil
+	}
+	return policy
+}
+
+// checkTLS checks a connection against the TLS policy. cs is nil if TLS isn't
+// used. If report is true, the result is recorded for TLS reporting.
+//
+// MTA-STS failures are only logged in testing mode.
+func (q *Queue) checkTLS(p *tlsPolicy, host string, cs *tls.ConnectionState, report bool) error {
+	var err error
+	if len(p.tlsa) > 0 || p.sts == nil {
+		// DANE authentication is done during the TLS handshake
+		if cs == nil {
+			err = errNoSTARTTLS
+		}
+	} else {
+		var roots *x509.CertPool
+		if q.TLSConfig != nil {
+			roots = q.TLSConfig.RootCAs
+		}
+		err = p.sts.Verify(host, cs, roots)
+	}
+
+	if report {
+		q.reportTLS(p, host, err)
+	}
+	if err == nil || (len(p.tlsa) == 0 && p.sts == nil) {
+		return nil
+	} else if p.required() {
+		return p.error(err)
+	}
+	q.ErrorLog.Printf("MTA-STS policy failure for %v (testing mode): %v", host, err)
+	return nil
+}
+
+// reportTLS records the result of a TLS session, if TLS reporting is
+// enabled.
+func (q *Queue) reportTLS(p *tlsPolicy, host string, err error) {
+	if q.TLSReports == nil {
+		return
+	}
+	if err == nil {
+		q.TLSReports.Success(p.report())
+		return
+	}
+	q.TLSReports.Failure(p.report(), &tlsrpt.FailureDetails{
+		ResultType:          resultType(err),
+		ReceivingMXHostname: host,
+		FailureReasonCode:   err.Error(),
+	})
+}
+
+// resultType returns the TLS reporting result type of a session failure.
+func resultType(err error) tlsrpt.ResultType {
+	var (
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		authorityErr x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.Is(err, errNoSTARTTLS) || errors.Is(err, mtasts.ErrNoTLS):
+		return tlsrpt.ResultSTARTTLSNotSupported
+	case errors.As(err, &hostnameErr):
+		return tlsrpt.ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr) && invalidErr.Reason == x509.Expired:
+		return tlsrpt.ResultCertificateExpired
+	case errors.As(err, &authorityErr):
+		return tlsrpt.ResultCertificateNotTrusted
+	default:
+		return tlsrpt.ResultValidationFailure
+	}
+}
+
+func daneError(err error) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 5},
+		Message:      fmt.Sprintf("DANE authentication failure: %v", err),
+	}
+}
+
+func policyError(err error) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 5},
+		Message:      fmt.Sprintf("MTA-STS policy failure: %v", err),
+	}
+}
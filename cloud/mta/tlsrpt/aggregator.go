@@ -0,0 +1,122 @@
+package tlsrpt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type policyStats struct {
+	result   PolicyResult
+	failures map[FailureDetails]int // index in result.FailureDetails
+}
+
+// Aggregator collects session results for reports. It's safe for concurrent
+// use.
+type Aggregator struct {
+	mutex    sync.Mutex
+	policies map[string]*policyStats
+}
+
+// NewAggregator creates a new empty aggregator.
+func NewAggregator() *Aggregator {
+	return &Aggregator{policies: make(map[string]*policyStats)}
+}
+
+func policyKey(p *Policy) string {
+	return strings.Join([]string{
+		string(p.Type),
+		strings.ToLower(p.Domain),
+		strings.Join(p.String, "\n"),
+		strings.Join(p.MXHost, "\n"),
+	}, "\x00")
+}
+
+func (a *Aggregator) stats(p *Policy) *policyStats {
+	key := policyKey(p)
+	stats, ok := a.policies[key]
+	if !ok {
+		stats = &policyStats{failures: make(map[FailureDetails]int)}
+		stats.result.Policy = *p
+		stats.result.Policy.Domain = strings.ToLower(p.Domain)
+		a.policies[key] = stats
+	}
+	return stats
+}
+
+// Success records a successful session.
+func (a *Aggregator) Success(p *Policy) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.stats(p).result.Summary.TotalSuccessfulSessionCount++
+}
+
+// Failure records a failed session. The FailedSessionCount field of details
+// is ignored. Failures with identical details are counted together.
+func (a *Aggregator) Failure(p *Policy, details *FailureDetails) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	stats := a.stats(p)
+	stats.result.Summary.TotalFailureSessionCount++
+
+	key := *details
+	key.FailedSessionCount = 0
+	i, ok := stats.failures[key]
+	if !ok {
+		i = len(stats.result.FailureDetails)
+		stats.failures[key] = i
+		stats.result.FailureDetails = append(stats.result.FailureDetails, key)
+	}
+	stats.result.FailureDetails[i].FailedSessionCount++
+}
+
+// Reports returns the reports for all recorded sessions, one per policy
+// domain, and resets the aggregator.
+func (a *Aggregator) Reports(organization, contact string, start, end time.Time) []*Report {
+	a.mutex.Lock()
+	policies := a.policies
+	a.policies = make(map[string]*policyStats)
+	a.mutex.Unlock()
+
+	byDomain := make(map[string][]PolicyResult)
+	var domains []string
+	for _, stats := range policies {
+		domain := stats.result.Policy.Domain
+		if _, ok := byDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		byDomain[domain] = append(byDomain[domain], stats.result)
+	}
+	sort.Strings(domains)
+
+	reports := make([]*Report, 0, len(domains))
+	for _, domain := range domains {
+		results := byDomain[domain]
+		sort.Slice(results, func(i, j int) bool {
+			return policyKey(&results[i].Policy) < policyKey(&results[j].Policy)
+		})
+		reports = append(reports, &Report{
+			OrganizationName: organization,
+			DateRange: DateRange{
+				Start: start.UTC(),
+				End:   end.UTC(),
+			},
+			ContactInfo: contact,
+			ReportID:    newReportID(start),
+			Policies:    results,
+		})
+	}
+	return reports
+}
+
+func newReportID(start time.Time) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return start.UTC().Format("2006-01-02T15:04:05Z") + "_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,249 @@
+// Package tlsrpt implements SMTP TLS Reporting, as defined in RFC 8460.
+//
+// Sending MTAs aggregate the results of TLS sessions with an Aggregator, and
+// periodically (usually daily) send Reports to the addresses published by
+// recipient domains in their "_smtp._tls" TXT record.
+package tlsrpt
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PolicyType is the type of the policy applied to a session.
+type PolicyType string
+
+const (
+	PolicyTypeSTS           PolicyType = "sts"
+	PolicyTypeTLSA          PolicyType = "tlsa"
+	PolicyTypeNoPolicyFound PolicyType = "no-policy-found"
+)
+
+// ResultType is the type of a session failure.
+type ResultType string
+
+// Negotiation failures.
+const (
+	ResultSTARTTLSNotSupported    ResultType = "starttls-not-supported"
+	ResultCertificateHostMismatch ResultType = "certificate-host-mismatch"
+	ResultCertificateExpired      ResultType = "certificate-expired"
+	ResultCertificateNotTrusted   ResultType = "certificate-not-trusted"
+	ResultValidationFailure       ResultType = "validation-failure"
+)
+
+// Policy failures.
+const (
+	ResultTLSAInvalid         ResultType = "tlsa-invalid"
+	ResultDNSSECInvalid       ResultType = "dnssec-invalid"
+	ResultDANERequired        ResultType = "dane-required"
+	ResultSTSPolicyFetchError ResultType = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid    ResultType = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid    ResultType = "sts-webpki-invalid"
+)
+
+// MediaType is the media type of gzip-compressed reports sent by email.
+const MediaType = "application/tlsrpt+gzip"
+
+// Report is a TLS report.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+// DateRange is the time range covered by a report.
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// PolicyResult contains the results of the sessions for a policy.
+type PolicyResult struct {
+	Policy         Policy           `json:"policy"`
+	Summary        Summary          `json:"summary"`
+	FailureDetails []FailureDetails `json:"failure-details,omitempty"`
+}
+
+// Policy describes the policy applied to sessions.
+type Policy struct {
+	Type PolicyType `json:"policy-type"`
+	// The policy: lines of the MTA-STS policy, or TLSA records in
+	// presentation format.
+	String []string `json:"policy-string,omitempty"`
+	Domain string   `json:"policy-domain"`
+	// MX host patterns of an MTA-STS policy.
+	MXHost []string `json:"mx-host,omitempty"`
+}
+
+// Summary contains session counts.
+type Summary struct {
+	TotalSuccessfulSessionCount int64 `json:"total-successful-session-count"`
+	TotalFailureSessionCount    int64 `json:"total-failure-session-count"`
+}
+
+// FailureDetails describes session failures.
+type FailureDetails struct {
+	ResultType            ResultType `json:"result-type"`
+	SendingMTAIP          string     `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname   string     `json:"receiving-mx-hostname,omitempty"`
+	ReceivingMXHelo       string     `json:"receiving-mx-helo,omitempty"`
+	ReceivingIP           string     `json:"receiving-ip,omitempty"`
+	FailedSessionCount    int64      `json:"failed-session-count"`
+	AdditionalInformation string     `json:"additional-information,omitempty"`
+	FailureReasonCode     string     `json:"failure-reason-code,omitempty"`
+}
+
+// Parse parses a JSON report. gzip-compressed reports are detected and
+// decompressed.
+func Parse(r io.Reader) (*Report, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("tlsrpt: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	var report Report
+	if err := json.NewDecoder(r).Decode(&report); err != nil {
+		return nil, fmt.Errorf("tlsrpt: malformed report: %v", err)
+	}
+	return &report, nil
+}
+
+// Write writes the report in the JSON format.
+func (r *Report) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// WriteGzip writes the report in the gzip-compressed JSON format.
+func (r *Report) WriteGzip(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if err := r.Write(zw); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// Filename returns the file name of the report, as defined in RFC 8460
+// section 5.1, e.g. "mail.sender.example!example.com!1470013207!1470186007.json.gz".
+// sender is the domain of the reporting organization, uniqueID is optional
+// and must be alphanumeric.
+func (r *Report) Filename(sender, uniqueID string, compressed bool) string {
+	var domain string
+	if len(r.Policies) > 0 {
+		domain = r.Policies[0].Policy.Domain
+	}
+
+	name := fmt.Sprintf("%v!%v!%v!%v", sender, domain, r.DateRange.Start.Unix(), r.DateRange.End.Unix())
+	if uniqueID != "" {
+		name += "!" + uniqueID
+	}
+	if compressed {
+		return name + ".json.gz"
+	}
+	return name + ".json"
+}
+
+// Record is a TLS-RPT TXT record.
+type Record struct {
+	// Aggregate report URIs, either "mailto:" or "https:".
+	RUA []*url.URL
+}
+
+// ParseRecord parses a TLS-RPT TXT record, e.g.
+// "v=TLSRPTv1; rua=mailto:reports@example.com".
+func ParseRecord(txt string) (*Record, error) {
+	var record Record
+	for i, kv := range strings.Split(txt, ";") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, errors.New("tlsrpt: malformed record field")
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+
+		if i == 0 {
+			if k != "v" || v != "TLSRPTv1" {
+				return nil, errors.New("tlsrpt: unsupported record version")
+			}
+			continue
+		}
+		if k != "rua" {
+			continue
+		}
+
+		for _, s := range strings.Split(v, ",") {
+			u, err := url.Parse(strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("tlsrpt: malformed rua: %v", err)
+			}
+			switch u.Scheme {
+			case "mailto", "https":
+				record.RUA = append(record.RUA, u)
+			}
+			// Unknown schemes are ignored
+		}
+	}
+
+	if len(record.RUA) == 0 {
+		return nil, errors.New("tlsrpt: missing rua")
+	}
+	return &record, nil
+}
+
+// Resolver looks up TXT records. net.Resolver implements this interface.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// ErrNoRecord is returned by LookupRecord when a domain has no TLS-RPT
+// record.
+var ErrNoRecord = errors.New("tlsrpt: no record found for domain")
+
+// LookupRecord looks up the TLS-RPT record of a domain. If r is nil,
+// net.DefaultResolver is used.
+func LookupRecord(ctx context.Context, r Resolver, domain string) (*Record, error) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+
+	txts, err := r.LookupTXT(ctx, "_smtp._tls."+domain)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, ErrNoRecord
+	} else if err != nil {
+		return nil, fmt.Errorf("tlsrpt: failed to lookup TXT record: %v", err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=TLSRPTv1") {
+			records = append(records, txt)
+		}
+	}
+	// Multiple records mean there is no record (RFC 8460 section 3)
+	if len(records) != 1 {
+		return nil, ErrNoRecord
+	}
+	return ParseRecord(records[0])
+}
@@ -0,0 +1,171 @@
+package tlsrpt
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// From RFC 8460 appendix B
+const testReport = `{
+  "organization-name": "Company-X",
+  "date-range": {
+    "start-datetime": "2016-04-01T00:00:00Z",
+    "end-datetime": "2016-04-01T23:59:59Z"
+  },
+  "contact-info": "sts-reporting@company-x.example",
+  "report-id": "5065427c-23d3-47ca-b6e0-946ea0e8c4be",
+  "policies": [{
+    "policy": {
+      "policy-type": "sts",
+      "policy-string": ["version: STSv1","mode: testing",
+            "mx: *.mail.company-y.example","max_age: 86400"],
+      "policy-domain": "company-y.example",
+      "mx-host": ["*.mail.company-y.example"]
+    },
+    "summary": {
+      "total-successful-session-count": 5326,
+      "total-failure-session-count": 303
+    },
+    "failure-details": [{
+      "result-type": "certificate-expired",
+      "sending-mta-ip": "2001:db8:abcd:0012::1",
+      "receiving-mx-hostname": "mx1.mail.company-y.example",
+      "failed-session-count": 100
+    }, {
+      "result-type": "starttls-not-supported",
+      "sending-mta-ip": "2001:db8:abcd:0013::1",
+      "receiving-mx-hostname": "mx2.mail.company-y.example",
+      "receiving-ip": "203.0.113.56",
+      "failed-session-count": 200,
+      "additional-information": "https://reports.company-x.example/report_info?id=5065427c-23d3#StarttlsNotSupported"
+    }, {
+      "result-type": "validation-failure",
+      "sending-mta-ip": "198.51.100.62",
+      "receiving-ip": "203.0.113.58",
+      "receiving-mx-hostname": "mx-backup.mail.company-y.example",
+      "failed-session-count": 3,
+      "failure-reason-code": "X509_V_ERR_PROXY_PATH_LENGTH_EXCEEDED"
+    }]
+  }]
+}`
+
+func TestParse(t *testing.T) {
+	r, err := Parse(strings.NewReader(testReport))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+
+	if r.OrganizationName != "Company-X" || r.ReportID != "5065427c-23d3-47ca-b6e0-946ea0e8c4be" {
+		t.Errorf("unexpected report: %+v", r)
+	}
+	if want := time.Date(2016, 4, 1, 0, 0, 0, 0, time.UTC); !r.DateRange.Start.Equal(want) {
+		t.Errorf("DateRange.Start = %v, want %v", r.DateRange.Start, want)
+	}
+	if len(r.Policies) != 1 {
+		t.Fatalf("got %v policies, want 1", len(r.Policies))
+	}
+	p := r.Policies[0]
+	if p.Policy.Type != PolicyTypeSTS || p.Policy.Domain != "company-y.example" || len(p.Policy.String) != 4 {
+		t.Errorf("unexpected policy: %+v", p.Policy)
+	}
+	if p.Summary.TotalSuccessfulSessionCount != 5326 || p.Summary.TotalFailureSessionCount != 303 {
+		t.Errorf("unexpected summary: %+v", p.Summary)
+	}
+	if len(p.FailureDetails) != 3 || p.FailureDetails[1].ResultType != ResultSTARTTLSNotSupported || p.FailureDetails[1].FailedSessionCount != 200 {
+		t.Errorf("unexpected failure details: %+v", p.FailureDetails)
+	}
+
+	// gzip round-trip
+	var buf bytes.Buffer
+	if err := r.WriteGzip(&buf); err != nil {
+		t.Fatalf("WriteGzip() = %v", err)
+	}
+	r2, err := Parse(&buf)
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	if !reflect.DeepEqual(r, r2) {
+		t.Errorf("Parse(WriteGzip()) = %+v, want %+v", r2, r)
+	}
+
+	want := "mail.sender.example!company-y.example!1459468800!1459555199.json.gz"
+	if name := r.Filename("mail.sender.example", "", true); name != want {
+		t.Errorf("Filename() = %q, want %q", name, want)
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=TLSRPTv1; rua=mailto:reports@example.com, https://reporting.example.com/v1/tlsrpt, ftp://example.com")
+	if err != nil {
+		t.Fatalf("ParseRecord() = %v", err)
+	}
+	if len(r.RUA) != 2 || r.RUA[0].String() != "mailto:reports@example.com" || r.RUA[1].Host != "reporting.example.com" {
+		t.Errorf("RUA = %v", r.RUA)
+	}
+
+	for _, s := range []string{"rua=mailto:reports@example.com", "v=TLSRPTv1", "v=TLSRPTv1; rua=ftp://example.com"} {
+		if _, err := ParseRecord(s); err == nil {
+			t.Errorf("ParseRecord(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	sts := &Policy{
+		Type:   PolicyTypeSTS,
+		String: []string{"version: STSv1", "mode: enforce", "mx: mx.example.com", "max_age: 86400"},
+		Domain: "example.com",
+		MXHost: []string{"mx.example.com"},
+	}
+	none := &Policy{Type: PolicyTypeNoPolicyFound, Domain: "example.org"}
+	failure := &FailureDetails{
+		ResultType:          ResultCertificateExpired,
+		ReceivingMXHostname: "mx.example.com",
+	}
+
+	a := NewAggregator()
+	a.Success(sts)
+	a.Success(sts)
+	a.Failure(sts, failure)
+	a.Failure(sts, failure)
+	a.Failure(sts, &FailureDetails{ResultType: ResultSTARTTLSNotSupported})
+	a.Success(none)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	reports := a.Reports("Example", "tlsrpt@example.net", start, start.Add(24*time.Hour))
+	if len(reports) != 2 {
+		t.Fatalf("got %v reports, want 2", len(reports))
+	}
+
+	r := reports[0]
+	if len(r.Policies) != 1 || r.Policies[0].Policy.Domain != "example.com" {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+	want := PolicyResult{
+		Policy: *sts,
+		Summary: Summary{
+			TotalSuccessfulSessionCount: 2,
+			TotalFailureSessionCount:    3,
+		},
+		FailureDetails: []FailureDetails{
+			{ResultType: ResultCertificateExpired, ReceivingMXHostname: "mx.example.com", FailedSessionCount: 2},
+			{ResultType: ResultSTARTTLSNotSupported, FailedSessionCount: 1},
+		},
+	}
+	if !reflect.DeepEqual(r.Policies[0], want) {
+		t.Errorf("policy result = %+v, want %+v", r.Policies[0], want)
+	}
+	if reports[1].Policies[0].Summary.TotalSuccessfulSessionCount != 1 {
+		t.Errorf("unexpected report: %+v", reports[1])
+	}
+	if r.ReportID == reports[1].ReportID {
+		t.Errorf("report IDs aren't unique")
+	}
+
+	if reports := a.Reports("Example", "tlsrpt@example.net", start, start); len(reports) != 0 {
+		t.Errorf("aggregator not reset after Reports()")
+	}
+}
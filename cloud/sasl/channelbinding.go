@@ -0,0 +1,86 @@
+package sasl
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Channel binding types, as defined in RFC 5929 and RFC 9266.
+const (
+	ChannelBindingTLSUnique         = "tls-unique"
+	ChannelBindingTLSServerEndPoint = "tls-server-end-point"
+	ChannelBindingTLSExporter       = "tls-exporter"
+)
+
+// ChannelBinding holds the data binding an authentication exchange to the
+// underlying secure channel, as defined in RFC 5056.
+type ChannelBinding struct {
+	// Channel binding type, e.g. ChannelBindingTLSExporter.
+	Type string
+	// Channel binding data.
+	Data []byte
+}
+
+// TLSChannelBinding computes channel binding data from a TLS connection state,
+// as returned by the TLSConnectionState methods of the smtp and imap
+// connections.
+//
+// ChannelBindingTLSServerEndPoint uses the peer certificate, so it can only be
+// computed this way by clients. Servers should use
+// TLSServerEndPointChannelBinding with their own certificate instead.
+func TLSChannelBinding(cs *tls.ConnectionState, typ string) (*ChannelBinding, error) {
+	if cs == nil || !cs.HandshakeComplete {
+		return nil, errors.New("sasl: TLS handshake not complete")
+	}
+
+	switch typ {
+	case ChannelBindingTLSUnique:
+		// tls-unique is not defined for TLS 1.3 (RFC 8446 section C.5)
+		if cs.Version >= tls.VersionTLS13 || len(cs.TLSUnique) == 0 {
+			return nil, errors.New("sasl: tls-unique channel binding not available")
+		}
+		return &ChannelBinding{Type: typ, Data: cs.TLSUnique}, nil
+	case ChannelBindingTLSExporter:
+		data, err := cs.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil, fmt.Errorf("sasl: tls-exporter channel binding not available: %v", err)
+		}
+		return &ChannelBinding{Type: typ, Data: data}, nil
+	case ChannelBindingTLSServerEndPoint:
+		if len(cs.PeerCertificates) == 0 {
+			return nil, errors.New("sasl: tls-server-end-point channel binding needs a peer certificate")
+		}
+		return TLSServerEndPointChannelBinding(cs.PeerCertificates[0]), nil
+	default:
+		return nil, fmt.Errorf("sasl: unsupported channel binding type %q", typ)
+	}
+}
+
+// TLSServerEndPointChannelBinding computes tls-server-end-point channel
+// binding data for a server certificate, as defined in RFC 5929 section 4.
+func TLSServerEndPointChannelBinding(cert *x509.Certificate) *ChannelBinding {
+	var newHash func() hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256, x509.DSAWithSHA256:
+		// MD5 and SHA-1 are replaced with SHA-256
+		newHash = sha256.New
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		newHash = sha512.New384
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		newHash = sha512.New
+	default:
+		// Signature algorithms without a single hash function (e.g. Ed25519)
+		// are not covered by RFC 5929, use SHA-256 like most implementations
+		newHash = sha256.New
+	}
+
+	h := newHash()
+	h.Write(cert.Raw)
+	return &ChannelBinding{Type: ChannelBindingTLSServerEndPoint, Data: h.Sum(nil)}
+}
@@ -0,0 +1,152 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// The CRAM-MD5 mechanism name.
+const CramMD5 = "CRAM-MD5"
+
+type cramMD5Client struct {
+	Username string
+	Password string
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	mech = CramMD5
+	return
+}
+
+func (a *cramMD5Client) Next(challenge []byte) (response []byte, err error) {
+	mac := hmac.New(md5.New, []byte(a.Password))
+	mac.Write(challenge)
+	return []byte(a.Username + " " + hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+// A client implementation of the CRAM-MD5 authentication mechanism, as
+// described in RFC 2195.
+//
+// CRAM-MD5 is obsolete and should only be used with legacy servers that don't
+// support SCRAM or PLAIN over TLS.
+func NewCramMD5Client(username, password string) Client {
+	return &cramMD5Client{username, password}
+}
+
+// CramMD5Secret is the secret used by servers to verify CRAM-MD5 responses
+// without storing the password: the MD5 states of the HMAC inner and outer
+// keys. It's the format used by Dovecot's CRAM-MD5 password scheme.
+type CramMD5Secret [32]byte
+
+// NewCramMD5Secret computes the CRAM-MD5 secret of a password.
+func NewCramMD5Secret(password string) *CramMD5Secret {
+	key := []byte(password)
+	if len(key) > md5.BlockSize {
+		sum := md5.Sum(key)
+		key = sum[:]
+	}
+
+	var secret CramMD5Secret
+	for i, pad := range []byte{0x36, 0x5c} {
+		block := make([]byte, md5.BlockSize)
+		copy(block, key)
+		for j := range block {
+			block[j] ^= pad
+		}
+
+		state := md5Init
+		md5Block(&state, block)
+		for j, word := range state {
+			binary.LittleEndian.PutUint32(secret[16*i+4*j:], word)
+		}
+	}
+	return &secret
+}
+
+// state returns the MD5 state after processing the inner (i = 0) or outer
+// (i = 1) HMAC key block.
+func (secret *CramMD5Secret) state(i int) [4]uint32 {
+	var state [4]uint32
+	for j := range state {
+		state[j] = binary.LittleEndian.Uint32(secret[16*i+4*j:])
+	}
+	return state
+}
+
+func (secret *CramMD5Secret) digest(challenge []byte) []byte {
+	inner := md5Resume(secret.state(0), md5.BlockSize, challenge)
+	outer := md5Resume(secret.state(1), md5.BlockSize, inner[:])
+	return outer[:]
+}
+
+// CramMD5Lookup returns the CRAM-MD5 secret of a user. Servers storing
+// plaintext passwords can use NewCramMD5Secret.
+type CramMD5Lookup func(username string) (*CramMD5Secret, error)
+
+type cramMD5Server struct {
+	hostname  string
+	lookup    CramMD5Lookup
+	challenge []byte
+	done      bool
+}
+
+// A server implementation of the CRAM-MD5 authentication mechanism, as
+// described in RFC 2195. The hostname is used to build the challenge.
+//
+// CRAM-MD5 is obsolete and should only be enabled for legacy clients.
+func NewCramMD5Server(hostname string, lookup CramMD5Lookup) Server {
+	return &cramMD5Server{hostname: hostname, lookup: lookup}
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		err = ErrUnexpectedClientResponse
+		return
+	}
+
+	// CRAM-MD5 is server-first, there is no initial response
+	if a.challenge == nil {
+		if len(response) > 0 {
+			return nil, true, ErrUnexpectedClientResponse
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			return nil, true, err
+		}
+		a.challenge = []byte(fmt.Sprintf("<%v.%v@%v>", n, time.Now().Unix(), a.hostname))
+		return a.challenge, false, nil
+	}
+
+	a.done = true
+
+	i := strings.LastIndexByte(string(response), ' ')
+	if i < 0 {
+		return nil, true, errors.New("sasl: invalid CRAM-MD5 response")
+	}
+	username := string(response[:i])
+	digest, err := hex.DecodeString(string(response[i+1:]))
+	if err != nil || len(digest) != md5.Size {
+		return nil, true, errors.New("sasl: invalid CRAM-MD5 response")
+	}
+
+	secret, err := a.lookup(username)
+	if err != nil {
+		return nil, true, err
+	}
+	if secret == nil {
+		return nil, true, errors.New("sasl: invalid CRAM-MD5 digest")
+	}
+	if subtle.ConstantTimeCompare(secret.digest(a.challenge), digest) != 1 {
+		return nil, true, errors.New("sasl: invalid CRAM-MD5 digest")
+	}
+	return nil, true, nil
+}
@@ -0,0 +1,51 @@
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCramMD5Secret(t *testing.T) {
+	// Example from RFC 2195 section 2
+	challenge := []byte("<1896.697170952@postoffice.reston.mci.net>")
+	secret := NewCramMD5Secret("tanstaaftanstaaf")
+	if got, want := hex.EncodeToString(secret.digest(challenge)), "b913a602c7eda7a495b4e6e7334d3890"; got != want {
+		t.Errorf("digest = %v, want %v", got, want)
+	}
+
+	for _, password := range []string{"", "p", strings.Repeat("x", 64), strings.Repeat("y", 100)} {
+		for _, msg := range []string{"", "<a@b>", strings.Repeat("z", 55), strings.Repeat("z", 56), strings.Repeat("z", 200)} {
+			mac := hmac.New(md5.New, []byte(password))
+			mac.Write([]byte(msg))
+			if got := NewCramMD5Secret(password).digest([]byte(msg)); !hmac.Equal(got, mac.Sum(nil)) {
+				t.Errorf("digest(%q) with %v-byte password doesn't match HMAC-MD5", msg, len(password))
+			}
+		}
+	}
+}
+
+func TestCramMD5Server(t *testing.T) {
+	lookup := func(username string) (*CramMD5Secret, error) {
+		if username != "tim" {
+			return nil, nil
+		}
+		return NewCramMD5Secret("tanstaaftanstaaf"), nil
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"tim", "tanstaaftanstaaf", true},
+		{"tim", "wrong", false},
+		{"nobody", "tanstaaftanstaaf", false},
+	} {
+		_, err := exchange(t, NewCramMD5Client(tc.username, tc.password), NewCramMD5Server("example.org", lookup))
+		if (err == nil) != tc.ok {
+			t.Errorf("exchange(%v, %v) = %v", tc.username, tc.password, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package credstore
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/unix-world/smartgo/crypto/argon2"
+)
+
+// Argon2Params contains argon2id parameters.
+type Argon2Params struct {
+	// Number of passes over the memory.
+	Time uint32
+	// Memory size, in KiB.
+	Memory uint32
+	// Degree of parallelism.
+	Threads uint8
+	// Length of the salt and of the key, in bytes.
+	SaltLen, KeyLen uint32
+}
+
+// DefaultArgon2Params are the argon2id parameters recommended by RFC 9106
+// section 4 for memory-constrained environments.
+var DefaultArgon2Params = Argon2Params{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// Limits on the parameters of parsed hashes, so that a malformed stored hash
+// can't make Verify panic or allocate unbounded memory.
+const (
+	argon2MaxMemory  = 4 * 1024 * 1024 // KiB
+	argon2MaxTime    = 1024
+	argon2MaxSaltLen = 256
+	argon2MaxKeyLen  = 1024
+)
+
+type argon2Hash struct {
+	params Argon2Params
+	salt   []byte
+	key    []byte
+}
+
+// NewArgon2id hashes a password with argon2id. If params is nil,
+// DefaultArgon2Params is used.
+func NewArgon2id(password string, params *Argon2Params) (Hash, error) {
+	if params == nil {
+		params = &DefaultArgon2Params
+	}
+	salt, err := randomSalt(int(params.SaltLen))
+	if err != nil {
+		return nil, err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return &argon2Hash{params: *params, salt: salt, key: key}, nil
+}
+
+// parseArgon2id parses a hash in the PHC string format:
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func parseArgon2id(scheme, value string) (Hash, error) {
+	malformed := errors.New("credstore: malformed argon2id hash")
+
+	fields := strings.Split(value, "$")
+	if len(fields) != 6 || fields[0] != "" || fields[1] != "argon2id" {
+		return nil, malformed
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+		return nil, malformed
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("credstore: unsupported argon2id version %v", version)
+	}
+
+	var memory, time, threads int64
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return nil, malformed
+	}
+	if time < 1 || time > argon2MaxTime || threads < 1 || threads > 255 || memory < 8*threads || memory > argon2MaxMemory {
+		return nil, malformed
+	}
+
+	h := &argon2Hash{}
+	h.params.Memory = uint32(memory)
+	h.params.Time = uint32(time)
+	h.params.Threads = uint8(threads)
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(fields[4]); err != nil || len(h.salt) > argon2MaxSaltLen {
+		return nil, malformed
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(fields[5]); err != nil || len(h.key) == 0 || len(h.key) > argon2MaxKeyLen {
+		return nil, malformed
+	}
+	h.params.SaltLen = uint32(len(h.salt))
+	h.params.KeyLen = uint32(len(h.key))
+	return h, nil
+}
+
+func (h *argon2Hash) Scheme() string {
+	return "ARGON2ID"
+}
+
+func (h *argon2Hash) Verify(password string) error {
+	key := argon2.IDKey([]byte(password), h.salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *argon2Hash) String() string {
+	return fmt.Sprintf("{%v}$argon2id$v=%d$m=%d,t=%d,p=%d$%v$%v", h.Scheme(), argon2.Version,
+		h.params.Memory, h.params.Time, h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(h.salt),
+		base64.RawStdEncoding.EncodeToString(h.key))
+}
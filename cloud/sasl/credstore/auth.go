@@ -0,0 +1,281 @@
+package credstore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+)
+
+// Authenticator checks user passwords against a Store.
+//
+// It can be used to implement smtp.AuthSession and imapserver.SessionSASL:
+//
+//	func (s *session) AuthMechanisms() []string {
+//		return s.auth.Mechanisms()
+//	}
+//
+//	func (s *session) Auth(mech string) (sasl.Server, error) {
+//		return s.auth.NewServer(mech)
+//	}
+//
+// and imapserver.Session.Login with Authenticate.
+type Authenticator struct {
+	// Store containing the password hashes. Required.
+	Store Store
+
+	// Error returned when authentication fails, e.g. smtp.ErrAuthFailed or
+	// imapserver.ErrAuthFailed. Defaults to ErrInvalidCredentials.
+	ErrAuthFailed error
+
+	// Called with the username once a user is authenticated. An error aborts
+	// the authentication. Optional.
+	Login func(username string) error
+
+	// Host name of the server, used in CRAM-MD5 challenges and as the
+	// DIGEST-MD5 realm.
+	Hostname string
+
+	// SASL mechanisms returned by Mechanisms. If nil, they're derived from
+	// the store, see Mechanisms.
+	SASLMechanisms []string
+
+	mutex    sync.Mutex
+	mechs    []string // derived from the store, nil if not computed yet
+	mechsGen uint64   // RangeStore generation mechs was computed for
+}
+
+func (a *Authenticator) authFailed() error {
+	if a.ErrAuthFailed != nil {
+		return a.ErrAuthFailed
+	}
+	return ErrInvalidCredentials
+}
+
+func (a *Authenticator) login(username string) error {
+	if a.Login != nil {
+		return a.Login(username)
+	}
+	return nil
+}
+
+// Authenticate checks the password of a user.
+//
+// ErrAuthFailed is returned if the user doesn't exist or if the password
+// doesn't match. Other errors, e.g. a store failure, are returned unchanged.
+func (a *Authenticator) Authenticate(username, password string) error {
+	h, err := a.Store.Lookup(username)
+	if err == ErrUserNotFound {
+		return a.authFailed()
+	} else if err != nil {
+		return err
+	}
+
+	if err := h.Verify(password); err == ErrInvalidCredentials {
+		return a.authFailed()
+	} else if err != nil {
+		return err
+	}
+
+	return a.login(username)
+}
+
+// PlainAuthenticator returns an authenticator for sasl.NewPlainServer. The
+// authorization identity must be empty or equal to the username.
+func (a *Authenticator) PlainAuthenticator() sasl.PlainAuthenticator {
+	return func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return a.authFailed()
+		}
+		return a.Authenticate(username, password)
+	}
+}
+
+// LoginAuthenticator returns an authenticator for sasl.NewLoginServer.
+func (a *Authenticator) LoginAuthenticator() sasl.LoginAuthenticator {
+	return a.Authenticate
+}
+
+// ScramLookup returns a lookup function for sasl.NewScramServer. Users must
+// have a SCRAM hash for the mechanism.
+func (a *Authenticator) ScramLookup(mech string) sasl.ScramLookup {
+	mech = strings.TrimSuffix(mech, "-PLUS")
+	return func(username string) (*sasl.ScramCredentials, error) {
+		h, err := a.Store.Lookup(username)
+		if err == ErrUserNotFound {
+			return nil, a.authFailed()
+		} else if err != nil {
+			return nil, err
+		}
+
+		scramHash, ok := h.(*ScramHash)
+		if !ok || scramHash.Mechanism != mech {
+			return nil, a.authFailed()
+		}
+		return scramHash.Credentials, nil
+	}
+}
+
+// CramMD5Lookup returns a lookup function for sasl.NewCramMD5Server. Users
+// must have a plain text password or a CRAM-MD5 hash.
+func (a *Authenticator) CramMD5Lookup() sasl.CramMD5Lookup {
+	return func(username string) (*sasl.CramMD5Secret, error) {
+		h, err := a.Store.Lookup(username)
+		if err == ErrUserNotFound {
+			return nil, a.authFailed()
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch h := h.(type) {
+		case *plainHash:
+			return sasl.NewCramMD5Secret(h.password), nil
+		case *cramMD5Hash:
+			return h.secret, nil
+		default:
+			return nil, a.authFailed()
+		}
+	}
+}
+
+// DigestMD5Lookup returns a lookup function for sasl.NewDigestMD5Server.
+// Users must have a plain text password.
+func (a *Authenticator) DigestMD5Lookup() sasl.DigestMD5Lookup {
+	return func(username, realm string) (*sasl.DigestMD5Secret, error) {
+		h, err := a.Store.Lookup(username)
+		if err == ErrUserNotFound {
+			return nil, a.authFailed()
+		} else if err != nil {
+			return nil, err
+		}
+
+		plain, ok := h.(*plainHash)
+		if !ok {
+			return nil, a.authFailed()
+		}
+		return sasl.NewDigestMD5Secret(username, realm, plain.password), nil
+	}
+}
+
+func (a *Authenticator) authorize(identity, username string) error {
+	if identity != "" && identity != username {
+		return a.authFailed()
+	}
+	return a.login(username)
+}
+
+// Mechanisms returns the SASL mechanisms to advertise, SASLMechanisms if set.
+//
+// Otherwise, PLAIN and LOGIN are always returned. If the store implements
+// RangeStore, SCRAM mechanisms are added when all users have a SCRAM hash for
+// them; the result is cached until the store changes. The legacy CRAM-MD5 and
+// DIGEST-MD5 mechanisms must be enabled explicitly in SASLMechanisms.
+func (a *Authenticator) Mechanisms() []string {
+	if a.SASLMechanisms != nil {
+		return a.SASLMechanisms
+	}
+
+	rs, ok := a.Store.(RangeStore)
+	if !ok {
+		return []string{sasl.Plain, sasl.Login}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if gen := rs.Generation(); a.mechs == nil || a.mechsGen != gen {
+		a.mechs = storeMechanisms(rs)
+		a.mechsGen = gen
+	}
+	return a.mechs
+}
+
+func storeMechanisms(rs RangeStore) []string {
+	scram := map[string]bool{sasl.ScramSHA256: true, sasl.ScramSHA1: true}
+	empty := true
+	rs.Range(func(username string, h Hash) bool {
+		empty = false
+		for mech := range scram {
+			if scramHash, ok := h.(*ScramHash); !ok || scramHash.Mechanism != mech {
+				delete(scram, mech)
+			}
+		}
+		return len(scram) > 0
+	})
+
+	var mechs []string
+	for _, mech := range []string{sasl.ScramSHA256, sasl.ScramSHA1} {
+		if scram[mech] && !empty {
+			mechs = append(mechs, mech)
+		}
+	}
+	return append(mechs, sasl.Plain, sasl.Login)
+}
+
+// NewServer creates a SASL server for the specified mechanism.
+//
+// The PLAIN and LOGIN mechanisms are supported for all password hashes. The
+// SCRAM-SHA-1 and SCRAM-SHA-256 mechanisms are supported for users with a
+// SCRAM hash for the mechanism. The legacy CRAM-MD5 and DIGEST-MD5 mechanisms
+// are supported for users with a plain text password, or a CRAM-MD5 hash for
+// CRAM-MD5.
+//
+// Mechanisms not returned by Mechanisms are rejected.
+func (a *Authenticator) NewServer(mech string) (sasl.Server, error) {
+	if !a.hasMechanism(mech) {
+		return nil, fmt.Errorf("credstore: unsupported SASL mechanism %q", mech)
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(a.PlainAuthenticator()), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(a.LoginAuthenticator()), nil
+	case sasl.ScramSHA1, sasl.ScramSHA256:
+		return sasl.NewScramServer(mech, &sasl.ScramServerOptions{
+			Lookup:    a.ScramLookup(mech),
+			Authorize: a.authorize,
+		}), nil
+	case sasl.CramMD5:
+		// CRAM-MD5 has no authorization identity, call Login once the
+		// exchange succeeds
+		var username string
+		lookup := a.CramMD5Lookup()
+		srv := sasl.NewCramMD5Server(a.Hostname, func(u string) (*sasl.CramMD5Secret, error) {
+			username = u
+			return lookup(u)
+		})
+		return &loginServer{srv, func() error { return a.login(username) }}, nil
+	case sasl.DigestMD5:
+		return sasl.NewDigestMD5Server(&sasl.DigestMD5ServerOptions{
+			Realm:     a.Hostname,
+			Lookup:    a.DigestMD5Lookup(),
+			Authorize: a.authorize,
+		}), nil
+	default:
+		return nil, fmt.Errorf("credstore: unsupported SASL mechanism %q", mech)
+	}
+}
+
+func (a *Authenticator) hasMechanism(mech string) bool {
+	for _, m := range a.Mechanisms() {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
+
+// loginServer calls a function once the wrapped SASL exchange succeeds.
+type loginServer struct {
+	sasl.Server
+	login func() error
+}
+
+func (s *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	challenge, done, err = s.Server.Next(response)
+	if done && err == nil {
+		err = s.login()
+	}
+	return challenge, done, err
+}
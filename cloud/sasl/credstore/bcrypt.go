@@ -0,0 +1,50 @@
+package credstore
+
+import (
+	"errors"
+
+	"github.com/unix-world/smartgo/crypto/bcrypt"
+)
+
+// DefaultBcryptCost is the default bcrypt cost used by NewBcrypt.
+const DefaultBcryptCost = bcrypt.DefaultCost
+
+type bcryptHash struct {
+	hash []byte
+}
+
+// NewBcrypt hashes a password with bcrypt. If cost is zero,
+// DefaultBcryptCost is used.
+func NewBcrypt(password string, cost int) (Hash, error) {
+	if cost == 0 {
+		cost = DefaultBcryptCost
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &bcryptHash{hash}, nil
+}
+
+func parseBcrypt(scheme, value string) (Hash, error) {
+	if _, err := bcrypt.Cost([]byte(value)); err != nil {
+		return nil, errors.New("credstore: malformed bcrypt hash")
+	}
+	return &bcryptHash{[]byte(value)}, nil
+}
+
+func (h *bcryptHash) Scheme() string {
+	return "BLF-CRYPT"
+}
+
+func (h *bcryptHash) Verify(password string) error {
+	err := bcrypt.CompareHashAndPassword(h.hash, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+func (h *bcryptHash) String() string {
+	return "{" + h.Scheme() + "}" + string(h.hash)
+}
@@ -0,0 +1,39 @@
+package credstore
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+)
+
+// cramMD5Hash is a precomputed CRAM-MD5 secret. Like plain text passwords, it
+// can be used by CRAM-MD5 servers.
+type cramMD5Hash struct {
+	secret *sasl.CramMD5Secret
+}
+
+func parseCramMD5(scheme, value string) (Hash, error) {
+	b, err := hex.DecodeString(value)
+	if err != nil || len(b) != len(sasl.CramMD5Secret{}) {
+		return nil, errors.New("credstore: malformed CRAM-MD5 hash")
+	}
+	secret := sasl.CramMD5Secret(b)
+	return &cramMD5Hash{&secret}, nil
+}
+
+func (h *cramMD5Hash) Scheme() string {
+	return "CRAM-MD5"
+}
+
+func (h *cramMD5Hash) Verify(password string) error {
+	if subtle.ConstantTimeCompare(sasl.NewCramMD5Secret(password)[:], h.secret[:]) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *cramMD5Hash) String() string {
+	return "{" + h.Scheme() + "}" + hex.EncodeToString(h.secret[:])
+}
@@ -0,0 +1,246 @@
+// Package credstore stores user passwords for SASL servers.
+//
+// Passwords are kept as hashes, using one of the supported schemes: bcrypt,
+// argon2id, PBKDF2, SCRAM stored keys, and for compatibility with existing
+// user databases SHA-crypt, salted SHA digests, CRAM-MD5 secrets and plain
+// text.
+//
+// Hashes use the Dovecot "{SCHEME}hash" format. crypt(3) hashes without a
+// scheme prefix (e.g. "$2y$10$...") are recognized as well.
+package credstore
+
+import (
+	"bufio"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUserNotFound is returned by Store.Lookup when the user doesn't exist.
+	ErrUserNotFound = errors.New("credstore: user not found")
+	// ErrInvalidCredentials is returned by Hash.Verify when the password
+	// doesn't match.
+	ErrInvalidCredentials = errors.New("credstore: invalid credentials")
+)
+
+// Hash is a password hash.
+type Hash interface {
+	// Scheme returns the name of the hash scheme, e.g. "BLF-CRYPT".
+	Scheme() string
+	// Verify checks a password against the hash. ErrInvalidCredentials is
+	// returned if the password doesn't match.
+	Verify(password string) error
+	// String returns the hash in the "{SCHEME}hash" format.
+	String() string
+}
+
+type hashParser func(scheme, value string) (Hash, error)
+
+var schemes = map[string]hashParser{
+	"BLF-CRYPT":     parseBcrypt,
+	"ARGON2ID":      parseArgon2id,
+	"PBKDF2":        parsePBKDF2,
+	"PBKDF2-SHA256": parsePBKDF2,
+	"PBKDF2-SHA512": parsePBKDF2,
+	"SCRAM-SHA-1":   parseScram,
+	"SCRAM-SHA-256": parseScram,
+	"CRAM-MD5":      parseCramMD5,
+	"SHA256-CRYPT":  parseSHACrypt,
+	"SHA512-CRYPT":  parseSHACrypt,
+	"SHA":           parseDigest,
+	"SHA1":          parseDigest,
+	"SSHA":          parseDigest,
+	"SHA256":        parseDigest,
+	"SSHA256":       parseDigest,
+	"SHA512":        parseDigest,
+	"SSHA512":       parseDigest,
+	"PLAIN":         parsePlain,
+	"CLEAR":         parsePlain,
+	"CLEARTEXT":     parsePlain,
+}
+
+// cryptScheme guesses the scheme of a crypt(3) hash from its prefix.
+func cryptScheme(value string) string {
+	switch {
+	case strings.HasPrefix(value, "$2a$"), strings.HasPrefix(value, "$2b$"), strings.HasPrefix(value, "$2y$"):
+		return "BLF-CRYPT"
+	case strings.HasPrefix(value, "$argon2id$"):
+		return "ARGON2ID"
+	case strings.HasPrefix(value, "$5$"):
+		return "SHA256-CRYPT"
+	case strings.HasPrefix(value, "$6$"):
+		return "SHA512-CRYPT"
+	case strings.HasPrefix(value, "$pbkdf2-sha256$"):
+		return "PBKDF2-SHA256"
+	case strings.HasPrefix(value, "$pbkdf2-sha512$"):
+		return "PBKDF2-SHA512"
+	default:
+		return ""
+	}
+}
+
+// ParseHash parses a password hash.
+//
+// The hash is either in the "{SCHEME}hash" format used by Dovecot, or a
+// crypt(3) hash whose scheme can be guessed from its prefix.
+func ParseHash(s string) (Hash, error) {
+	var scheme, value string
+	if strings.HasPrefix(s, "{") {
+		i := strings.IndexByte(s, '}')
+		if i < 0 {
+			return nil, errors.New("credstore: malformed hash scheme")
+		}
+		scheme, value = strings.ToUpper(s[1:i]), s[i+1:]
+	} else {
+		scheme, value = cryptScheme(s), s
+		if scheme == "" {
+			return nil, errors.New("credstore: unknown hash scheme")
+		}
+	}
+
+	parse, ok := schemes[scheme]
+	if !ok {
+		// Digest schemes may specify the encoding, e.g. "{SSHA256.HEX}"
+		if i := strings.LastIndexByte(scheme, '.'); i >= 0 {
+			if parse, ok = schemes[scheme[:i]]; ok && !isDigestScheme(scheme[:i]) {
+				ok = false
+			}
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("credstore: unsupported hash scheme %q", scheme)
+	}
+	return parse(scheme, value)
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// Store looks up user password hashes.
+type Store interface {
+	// Lookup returns the password hash of a user. ErrUserNotFound is returned
+	// if the user doesn't exist.
+	Lookup(username string) (Hash, error)
+}
+
+// RangeStore is a Store which can enumerate its users.
+type RangeStore interface {
+	Store
+
+	// Range calls fn for each user, until fn returns false.
+	Range(fn func(username string, h Hash) bool)
+	// Generation returns a number which changes each time the users or
+	// their hashes change.
+	Generation() uint64
+}
+
+// MemoryStore is a Store keeping hashes in memory. It's safe for concurrent
+// use.
+type MemoryStore struct {
+	mutex  sync.RWMutex
+	hashes map[string]Hash
+	gen    uint64
+}
+
+var _ RangeStore = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a new empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{hashes: make(map[string]Hash)}
+}
+
+// Set sets the password hash of a user.
+func (s *MemoryStore) Set(username string, h Hash) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hashes[username] = h
+	s.gen++
+}
+
+// Delete removes a user.
+func (s *MemoryStore) Delete(username string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.hashes, username)
+	s.gen++
+}
+
+// Lookup implements Store.
+func (s *MemoryStore) Lookup(username string) (Hash, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	h, ok := s.hashes[username]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return h, nil
+}
+
+// Range implements RangeStore. fn must not modify the store.
+func (s *MemoryStore) Range(fn func(username string, h Hash) bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for username, h := range s.hashes {
+		if !fn(username, h) {
+			return
+		}
+	}
+}
+
+// Generation implements RangeStore.
+func (s *MemoryStore) Generation() uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.gen
+}
+
+// ReadPasswdFile reads a passwd-like user database, as used by Dovecot's
+// passwd-file driver: one "user:{SCHEME}hash" entry per line. Additional
+// colon-separated fields, empty lines and lines starting with "#" are ignored.
+func ReadPasswdFile(r io.Reader) (*MemoryStore, error) {
+	s := NewMemoryStore()
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("credstore: line %v: malformed entry", lineno)
+		}
+		h, err := ParseHash(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("credstore: line %v: %v", lineno, err)
+		}
+		s.Set(fields[0], h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// LoadPasswdFile reads a passwd-like user database from the named file. See
+// ReadPasswdFile.
+func LoadPasswdFile(name string) (*MemoryStore, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPasswdFile(f)
+}
@@ -0,0 +1,209 @@
+package credstore
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+)
+
+// Test vectors from https://www.akkadia.org/drepper/SHA-crypt.txt
+var shaCryptTests = []struct {
+	hash, password string
+}{
+	{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+	{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+	{"$5$rounds=10000$saltstringsaltstring$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+	{"$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5", "This is just a test"},
+	{"$5$rounds=77777$short$JiO1O3ZpDAxGJeaDIuqCoEFysAe1mZNJRs3pw0KQRd/", "we have a short salt string but not a short password"},
+	{"$5$rounds=10$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC", "the minimum number is still observed"},
+	{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+	{"$6$rounds=10000$saltstringsaltstring$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", "Hello world!"},
+	{"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0", "This is just a test"},
+}
+
+func TestSHACrypt(t *testing.T) {
+	for _, tc := range shaCryptTests {
+		h, err := ParseHash(tc.hash)
+		if err != nil {
+			t.Errorf("ParseHash(%q) = %v", tc.hash, err)
+			continue
+		}
+		if err := h.Verify(tc.password); err != nil {
+			t.Errorf("Verify(%q) for %q = %v", tc.password, tc.hash, err)
+		}
+		if err := h.Verify(tc.password + "x"); err != ErrInvalidCredentials {
+			t.Errorf("Verify(wrong password) for %q = %v, want ErrInvalidCredentials", tc.hash, err)
+		}
+		if h.String() != "{"+h.Scheme()+"}"+tc.hash {
+			t.Errorf("String() = %q", h.String())
+		}
+	}
+}
+
+// Reference hashes of "password", generated with the argon2 reference
+// implementation, crypt(3), passlib, Dovecot's formats and the RFC 7677
+// example for SCRAM
+var parseHashTests = []struct {
+	hash, password, scheme string
+}{
+	{"$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc", "password", "ARGON2ID"},
+	{"$2b$04$abcdefghijklmnopqrstuughE8Ev8uGFaUgY2cNEySvxngrb/Jzdm", "password", "BLF-CRYPT"},
+	{"{BLF-CRYPT}$2y$05$abcdefghijklmnopqrstuuWG29KuyeAicPCJODk1zjyGvyQUU2awu", "password", "BLF-CRYPT"},
+	{"$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$8nX7hwFEzIB8aPajJTYK8weHQc5Ngz0pFVAKvSu4jQA", "password", "PBKDF2-SHA256"},
+	{"$pbkdf2-sha512$1000$c2FsdHNhbHRzYWx0c2FsdA$715rqIr5dXOVPpBhqqsugl037zT5bWJTWYmZtIcK8hBnisKpwfY7kokvwjDrNHqHhF50Pb7MD6HvkJwiDQw4ww", "password", "PBKDF2-SHA512"},
+	{"{PBKDF2}$1$S4lt$5000$6489552c633b0a6820acbd2ff3b9a7ddd93b5b27", "password", "PBKDF2"},
+	{"{SCRAM-SHA-256}4096,W22ZaJ0SNY7soEsUEjb6gQ==,WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=,wfPLwcE6nTWhTAmQ7tl2KeoiWGPlZqQxSrmfPwDl2dU=", "pencil", "SCRAM-SHA-256"},
+	{"{CRAM-MD5}54b21152711fb604ca3e035e7015116bd06d4e1b26fccaa4b0b61801132340a3", "tanstaaftanstaaf", "CRAM-MD5"},
+	{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password", "SHA"},
+	{"{SSHA}rXVtWiPAY6/w8MuTLKIjpBjj2mtzYWx0MTIzNA==", "password", "SSHA"},
+	{"{SSHA256.HEX}66a6dc5a3ebe2aa0f90419bad7b40fb6ba4b5848175120169bc304aeb4aa46ae73616c7431323334", "password", "SSHA256.HEX"},
+	{"{SHA512}sQnzu7wkTrgkQZF+0G1hi5AI3Qmzvv0bXgc5THBqi7mAsdd4Xll27ASbRt9fEyavWi6m0QP9B8lThf+rDKy8hg==", "password", "SHA512"},
+	{"{PLAIN}password", "password", "PLAIN"},
+}
+
+func TestParseHash(t *testing.T) {
+	for _, tc := range parseHashTests {
+		h, err := ParseHash(tc.hash)
+		if err != nil {
+			t.Errorf("ParseHash(%q) = %v", tc.hash, err)
+			continue
+		}
+		if h.Scheme() != tc.scheme {
+			t.Errorf("Scheme() for %q = %v, want %v", tc.hash, h.Scheme(), tc.scheme)
+		}
+		if err := h.Verify(tc.password); err != nil {
+			t.Errorf("Verify(%q) for %q = %v", tc.password, tc.hash, err)
+		}
+		if err := h.Verify(tc.password + "x"); err != ErrInvalidCredentials {
+			t.Errorf("Verify(wrong password) for %q = %v, want ErrInvalidCredentials", tc.hash, err)
+		}
+
+		// String must round-trip
+		h2, err := ParseHash(h.String())
+		if err != nil || h2.String() != h.String() {
+			t.Errorf("ParseHash(%q) = %v, %v", h.String(), h2, err)
+		}
+	}
+}
+
+func TestNewHash(t *testing.T) {
+	for _, newHash := range []func(password string) (Hash, error){
+		func(password string) (Hash, error) { return NewBcrypt(password, 4) },
+		func(password string) (Hash, error) { return NewPBKDF2(password, 1000) },
+		func(password string) (Hash, error) { return NewScram(sasl.ScramSHA256, password, 0) },
+	} {
+		h, err := newHash("hunter2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err = ParseHash(h.String())
+		if err != nil {
+			t.Fatalf("ParseHash(%q) = %v", h, err)
+		}
+		if err := h.Verify("hunter2"); err != nil {
+			t.Errorf("Verify() for %q = %v", h, err)
+		}
+		if err := h.Verify("hunter3"); err != ErrInvalidCredentials {
+			t.Errorf("Verify(wrong password) for %q = %v, want ErrInvalidCredentials", h, err)
+		}
+	}
+}
+
+func TestParseHashMalformed(t *testing.T) {
+	for _, s := range []string{
+		"{ARGON2ID}$argon2id$v=19$m=65536,t=0,p=4$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"{ARGON2ID}$argon2id$v=19$m=65536,t=2,p=0$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"{ARGON2ID}$argon2id$v=19$m=65536,t=2,p=256$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"{ARGON2ID}$argon2id$v=19$m=4294967295,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"{ARGON2ID}$argon2id$v=19$m=-1,t=2,p=1$c29tZXNhbHQ$CTFhFdXPJO1aFaMaO6Mm5c8y7cJHAph8ArZWb2GRPPc",
+		"{ARGON2ID}$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ$",
+		"{ARGON2ID}$argon2id$v=19$m=65536,t=2,p=1$c29tZXNhbHQ",
+		"$2b$04$tooshort",
+		"$pbkdf2-sha256$0$c2FsdA$a2V5",
+		"$pbkdf2-sha256$1000$c2FsdA$",
+		"{PBKDF2}$2$S4lt$5000$6489",
+		"{SCRAM-SHA-256}4096,W22ZaJ0SNY7soEsUEjb6gQ==,WG5d8oPm3OtcPnkdi4Uo7BkeZkBFzpcXkuLmtbsT4qY=",
+		"{SCRAM-SHA-256}0,W22ZaJ0SNY7soEsUEjb6gQ==,WG5d,wfPL",
+		"{CRAM-MD5}54b21152711fb604",
+		"{SHA}W6ph5Mm5Pz8GgiULbPgzG37m",
+		"{SHA.BIN}W6ph5Mm5Pz8GgiULbPgzG37mj9g=",
+		"{MD4}whatever",
+		"{SHA",
+		"plaintext",
+		"$5$rounds=abc$salt$digest",
+		"$5$salt",
+		"{SHA256-CRYPT}$6$salt$digest",
+	} {
+		if _, err := ParseHash(s); err == nil {
+			t.Errorf("ParseHash(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestAuthenticatorMechanisms(t *testing.T) {
+	scram256, err := NewScram(sasl.ScramSHA256, "pencil", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scram1, err := NewScram(sasl.ScramSHA1, "pencil", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ParseHash("{PLAIN}pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryStore()
+	auth := &Authenticator{Store: store}
+	check := func(want ...string) {
+		t.Helper()
+		if got := auth.Mechanisms(); strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("Mechanisms() = %v, want %v", got, want)
+		}
+	}
+
+	check(sasl.Plain, sasl.Login)
+	store.Set("alice", scram256)
+	check(sasl.ScramSHA256, sasl.Plain, sasl.Login)
+	store.Set("bob", scram1)
+	check(sasl.Plain, sasl.Login)
+	store.Set("bob", scram256)
+	store.Set("carol", plain)
+	check(sasl.Plain, sasl.Login)
+	store.Delete("carol")
+	check(sasl.ScramSHA256, sasl.Plain, sasl.Login)
+
+	auth.SASLMechanisms = []string{sasl.Plain, sasl.CramMD5}
+	check(sasl.Plain, sasl.CramMD5)
+}
+
+func TestAuthenticatorNewServer(t *testing.T) {
+	plain, err := ParseHash("{PLAIN}pencil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	store.Set("alice", plain)
+
+	auth := &Authenticator{Store: store, Hostname: "example.org"}
+	for _, mech := range []string{sasl.Plain, sasl.Login} {
+		if _, err := auth.NewServer(mech); err != nil {
+			t.Errorf("NewServer(%v) = %v", mech, err)
+		}
+	}
+	for _, mech := range []string{sasl.ScramSHA256, sasl.CramMD5, sasl.DigestMD5, "UNKNOWN"} {
+		if _, err := auth.NewServer(mech); err == nil {
+			t.Errorf("NewServer(%v) succeeded for a mechanism not in Mechanisms()", mech)
+		}
+	}
+
+	auth.SASLMechanisms = []string{sasl.CramMD5}
+	if _, err := auth.NewServer(sasl.CramMD5); err != nil {
+		t.Errorf("NewServer(%v) = %v", sasl.CramMD5, err)
+	}
+	if _, err := auth.NewServer(sasl.Plain); err == nil {
+		t.Errorf("NewServer(%v) succeeded for a mechanism not in SASLMechanisms", sasl.Plain)
+	}
+}
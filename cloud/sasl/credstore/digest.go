@@ -0,0 +1,115 @@
+package credstore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// Plain and salted digest schemes. They are only supported to import legacy
+// user databases.
+
+type digestHash struct {
+	scheme  string
+	newHash func() hash.Hash
+	salted  bool
+	hex     bool
+	// Digest, followed by the salt for salted schemes
+	value []byte
+}
+
+func isDigestScheme(scheme string) bool {
+	switch scheme {
+	case "SHA", "SHA1", "SSHA", "SHA256", "SSHA256", "SHA512", "SSHA512":
+		return true
+	}
+	return false
+}
+
+func parseDigest(scheme, value string) (Hash, error) {
+	h := &digestHash{scheme: scheme}
+
+	base, encoding, _ := strings.Cut(scheme, ".")
+	switch encoding {
+	case "", "B64", "BASE64":
+		// default
+	case "HEX":
+		h.hex = true
+	default:
+		return nil, errors.New("credstore: unsupported digest encoding")
+	}
+
+	switch base {
+	case "SHA", "SHA1", "SSHA":
+		h.newHash = sha1.New
+	case "SHA256", "SSHA256":
+		h.newHash = sha256.New
+	case "SHA512", "SSHA512":
+		h.newHash = sha512.New
+	}
+	h.salted = strings.HasPrefix(base, "SSHA")
+
+	var err error
+	if h.hex {
+		h.value, err = hex.DecodeString(value)
+	} else {
+		h.value, err = base64.StdEncoding.DecodeString(value)
+	}
+	size := h.newHash().Size()
+	if err != nil || len(h.value) < size || (!h.salted && len(h.value) != size) {
+		return nil, errors.New("credstore: malformed digest hash")
+	}
+	return h, nil
+}
+
+func (h *digestHash) Scheme() string {
+	return h.scheme
+}
+
+func (h *digestHash) Verify(password string) error {
+	size := h.newHash().Size()
+	d := h.newHash()
+	d.Write([]byte(password))
+	d.Write(h.value[size:]) // salt
+	if subtle.ConstantTimeCompare(d.Sum(nil), h.value[:size]) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *digestHash) String() string {
+	if h.hex {
+		return "{" + h.scheme + "}" + hex.EncodeToString(h.value)
+	}
+	return "{" + h.scheme + "}" + base64.StdEncoding.EncodeToString(h.value)
+}
+
+type plainHash struct {
+	scheme   string
+	password string
+}
+
+func parsePlain(scheme, value string) (Hash, error) {
+	return &plainHash{scheme, value}, nil
+}
+
+func (h *plainHash) Scheme() string {
+	return h.scheme
+}
+
+func (h *plainHash) Verify(password string) error {
+	if subtle.ConstantTimeCompare([]byte(password), []byte(h.password)) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *plainHash) String() string {
+	return "{" + h.scheme + "}" + h.password
+}
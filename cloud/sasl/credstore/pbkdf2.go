@@ -0,0 +1,124 @@
+package credstore
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/unix-world/smartgo/crypto/pbkdf2"
+)
+
+// DefaultPBKDF2Iterations is the default number of PBKDF2-SHA256 iterations
+// used by NewPBKDF2.
+const DefaultPBKDF2Iterations = 600000
+
+// passlib's "adapted base64" encoding: standard base64 without padding, with
+// "." instead of "+".
+var ab64Encoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789./").WithPadding(base64.NoPadding)
+
+type pbkdf2Hash struct {
+	scheme     string
+	newHash    func() hash.Hash
+	salt       []byte
+	iterations int
+	key        []byte
+}
+
+// NewPBKDF2 hashes a password with PBKDF2-SHA256. If iterations is zero,
+// DefaultPBKDF2Iterations is used.
+func NewPBKDF2(password string, iterations int) (Hash, error) {
+	if iterations == 0 {
+		iterations = DefaultPBKDF2Iterations
+	}
+	salt, err := randomSalt(16)
+	if err != nil {
+		return nil, err
+	}
+	h := &pbkdf2Hash{
+		scheme:     "PBKDF2-SHA256",
+		newHash:    sha256.New,
+		salt:       salt,
+		iterations: iterations,
+	}
+	h.key = h.derive(password)
+	return h, nil
+}
+
+// parsePBKDF2 parses either a Dovecot PBKDF2-SHA1 hash:
+// $1$salt$iterations$hexkey
+// or a passlib PBKDF2-SHA256/SHA512 hash:
+// $pbkdf2-sha256$iterations$salt$key
+func parsePBKDF2(scheme, value string) (Hash, error) {
+	malformed := errors.New("credstore: malformed PBKDF2 hash")
+
+	fields := strings.Split(value, "$")
+	if len(fields) != 5 || fields[0] != "" {
+		return nil, malformed
+	}
+
+	h := &pbkdf2Hash{scheme: scheme}
+	var err error
+	switch {
+	case scheme == "PBKDF2" && fields[1] == "1":
+		h.newHash = sha1.New
+		h.salt = []byte(fields[2])
+		h.iterations, err = strconv.Atoi(fields[3])
+		if err == nil {
+			h.key, err = hex.DecodeString(fields[4])
+		}
+	case scheme == "PBKDF2-SHA256" && fields[1] == "pbkdf2-sha256",
+		scheme == "PBKDF2-SHA512" && fields[1] == "pbkdf2-sha512":
+		h.newHash = sha256.New
+		if scheme == "PBKDF2-SHA512" {
+			h.newHash = sha512.New
+		}
+		h.iterations, err = strconv.Atoi(fields[2])
+		if err == nil {
+			h.salt, err = ab64Encoding.DecodeString(fields[3])
+		}
+		if err == nil {
+			h.key, err = ab64Encoding.DecodeString(fields[4])
+		}
+	default:
+		return nil, malformed
+	}
+	if err != nil || h.iterations <= 0 || len(h.key) == 0 {
+		return nil, malformed
+	}
+	return h, nil
+}
+
+func (h *pbkdf2Hash) derive(password string) []byte {
+	keyLen := h.newHash().Size()
+	if h.key != nil {
+		keyLen = len(h.key)
+	}
+	return pbkdf2.Key([]byte(password), h.salt, h.iterations, keyLen, h.newHash)
+}
+
+func (h *pbkdf2Hash) Scheme() string {
+	return h.scheme
+}
+
+func (h *pbkdf2Hash) Verify(password string) error {
+	if subtle.ConstantTimeCompare(h.derive(password), h.key) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *pbkdf2Hash) String() string {
+	if h.scheme == "PBKDF2" {
+		return fmt.Sprintf("{%v}$1$%s$%d$%x", h.scheme, h.salt, h.iterations, h.key)
+	}
+	return fmt.Sprintf("{%v}$%v$%d$%v$%v", h.scheme, strings.ToLower(h.scheme), h.iterations,
+		ab64Encoding.EncodeToString(h.salt), ab64Encoding.EncodeToString(h.key))
+}
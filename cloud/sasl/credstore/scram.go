@@ -0,0 +1,84 @@
+package credstore
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+)
+
+// ScramHash is a SCRAM stored-key hash. Unlike the other hashes, it can be
+// used by SCRAM servers, which never see the password.
+type ScramHash struct {
+	// SCRAM mechanism, e.g. sasl.ScramSHA256.
+	Mechanism   string
+	Credentials *sasl.ScramCredentials
+}
+
+var _ Hash = (*ScramHash)(nil)
+
+// NewScram computes the SCRAM stored keys of a password for the specified
+// mechanism. If iterations is zero, sasl.DefaultScramMinIterations is used.
+func NewScram(mech, password string, iterations int) (*ScramHash, error) {
+	if iterations == 0 {
+		iterations = sasl.DefaultScramMinIterations
+	}
+	salt, err := randomSalt(16)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := sasl.NewScramCredentials(mech, password, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	return &ScramHash{Mechanism: mech, Credentials: creds}, nil
+}
+
+// parseScram parses a Dovecot SCRAM hash:
+// iterations,salt,storedkey,serverkey
+func parseScram(scheme, value string) (Hash, error) {
+	malformed := errors.New("credstore: malformed SCRAM hash")
+
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return nil, malformed
+	}
+
+	creds := &sasl.ScramCredentials{}
+	var err error
+	if creds.Iterations, err = strconv.Atoi(fields[0]); err != nil || creds.Iterations <= 0 {
+		return nil, malformed
+	}
+	for i, dst := range []*[]byte{&creds.Salt, &creds.StoredKey, &creds.ServerKey} {
+		if *dst, err = base64.StdEncoding.DecodeString(fields[i+1]); err != nil {
+			return nil, malformed
+		}
+	}
+	return &ScramHash{Mechanism: scheme, Credentials: creds}, nil
+}
+
+func (h *ScramHash) Scheme() string {
+	return h.Mechanism
+}
+
+func (h *ScramHash) Verify(password string) error {
+	creds, err := sasl.NewScramCredentials(h.Mechanism, password, h.Credentials.Salt, h.Credentials.Iterations)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(creds.StoredKey, h.Credentials.StoredKey) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *ScramHash) String() string {
+	return fmt.Sprintf("{%v}%d,%v,%v,%v", h.Mechanism, h.Credentials.Iterations,
+		base64.StdEncoding.EncodeToString(h.Credentials.Salt),
+		base64.StdEncoding.EncodeToString(h.Credentials.StoredKey),
+		base64.StdEncoding.EncodeToString(h.Credentials.ServerKey))
+}
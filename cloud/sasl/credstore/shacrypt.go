@@ -0,0 +1,199 @@
+package credstore
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt, as specified in https://www.akkadia.org/drepper/SHA-crypt.txt.
+// Only verification is supported, new hashes should use a stronger scheme.
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLen    = 16
+)
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Byte permutations used to encode the final digests.
+var (
+	sha256CryptPerm = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		31, 30,
+	}
+	sha512CryptPerm = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41, 63,
+	}
+)
+
+type shaCryptHash struct {
+	scheme string
+	value  string
+	id     string
+	salt   string
+	digest string // encoded
+	rounds int
+}
+
+func parseSHACrypt(scheme, value string) (Hash, error) {
+	malformed := errors.New("credstore: malformed SHA-crypt hash")
+
+	h := &shaCryptHash{scheme: scheme, value: value, rounds: shaCryptDefaultRounds}
+	switch scheme {
+	case "SHA256-CRYPT":
+		h.id = "5"
+	case "SHA512-CRYPT":
+		h.id = "6"
+	}
+
+	fields := strings.Split(value, "$")
+	if len(fields) < 4 || fields[0] != "" || fields[1] != h.id {
+		return nil, malformed
+	}
+	fields = fields[2:]
+	if s, ok := strings.CutPrefix(fields[0], "rounds="); ok {
+		rounds, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, malformed
+		}
+		h.rounds = min(max(rounds, shaCryptMinRounds), shaCryptMaxRounds)
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return nil, malformed
+	}
+	h.salt = fields[0]
+	if len(h.salt) > shaCryptMaxSaltLen {
+		h.salt = h.salt[:shaCryptMaxSaltLen]
+	}
+	h.digest = fields[1]
+	return h, nil
+}
+
+func (h *shaCryptHash) Scheme() string {
+	return h.scheme
+}
+
+func (h *shaCryptHash) Verify(password string) error {
+	// Only the digest is compared: the salt may have been truncated and the
+	// rounds clamped
+	if subtle.ConstantTimeCompare([]byte(h.crypt(password)), []byte(h.digest)) != 1 {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+func (h *shaCryptHash) String() string {
+	return "{" + h.scheme + "}" + h.value
+}
+
+// crypt returns the encoded digest of a password.
+func (h *shaCryptHash) crypt(password string) string {
+	newHash, perm := sha256.New, sha256CryptPerm
+	if h.id == "6" {
+		newHash, perm = sha512.New, sha512CryptPerm
+	}
+	digest := shaCrypt(newHash, []byte(password), []byte(h.salt), h.rounds)
+
+	var sb strings.Builder
+	for i := 0; i < len(perm); i += 3 {
+		var w uint
+		n := 4
+		switch len(perm) - i {
+		case 1:
+			w = uint(digest[perm[i]])
+			n = 2
+		case 2:
+			w = uint(digest[perm[i]])<<8 | uint(digest[perm[i+1]])
+			n = 3
+		default:
+			w = uint(digest[perm[i]])<<16 | uint(digest[perm[i+1]])<<8 | uint(digest[perm[i+2]])
+		}
+		for ; n > 0; n-- {
+			sb.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return sb.String()
+}
+
+func shaCrypt(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	// Digest B
+	b := newHash()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	digestB := b.Sum(nil)
+
+	// Digest A
+	a := newHash()
+	a.Write(password)
+	a.Write(salt)
+	a.Write(repeat(digestB, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(password)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	// Sequence P
+	dp := newHash()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeat(dp.Sum(nil), len(password))
+
+	// Sequence S
+	ds := newHash()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeat(ds.Sum(nil), len(salt))
+
+	c := digestA
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+	return c
+}
+
+// repeat returns n bytes of b, repeated as necessary.
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
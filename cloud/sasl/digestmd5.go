@@ -0,0 +1,362 @@
+package sasl
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The DIGEST-MD5 mechanism name.
+const DigestMD5 = "DIGEST-MD5"
+
+// DigestMD5Secret is the secret used by servers to verify DIGEST-MD5
+// responses without storing the password: the MD5 hash of
+// "username:realm:password". It's the format used by Dovecot's DIGEST-MD5
+// password scheme.
+type DigestMD5Secret [md5.Size]byte
+
+// NewDigestMD5Secret computes the DIGEST-MD5 secret of a password.
+func NewDigestMD5Secret(username, realm, password string) *DigestMD5Secret {
+	secret := DigestMD5Secret(md5.Sum([]byte(username + ":" + realm + ":" + password)))
+	return &secret
+}
+
+// digestMD5Response computes the "response" directive (if authenticate is
+// true) or the "rspauth" directive, as defined in RFC 2831 section 2.1.2.1.
+func digestMD5Response(secret *DigestMD5Secret, nonce, nc, cnonce, qop, digestURI, authzid string, authenticate bool) string {
+	a1 := string(secret[:]) + ":" + nonce + ":" + cnonce
+	if authzid != "" {
+		a1 += ":" + authzid
+	}
+	a2 := ":" + digestURI
+	if authenticate {
+		a2 = "AUTHENTICATE" + a2
+	}
+	ha1 := md5.Sum([]byte(a1))
+	ha2 := md5.Sum([]byte(a2))
+	kd := md5.Sum([]byte(hex.EncodeToString(ha1[:]) + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + hex.EncodeToString(ha2[:])))
+	return hex.EncodeToString(kd[:])
+}
+
+// digestMD5Parse parses a list of directives, as defined in RFC 2831 section
+// 7.1. Only the first occurrence of a directive is kept.
+func digestMD5Parse(s string) (map[string]string, error) {
+	directives := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return directives, nil
+		}
+
+		i := strings.IndexByte(s, '=')
+		if i <= 0 {
+			return nil, errors.New("sasl: malformed DIGEST-MD5 directive")
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimLeft(s[i+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				sb.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("sasl: unterminated DIGEST-MD5 quoted string")
+			}
+			value, s = sb.String(), s[i+1:]
+		} else {
+			i := strings.IndexByte(s, ',')
+			if i < 0 {
+				i = len(s)
+			}
+			value, s = strings.TrimSpace(s[:i]), s[i:]
+		}
+
+		if _, ok := directives[key]; !ok {
+			directives[key] = value
+		}
+
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ',' {
+			return nil, errors.New("sasl: malformed DIGEST-MD5 directive list")
+		}
+	}
+}
+
+func digestMD5Quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func digestMD5Nonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// DigestMD5Options contains options for DIGEST-MD5 clients.
+type DigestMD5Options struct {
+	// Authorization identity. Optional.
+	Identity string
+	Username string
+	Password string
+
+	// Service name ("smtp", "imap", etc) and host name of the server, used
+	// to build the digest-uri directive.
+	Service string
+	Host    string
+
+	// Realm of the user. If empty, the first realm offered by the server is
+	// used.
+	Realm string
+}
+
+type digestMD5Client struct {
+	opts    DigestMD5Options
+	step    int
+	rspauth string
+}
+
+// A client implementation of the DIGEST-MD5 authentication mechanism, as
+// described in RFC 2831. Only authentication is supported (qop=auth), not
+// integrity or confidentiality protection.
+//
+// DIGEST-MD5 is obsolete (RFC 6331) and should only be used with legacy
+// servers that don't support SCRAM or PLAIN over TLS.
+func NewDigestMD5Client(opts *DigestMD5Options) Client {
+	return &digestMD5Client{opts: *opts}
+}
+
+func (a *digestMD5Client) Start() (mech string, ir []byte, err error) {
+	mech = DigestMD5
+	return
+}
+
+func (a *digestMD5Client) Next(challenge []byte) (response []byte, err error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.handleChallenge(challenge)
+	case 2:
+		directives, err := digestMD5Parse(string(challenge))
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(directives["rspauth"]), []byte(a.rspauth)) != 1 {
+			return nil, errors.New("sasl: invalid DIGEST-MD5 server response")
+		}
+		return []byte{}, nil
+	default:
+		return nil, ErrUnexpectedServerChallenge
+	}
+}
+
+func (a *digestMD5Client) handleChallenge(challenge []byte) ([]byte, error) {
+	directives, err := digestMD5Parse(string(challenge))
+	if err != nil {
+		return nil, err
+	}
+	nonce := directives["nonce"]
+	if nonce == "" {
+		return nil, errors.New("sasl: missing DIGEST-MD5 nonce")
+	}
+	if alg := directives["algorithm"]; alg != "md5-sess" {
+		return nil, fmt.Errorf("sasl: unsupported DIGEST-MD5 algorithm %q", alg)
+	}
+	if qop, ok := directives["qop"]; ok {
+		supported := false
+		for _, v := range strings.Split(qop, ",") {
+			if strings.TrimSpace(v) == "auth" {
+				supported = true
+			}
+		}
+		if !supported {
+			return nil, errors.New("sasl: server requires a DIGEST-MD5 security layer")
+		}
+	}
+
+	realm := a.opts.Realm
+	if realm == "" {
+		realm = directives["realm"]
+	}
+	cnonce, err := digestMD5Nonce()
+	if err != nil {
+		return nil, err
+	}
+	const nc, qop = "00000001", "auth"
+	digestURI := a.opts.Service + "/" + a.opts.Host
+
+	secret := NewDigestMD5Secret(a.opts.Username, realm, a.opts.Password)
+	resp := digestMD5Response(secret, nonce, nc, cnonce, qop, digestURI, a.opts.Identity, true)
+	a.rspauth = digestMD5Response(secret, nonce, nc, cnonce, qop, digestURI, a.opts.Identity, false)
+
+	s := "charset=utf-8,username=" + digestMD5Quote(a.opts.Username)
+	if realm != "" {
+		s += ",realm=" + digestMD5Quote(realm)
+	}
+	s += ",nonce=" + digestMD5Quote(nonce) +
+		",nc=" + nc +
+		",cnonce=" + digestMD5Quote(cnonce) +
+		",digest-uri=" + digestMD5Quote(digestURI) +
+		",response=" + resp +
+		",qop=" + qop
+	if a.opts.Identity != "" {
+		s += ",authzid=" + digestMD5Quote(a.opts.Identity)
+	}
+	return []byte(s), nil
+}
+
+// DigestMD5Lookup returns the DIGEST-MD5 secret of a user in a realm. Servers
+// storing plaintext passwords can use NewDigestMD5Secret.
+type DigestMD5Lookup func(username, realm string) (*DigestMD5Secret, error)
+
+// DigestMD5ServerOptions contains options for DIGEST-MD5 servers.
+type DigestMD5ServerOptions struct {
+	// Realm offered to clients. Optional.
+	Realm string
+
+	// Expected service name and host name in the digest-uri directive. If
+	// empty, they are not checked.
+	Service string
+	Host    string
+
+	// Looks up the secret of a user. Required.
+	Lookup DigestMD5Lookup
+
+	// Checks that the authenticated user is allowed to act as the requested
+	// authorization identity. If nil, only an empty identity or an identity
+	// equal to the username is accepted.
+	Authorize func(identity, username string) error
+}
+
+type digestMD5ServerState int
+
+const (
+	digestMD5NotStarted digestMD5ServerState = iota
+	digestMD5ChallengeSent
+	digestMD5RspAuthSent
+	digestMD5Done
+)
+
+type digestMD5Server struct {
+	opts  DigestMD5ServerOptions
+	state digestMD5ServerState
+	nonce string
+}
+
+// A server implementation of the DIGEST-MD5 authentication mechanism, as
+// described in RFC 2831. Only authentication is supported (qop=auth), and
+// subsequent authentication is not.
+//
+// DIGEST-MD5 is obsolete (RFC 6331) and should only be enabled for legacy
+// clients.
+func NewDigestMD5Server(opts *DigestMD5ServerOptions) Server {
+	return &digestMD5Server{opts: *opts}
+}
+
+func (a *digestMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.state {
+	case digestMD5NotStarted:
+		// DIGEST-MD5 is server-first, subsequent authentication with an
+		// initial response isn't supported
+		if len(response) > 0 {
+			return nil, true, ErrUnexpectedClientResponse
+		}
+		if a.nonce, err = digestMD5Nonce(); err != nil {
+			return nil, true, err
+		}
+		s := ""
+		if a.opts.Realm != "" {
+			s = "realm=" + digestMD5Quote(a.opts.Realm) + ","
+		}
+		s += "nonce=" + digestMD5Quote(a.nonce) + `,qop="auth",charset=utf-8,algorithm=md5-sess`
+		a.state = digestMD5ChallengeSent
+		return []byte(s), false, nil
+	case digestMD5ChallengeSent:
+		a.state = digestMD5Done
+		rspauth, err := a.handleResponse(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		a.state = digestMD5RspAuthSent
+		return []byte("rspauth=" + rspauth), false, nil
+	case digestMD5RspAuthSent:
+		a.state = digestMD5Done
+		if len(response) > 0 {
+			return nil, true, ErrUnexpectedClientResponse
+		}
+		return nil, true, nil
+	default:
+		return nil, true, ErrUnexpectedClientResponse
+	}
+}
+
+func (a *digestMD5Server) handleResponse(response string) (rspauth string, err error) {
+	directives, err := digestMD5Parse(response)
+	if err != nil {
+		return "", err
+	}
+
+	username, realm := directives["username"], directives["realm"]
+	nonce, cnonce, nc := directives["nonce"], directives["cnonce"], directives["nc"]
+	digestURI, authzid := directives["digest-uri"], directives["authzid"]
+	qop := directives["qop"]
+	if qop == "" {
+		qop = "auth"
+	}
+
+	if username == "" || cnonce == "" || directives["response"] == "" {
+		return "", errors.New("sasl: malformed DIGEST-MD5 response")
+	}
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(a.nonce)) != 1 || nc != "00000001" {
+		return "", errors.New("sasl: invalid DIGEST-MD5 nonce")
+	}
+	if qop != "auth" {
+		return "", fmt.Errorf("sasl: unsupported DIGEST-MD5 qop %q", qop)
+	}
+	if realm != a.opts.Realm && a.opts.Realm != "" {
+		return "", fmt.Errorf("sasl: unknown DIGEST-MD5 realm %q", realm)
+	}
+	service, host, _ := strings.Cut(digestURI, "/")
+	// The digest-uri may contain a third serv-name part, ignore it
+	host, _, _ = strings.Cut(host, "/")
+	if (a.opts.Service != "" && !strings.EqualFold(service, a.opts.Service)) ||
+		(a.opts.Host != "" && !strings.EqualFold(host, a.opts.Host)) {
+		return "", fmt.Errorf("sasl: invalid DIGEST-MD5 digest-uri %q", digestURI)
+	}
+
+	secret, err := a.opts.Lookup(username, realm)
+	if err != nil {
+		return "", err
+	}
+	if secret == nil {
+		return "", errors.New("sasl: invalid DIGEST-MD5 response")
+	}
+	expected := digestMD5Response(secret, nonce, nc, cnonce, qop, digestURI, authzid, true)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(directives["response"]))) != 1 {
+		return "", errors.New("sasl: invalid DIGEST-MD5 response")
+	}
+
+	if a.opts.Authorize != nil {
+		err = a.opts.Authorize(authzid, username)
+	} else if authzid != "" && authzid != username {
+		err = errors.New("sasl: DIGEST-MD5 authorization identity not supported")
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return digestMD5Response(secret, nonce, nc, cnonce, qop, digestURI, authzid, false), nil
+}
@@ -0,0 +1,116 @@
+package sasl
+
+import (
+	"errors"
+	"testing"
+)
+
+// Example from RFC 2831 section 4
+const (
+	digestMD5ExampleChallenge = `realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth",algorithm=md5-sess,charset=utf-8`
+	digestMD5ExampleResponse  = `charset=utf-8,username="chris",realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",nc=00000001,cnonce="OA6MHXh6VqTrRk",digest-uri="imap/elwood.innosoft.com",response=d388dad90d4bbd760a152321f2143af7,qop=auth`
+	digestMD5ExampleRspAuth   = "rspauth=ea40f60335c427b5527b84dbabcdfffd"
+)
+
+func digestMD5TestLookup(username, realm string) (*DigestMD5Secret, error) {
+	switch username {
+	case "chris":
+	case "ghost":
+		// Lookup functions may return a nil secret without error
+		return nil, nil
+	default:
+		return nil, errors.New("unknown user")
+	}
+	return NewDigestMD5Secret(username, realm, "secret"), nil
+}
+
+func TestDigestMD5Server(t *testing.T) {
+	s := NewDigestMD5Server(&DigestMD5ServerOptions{
+		Realm:   "elwood.innosoft.com",
+		Service: "imap",
+		Host:    "elwood.innosoft.com",
+		Lookup:  digestMD5TestLookup,
+	})
+	if _, _, err := s.Next(nil); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	// Replace the random nonce with the one of the example
+	s.(*digestMD5Server).nonce = "OA6MG9tEQGm2hh"
+
+	challenge, done, err := s.Next([]byte(digestMD5ExampleResponse))
+	if err != nil || done {
+		t.Fatalf("Next(response) = %v, %v", done, err)
+	}
+	if string(challenge) != digestMD5ExampleRspAuth {
+		t.Errorf("challenge = %q, want %q", challenge, digestMD5ExampleRspAuth)
+	}
+	if _, done, err := s.Next(nil); err != nil || !done {
+		t.Errorf("Next() = %v, %v, want done", done, err)
+	}
+}
+
+func TestDigestMD5Client(t *testing.T) {
+	secret := NewDigestMD5Secret("chris", "elwood.innosoft.com", "secret")
+	const nonce, cnonce, digestURI = "OA6MG9tEQGm2hh", "OA6MHXh6VqTrRk", "imap/elwood.innosoft.com"
+	if got := digestMD5Response(secret, nonce, "00000001", cnonce, "auth", digestURI, "", true); got != "d388dad90d4bbd760a152321f2143af7" {
+		t.Errorf("response = %v", got)
+	}
+
+	c := NewDigestMD5Client(&DigestMD5Options{
+		Username: "chris",
+		Password: "secret",
+		Service:  "imap",
+		Host:     "elwood.innosoft.com",
+	})
+	resp, err := c.Next([]byte(digestMD5ExampleChallenge))
+	if err != nil {
+		t.Fatalf("Next(challenge) = %v", err)
+	}
+	directives, err := digestMD5Parse(string(resp))
+	if err != nil {
+		t.Fatalf("malformed response %q: %v", resp, err)
+	}
+	for k, want := range map[string]string{
+		"username":   "chris",
+		"realm":      "elwood.innosoft.com",
+		"nonce":      nonce,
+		"digest-uri": digestURI,
+		"qop":        "auth",
+		"response":   digestMD5Response(secret, nonce, "00000001", directives["cnonce"], "auth", digestURI, "", true),
+	} {
+		if directives[k] != want {
+			t.Errorf("%v = %q, want %q", k, directives[k], want)
+		}
+	}
+	if _, err := c.Next([]byte(digestMD5ExampleRspAuth)); err == nil {
+		t.Errorf("Next() accepted an rspauth for another cnonce")
+	}
+}
+
+func TestDigestMD5Exchange(t *testing.T) {
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"chris", "secret", true},
+		{"chris", "wrong", false},
+		{"nobody", "secret", false},
+		{"ghost", "secret", false},
+	} {
+		c := NewDigestMD5Client(&DigestMD5Options{
+			Username: tc.username,
+			Password: tc.password,
+			Service:  "imap",
+			Host:     "elwood.innosoft.com",
+		})
+		s := NewDigestMD5Server(&DigestMD5ServerOptions{
+			Realm:   "elwood.innosoft.com",
+			Service: "imap",
+			Host:    "elwood.innosoft.com",
+			Lookup:  digestMD5TestLookup,
+		})
+		if _, err := exchange(t, c, s); (err == nil) != tc.ok {
+			t.Errorf("exchange(%v, %v) = %v", tc.username, tc.password, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package jwtbearer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+)
+
+// jsonWebKey is a JSON Web Key, as defined in RFC 7517.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Curve string `json:"crv"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// Key is a public key of a KeySet.
+type Key struct {
+	ID        string
+	Algorithm string
+	PublicKey crypto.PublicKey
+}
+
+// KeySet is a set of public keys used to verify token signatures, usually
+// loaded from a JSON Web Key Set (JWKS) document.
+type KeySet struct {
+	Keys []Key
+}
+
+// ParseKeySet parses a JWKS document, as defined in RFC 7517 section 5.
+//
+// Keys which are not signature keys, or whose type is not supported, are
+// skipped.
+func ParseKeySet(b []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("jwtbearer: malformed JWKS document: %v", err)
+	}
+
+	ks := &KeySet{}
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		k, err := parseKey(&jwk)
+		if err == errUnsupportedKey {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("jwtbearer: malformed key %q: %v", jwk.KeyID, err)
+		}
+		ks.Keys = append(ks.Keys, *k)
+	}
+	if len(ks.Keys) == 0 {
+		return nil, errors.New("jwtbearer: no usable key in JWKS document")
+	}
+	return ks, nil
+}
+
+// maxKeySetSize is the maximum size of a JWKS document.
+const maxKeySetSize = 1 << 20
+
+// ReadKeySet reads a JWKS document from r.
+func ReadKeySet(r io.Reader) (*KeySet, error) {
+	b, err := io.ReadAll(io.LimitReader(r, maxKeySetSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxKeySetSize {
+		return nil, errors.New("jwtbearer: JWKS document too large")
+	}
+	return ParseKeySet(b)
+}
+
+// LoadKeySet reads a JWKS document from the named file.
+func LoadKeySet(name string) (*KeySet, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadKeySet(f)
+}
+
+// FetchKeySet fetches a JWKS document with an HTTP GET request. If client is
+// nil, http.DefaultClient is used.
+func FetchKeySet(client *http.Client, url string) (*KeySet, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwtbearer: failed to fetch JWKS document: HTTP %v", resp.StatusCode)
+	}
+	return ReadKeySet(resp.Body)
+}
+
+// LoadKeySetFromHandler fetches a JWKS document from an HTTP handler, without
+// going through the network. This is useful when the identity provider runs
+// in the same process.
+func LoadKeySetFromHandler(h http.Handler, target string) (*KeySet, error) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		return nil, fmt.Errorf("jwtbearer: failed to fetch JWKS document: HTTP %v", rec.Code)
+	}
+	return ReadKeySet(rec.Body)
+}
+
+var errUnsupportedKey = errors.New("jwtbearer: unsupported key")
+
+func parseKey(jwk *jsonWebKey) (*Key, error) {
+	k := &Key{ID: jwk.KeyID}
+
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		k.Algorithm = algRS256
+		k.PublicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		k.Algorithm = algES256
+		k.PublicKey = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	case "OKP":
+		if jwk.Curve != "Ed25519" {
+			return nil, errUnsupportedKey
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key size")
+		}
+		k.Algorithm = algEdDSA
+		k.PublicKey = ed25519.PublicKey(x)
+	default:
+		return nil, errUnsupportedKey
+	}
+
+	if jwk.Algorithm != "" && jwk.Algorithm != k.Algorithm {
+		return nil, errUnsupportedKey
+	}
+	return k, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,384 @@
+// Package jwtbearer validates JSON Web Token (JWT, RFC 7519) bearer tokens for
+// the OAUTHBEARER and XOAUTH2 SASL mechanisms.
+//
+// A Validator checks the token signature against a local JSON Web Key Set
+// and the standard claims, and reports failures as RFC 7628 error responses:
+//
+//	keys, err := jwtbearer.LoadKeySet("/etc/mail/sso-jwks.json")
+//	v := &jwtbearer.Validator{
+//		Keys:     keys,
+//		Issuer:   "https://sso.example.org",
+//		Audience: "mail",
+//		Scope:    []string{"mail"},
+//	}
+//	saslServer := sasl.NewOAuthBearerServer(v.OAuthBearerAuthenticator(login))
+package jwtbearer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+)
+
+// Supported signature algorithms, as defined in RFC 7518 and RFC 8037.
+const (
+	algRS256 = "RS256"
+	algES256 = "ES256"
+	algEdDSA = "EdDSA"
+)
+
+// Error statuses, as defined in RFC 6750 section 3.1.
+const (
+	StatusInvalidRequest    = "invalid_request"
+	StatusInvalidToken      = "invalid_token"
+	StatusInsufficientScope = "insufficient_scope"
+)
+
+// Error is returned when a token is rejected.
+type Error struct {
+	// RFC 6750 error status, e.g. StatusInvalidToken.
+	Status string
+	Err    error
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("jwtbearer: %v: %v", err.Status, err.Err)
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+func invalidToken(format string, v ...interface{}) error {
+	return &Error{Status: StatusInvalidToken, Err: fmt.Errorf(format, v...)}
+}
+
+// Claims contains the claims of a validated token.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	Scope     []string
+
+	// All claims, as decoded from JSON.
+	Raw map[string]interface{}
+}
+
+// String returns the value of a string claim, or an empty string if the claim
+// is missing or is not a string.
+func (c *Claims) String(name string) string {
+	s, _ := c.Raw[name].(string)
+	return s
+}
+
+// Validator checks JWT bearer tokens.
+type Validator struct {
+	// Keys used to verify token signatures. Required.
+	Keys *KeySet
+
+	// Expected "iss" claim. If empty, the issuer is not checked.
+	Issuer string
+	// Expected value in the "aud" claim. If empty, the audience is not
+	// checked.
+	Audience string
+	// Scopes which must all be granted by the "scope" (or "scp") claim.
+	Scope []string
+
+	// Claim holding the username which is compared with the SASL
+	// authorization identity. Defaults to "sub".
+	UsernameClaim string
+
+	// Allowed clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+	// Returns the current time. Defaults to time.Now.
+	Now func() time.Time
+}
+
+func (v *Validator) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+// Validate checks the signature and the claims of a token. If the token is
+// rejected, the returned error is of type *Error.
+func (v *Validator) Validate(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, invalidToken("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalidToken("malformed token header")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, invalidToken("malformed token header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("malformed token signature")
+	}
+	if err := v.verify(header.Algorithm, header.KeyID, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	rawPayload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, invalidToken("malformed token payload")
+	}
+	claims, err := parseClaims(rawPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, v.checkClaims(claims)
+}
+
+func (v *Validator) verify(alg, kid string, signingInput, sig []byte) error {
+	if v.Keys == nil {
+		return errors.New("jwtbearer: no key set configured")
+	}
+
+	switch alg {
+	case algRS256, algES256, algEdDSA:
+		// supported
+	default:
+		return invalidToken("unsupported signature algorithm %q", alg)
+	}
+
+	found := false
+	for _, k := range v.Keys.Keys {
+		if k.Algorithm != alg || (kid != "" && k.ID != kid) {
+			continue
+		}
+		found = true
+		if verifySignature(&k, signingInput, sig) {
+			return nil
+		}
+	}
+	if !found {
+		return invalidToken("no key matching %q", kid)
+	}
+	return invalidToken("invalid signature")
+}
+
+func verifySignature(k *Key, signingInput, sig []byte) bool {
+	switch pub := k.PublicKey.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signingInput)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// The signature is the concatenation of R and S (RFC 7518 section 3.4)
+		if len(sig) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signingInput)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, signingInput, sig)
+	default:
+		return false
+	}
+}
+
+func parseClaims(b []byte) (*Claims, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	claims := &Claims{}
+	if err := dec.Decode(&claims.Raw); err != nil || claims.Raw == nil {
+		return nil, invalidToken("malformed token payload")
+	}
+
+	var err error
+	claims.Issuer = claims.String("iss")
+	claims.Subject = claims.String("sub")
+	if claims.Audience, err = stringList(claims.Raw["aud"]); err != nil {
+		return nil, invalidToken("malformed aud claim")
+	}
+	if claims.ExpiresAt, err = numericDate(claims.Raw["exp"]); err != nil {
+		return nil, invalidToken("malformed exp claim")
+	}
+	if claims.NotBefore, err = numericDate(claims.Raw["nbf"]); err != nil {
+		return nil, invalidToken("malformed nbf claim")
+	}
+	if claims.IssuedAt, err = numericDate(claims.Raw["iat"]); err != nil {
+		return nil, invalidToken("malformed iat claim")
+	}
+
+	// "scope" is a space-separated string (RFC 8693), some providers use
+	// "scp" with either a string or a list of strings
+	if s, ok := claims.Raw["scope"].(string); ok {
+		claims.Scope = strings.Fields(s)
+	} else if s, ok := claims.Raw["scp"].(string); ok {
+		claims.Scope = strings.Fields(s)
+	} else if claims.Scope, err = stringList(claims.Raw["scp"]); err != nil {
+		return nil, invalidToken("malformed scp claim")
+	}
+
+	return claims, nil
+}
+
+func stringList(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		l := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, errors.New("not a string")
+			}
+			l = append(l, s)
+		}
+		return l, nil
+	default:
+		return nil, errors.New("not a string or a list of strings")
+	}
+}
+
+func numericDate(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(int64(f), 0), nil
+	default:
+		return time.Time{}, errors.New("not a number")
+	}
+}
+
+func (v *Validator) checkClaims(claims *Claims) error {
+	now := v.now()
+
+	if claims.ExpiresAt.IsZero() {
+		return invalidToken("missing exp claim")
+	}
+	if now.After(claims.ExpiresAt.Add(v.Leeway)) {
+		return invalidToken("token expired")
+	}
+	if !claims.NotBefore.IsZero() && now.Add(v.Leeway).Before(claims.NotBefore) {
+		return invalidToken("token not valid yet")
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return invalidToken("unexpected issuer %q", claims.Issuer)
+	}
+	if v.Audience != "" && !contains(claims.Audience, v.Audience) {
+		return invalidToken("token not issued for audience %q", v.Audience)
+	}
+	for _, scope := range v.Scope {
+		if !contains(claims.Scope, scope) {
+			return &Error{Status: StatusInsufficientScope, Err: fmt.Errorf("missing scope %q", scope)}
+		}
+	}
+
+	return nil
+}
+
+func contains(l []string, s string) bool {
+	for _, item := range l {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Validator) usernameClaim() string {
+	if v.UsernameClaim != "" {
+		return v.UsernameClaim
+	}
+	return "sub"
+}
+
+// Username returns the username carried by validated claims.
+func (v *Validator) Username(claims *Claims) string {
+	return claims.String(v.usernameClaim())
+}
+
+// OAuthBearerError converts an error returned by Validate into an RFC 7628
+// error response.
+func (v *Validator) OAuthBearerError(err error) *sasl.OAuthBearerError {
+	status := StatusInvalidToken
+	var validationErr *Error
+	if errors.As(err, &validationErr) {
+		status = validationErr.Status
+	}
+	return &sasl.OAuthBearerError{
+		Status:  status,
+		Schemes: "bearer",
+		Scope:   strings.Join(v.Scope, " "),
+	}
+}
+
+// authenticate validates a token for a SASL exchange. If username is not
+// empty, it must match the username carried by the token. login is called
+// with the authenticated username.
+func (v *Validator) authenticate(username, token string, login func(username string) error) *sasl.OAuthBearerError {
+	claims, err := v.Validate(token)
+	if err != nil {
+		return v.OAuthBearerError(err)
+	}
+
+	tokenUsername := v.Username(claims)
+	if tokenUsername == "" {
+		return v.OAuthBearerError(invalidToken("missing %v claim", v.usernameClaim()))
+	}
+	if username != "" && username != tokenUsername {
+		return v.OAuthBearerError(invalidToken("token not issued for %q", username))
+	}
+
+	if login != nil {
+		if err := login(tokenUsername); err != nil {
+			return v.OAuthBearerError(err)
+		}
+	}
+	return nil
+}
+
+// OAuthBearerAuthenticator returns an authenticator for
+// sasl.NewOAuthBearerServer. The login function, if not nil, is called with
+// the authenticated username.
+func (v *Validator) OAuthBearerAuthenticator(login func(username string) error) sasl.OAuthBearerAuthenticator {
+	return func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+		return v.authenticate(opts.Username, opts.Token, login)
+	}
+}
+
+// XOAuth2Authenticator returns an authenticator for sasl.NewXOAuth2Server.
+// The login function, if not nil, is called with the authenticated username.
+func (v *Validator) XOAuth2Authenticator(login func(username string) error) sasl.XOAuth2Authenticator {
+	return func(username, token string) *sasl.OAuthBearerError {
+		return v.authenticate(username, token, login)
+	}
+}
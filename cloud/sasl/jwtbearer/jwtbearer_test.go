@@ -0,0 +1,156 @@
+package jwtbearer
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func newTestKey(t *testing.T, kid string) (ed25519.PrivateKey, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := fmt.Sprintf(`{"kty":"OKP","crv":"Ed25519","kid":%q,"x":%q}`, kid, base64.RawURLEncoding.EncodeToString(pub))
+	return priv, jwk
+}
+
+func signToken(t *testing.T, priv ed25519.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": algEdDSA, "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(priv, []byte(input)))
+}
+
+func TestValidate(t *testing.T) {
+	priv, jwk := newTestKey(t, "k1")
+	otherPriv, _ := newTestKey(t, "k1")
+	keys, err := ParseKeySet([]byte(`{"keys":[` + jwk + `]}`))
+	if err != nil {
+		t.Fatalf("ParseKeySet() = %v", err)
+	}
+
+	v := &Validator{
+		Keys:     keys,
+		Issuer:   "https://sso.example.org",
+		Audience: "mail",
+		Scope:    []string{"mail"},
+		Leeway:   time.Minute,
+		Now:      func() time.Time { return testNow },
+	}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		m := map[string]interface{}{
+			"iss":   "https://sso.example.org",
+			"sub":   "alice",
+			"aud":   []string{"mail", "calendar"},
+			"exp":   testNow.Add(time.Hour).Unix(),
+			"nbf":   testNow.Add(-time.Hour).Unix(),
+			"scope": "openid mail",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(m, k)
+			} else {
+				m[k] = v
+			}
+		}
+		return m
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status string
+	}{
+		{"valid", signToken(t, priv, "k1", claims(nil)), ""},
+		{"leeway", signToken(t, priv, "k1", claims(map[string]interface{}{"exp": testNow.Add(-30 * time.Second).Unix()})), ""},
+		{"expired", signToken(t, priv, "k1", claims(map[string]interface{}{"exp": testNow.Add(-2 * time.Minute).Unix()})), StatusInvalidToken},
+		{"no exp", signToken(t, priv, "k1", claims(map[string]interface{}{"exp": nil})), StatusInvalidToken},
+		{"not yet valid", signToken(t, priv, "k1", claims(map[string]interface{}{"nbf": testNow.Add(time.Hour).Unix()})), StatusInvalidToken},
+		{"wrong audience", signToken(t, priv, "k1", claims(map[string]interface{}{"aud": "calendar"})), StatusInvalidToken},
+		{"no audience", signToken(t, priv, "k1", claims(map[string]interface{}{"aud": nil})), StatusInvalidToken},
+		{"wrong issuer", signToken(t, priv, "k1", claims(map[string]interface{}{"iss": "https://evil.example"})), StatusInvalidToken},
+		{"missing scope", signToken(t, priv, "k1", claims(map[string]interface{}{"scope": "openid"})), StatusInsufficientScope},
+		{"wrong key", signToken(t, otherPriv, "k1", claims(nil)), StatusInvalidToken},
+		{"unknown kid", signToken(t, priv, "k2", claims(nil)), StatusInvalidToken},
+		{"malformed", "a.b", StatusInvalidToken},
+	} {
+		_, err := v.Validate(tc.token)
+		var validationErr *Error
+		if tc.status == "" {
+			if err != nil {
+				t.Errorf("%v: Validate() = %v", tc.name, err)
+			}
+		} else if !errors.As(err, &validationErr) || validationErr.Status != tc.status {
+			t.Errorf("%v: Validate() = %v, want %v error", tc.name, err, tc.status)
+		}
+	}
+
+	// Tamper with the payload of a valid token
+	token := signToken(t, priv, "k1", claims(nil))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(claims(map[string]interface{}{"sub": "admin"}))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if _, err := v.Validate(strings.Join(parts, ".")); err == nil {
+		t.Errorf("Validate() succeeded for a tampered token")
+	}
+
+	// alg "none" is never accepted
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	if _, err := v.Validate(header + "." + parts[1] + "."); err == nil {
+		t.Errorf("Validate() succeeded for an unsigned token")
+	}
+}
+
+func TestFetchKeySet(t *testing.T) {
+	_, jwk := newTestKey(t, "k1")
+	doc := `{"keys":[` + jwk + `,{"kty":"oct","k":"c2VjcmV0"},{"kty":"OKP","crv":"Ed25519","use":"enc","x":"AA"}]}`
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(doc))
+	})
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	ks, err := FetchKeySet(ts.Client(), ts.URL+"/jwks.json")
+	if err != nil {
+		t.Fatalf("FetchKeySet() = %v", err)
+	}
+	if len(ks.Keys) != 1 || ks.Keys[0].ID != "k1" || ks.Keys[0].Algorithm != algEdDSA {
+		t.Errorf("FetchKeySet() = %+v, want a single Ed25519 key", ks.Keys)
+	}
+
+	if _, err := FetchKeySet(ts.Client(), ts.URL+"/missing"); err == nil {
+		t.Errorf("FetchKeySet() succeeded for a 404 response")
+	}
+
+	ks, err = LoadKeySetFromHandler(h, "/jwks.json")
+	if err != nil {
+		t.Fatalf("LoadKeySetFromHandler() = %v", err)
+	}
+	if len(ks.Keys) != 1 || ks.Keys[0].ID != "k1" {
+		t.Errorf("LoadKeySetFromHandler() = %+v, want a single key", ks.Keys)
+	}
+
+	if _, err := LoadKeySetFromHandler(h, "/missing"); err == nil {
+		t.Errorf("LoadKeySetFromHandler() succeeded for a 404 response")
+	}
+}
@@ -0,0 +1,86 @@
+package sasl
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math/bits"
+)
+
+// A minimal MD5 implementation exposing the internal state, needed to resume
+// a hash from a CRAM-MD5 secret, as specified in RFC 1321.
+
+var md5Init = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+
+var md5Shifts = [4][4]int{
+	{7, 12, 17, 22},
+	{5, 9, 14, 20},
+	{4, 11, 16, 23},
+	{6, 10, 15, 21},
+}
+
+var md5Table = [64]uint32{
+	0xd76aa478, 0xe8c7b756, 0x242070db, 0xc1bdceee, 0xf57c0faf, 0x4787c62a, 0xa8304613, 0xfd469501,
+	0x698098d8, 0x8b44f7af, 0xffff5bb1, 0x895cd7be, 0x6b901122, 0xfd987193, 0xa679438e, 0x49b40821,
+	0xf61e2562, 0xc040b340, 0x265e5a51, 0xe9b6c7aa, 0xd62f105d, 0x02441453, 0xd8a1e681, 0xe7d3fbc8,
+	0x21e1cde6, 0xc33707d6, 0xf4d50d87, 0x455a14ed, 0xa9e3e905, 0xfcefa3f8, 0x676f02d9, 0x8d2a4c8a,
+	0xfffa3942, 0x8771f681, 0x6d9d6122, 0xfde5380c, 0xa4beea44, 0x4bdecfa9, 0xf6bb4b60, 0xbebfbc70,
+	0x289b7ec6, 0xeaa127fa, 0xd4ef3085, 0x04881d05, 0xd9d4d039, 0xe6db99e5, 0x1fa27cf8, 0xc4ac5665,
+	0xf4292244, 0x432aff97, 0xab9423a7, 0xfc93a039, 0x655b59c3, 0x8f0ccc92, 0xffeff47d, 0x85845dd1,
+	0x6fa87e4f, 0xfe2ce6e0, 0xa3014314, 0x4e0811a1, 0xf7537e82, 0xbd3af235, 0x2ad7d2bb, 0xeb86d391,
+}
+
+// md5Block applies the MD5 compression function to a 64-byte block.
+func md5Block(state *[4]uint32, block []byte) {
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+
+	a, b, c, d := state[0], state[1], state[2], state[3]
+	for i := 0; i < 64; i++ {
+		var f uint32
+		var g int
+		switch i / 16 {
+		case 0:
+			f, g = (b&c)|(^b&d), i
+		case 1:
+			f, g = (d&b)|(^d&c), (5*i+1)%16
+		case 2:
+			f, g = b^c^d, (3*i+5)%16
+		case 3:
+			f, g = c^(b|^d), (7*i)%16
+		}
+		f += a + md5Table[i] + m[g]
+		a, d, c = d, c, b
+		b += bits.RotateLeft32(f, md5Shifts[i/16][i%4])
+	}
+
+	state[0] += a
+	state[1] += b
+	state[2] += c
+	state[3] += d
+}
+
+// md5Resume finishes a MD5 hash whose state is the result of processing
+// prefixLen bytes, prefixLen being a multiple of the block size.
+func md5Resume(state [4]uint32, prefixLen uint64, msg []byte) [md5.Size]byte {
+	length := (prefixLen + uint64(len(msg))) * 8
+
+	buf := append([]byte(nil), msg...)
+	buf = append(buf, 0x80)
+	for len(buf)%md5.BlockSize != md5.BlockSize-8 {
+		buf = append(buf, 0)
+	}
+	buf = binary.LittleEndian.AppendUint64(buf, length)
+
+	for len(buf) > 0 {
+		md5Block(&state, buf[:md5.BlockSize])
+		buf = buf[md5.BlockSize:]
+	}
+
+	var sum [md5.Size]byte
+	for i, word := range state {
+		binary.LittleEndian.PutUint32(sum[4*i:], word)
+	}
+	return sum
+}
@@ -0,0 +1,617 @@
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The SCRAM mechanism names.
+const (
+	ScramSHA1       = "SCRAM-SHA-1"
+	ScramSHA1Plus   = "SCRAM-SHA-1-PLUS"
+	ScramSHA256     = "SCRAM-SHA-256"
+	ScramSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+// Default minimum iteration count accepted by SCRAM clients, as recommended
+// by RFC 7677 section 4.
+const DefaultScramMinIterations = 4096
+
+// scramHash returns the hash function used by a SCRAM mechanism, and whether
+// the mechanism uses channel binding.
+func scramHash(mech string) (newHash func() hash.Hash, plus bool, err error) {
+	switch strings.ToUpper(mech) {
+	case ScramSHA1:
+		return sha1.New, false, nil
+	case ScramSHA1Plus:
+		return sha1.New, true, nil
+	case ScramSHA256:
+		return sha256.New, false, nil
+	case ScramSHA256Plus:
+		return sha256.New, true, nil
+	default:
+		return nil, false, fmt.Errorf("sasl: unknown SCRAM mechanism %q", mech)
+	}
+}
+
+// ScramCredentials contains the SCRAM keys stored by a server for a user, as
+// defined in RFC 5802 section 3. The plaintext password is not needed.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives the SCRAM keys for a password. The hash function
+// is selected by the mechanism name; the -PLUS variants share the keys of the
+// plain ones.
+func NewScramCredentials(mech, password string, salt []byte, iterations int) (*ScramCredentials, error) {
+	newHash, _, err := scramHash(mech)
+	if err != nil {
+		return nil, err
+	}
+	if iterations <= 0 {
+		return nil, errors.New("sasl: invalid SCRAM iteration count")
+	}
+
+	_, storedKey, serverKey := scramKeys(newHash, password, salt, iterations)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
+	}, nil
+}
+
+// scramKeys derives the client, stored and server keys for a password.
+func scramKeys(newHash func() hash.Hash, password string, salt []byte, iterations int) (clientKey, storedKey, serverKey []byte) {
+	saltedPassword := scramHi(newHash, []byte(password), salt, iterations)
+	clientKey = scramHMAC(newHash, saltedPassword, []byte("Client Key"))
+	h := newHash()
+	h.Write(clientKey)
+	return clientKey, h.Sum(nil), scramHMAC(newHash, saltedPassword, []byte("Server Key"))
+}
+
+// scramHi implements the Hi function from RFC 5802 section 2.2, which is
+// PBKDF2 with HMAC as the pseudorandom function and a single output block.
+func scramHi(newHash func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramHMAC(newHash func() hash.Hash, key, msg []byte) []byte {
+	mac := hmac.New(newHash, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// scramEscape encodes a saslname, as defined in RFC 5802 section 5.1.
+func scramEscape(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	return strings.ReplaceAll(s, ",", "=2C")
+}
+
+func scramUnescape(s string) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		sb.WriteString(s[:i])
+		switch {
+		case strings.HasPrefix(s[i:], "=3D"):
+			sb.WriteByte('=')
+		case strings.HasPrefix(s[i:], "=2C"):
+			sb.WriteByte(',')
+		default:
+			return "", errors.New("sasl: invalid SCRAM username encoding")
+		}
+		s = s[i+3:]
+	}
+}
+
+// scramAttrs parses a SCRAM message into attributes. The order is kept so
+// that callers can check mandatory attribute positions.
+func scramAttrs(msg string) ([][2]string, error) {
+	var attrs [][2]string
+	for _, field := range strings.Split(msg, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, errors.New("sasl: malformed SCRAM message")
+		}
+		attrs = append(attrs, [2]string{field[:1], field[2:]})
+	}
+	return attrs, nil
+}
+
+// ScramOptions contains options for SCRAM clients.
+type ScramOptions struct {
+	// Authorization identity, may be left blank to indicate that it is the
+	// same as the username.
+	Identity string
+	Username string
+	Password string
+
+	// Channel binding data. Required for the -PLUS mechanisms.
+	//
+	// For the other mechanisms, a non-nil value indicates that the client
+	// supports channel binding but selected a non-PLUS mechanism because the
+	// server didn't advertise any, allowing the server to detect downgrade
+	// attacks.
+	ChannelBinding *ChannelBinding
+
+	// Iteration count policy. The client aborts the exchange if the server
+	// requests fewer than MinIterations or more than MaxIterations
+	// iterations. A zero MinIterations defaults to DefaultScramMinIterations,
+	// a zero MaxIterations means no limit.
+	MinIterations int
+	MaxIterations int
+}
+
+type scramClientState int
+
+const (
+	scramClientStart scramClientState = iota
+	scramClientFirstSent
+	scramClientFinalSent
+	scramClientDone
+)
+
+type scramClient struct {
+	mech string
+	opts ScramOptions
+
+	state           scramClientState
+	gs2Header       string
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// A client implementation of the SCRAM authentication mechanisms, as described
+// in RFC 5802 and RFC 7677. The mechanism is one of ScramSHA1, ScramSHA1Plus,
+// ScramSHA256 or ScramSHA256Plus.
+//
+// The password is used as-is: callers are responsible for SASLprep
+// normalization if needed.
+func NewScramClient(mech string, opts *ScramOptions) Client {
+	return &scramClient{mech: strings.ToUpper(mech), opts: *opts}
+}
+
+func (a *scramClient) Start() (mech string, ir []byte, err error) {
+	_, plus, err := scramHash(a.mech)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch {
+	case plus && a.opts.ChannelBinding == nil:
+		return "", nil, errors.New("sasl: SCRAM -PLUS mechanism requires channel binding")
+	case plus:
+		a.gs2Header = "p=" + a.opts.ChannelBinding.Type + ","
+	case a.opts.ChannelBinding != nil:
+		a.gs2Header = "y,"
+	default:
+		a.gs2Header = "n,"
+	}
+	if a.opts.Identity != "" {
+		a.gs2Header += "a=" + scramEscape(a.opts.Identity)
+	}
+	a.gs2Header += ","
+
+	a.clientNonce, err = scramNonce()
+	if err != nil {
+		return "", nil, err
+	}
+	a.clientFirstBare = "n=" + scramEscape(a.opts.Username) + ",r=" + a.clientNonce
+
+	a.state = scramClientFirstSent
+	return a.mech, []byte(a.gs2Header + a.clientFirstBare), nil
+}
+
+func (a *scramClient) Next(challenge []byte) (response []byte, err error) {
+	switch a.state {
+	case scramClientFirstSent:
+		return a.handleServerFirst(string(challenge))
+	case scramClientFinalSent:
+		return a.handleServerFinal(string(challenge))
+	default:
+		return nil, ErrUnexpectedServerChallenge
+	}
+}
+
+func (a *scramClient) handleServerFirst(serverFirst string) ([]byte, error) {
+	attrs, err := scramAttrs(serverFirst)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) > 0 && attrs[0][0] == "e" {
+		return nil, fmt.Errorf("sasl: SCRAM server error: %v", attrs[0][1])
+	}
+	if len(attrs) < 3 || attrs[0][0] == "m" {
+		return nil, errors.New("sasl: unsupported SCRAM server-first-message")
+	}
+	if attrs[0][0] != "r" || attrs[1][0] != "s" || attrs[2][0] != "i" {
+		return nil, errors.New("sasl: malformed SCRAM server-first-message")
+	}
+
+	nonce := attrs[0][1]
+	if !strings.HasPrefix(nonce, a.clientNonce) || len(nonce) == len(a.clientNonce) {
+		return nil, errors.New("sasl: invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs[1][1])
+	if err != nil {
+		return nil, errors.New("sasl: malformed SCRAM salt")
+	}
+	iterations, err := strconv.Atoi(attrs[2][1])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("sasl: malformed SCRAM iteration count")
+	}
+
+	minIterations := a.opts.MinIterations
+	if minIterations == 0 {
+		minIterations = DefaultScramMinIterations
+	}
+	if iterations < minIterations {
+		return nil, fmt.Errorf("sasl: SCRAM iteration count %v is below the minimum of %v", iterations, minIterations)
+	}
+	if a.opts.MaxIterations > 0 && iterations > a.opts.MaxIterations {
+		return nil, fmt.Errorf("sasl: SCRAM iteration count %v is above the maximum of %v", iterations, a.opts.MaxIterations)
+	}
+
+	newHash, _, _ := scramHash(a.mech)
+	clientKey, storedKey, serverKey := scramKeys(newHash, a.opts.Password, salt, iterations)
+
+	cbind := []byte(a.gs2Header)
+	if strings.HasPrefix(a.gs2Header, "p=") {
+		cbind = append(cbind, a.opts.ChannelBinding.Data...)
+	}
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+	authMessage := []byte(a.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	clientSignature := scramHMAC(newHash, storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	a.serverSignature = scramHMAC(newHash, serverKey, authMessage)
+
+	a.state = scramClientFinalSent
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (a *scramClient) handleServerFinal(serverFinal string) ([]byte, error) {
+	a.state = scramClientDone
+
+	attrs, err := scramAttrs(serverFinal)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) == 0 {
+		return nil, errors.New("sasl: malformed SCRAM server-final-message")
+	}
+	switch attrs[0][0] {
+	case "e":
+		return nil, fmt.Errorf("sasl: SCRAM server error: %v", attrs[0][1])
+	case "v":
+		sig, err := base64.StdEncoding.DecodeString(attrs[0][1])
+		if err != nil {
+			return nil, errors.New("sasl: malformed SCRAM server signature")
+		}
+		if !hmac.Equal(sig, a.serverSignature) {
+			return nil, errors.New("sasl: invalid SCRAM server signature")
+		}
+		return []byte{}, nil
+	default:
+		return nil, errors.New("sasl: malformed SCRAM server-final-message")
+	}
+}
+
+// ScramLookup returns the stored SCRAM credentials of a user.
+type ScramLookup func(username string) (*ScramCredentials, error)
+
+// ScramServerOptions contains options for SCRAM servers.
+type ScramServerOptions struct {
+	// Looks up the credentials of a user. Required.
+	Lookup ScramLookup
+
+	// Checks that the authenticated user is allowed to act as the requested
+	// authorization identity. If nil, only an empty identity or an identity
+	// equal to the username is accepted.
+	Authorize func(identity, username string) error
+
+	// Channel binding data of the connection. Required for the -PLUS
+	// mechanisms.
+	//
+	// For the other mechanisms, a non-nil value indicates that the server
+	// advertises a -PLUS mechanism: clients claiming channel binding support
+	// with the "y" flag are then rejected to prevent downgrade attacks.
+	ChannelBinding *ChannelBinding
+
+	// Secret used to derive a salt for users without credentials, so that
+	// the exchange fails the same way as with a wrong password and doesn't
+	// reveal which users exist. If nil, a random secret generated once per
+	// process is used.
+	Secret []byte
+}
+
+var (
+	scramSecretOnce sync.Once
+	scramSecret     []byte
+)
+
+// scramMockCredentials returns credentials with a salt derived from the
+// username, sent to clients authenticating as users without credentials.
+func (a *scramServer) scramMockCredentials() *ScramCredentials {
+	secret := a.opts.Secret
+	if secret == nil {
+		scramSecretOnce.Do(func() {
+			scramSecret = make([]byte, 32)
+			if _, err := rand.Read(scramSecret); err != nil {
+				panic(err)
+			}
+		})
+		secret = scramSecret
+	}
+	salt := scramHMAC(sha256.New, secret, []byte(strings.TrimSuffix(a.mech, "-PLUS")+"\x00"+a.username))
+	return &ScramCredentials{Salt: salt[:16], Iterations: DefaultScramMinIterations}
+}
+
+type scramServerState int
+
+const (
+	scramServerStart scramServerState = iota
+	scramServerFirstSent
+	scramServerFinalSent
+	scramServerDone
+)
+
+type scramServer struct {
+	mech string
+	opts ScramServerOptions
+
+	state           scramServerState
+	failErr         error
+	identity        string
+	username        string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           *ScramCredentials
+	lookupErr       error // set if creds are mock credentials
+}
+
+// A server implementation of the SCRAM authentication mechanisms, as
+// described in RFC 5802 and RFC 7677. The mechanism is one of ScramSHA1,
+// ScramSHA1Plus, ScramSHA256 or ScramSHA256Plus.
+func NewScramServer(mech string, opts *ScramServerOptions) Server {
+	return &scramServer{mech: strings.ToUpper(mech), opts: *opts}
+}
+
+// fail sends a server-error to the client. Per RFC 5802, the error is sent as
+// a server-final-message and the exchange is aborted once the client replies.
+func (a *scramServer) fail(serverError string, err error) ([]byte, bool, error) {
+	a.state = scramServerDone
+	a.failErr = err
+	return []byte("e=" + serverError), false, nil
+}
+
+func (a *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failErr != nil {
+		return nil, true, a.failErr
+	}
+
+	switch a.state {
+	case scramServerStart:
+		// No initial response, send an empty challenge
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		return a.handleClientFirst(string(response))
+	case scramServerFirstSent:
+		return a.handleClientFinal(string(response))
+	case scramServerFinalSent:
+		a.state = scramServerDone
+		if len(response) != 0 {
+			return nil, true, ErrUnexpectedClientResponse
+		}
+		return nil, true, nil
+	default:
+		return nil, true, ErrUnexpectedClientResponse
+	}
+}
+
+func (a *scramServer) handleClientFirst(clientFirst string) ([]byte, bool, error) {
+	_, plus, err := scramHash(a.mech)
+	if err != nil {
+		return nil, true, err
+	}
+	if plus && a.opts.ChannelBinding == nil {
+		return nil, true, errors.New("sasl: SCRAM -PLUS mechanism requires channel binding")
+	}
+
+	// gs2-header is gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(clientFirst, ",", 3)
+	if len(parts) != 3 {
+		return a.fail("other-error", errors.New("sasl: malformed SCRAM client-first-message"))
+	}
+	cbFlag, authzid := parts[0], parts[1]
+	a.gs2Header = cbFlag + "," + authzid + ","
+	a.clientFirstBare = parts[2]
+
+	switch {
+	case cbFlag == "n":
+		if plus {
+			return a.fail("server-does-support-channel-binding", errors.New("sasl: SCRAM -PLUS mechanism used without channel binding"))
+		}
+	case cbFlag == "y":
+		if plus || a.opts.ChannelBinding != nil {
+			return a.fail("server-does-support-channel-binding", errors.New("sasl: SCRAM channel binding downgrade detected"))
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		if !plus {
+			return a.fail("channel-binding-not-supported", errors.New("sasl: SCRAM channel binding requested with a non-PLUS mechanism"))
+		}
+		if cbFlag[2:] != a.opts.ChannelBinding.Type {
+			return a.fail("unsupported-channel-binding-type", fmt.Errorf("sasl: unsupported SCRAM channel binding type %q", cbFlag[2:]))
+		}
+	default:
+		return a.fail("other-error", errors.New("sasl: malformed SCRAM gs2-cbind-flag"))
+	}
+
+	if authzid != "" {
+		identity, ok := strings.CutPrefix(authzid, "a=")
+		if !ok {
+			return a.fail("other-error", errors.New("sasl: malformed SCRAM authzid"))
+		}
+		if a.identity, err = scramUnescape(identity); err != nil {
+			return a.fail("invalid-encoding", err)
+		}
+	}
+
+	attrs, err := scramAttrs(a.clientFirstBare)
+	if err != nil {
+		return a.fail("other-error", err)
+	}
+	if len(attrs) < 2 || attrs[0][0] == "m" {
+		return a.fail("extensions-not-supported", errors.New("sasl: unsupported SCRAM client-first-message"))
+	}
+	if attrs[0][0] != "n" || attrs[1][0] != "r" || attrs[1][1] == "" {
+		return a.fail("other-error", errors.New("sasl: malformed SCRAM client-first-message"))
+	}
+	if a.username, err = scramUnescape(attrs[0][1]); err != nil {
+		return a.fail("invalid-encoding", err)
+	}
+
+	// Unknown users are only rejected once the client proof is received,
+	// with the same error as a wrong password
+	a.creds, err = a.opts.Lookup(a.username)
+	newHash, _, _ := scramHash(a.mech)
+	if err == nil && (a.creds == nil || len(a.creds.StoredKey) != newHash().Size() || len(a.creds.ServerKey) != newHash().Size()) {
+		err = fmt.Errorf("sasl: no %v credentials for user %q", a.mech, a.username)
+	}
+	if err != nil {
+		a.lookupErr = err
+		a.creds = a.scramMockCredentials()
+	}
+
+	serverNonce, err := scramNonce()
+	if err != nil {
+		return nil, true, err
+	}
+	a.nonce = attrs[1][1] + serverNonce
+	a.serverFirst = "r=" + a.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(a.creds.Salt) +
+		",i=" + strconv.Itoa(a.creds.Iterations)
+
+	a.state = scramServerFirstSent
+	return []byte(a.serverFirst), false, nil
+}
+
+func (a *scramServer) handleClientFinal(clientFinal string) ([]byte, bool, error) {
+	proofIndex := strings.LastIndex(clientFinal, ",p=")
+	if proofIndex < 0 {
+		return a.fail("other-error", errors.New("sasl: missing SCRAM client proof"))
+	}
+	clientFinalWithoutProof := clientFinal[:proofIndex]
+
+	attrs, err := scramAttrs(clientFinalWithoutProof)
+	if err != nil {
+		return a.fail("other-error", err)
+	}
+	if len(attrs) < 2 || attrs[0][0] != "c" || attrs[1][0] != "r" {
+		return a.fail("other-error", errors.New("sasl: malformed SCRAM client-final-message"))
+	}
+
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][1])
+	if err != nil {
+		return a.fail("invalid-encoding", errors.New("sasl: malformed SCRAM channel binding"))
+	}
+	wantCbind := []byte(a.gs2Header)
+	if strings.HasPrefix(a.gs2Header, "p=") {
+		wantCbind = append(wantCbind, a.opts.ChannelBinding.Data...)
+	}
+	if subtle.ConstantTimeCompare(cbind, wantCbind) != 1 {
+		if bytes.HasPrefix(cbind, []byte(a.gs2Header)) {
+			return a.fail("channel-bindings-dont-match", errors.New("sasl: SCRAM channel bindings don't match"))
+		}
+		return a.fail("other-error", errors.New("sasl: SCRAM gs2-header mismatch"))
+	}
+	if attrs[1][1] != a.nonce {
+		return a.fail("other-error", errors.New("sasl: SCRAM nonce mismatch"))
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofIndex+len(",p="):])
+	if err != nil {
+		return a.fail("invalid-encoding", errors.New("sasl: malformed SCRAM client proof"))
+	}
+
+	if a.lookupErr != nil {
+		return a.fail("invalid-proof", a.lookupErr)
+	}
+
+	newHash, _, _ := scramHash(a.mech)
+	authMessage := []byte(a.clientFirstBare + "," + a.serverFirst + "," + clientFinalWithoutProof)
+	clientSignature := scramHMAC(newHash, a.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return a.fail("invalid-proof", errors.New("sasl: invalid SCRAM client proof"))
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := newHash()
+	storedKey.Write(clientKey)
+	if subtle.ConstantTimeCompare(storedKey.Sum(nil), a.creds.StoredKey) != 1 {
+		return a.fail("invalid-proof", errors.New("sasl: invalid SCRAM client proof"))
+	}
+
+	if a.opts.Authorize != nil {
+		err = a.opts.Authorize(a.identity, a.username)
+	} else if a.identity != "" && a.identity != a.username {
+		err = errors.New("sasl: SCRAM authorization identity not supported")
+	}
+	if err != nil {
+		return a.fail("other-error", err)
+	}
+
+	serverSignature := scramHMAC(newHash, a.creds.ServerKey, authMessage)
+	a.state = scramServerFinalSent
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
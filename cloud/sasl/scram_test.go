@@ -0,0 +1,206 @@
+package sasl
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Examples from RFC 5802 section 5 and RFC 7677 section 3
+var scramTests = []struct {
+	mech        string
+	clientNonce string
+	salt        string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}{
+	{
+		mech:        ScramSHA1,
+		clientNonce: "fyko+d2lbbFgONRv9qkxdawL",
+		salt:        "QSXCR+Q6sek8bf92",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mech:        ScramSHA256,
+		clientNonce: "rOprNGfwEbeRWgbNEkqO",
+		salt:        "W22ZaJ0SNY7soEsUEjb6gQ==",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+func TestScramClient(t *testing.T) {
+	for _, tc := range scramTests {
+		c := NewScramClient(tc.mech, &ScramOptions{Username: "user", Password: "pencil"})
+		if _, _, err := c.Start(); err != nil {
+			t.Fatalf("%v: Start() = %v", tc.mech, err)
+		}
+		// Replace the random nonce with the one of the example
+		sc := c.(*scramClient)
+		sc.clientNonce = tc.clientNonce
+		sc.clientFirstBare = "n=user,r=" + tc.clientNonce
+
+		resp, err := c.Next([]byte(tc.serverFirst))
+		if err != nil {
+			t.Fatalf("%v: Next(server-first) = %v", tc.mech, err)
+		}
+		if string(resp) != tc.clientFinal {
+			t.Errorf("%v: client-final = %q, want %q", tc.mech, resp, tc.clientFinal)
+		}
+		if _, err := c.Next([]byte(tc.serverFinal)); err != nil {
+			t.Errorf("%v: Next(server-final) = %v", tc.mech, err)
+		}
+	}
+
+	// A server signature mismatch must be detected
+	tc := scramTests[1]
+	c := NewScramClient(tc.mech, &ScramOptions{Username: "user", Password: "pencil"})
+	c.Start()
+	c.(*scramClient).clientNonce = tc.clientNonce
+	c.(*scramClient).clientFirstBare = "n=user,r=" + tc.clientNonce
+	c.Next([]byte(tc.serverFirst))
+	if _, err := c.Next([]byte(scramTests[0].serverFinal)); err == nil {
+		t.Errorf("Next() succeeded with an invalid server signature")
+	}
+}
+
+func TestScramServer(t *testing.T) {
+	for _, tc := range scramTests {
+		salt, _ := base64.StdEncoding.DecodeString(tc.salt)
+		s := NewScramServer(tc.mech, &ScramServerOptions{
+			Lookup: func(username string) (*ScramCredentials, error) {
+				if username != "user" {
+					return nil, errors.New("unknown user")
+				}
+				return NewScramCredentials(tc.mech, "pencil", salt, 4096)
+			},
+		})
+
+		if _, _, err := s.Next([]byte("n,,n=user,r=" + tc.clientNonce)); err != nil {
+			t.Fatalf("%v: Next(client-first) = %v", tc.mech, err)
+		}
+		// Replace the random nonce with the one of the example
+		ss := s.(*scramServer)
+		ss.nonce = strings.TrimPrefix(strings.Split(tc.serverFirst, ",")[0], "r=")
+		ss.serverFirst = tc.serverFirst
+
+		challenge, done, err := s.Next([]byte(tc.clientFinal))
+		if err != nil || done {
+			t.Fatalf("%v: Next(client-final) = %v, %v", tc.mech, done, err)
+		}
+		if string(challenge) != tc.serverFinal {
+			t.Errorf("%v: server-final = %q, want %q", tc.mech, challenge, tc.serverFinal)
+		}
+		if _, done, err := s.Next([]byte{}); err != nil || !done {
+			t.Errorf("%v: Next() = %v, %v, want done", tc.mech, done, err)
+		}
+	}
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	cb := &ChannelBinding{Type: ChannelBindingTLSExporter, Data: []byte("0123456789abcdef0123456789abcdef")}
+	otherCB := &ChannelBinding{Type: ChannelBindingTLSExporter, Data: []byte("fedcba9876543210fedcba9876543210")}
+	creds, err := NewScramCredentials(ScramSHA256, "pencil", []byte("salt"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(username string) (*ScramCredentials, error) {
+		return creds, nil
+	}
+
+	for _, tc := range []struct {
+		name           string
+		mech           string
+		clientCB       *ChannelBinding
+		serverCB       *ChannelBinding
+		ok             bool
+		serverErrorMsg string
+	}{
+		{"PLUS", ScramSHA256Plus, cb, cb, true, ""},
+		{"PLUS mismatch", ScramSHA256Plus, otherCB, cb, false, "e=channel-bindings-dont-match"},
+		{"PLUS wrong type", ScramSHA256Plus, &ChannelBinding{Type: ChannelBindingTLSUnique, Data: cb.Data}, cb, false, "e=unsupported-channel-binding-type"},
+		{"no channel binding", ScramSHA256, nil, nil, true, ""},
+		{"client supports", ScramSHA256, cb, nil, true, ""},
+		{"downgrade", ScramSHA256, cb, cb, false, "e=server-does-support-channel-binding"},
+	} {
+		c := NewScramClient(tc.mech, &ScramOptions{Username: "user", Password: "pencil", ChannelBinding: tc.clientCB})
+		s := NewScramServer(tc.mech, &ScramServerOptions{Lookup: lookup, ChannelBinding: tc.serverCB})
+		challenges, err := exchange(t, c, s)
+		if (err == nil) != tc.ok {
+			t.Errorf("%v: server error = %v", tc.name, err)
+		}
+		if tc.serverErrorMsg != "" && (len(challenges) == 0 || challenges[len(challenges)-1] != tc.serverErrorMsg) {
+			t.Errorf("%v: challenges = %q, want %v", tc.name, challenges, tc.serverErrorMsg)
+		}
+	}
+}
+
+// exchange runs a SASL exchange between a client and a server. It returns
+// the challenges sent by the server and the server error.
+func exchange(t *testing.T, c Client, s Server) ([]string, error) {
+	t.Helper()
+
+	_, ir, err := c.Start()
+	if err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+
+	var challenges []string
+	response := ir
+	for {
+		challenge, done, err := s.Next(response)
+		if err != nil || done {
+			return challenges, err
+		}
+		challenges = append(challenges, string(challenge))
+		if response, err = c.Next(challenge); err != nil {
+			// Let the server abort the exchange, like a client sending "*"
+			_, _, err := s.Next([]byte{})
+			return challenges, err
+		}
+	}
+}
+
+func TestScramUnknownUser(t *testing.T) {
+	errUnknownUser := errors.New("unknown user")
+	newServer := func() Server {
+		return NewScramServer(ScramSHA256, &ScramServerOptions{
+			Lookup: func(username string) (*ScramCredentials, error) {
+				return nil, errUnknownUser
+			},
+			Secret: []byte("secret"),
+		})
+	}
+	newClient := func(username string) Client {
+		return NewScramClient(ScramSHA256, &ScramOptions{Username: username, Password: "pencil"})
+	}
+
+	challenges, err := exchange(t, newClient("nobody"), newServer())
+	if err != errUnknownUser {
+		t.Errorf("server error = %v, want %v", err, errUnknownUser)
+	}
+	if len(challenges) != 2 || !strings.HasPrefix(challenges[0], "r=") || challenges[1] != "e=invalid-proof" {
+		t.Fatalf("challenges = %q, want server-first then e=invalid-proof", challenges)
+	}
+
+	salt := func(challenge string) string {
+		attrs, err := scramAttrs(challenge)
+		if err != nil || len(attrs) != 3 {
+			t.Fatalf("malformed server-first-message %q", challenge)
+		}
+		return attrs[1][1] + "," + attrs[2][1]
+	}
+	again, _ := exchange(t, newClient("nobody"), newServer())
+	if salt(again[0]) != salt(challenges[0]) {
+		t.Errorf("salt changed between exchanges: %q, %q", again[0], challenges[0])
+	}
+	other, _ := exchange(t, newClient("somebody"), newServer())
+	if salt(other[0]) == salt(challenges[0]) {
+		t.Errorf("same salt for different users: %q", other[0])
+	}
+}
@@ -0,0 +1,124 @@
+package sasl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// The XOAUTH2 mechanism name.
+const XOAuth2 = "XOAUTH2"
+
+type xoauth2Client struct {
+	Username string
+	Token    string
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	mech = XOAuth2
+	ir = []byte("user=" + a.Username + "\x01auth=Bearer " + a.Token + "\x01\x01")
+	return
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server only sends a challenge to report an error
+	authBearerErr := &OAuthBearerError{}
+	if err := json.Unmarshal(challenge, authBearerErr); err != nil {
+		return nil, err
+	}
+	return nil, authBearerErr
+}
+
+// A client implementation of the XOAUTH2 authentication mechanism, as used by
+// Google and Microsoft mail services. OAUTHBEARER (RFC 7628) should be
+// preferred when the server supports it.
+func NewXOAuth2Client(username, token string) Client {
+	return &xoauth2Client{username, token}
+}
+
+// Authenticates users with an username and an OAuth 2.0 bearer token.
+type XOAuth2Authenticator func(username, token string) *OAuthBearerError
+
+type xoauth2Server struct {
+	done         bool
+	failErr      error
+	authenticate XOAuth2Authenticator
+}
+
+func (a *xoauth2Server) fail(authErr *OAuthBearerError, err error) ([]byte, bool, error) {
+	blob, jsonErr := json.Marshal(authErr)
+	if jsonErr != nil {
+		panic(jsonErr) // wtf
+	}
+	a.failErr = err
+	return blob, false, nil
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	// Like OAUTHBEARER, errors are sent as a JSON challenge and the exchange
+	// is aborted once the client sends the (empty) reply.
+	if a.failErr != nil {
+		return nil, true, a.failErr
+	}
+
+	if a.done {
+		err = ErrUnexpectedClientResponse
+		return
+	}
+
+	// Generate empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+
+	invalidRequest := &OAuthBearerError{
+		Status:  "invalid_request",
+		Schemes: "bearer",
+	}
+
+	// Cut user=...\x01auth=Bearer ...\x01\x01
+	var username, token string
+	var hasUser, hasAuth bool
+	for _, p := range bytes.Split(response, []byte{0x01}) {
+		// Skip empty fields (at the end).
+		if len(p) == 0 {
+			continue
+		}
+
+		k, v, ok := strings.Cut(string(p), "=")
+		if !ok {
+			return a.fail(invalidRequest, errors.New("sasl: client error: Invalid response, missing '='"))
+		}
+
+		switch k {
+		case "user":
+			username, hasUser = v, true
+		case "auth":
+			const prefix = "bearer "
+			// Token type is case-insensitive.
+			if !strings.HasPrefix(strings.ToLower(v), prefix) {
+				return a.fail(invalidRequest, errors.New("sasl: client error: Unsupported token type"))
+			}
+			token, hasAuth = v[len(prefix):], true
+		default:
+			return a.fail(invalidRequest, errors.New("sasl: client error: Invalid response, unknown parameter: "+k))
+		}
+	}
+	if !hasUser || !hasAuth {
+		return a.fail(invalidRequest, errors.New("sasl: client error: Invalid response, missing user or auth"))
+	}
+
+	if authErr := a.authenticate(username, token); authErr != nil {
+		return a.fail(authErr, authErr)
+	}
+
+	return nil, true, nil
+}
+
+// A server implementation of the XOAUTH2 authentication mechanism.
+func NewXOAuth2Server(auth XOAuth2Authenticator) Server {
+	return &xoauth2Server{authenticate: auth}
+}
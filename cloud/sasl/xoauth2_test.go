@@ -0,0 +1,66 @@
+package sasl
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestXOAuth2Client(t *testing.T) {
+	// Example from Google's XOAUTH2 protocol documentation
+	c := NewXOAuth2Client("someuser@example.com", "ya29.vF9dft4qmTc2Nvb3RlckBhdHRhdmlzdGEuY29tCg")
+	_, ir, err := c.Start()
+	if err != nil {
+		t.Fatalf("Start() = %v", err)
+	}
+	const want = "dXNlcj1zb21ldXNlckBleGFtcGxlLmNvbQFhdXRoPUJlYXJlciB5YTI5LnZGOWRmdDRxbVRjMk52YjNSbGNrQmhkSFJoZG1semRHRXVZMjl0Q2cBAQ=="
+	if got := base64.StdEncoding.EncodeToString(ir); got != want {
+		t.Errorf("initial response = %v, want %v", got, want)
+	}
+
+	_, err = c.Next([]byte(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`))
+	if authErr, ok := err.(*OAuthBearerError); !ok || authErr.Status != "401" {
+		t.Errorf("Next(error challenge) = %v, want a 401 OAuthBearerError", err)
+	}
+}
+
+func TestXOAuth2Server(t *testing.T) {
+	auth := func(username, token string) *OAuthBearerError {
+		if username != "alice" || token != "t0ken" {
+			return &OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+		}
+		return nil
+	}
+
+	for _, tc := range []struct {
+		response string
+		status   string
+	}{
+		{"user=alice\x01auth=Bearer t0ken\x01\x01", ""},
+		{"user=alice\x01auth=bearer t0ken\x01\x01", ""},
+		{"user=alice\x01auth=Bearer wrong\x01\x01", "invalid_token"},
+		{"user=bob\x01auth=Bearer t0ken\x01\x01", "invalid_token"},
+		{"user=alice\x01auth=Basic t0ken\x01\x01", "invalid_request"},
+		{"user=alice\x01\x01", "invalid_request"},
+		{"user=alice\x01auth=Bearer t0ken\x01foo=bar\x01\x01", "invalid_request"},
+		{"garbage", "invalid_request"},
+	} {
+		s := NewXOAuth2Server(auth)
+		challenge, done, err := s.Next([]byte(tc.response))
+		if tc.status == "" {
+			if err != nil || !done {
+				t.Errorf("Next(%q) = %v, %v, want success", tc.response, done, err)
+			}
+			continue
+		}
+
+		var authErr OAuthBearerError
+		if err != nil || done || json.Unmarshal(challenge, &authErr) != nil || authErr.Status != tc.status {
+			t.Errorf("Next(%q) = %q, %v, %v, want %v error challenge", tc.response, challenge, done, err, tc.status)
+			continue
+		}
+		if _, done, err := s.Next([]byte{}); err == nil || !done {
+			t.Errorf("Next(%q) after error challenge = %v, %v, want error", tc.response, done, err)
+		}
+	}
+}
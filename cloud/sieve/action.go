@@ -0,0 +1,61 @@
+package sieve
+
+import (
+	"github.com/unix-world/smartgoplus/cloud/imap"
+)
+
+// Action is an action to be applied by the delivery code. It is one of
+// *Keep, *FileInto, *Redirect, *Reject or *Vacation.
+type Action interface {
+	isAction()
+}
+
+// Keep stores the message in the default mailbox, usually the INBOX.
+type Keep struct {
+	Flags []imap.Flag
+}
+
+// FileInto stores the message in a mailbox.
+type FileInto struct {
+	Mailbox string
+	Flags   []imap.Flag
+}
+
+// Redirect forwards the message to another address, without altering it.
+type Redirect struct {
+	Address string
+}
+
+// Reject refuses the message. If possible, the message should be rejected
+// at the SMTP level, otherwise a delivery status notification should be
+// sent.
+type Reject struct {
+	Reason string
+}
+
+func (*Keep) isAction()     {}
+func (*FileInto) isAction() {}
+func (*Redirect) isAction() {}
+func (*Reject) isAction()   {}
+func (*Vacation) isAction() {}
+
+// appendAction adds an action, skipping duplicates.
+func appendAction(l []Action, action Action) []Action {
+	for _, other := range l {
+		switch other := other.(type) {
+		case *Keep:
+			if _, ok := action.(*Keep); ok {
+				return l
+			}
+		case *FileInto:
+			if action, ok := action.(*FileInto); ok && action.Mailbox == other.Mailbox {
+				return l
+			}
+		case *Redirect:
+			if action, ok := action.(*Redirect); ok && asciiLower(action.Address) == asciiLower(other.Address) {
+				return l
+			}
+		}
+	}
+	return append(l, action)
+}
@@ -0,0 +1,444 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tagSpec struct {
+	kind  argKind
+	ext   string // required extension
+	group string // at most one tag per group can be used
+}
+
+type nodeSpec struct {
+	ext      string // required extension
+	test     bool
+	tags     map[string]tagSpec
+	args     []argKind
+	optional int  // number of leading arguments which can be omitted
+	tests    int  // number of tests, -1 for a test list
+	block    bool // command takes a block
+	match    bool // test takes a comparator and a match type
+}
+
+func tags(sets ...map[string]tagSpec) map[string]tagSpec {
+	m := make(map[string]tagSpec)
+	for _, set := range sets {
+		for k, v := range set {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+var (
+	matchTags = map[string]tagSpec{
+		"comparator": {kind: argString, group: "comparator"},
+		"is":         {group: "match"},
+		"contains":   {group: "match"},
+		"matches":    {group: "match"},
+		"count":      {kind: argString, ext: "relational", group: "match"},
+		"value":      {kind: argString, ext: "relational", group: "match"},
+	}
+	addressPartTags = map[string]tagSpec{
+		"all":       {group: "address-part"},
+		"localpart": {group: "address-part"},
+		"domain":    {group: "address-part"},
+	}
+	indexTags = map[string]tagSpec{
+		"index": {kind: argNumber, ext: "index"},
+		"last":  {ext: "index"},
+	}
+	zoneTags = map[string]tagSpec{
+		"zone":         {kind: argString, group: "zone"},
+		"originalzone": {group: "zone"},
+	}
+	copyTags = map[string]tagSpec{
+		"copy": {ext: "copy"},
+	}
+	flagsTags = map[string]tagSpec{
+		"flags": {kind: argStringList, ext: "imap4flags"},
+	}
+)
+
+var specs = map[string]*nodeSpec{
+	// Control commands
+	"require": {args: []argKind{argStringList}},
+	"if":      {tests: 1, block: true},
+	"elsif":   {tests: 1, block: true},
+	"else":    {block: true},
+	"stop":    {},
+
+	// Action commands
+	"keep":       {tags: flagsTags},
+	"discard":    {},
+	"redirect":   {tags: copyTags, args: []argKind{argString}},
+	"fileinto":   {ext: "fileinto", tags: tags(copyTags, flagsTags), args: []argKind{argString}},
+	"reject":     {ext: "reject", args: []argKind{argString}},
+	"setflag":    {ext: "imap4flags", args: []argKind{argString, argStringList}, optional: 1},
+	"addflag":    {ext: "imap4flags", args: []argKind{argString, argStringList}, optional: 1},
+	"removeflag": {ext: "imap4flags", args: []argKind{argString, argStringList}, optional: 1},
+	"set": {
+		ext: "variables",
+		tags: map[string]tagSpec{
+			"lower":         {group: "case"},
+			"upper":         {group: "case"},
+			"lowerfirst":    {group: "case-first"},
+			"upperfirst":    {group: "case-first"},
+			"quotewildcard": {},
+			"length":        {},
+		},
+		args: []argKind{argString, argString},
+	},
+	"vacation": {
+		ext: "vacation",
+		tags: map[string]tagSpec{
+			"days":      {kind: argNumber},
+			"subject":   {kind: argString},
+			"from":      {kind: argString},
+			"addresses": {kind: argStringList},
+			"mime":      {},
+			"handle":    {kind: argString},
+		},
+		args: []argKind{argString},
+	},
+
+	// Tests
+	"address":  {test: true, match: true, tags: tags(matchTags, addressPartTags, indexTags), args: []argKind{argStringList, argStringList}},
+	"header":   {test: true, match: true, tags: tags(matchTags, indexTags), args: []argKind{argStringList, argStringList}},
+	"envelope": {ext: "envelope", test: true, match: true, tags: tags(matchTags, addressPartTags), args: []argKind{argStringList, argStringList}},
+	"exists":   {test: true, args: []argKind{argStringList}},
+	"size": {
+		test: true,
+		tags: map[string]tagSpec{
+			"over":  {group: "size"},
+			"under": {group: "size"},
+		},
+		args: []argKind{argNumber},
+	},
+	"allof": {test: true, tests: -1},
+	"anyof": {test: true, tests: -1},
+	"not":   {test: true, tests: 1},
+	"true":  {test: true},
+	"false": {test: true},
+	"body": {
+		ext:   "body",
+		test:  true,
+		match: true,
+		tags: tags(matchTags, map[string]tagSpec{
+			"raw":     {group: "transform"},
+			"text":    {group: "transform"},
+			"content": {kind: argStringList, group: "transform"},
+		}),
+		args: []argKind{argStringList},
+	},
+	"string":      {ext: "variables", test: true, match: true, tags: matchTags, args: []argKind{argStringList, argStringList}},
+	"hasflag":     {ext: "imap4flags", test: true, match: true, tags: matchTags, args: []argKind{argStringList, argStringList}, optional: 1},
+	"date":        {ext: "date", test: true, match: true, tags: tags(matchTags, zoneTags, indexTags), args: []argKind{argString, argString, argStringList}},
+	"currentdate": {ext: "date", test: true, match: true, tags: tags(matchTags, map[string]tagSpec{"zone": {kind: argString}}), args: []argKind{argString, argStringList}},
+}
+
+// extensions contains the supported extensions.
+var extensions = map[string]bool{
+	"fileinto":                   true,
+	"envelope":                   true,
+	"imap4flags":                 true,
+	"variables":                  true,
+	"body":                       true,
+	"relational":                 true,
+	"vacation":                   true,
+	"date":                       true,
+	"index":                      true,
+	"copy":                       true,
+	"reject":                     true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+	"comparator-i;ascii-numeric": true,
+}
+
+var relationalOps = map[string]bool{
+	"gt": true, "ge": true, "lt": true, "le": true, "eq": true, "ne": true,
+}
+
+var dateParts = map[string]bool{
+	"year": true, "month": true, "day": true, "date": true, "julian": true,
+	"hour": true, "minute": true, "second": true, "time": true,
+	"iso8601": true, "std11": true, "zone": true, "weekday": true,
+}
+
+type compiler struct {
+	exts map[string]bool
+}
+
+func errorf(line int, format string, v ...interface{}) error {
+	return &Error{Line: line, Message: fmt.Sprintf(format, v...)}
+}
+
+func (c *compiler) requireExt(line int, ext string) error {
+	if ext != "" && !c.exts[ext] {
+		return errorf(line, "missing require for extension %q", ext)
+	}
+	return nil
+}
+
+func (c *compiler) commands(l []*node, top bool) ([]*node, error) {
+	var out []*node
+	var prev *node // last if or elsif
+	requireAllowed := top
+	for _, cmd := range l {
+		cmd.name = strings.ToLower(cmd.name)
+
+		if cmd.name == "require" {
+			if !requireAllowed {
+				return nil, errorf(cmd.line, "require must come before other commands")
+			}
+		} else {
+			requireAllowed = false
+		}
+
+		if err := c.node(cmd, false); err != nil {
+			return nil, err
+		}
+
+		switch cmd.name {
+		case "require":
+			for _, ext := range cmd.args[0].strs {
+				ext = strings.ToLower(ext)
+				if !extensions[ext] {
+					return nil, errorf(cmd.line, "unsupported extension %q", ext)
+				}
+				c.exts[ext] = true
+			}
+			continue
+		case "elsif", "else":
+			if prev == nil {
+				return nil, errorf(cmd.line, "%v without if", cmd.name)
+			}
+			prev.els = cmd
+		default:
+			out = append(out, cmd)
+		}
+
+		if cmd.name == "if" || cmd.name == "elsif" {
+			prev = cmd
+		} else {
+			prev = nil
+		}
+	}
+	return out, nil
+}
+
+func (c *compiler) node(n *node, test bool) error {
+	n.name = strings.ToLower(n.name)
+	spec, ok := specs[n.name]
+	if !ok || spec.test != test {
+		kind := "command"
+		if test {
+			kind = "test"
+		}
+		return errorf(n.line, "unknown %v %q", kind, n.name)
+	}
+	if err := c.requireExt(n.line, spec.ext); err != nil {
+		return err
+	}
+
+	if err := c.arguments(n, spec); err != nil {
+		return err
+	}
+
+	switch {
+	case spec.tests == 0 && len(n.tests) > 0:
+		return errorf(n.line, "%v doesn't take tests", n.name)
+	case spec.tests == 1 && len(n.tests) != 1:
+		return errorf(n.line, "%v takes exactly one test", n.name)
+	case spec.tests < 0 && len(n.tests) == 0:
+		return errorf(n.line, "%v takes a test list", n.name)
+	}
+	for _, t := range n.tests {
+		if err := c.node(t, true); err != nil {
+			return err
+		}
+	}
+
+	if !spec.block && n.block != nil {
+		return errorf(n.line, "%v doesn't take a block", n.name)
+	} else if spec.block && n.block == nil {
+		return errorf(n.line, "%v requires a block", n.name)
+	}
+	if n.block != nil {
+		var err error
+		if n.block, err = c.commands(n.block, false); err != nil {
+			return err
+		}
+	}
+
+	if spec.match {
+		var err error
+		if n.match, err = c.matchSpec(n); err != nil {
+			return err
+		}
+	}
+	return c.check(n)
+}
+
+func (c *compiler) arguments(n *node, spec *nodeSpec) error {
+	n.tags = make(map[string]*argument)
+	groups := make(map[string]string)
+	raw := n.raw
+	var positional []*argument
+	for len(raw) > 0 {
+		arg := raw[0]
+		raw = raw[1:]
+
+		if arg.kind != argNone {
+			positional = append(positional, arg)
+			continue
+		}
+
+		if len(positional) > 0 {
+			return errorf(arg.line, "tag :%v must come before positional arguments", arg.tag)
+		}
+		tag, ok := spec.tags[arg.tag]
+		if !ok {
+			return errorf(arg.line, "unknown tag :%v for %v", arg.tag, n.name)
+		}
+		if err := c.requireExt(arg.line, tag.ext); err != nil {
+			return err
+		}
+		if _, dup := n.tags[arg.tag]; dup {
+			return errorf(arg.line, "duplicate tag :%v", arg.tag)
+		}
+		if tag.group != "" {
+			if other, ok := groups[tag.group]; ok {
+				return errorf(arg.line, "tags :%v and :%v cannot be used together", other, arg.tag)
+			}
+			groups[tag.group] = arg.tag
+		}
+
+		if tag.kind != argNone {
+			if len(raw) == 0 || !compatible(raw[0].kind, tag.kind) {
+				return errorf(arg.line, "tag :%v requires a %v", arg.tag, tag.kind)
+			}
+			arg = &argument{kind: tag.kind, line: raw[0].line, tag: arg.tag, num: raw[0].num, strs: raw[0].strs}
+			raw = raw[1:]
+		}
+		n.tags[arg.tag] = arg
+	}
+
+	if len(positional) > len(spec.args) || len(positional) < len(spec.args)-spec.optional {
+		return errorf(n.line, "%v: wrong number of arguments", n.name)
+	}
+	n.args = make([]*argument, len(spec.args))
+	offset := len(spec.args) - len(positional)
+	for i, arg := range positional {
+		kind := spec.args[offset+i]
+		if !compatible(arg.kind, kind) {
+			return errorf(arg.line, "%v: expected %v, got %v", n.name, kind, arg.kind)
+		}
+		n.args[offset+i] = arg
+	}
+	return nil
+}
+
+func compatible(got, want argKind) bool {
+	return got == want || (got == argString && want == argStringList)
+}
+
+func (c *compiler) matchSpec(n *node) (*matchSpec, error) {
+	m := &matchSpec{
+		comparator:  comparatorCaseMap,
+		matchType:   matchIs,
+		addressPart: addressAll,
+	}
+	if arg := n.tags["comparator"]; arg != nil {
+		m.comparator = comparator(strings.ToLower(arg.str()))
+		switch m.comparator {
+		case comparatorOctet, comparatorCaseMap:
+		case comparatorNumeric:
+			if err := c.requireExt(arg.line, "comparator-"+string(m.comparator)); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errorf(arg.line, "unsupported comparator %q", arg.str())
+		}
+	}
+	for _, mt := range []matchType{matchIs, matchContains, matchMatches, matchCount, matchValue} {
+		arg := n.tags[string(mt)]
+		if arg == nil {
+			continue
+		}
+		m.matchType = mt
+		if mt == matchCount || mt == matchValue {
+			m.relation = strings.ToLower(arg.str())
+			if !relationalOps[m.relation] {
+				return nil, errorf(arg.line, "invalid relational operator %q", arg.str())
+			}
+		}
+	}
+	if m.comparator == comparatorNumeric && (m.matchType == matchContains || m.matchType == matchMatches) {
+		return nil, errorf(n.line, "comparator %v doesn't support :%v", m.comparator, m.matchType)
+	}
+	for _, part := range []addressPart{addressAll, addressLocalPart, addressDomain} {
+		if n.tags[string(part)] != nil {
+			m.addressPart = part
+		}
+	}
+	if arg := n.tags["index"]; arg != nil {
+		if arg.num < 1 {
+			return nil, errorf(arg.line, "index must be greater than zero")
+		}
+		m.index = int(arg.num)
+	}
+	if n.tags["last"] != nil {
+		if m.index == 0 {
+			return nil, errorf(n.line, ":last requires :index")
+		}
+		m.last = true
+	}
+	return m, nil
+}
+
+// check validates command-specific arguments.
+func (c *compiler) check(n *node) error {
+	switch n.name {
+	case "envelope":
+		for _, part := range n.args[0].strs {
+			switch strings.ToLower(part) {
+			case "from", "to":
+			default:
+				return errorf(n.line, "unsupported envelope part %q", part)
+			}
+		}
+	case "size":
+		if n.tags["over"] == nil && n.tags["under"] == nil {
+			return errorf(n.line, "size requires :over or :under")
+		}
+	case "set":
+		if !isVariableName(n.args[0].str()) {
+			return errorf(n.line, "invalid variable name %q", n.args[0].str())
+		}
+	case "setflag", "addflag", "removeflag":
+		if arg := n.args[0]; arg != nil && !isVariableName(arg.str()) {
+			return errorf(n.line, "invalid variable name %q", arg.str())
+		}
+	case "hasflag":
+		if arg := n.args[0]; arg != nil {
+			for _, name := range arg.strs {
+				if !isVariableName(name) {
+					return errorf(n.line, "invalid variable name %q", name)
+				}
+			}
+		}
+	case "date", "currentdate":
+		arg := n.args[len(n.args)-2]
+		if !c.exts["variables"] && !dateParts[strings.ToLower(arg.str())] {
+			return errorf(arg.line, "unknown date part %q", arg.str())
+		}
+	case "vacation":
+		if arg := n.tags["days"]; arg != nil && arg.num < 1 {
+			return errorf(arg.line, ":days must be greater than zero")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// mjdEpoch is the origin of the Modified Julian Day.
+var mjdEpoch = time.Date(1858, 11, 17, 0, 0, 0, 0, time.UTC)
+
+// parseZone parses a time zone offset such as "+0100".
+func parseZone(s string) (*time.Location, bool) {
+	if len(s) != 5 || (s[0] != '+' && s[0] != '-') {
+		return nil, false
+	}
+	for i := 1; i < 5; i++ {
+		if !isDigit(s[i]) {
+			return nil, false
+		}
+	}
+	hours := int(s[1]-'0')*10 + int(s[2]-'0')
+	minutes := int(s[3]-'0')*10 + int(s[4]-'0')
+	if minutes >= 60 {
+		return nil, false
+	}
+	offset := (hours*60 + minutes) * 60
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return time.FixedZone(s, offset), true
+}
+
+// datePart extracts a date part, as defined in RFC 5260 section 4.2.
+func datePart(t time.Time, part string) (string, bool) {
+	switch strings.ToLower(part) {
+	case "year":
+		return fmt.Sprintf("%04d", t.Year()), true
+	case "month":
+		return fmt.Sprintf("%02d", int(t.Month())), true
+	case "day":
+		return fmt.Sprintf("%02d", t.Day()), true
+	case "date":
+		return t.Format("2006-01-02"), true
+	case "julian":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return fmt.Sprintf("%d", int64(day.Sub(mjdEpoch)/(24*time.Hour))), true
+	case "hour":
+		return fmt.Sprintf("%02d", t.Hour()), true
+	case "minute":
+		return fmt.Sprintf("%02d", t.Minute()), true
+	case "second":
+		return fmt.Sprintf("%02d", t.Second()), true
+	case "time":
+		return t.Format("15:04:05"), true
+	case "iso8601":
+		return t.Format("2006-01-02T15:04:05-07:00"), true
+	case "std11":
+		return t.Format("Mon, 02 Jan 2006 15:04:05 -0700"), true
+	case "zone":
+		return t.Format("-0700"), true
+	case "weekday":
+		return fmt.Sprintf("%d", int(t.Weekday())), true
+	}
+	return "", false
+}
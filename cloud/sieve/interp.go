@@ -0,0 +1,527 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/unix-world/smartgoplus/cloud/imap"
+)
+
+var errStop = errors.New("sieve: stop")
+
+const defaultMaxRedirects = 4
+
+type runtime struct {
+	script  *Script
+	msg     *Message
+	env     *Envelope
+	options *Options
+	now     time.Time
+
+	vars      map[string]string
+	matchVars []string
+	flags     string // internal variable of imap4flags
+
+	actions      []Action
+	implicitKeep bool
+	redirects    int
+	rejected     bool
+	vacation     bool
+}
+
+func (r *runtime) has(ext string) bool {
+	return r.script.exts[ext]
+}
+
+func (r *runtime) expand(s string) string {
+	if !r.has("variables") {
+		return s
+	}
+	return expandVariables(s, func(name string) string {
+		if isMatchVariable(name) {
+			i, err := strconv.Atoi(name)
+			if err != nil || i >= len(r.matchVars) {
+				return ""
+			}
+			return r.matchVars[i]
+		}
+		return r.vars[name]
+	})
+}
+
+func (r *runtime) expandList(l []string) []string {
+	out := make([]string, len(l))
+	for i, s := range l {
+		out[i] = r.expand(s)
+	}
+	return out
+}
+
+func (r *runtime) str(arg *argument) string {
+	return r.expand(arg.str())
+}
+
+func (r *runtime) commands(l []*node) error {
+	for _, cmd := range l {
+		if err := r.command(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *runtime) command(cmd *node) error {
+	switch cmd.name {
+	case "if":
+		for branch := cmd; branch != nil; branch = branch.els {
+			if branch.name != "else" {
+				ok, err := r.test(branch.tests[0])
+				if err != nil {
+					return err
+				} else if !ok {
+					continue
+				}
+			}
+			return r.commands(branch.block)
+		}
+		return nil
+	case "stop":
+		return errStop
+	case "keep":
+		r.implicitKeep = false
+		r.actions = appendAction(r.actions, &Keep{Flags: r.actionFlags(cmd)})
+	case "discard":
+		r.implicitKeep = false
+	case "redirect":
+		addr := r.str(cmd.args[0])
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return errorf(cmd.line, "invalid redirect address %q", addr)
+		}
+		maxRedirects := r.options.MaxRedirects
+		if maxRedirects == 0 {
+			maxRedirects = defaultMaxRedirects
+		}
+		r.redirects++
+		if r.redirects > maxRedirects {
+			return errorf(cmd.line, "too many redirect actions")
+		}
+		if cmd.tags["copy"] == nil {
+			r.implicitKeep = false
+		}
+		r.actions = appendAction(r.actions, &Redirect{Address: addr})
+	case "fileinto":
+		if cmd.tags["copy"] == nil {
+			r.implicitKeep = false
+		}
+		r.actions = appendAction(r.actions, &FileInto{
+			Mailbox: r.str(cmd.args[0]),
+			Flags:   r.actionFlags(cmd),
+		})
+	case "reject":
+		if r.vacation {
+			return errorf(cmd.line, "reject cannot be used with vacation")
+		}
+		r.implicitKeep = false
+		r.rejected = true
+		r.actions = appendAction(r.actions, &Reject{Reason: r.str(cmd.args[0])})
+	case "setflag", "addflag", "removeflag":
+		r.setFlags(cmd)
+	case "set":
+		r.set(cmd)
+	case "vacation":
+		return r.executeVacation(cmd)
+	default:
+		panic(fmt.Errorf("sieve: unknown command %q", cmd.name))
+	}
+	return nil
+}
+
+func (r *runtime) set(cmd *node) {
+	v := r.str(cmd.args[1])
+	if cmd.tags["lower"] != nil {
+		v = strings.ToLower(v)
+	} else if cmd.tags["upper"] != nil {
+		v = strings.ToUpper(v)
+	}
+	if v != "" {
+		if cmd.tags["lowerfirst"] != nil || cmd.tags["upperfirst"] != nil {
+			ch, size := utf8.DecodeRuneInString(v)
+			if cmd.tags["lowerfirst"] != nil {
+				ch = unicode.ToLower(ch)
+			} else {
+				ch = unicode.ToUpper(ch)
+			}
+			v = string(ch) + v[size:]
+		}
+	}
+	if cmd.tags["quotewildcard"] != nil {
+		v = quoteWildcard(v)
+	}
+	if cmd.tags["length"] != nil {
+		v = strconv.Itoa(utf8.RuneCountInString(v))
+	}
+	r.vars[asciiLower(cmd.args[0].str())] = v
+}
+
+// parseFlags splits a list of space-separated flags, removing duplicates.
+func parseFlags(l []string) []string {
+	var flags []string
+	seen := make(map[string]bool)
+	for _, s := range l {
+		for _, flag := range strings.Fields(s) {
+			k := asciiLower(flag)
+			if !seen[k] {
+				seen[k] = true
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return flags
+}
+
+func (r *runtime) setFlags(cmd *node) {
+	cur := r.flags
+	var name string
+	if arg := cmd.args[0]; arg != nil {
+		name = asciiLower(arg.str())
+		cur = r.vars[name]
+	}
+
+	arg := parseFlags(r.expandList(cmd.args[1].strs))
+	var flags []string
+	switch cmd.name {
+	case "setflag":
+		flags = arg
+	case "addflag":
+		flags = parseFlags(append(strings.Fields(cur), arg...))
+	case "removeflag":
+		remove := make(map[string]bool)
+		for _, flag := range arg {
+			remove[asciiLower(flag)] = true
+		}
+		for _, flag := range strings.Fields(cur) {
+			if !remove[asciiLower(flag)] {
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	if name != "" {
+		r.vars[name] = strings.Join(flags, " ")
+	} else {
+		r.flags = strings.Join(flags, " ")
+	}
+}
+
+// actionFlags returns the flags for a keep or fileinto command: either the
+// :flags argument or the internal variable.
+func (r *runtime) actionFlags(cmd *node) []imap.Flag {
+	if !r.has("imap4flags") {
+		return nil
+	}
+	if arg := cmd.tags["flags"]; arg != nil {
+		return r.imapFlags(strings.Join(r.expandList(arg.strs), " "))
+	}
+	return r.imapFlags(r.flags)
+}
+
+func (r *runtime) imapFlags(s string) []imap.Flag {
+	if !r.has("imap4flags") {
+		return nil
+	}
+	var l []imap.Flag
+	for _, flag := range parseFlags([]string{s}) {
+		l = append(l, imap.Flag(flag))
+	}
+	return l
+}
+
+func (r *runtime) test(t *node) (bool, error) {
+	switch t.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := r.test(t.tests[0])
+		return !ok, err
+	case "allof":
+		for _, sub := range t.tests {
+			if ok, err := r.test(sub); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case "anyof":
+		for _, sub := range t.tests {
+			if ok, err := r.test(sub); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "exists":
+		for _, k := range r.expandList(t.args[0].strs) {
+			if len(r.msg.fields(k, 0, false)) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		size := int64(r.msg.Size())
+		if t.tags["over"] != nil {
+			return size > t.args[0].num, nil
+		}
+		return size < t.args[0].num, nil
+	}
+
+	values, err := r.testValues(t)
+	if err != nil {
+		return false, err
+	}
+	keys := r.expandList(t.args[len(t.args)-1].strs)
+	ok, captures := t.match.matchValues(values, keys)
+	if ok && captures != nil && r.has("variables") {
+		r.matchVars = captures
+	}
+	return ok, nil
+}
+
+// testValues returns the values matched against the keys of a test.
+func (r *runtime) testValues(t *node) ([]string, error) {
+	m := t.match
+	var values []string
+	switch t.name {
+	case "header":
+		for _, k := range r.expandList(t.args[0].strs) {
+			values = append(values, r.msg.values(k, m.index, m.last)...)
+		}
+	case "address":
+		for _, k := range r.expandList(t.args[0].strs) {
+			for _, v := range r.msg.fields(k, m.index, m.last) {
+				l, ok := addresses(v)
+				if !ok && m.addressPart != addressAll {
+					continue
+				}
+				for _, addr := range l {
+					values = append(values, m.addressPartOf(addr))
+				}
+			}
+		}
+	case "envelope":
+		for _, part := range t.args[0].strs {
+			var addr string
+			switch strings.ToLower(part) {
+			case "from":
+				addr = r.env.From
+			case "to":
+				addr = r.env.To
+			}
+			values = append(values, m.addressPartOf(addr))
+		}
+	case "body":
+		values = r.bodyValues(t)
+	case "string":
+		for _, v := range r.expandList(t.args[0].strs) {
+			// Empty strings aren't counted
+			if v != "" || m.matchType != matchCount {
+				values = append(values, v)
+			}
+		}
+	case "hasflag":
+		if arg := t.args[0]; arg != nil {
+			for _, name := range arg.strs {
+				values = append(values, strings.Fields(r.vars[asciiLower(name)])...)
+			}
+		} else {
+			values = strings.Fields(r.flags)
+		}
+	case "date":
+		return r.dateValues(t)
+	case "currentdate":
+		loc := r.location()
+		if arg := t.tags["zone"]; arg != nil {
+			var ok bool
+			if loc, ok = parseZone(r.str(arg)); !ok {
+				return nil, nil
+			}
+		}
+		if v, ok := datePart(r.now.In(loc), r.str(t.args[0])); ok {
+			values = append(values, v)
+		}
+	default:
+		panic(fmt.Errorf("sieve: unknown test %q", t.name))
+	}
+	return values, nil
+}
+
+func (m *matchSpec) addressPartOf(addr string) string {
+	localPart, domain := splitAddress(addr)
+	switch m.addressPart {
+	case addressLocalPart:
+		return localPart
+	case addressDomain:
+		return domain
+	}
+	return addr
+}
+
+func (r *runtime) location() *time.Location {
+	if r.options.Location != nil {
+		return r.options.Location
+	}
+	return time.Local
+}
+
+func (r *runtime) dateValues(t *node) ([]string, error) {
+	m := t.match
+	var loc *time.Location
+	if arg := t.tags["zone"]; arg != nil {
+		var ok bool
+		if loc, ok = parseZone(r.str(arg)); !ok {
+			return nil, nil
+		}
+	} else if t.tags["originalzone"] == nil {
+		loc = r.location()
+	}
+
+	var values []string
+	for _, v := range r.msg.values(r.str(t.args[0]), m.index, m.last) {
+		// Received fields contain the date after the last semicolon
+		if i := strings.LastIndexByte(v, ';'); i >= 0 {
+			v = v[i+1:]
+		}
+		date, err := mail.ParseDate(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		if loc != nil {
+			date = date.In(loc)
+		}
+		if part, ok := datePart(date, r.str(t.args[1])); ok {
+			values = append(values, part)
+		}
+	}
+	return values, nil
+}
+
+func (r *runtime) bodyValues(t *node) []string {
+	if t.tags["raw"] != nil {
+		return []string{string(r.msg.body)}
+	}
+
+	var types []string
+	if arg := t.tags["content"]; arg != nil {
+		types = r.expandList(arg.strs)
+	} else {
+		types = []string{"text"}
+	}
+
+	var values []string
+	for _, part := range r.msg.parts() {
+		for _, typ := range types {
+			if matchMediaType(part.mediaType, typ) {
+				values = append(values, string(part.body))
+				break
+			}
+		}
+	}
+	return values
+}
+
+// matchMediaType checks whether a media type matches a :content argument,
+// which can be empty, a type or a type and subtype.
+func matchMediaType(mediaType, pattern string) bool {
+	pattern = asciiLower(strings.TrimSpace(pattern))
+	if pattern == "" {
+		return true
+	}
+	if strings.Contains(pattern, "/") {
+		return mediaType == pattern
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	return typ == pattern
+}
+
+func (r *runtime) executeVacation(cmd *node) error {
+	if r.vacation {
+		return errorf(cmd.line, "vacation can only be used once")
+	} else if r.rejected {
+		return errorf(cmd.line, "vacation cannot be used with reject")
+	}
+	r.vacation = true
+
+	reason := r.str(cmd.args[0])
+	var subject, from, handle string
+	if arg := cmd.tags["subject"]; arg != nil {
+		subject = r.str(arg)
+	}
+	if arg := cmd.tags["from"]; arg != nil {
+		from = r.str(arg)
+	}
+	mime := cmd.tags["mime"] != nil
+	if arg := cmd.tags["handle"]; arg != nil {
+		handle = r.str(arg)
+	} else {
+		handle = vacationHandle(reason, subject, from, mime)
+	}
+	days := int64(7)
+	if arg := cmd.tags["days"]; arg != nil {
+		days = arg.num
+	}
+
+	sender := r.env.From
+	if sender == "" || isAutomatedSender(sender) || r.msg.isAutomatedMessage() {
+		return nil
+	}
+
+	userAddrs := []string{r.env.To}
+	userAddrs = append(userAddrs, r.options.Addresses...)
+	if arg := cmd.tags["addresses"]; arg != nil {
+		userAddrs = append(userAddrs, r.expandList(arg.strs)...)
+	}
+	if !r.msg.isAddressedTo(userAddrs) {
+		return nil
+	}
+	for _, addr := range userAddrs {
+		if strings.EqualFold(addr, sender) {
+			return nil
+		}
+	}
+
+	if tracker := r.options.VacationTracker; tracker != nil {
+		ok, err := tracker.Track(handle, r.env.To, sender, r.now, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+	}
+
+	if from == "" {
+		from = "<" + r.env.To + ">"
+	}
+	if subject == "" {
+		subject = "Auto: " + strings.Join(r.msg.values("Subject", 1, false), "")
+	}
+	var inReplyTo string
+	if l := r.msg.fields("Message-Id", 1, false); len(l) > 0 {
+		inReplyTo = strings.TrimSpace(l[0])
+	}
+
+	r.actions = append(r.actions, &Vacation{
+		From:      from,
+		To:        sender,
+		Subject:   subject,
+		Body:      reason,
+		MIME:      mime,
+		InReplyTo: inReplyTo,
+		Date:      r.now,
+	})
+	return nil
+}
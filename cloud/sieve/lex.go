@@ -0,0 +1,283 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+func (kind tokenKind) String() string {
+	switch kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenIdentifier:
+		return "identifier"
+	case tokenTag:
+		return "tag"
+	case tokenNumber:
+		return "number"
+	case tokenString:
+		return "string"
+	case tokenPunct:
+		return "punctuation"
+	}
+	return fmt.Sprintf("<unknown token %d>", int(kind))
+}
+
+type token struct {
+	kind tokenKind
+	line int
+	s    string // identifier, tag name, string value or punctuation
+	n    int64
+}
+
+func (tok *token) String() string {
+	switch tok.kind {
+	case tokenIdentifier, tokenPunct:
+		return fmt.Sprintf("%q", tok.s)
+	case tokenTag:
+		return fmt.Sprintf("%q", ":"+tok.s)
+	}
+	return tok.kind.String()
+}
+
+// lexer splits a script into tokens, as defined in RFC 5228 section 8.1.
+type lexer struct {
+	s    string
+	pos  int
+	line int
+
+	peeked *token
+}
+
+func newLexer(s string) *lexer {
+	return &lexer{s: s, line: 1}
+}
+
+func (l *lexer) errorf(format string, v ...interface{}) error {
+	return &Error{Line: l.line, Message: fmt.Sprintf(format, v...)}
+}
+
+func (l *lexer) peek() (*token, error) {
+	if l.peeked == nil {
+		tok, err := l.lex()
+		if err != nil {
+			return nil, err
+		}
+		l.peeked = tok
+	}
+	return l.peeked, nil
+}
+
+func (l *lexer) next() (*token, error) {
+	tok, err := l.peek()
+	l.peeked = nil
+	return tok, err
+}
+
+func isAlpha(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || ch == '_'
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.s) {
+		switch ch := l.s[l.pos]; {
+		case ch == '\n':
+			l.line++
+			l.pos++
+		case ch == ' ' || ch == '\t' || ch == '\r':
+			l.pos++
+		case ch == '#':
+			for l.pos < len(l.s) && l.s[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.s[l.pos:], "/*"):
+			end := strings.Index(l.s[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			comment := l.s[l.pos : l.pos+2+end+2]
+			l.line += strings.Count(comment, "\n")
+			l.pos += len(comment)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.s) && (isAlpha(l.s[l.pos]) || isDigit(l.s[l.pos])) {
+		l.pos++
+	}
+	return l.s[start:l.pos]
+}
+
+func (l *lexer) lex() (*token, error) {
+	if err := l.skipSpace(); err != nil {
+		return nil, err
+	}
+	if l.pos >= len(l.s) {
+		return &token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	tok := &token{line: l.line}
+	switch ch := l.s[l.pos]; {
+	case isAlpha(ch):
+		tok.kind = tokenIdentifier
+		tok.s = l.identifier()
+		if strings.EqualFold(tok.s, "text") && l.pos < len(l.s) && l.s[l.pos] == ':' {
+			l.pos++
+			s, err := l.multiLine()
+			if err != nil {
+				return nil, err
+			}
+			tok.kind = tokenString
+			tok.s = s
+		}
+	case ch == ':':
+		l.pos++
+		if l.pos >= len(l.s) || !isAlpha(l.s[l.pos]) {
+			return nil, l.errorf("invalid tag")
+		}
+		tok.kind = tokenTag
+		tok.s = strings.ToLower(l.identifier())
+	case isDigit(ch):
+		n, err := l.number()
+		if err != nil {
+			return nil, err
+		}
+		tok.kind = tokenNumber
+		tok.n = n
+	case ch == '"':
+		s, err := l.quotedString()
+		if err != nil {
+			return nil, err
+		}
+		tok.kind = tokenString
+		tok.s = s
+	case strings.IndexByte(";,[]{}()", ch) >= 0:
+		l.pos++
+		tok.kind = tokenPunct
+		tok.s = string(ch)
+	default:
+		return nil, l.errorf("unexpected character %q", ch)
+	}
+	return tok, nil
+}
+
+func (l *lexer) number() (int64, error) {
+	var n int64
+	for l.pos < len(l.s) && isDigit(l.s[l.pos]) {
+		n = n*10 + int64(l.s[l.pos]-'0')
+		if n > 1<<40 {
+			return 0, l.errorf("number too large")
+		}
+		l.pos++
+	}
+	if l.pos < len(l.s) {
+		var shift uint
+		switch l.s[l.pos] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		}
+		if shift > 0 {
+			n <<= shift
+			l.pos++
+		}
+	}
+	return n, nil
+}
+
+func (l *lexer) quotedString() (string, error) {
+	l.pos++ // opening quote
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.s) {
+			return "", l.errorf("unterminated string")
+		}
+		ch := l.s[l.pos]
+		l.pos++
+		switch ch {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			// Undefined escape sequences are interpreted as if there were no
+			// backslash
+			if l.pos >= len(l.s) {
+				return "", l.errorf("unterminated string")
+			}
+			ch = l.s[l.pos]
+			l.pos++
+		}
+		if ch == '\n' {
+			l.line++
+		}
+		sb.WriteByte(ch)
+	}
+}
+
+// multiLine reads a "text:" string. Lines are terminated by CRLF.
+func (l *lexer) multiLine() (string, error) {
+	for l.pos < len(l.s) && (l.s[l.pos] == ' ' || l.s[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.s) && l.s[l.pos] == '#' {
+		for l.pos < len(l.s) && l.s[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if strings.HasPrefix(l.s[l.pos:], "\r\n") {
+		l.pos += 2
+	} else if strings.HasPrefix(l.s[l.pos:], "\n") {
+		l.pos++
+	} else {
+		return "", l.errorf("expected newline after \"text:\"")
+	}
+	l.line++
+
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.s) {
+			return "", l.errorf("unterminated multi-line string")
+		}
+		end := strings.IndexByte(l.s[l.pos:], '\n')
+		var line string
+		if end < 0 {
+			line = l.s[l.pos:]
+			l.pos = len(l.s)
+		} else {
+			line = l.s[l.pos : l.pos+end]
+			l.pos += end + 1
+			l.line++
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if line == "." {
+			return sb.String(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		sb.WriteString(line)
+		sb.WriteString("\r\n")
+	}
+}
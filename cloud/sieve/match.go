@@ -0,0 +1,254 @@
+package sieve
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type comparator string
+
+const (
+	comparatorOctet   comparator = "i;octet"
+	comparatorCaseMap comparator = "i;ascii-casemap"
+	comparatorNumeric comparator = "i;ascii-numeric"
+)
+
+type matchType string
+
+const (
+	matchIs       matchType = "is"
+	matchContains matchType = "contains"
+	matchMatches  matchType = "matches"
+	matchCount    matchType = "count"
+	matchValue    matchType = "value"
+)
+
+type addressPart string
+
+const (
+	addressAll       addressPart = "all"
+	addressLocalPart addressPart = "localpart"
+	addressDomain    addressPart = "domain"
+)
+
+// matchSpec contains the comparator, match type and related options of a
+// test.
+type matchSpec struct {
+	comparator  comparator
+	matchType   matchType
+	relation    string // for matchCount and matchValue
+	addressPart addressPart
+	index       int // 1-based, zero if unset
+	last        bool
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, ch := range b {
+		if ch >= 'A' && ch <= 'Z' {
+			b[i] = ch + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// fold returns a string which can be compared byte-by-byte. For the
+// i;ascii-casemap comparator, byte offsets are preserved.
+func (c comparator) fold(s string) string {
+	if c == comparatorCaseMap {
+		return asciiLower(s)
+	}
+	return s
+}
+
+// numericValue returns the digits of the leading number of s without leading
+// zeroes. ok is false if s doesn't start with a digit, which stands for
+// positive infinity.
+func numericValue(s string) (digits string, ok bool) {
+	end := 0
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+	if end == 0 {
+		return "", false
+	}
+	digits = strings.TrimLeft(s[:end], "0")
+	return digits, true
+}
+
+// compare returns an integer comparing a and b, as defined by RFC 4790.
+func (c comparator) compare(a, b string) int {
+	if c != comparatorNumeric {
+		return strings.Compare(c.fold(a), c.fold(b))
+	}
+
+	da, okA := numericValue(a)
+	db, okB := numericValue(b)
+	switch {
+	case !okA && !okB:
+		return 0
+	case !okA:
+		return 1
+	case !okB:
+		return -1
+	case len(da) != len(db):
+		if len(da) < len(db) {
+			return -1
+		}
+		return 1
+	default:
+		return strings.Compare(da, db)
+	}
+}
+
+func relate(relation string, cmp int) bool {
+	switch relation {
+	case "gt":
+		return cmp > 0
+	case "ge":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "le":
+		return cmp <= 0
+	case "eq":
+		return cmp == 0
+	case "ne":
+		return cmp != 0
+	}
+	return false
+}
+
+// matchValues checks whether any value matches any key. For :matches, the
+// match variables are returned.
+func (m *matchSpec) matchValues(values, keys []string) (ok bool, captures []string) {
+	if m.matchType == matchCount {
+		count := strconv.Itoa(len(values))
+		for _, key := range keys {
+			if relate(m.relation, comparatorNumeric.compare(count, key)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	for _, value := range values {
+		for _, key := range keys {
+			if ok, captures := m.matchValue(value, key); ok {
+				return true, captures
+			}
+		}
+	}
+	return false, nil
+}
+
+func (m *matchSpec) matchValue(value, key string) (bool, []string) {
+	switch m.matchType {
+	case matchIs:
+		return m.comparator.compare(value, key) == 0, nil
+	case matchContains:
+		return strings.Contains(m.comparator.fold(value), m.comparator.fold(key)), nil
+	case matchMatches:
+		return matchWildcard(m.comparator.fold(key), m.comparator.fold(value), value)
+	case matchValue:
+		return relate(m.relation, m.comparator.compare(value, key)), nil
+	}
+	return false, nil
+}
+
+// matchWildcard matches a :matches pattern against a folded value. Captures
+// are extracted from the original value: the first item is the whole value,
+// and there is one item per wildcard. Wildcards match as few characters as
+// possible, as specified in RFC 5229 section 3.2.
+//
+// Only the position of the last "*" is remembered when backtracking, so that
+// matching takes linear time in the length of the value for each pattern
+// token.
+func matchWildcard(pattern, folded, orig string) (bool, []string) {
+	type token struct {
+		ch       byte
+		wildcard bool
+	}
+	var tokens []token
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*', '?':
+			tokens = append(tokens, token{ch: ch, wildcard: true})
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			tokens = append(tokens, token{ch: pattern[i]})
+		default:
+			tokens = append(tokens, token{ch: ch})
+		}
+	}
+
+	// starts[i] is the position in the value where tokens[i] matched
+	starts := make([]int, len(tokens)+1)
+	t, pos := 0, 0
+	star, starPos := -1, 0
+	for t < len(tokens) || pos < len(folded) {
+		if t < len(tokens) {
+			tok := tokens[t]
+			switch {
+			case tok.wildcard && tok.ch == '*':
+				starts[t] = pos
+				star, starPos = t, pos
+				t++
+				continue
+			case tok.wildcard && tok.ch == '?':
+				if pos < len(folded) {
+					_, size := utf8.DecodeRuneInString(folded[pos:])
+					starts[t] = pos
+					t++
+					pos += size
+					continue
+				}
+			default:
+				if pos < len(folded) && folded[pos] == tok.ch {
+					starts[t] = pos
+					t++
+					pos++
+					continue
+				}
+			}
+		}
+		if star < 0 || starPos >= len(folded) {
+			return false, nil
+		}
+		_, size := utf8.DecodeRuneInString(folded[starPos:])
+		starPos += size
+		t, pos = star+1, starPos
+	}
+	starts[len(tokens)] = len(folded)
+
+	captures := []string{orig}
+	for i, tok := range tokens {
+		if !tok.wildcard {
+			continue
+		}
+		end := starts[i+1]
+		if tok.ch == '?' {
+			_, size := utf8.DecodeRuneInString(folded[starts[i]:])
+			end = starts[i] + size
+		}
+		captures = append(captures, orig[starts[i]:end])
+	}
+	return true, captures
+}
+
+// quoteWildcard escapes the wildcard characters of a string, as done by the
+// :quotewildcard modifier of the set command.
+func quoteWildcard(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '\\':
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
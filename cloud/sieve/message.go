@@ -0,0 +1,206 @@
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+type headerField struct {
+	key   string // canonical
+	value string // unfolded, raw
+}
+
+// Message is a message being filtered.
+type Message struct {
+	header []headerField
+	raw    []byte
+	body   []byte
+}
+
+// ReadMessage reads a message. Malformed header fields are ignored.
+func ReadMessage(r io.Reader) (*Message, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &Message{raw: b}
+	br := bufio.NewReader(bytes.NewReader(b))
+	var cur *headerField
+	offset := 0
+	for {
+		line, err := br.ReadString('\n')
+		offset += len(line)
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if cur != nil {
+				cur.value += trimmed
+			}
+		} else if k, v, ok := strings.Cut(trimmed, ":"); ok && k != "" && !strings.ContainsAny(k, " \t") {
+			msg.header = append(msg.header, headerField{
+				key:   textproto.CanonicalMIMEHeaderKey(k),
+				value: v,
+			})
+			cur = &msg.header[len(msg.header)-1]
+		} else {
+			cur = nil
+		}
+		if err != nil {
+			break
+		}
+	}
+	msg.body = b[offset:]
+	return msg, nil
+}
+
+// Size returns the size of the message in bytes.
+func (msg *Message) Size() int {
+	return len(msg.raw)
+}
+
+var wordDecoder mime.WordDecoder
+
+func decodeHeader(v string) string {
+	v = strings.TrimSpace(v)
+	if s, err := wordDecoder.DecodeHeader(v); err == nil {
+		return s
+	}
+	return v
+}
+
+// fields returns the raw values of the header fields with the specified key,
+// with an optional 1-based index.
+func (msg *Message) fields(key string, index int, last bool) []string {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	var l []string
+	for _, f := range msg.header {
+		if f.key == key {
+			l = append(l, f.value)
+		}
+	}
+	if index == 0 {
+		return l
+	}
+	if index > len(l) {
+		return nil
+	}
+	if last {
+		return l[len(l)-index : len(l)-index+1]
+	}
+	return l[index-1 : index]
+}
+
+// values returns the decoded values of the header fields with the specified
+// key.
+func (msg *Message) values(key string, index int, last bool) []string {
+	l := msg.fields(key, index, last)
+	for i, v := range l {
+		l[i] = decodeHeader(v)
+	}
+	return l
+}
+
+// addresses returns the addresses contained in a header field value. If the
+// value cannot be parsed, the raw value is returned with ok set to false.
+func addresses(v string) (l []string, ok bool) {
+	list, err := mail.ParseAddressList(v)
+	if err != nil {
+		return []string{strings.TrimSpace(v)}, false
+	}
+	for _, addr := range list {
+		l = append(l, addr.Address)
+	}
+	return l, true
+}
+
+func splitAddress(addr string) (localPart, domain string) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
+
+type bodyPart struct {
+	mediaType string
+	body      []byte
+}
+
+// parts returns the leaf MIME parts of the message, with the transfer
+// encoding decoded.
+func (msg *Message) parts() []bodyPart {
+	h := make(textproto.MIMEHeader)
+	for _, f := range msg.header {
+		h.Add(f.key, f.value)
+	}
+	return appendParts(nil, h, msg.body, 0)
+}
+
+const maxPartDepth = 16
+
+func appendParts(l []bodyPart, h textproto.MIMEHeader, body []byte, depth int) []bodyPart {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxPartDepth {
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err != nil {
+				break
+			}
+			b, err := io.ReadAll(p)
+			if err != nil {
+				break
+			}
+			l = appendParts(l, p.Header, b, depth+1)
+		}
+		return l
+	}
+
+	var r io.Reader = bytes.NewReader(body)
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: r})
+	}
+	if b, err := io.ReadAll(r); err == nil {
+		body = b
+	}
+	return append(l, bodyPart{mediaType: mediaType, body: body})
+}
+
+// newlineStripper removes CR and LF characters, for base64 decoding.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (ns *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := ns.r.Read(p)
+		j := 0
+		for _, ch := range p[:n] {
+			if ch != '\r' && ch != '\n' {
+				p[j] = ch
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
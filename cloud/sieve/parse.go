@@ -0,0 +1,228 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+type argKind int
+
+const (
+	argNone argKind = iota
+	argNumber
+	argString
+	argStringList
+)
+
+func (kind argKind) String() string {
+	switch kind {
+	case argNone:
+		return "nothing"
+	case argNumber:
+		return "number"
+	case argString:
+		return "string"
+	case argStringList:
+		return "string list"
+	}
+	return fmt.Sprintf("<unknown argument %d>", int(kind))
+}
+
+// argument is a command or test argument. Tags are stored as arguments of
+// kind argNone with a tag name.
+type argument struct {
+	kind argKind
+	line int
+	tag  string
+	num  int64
+	strs []string
+}
+
+func (arg *argument) str() string {
+	return arg.strs[0]
+}
+
+// node is a command or a test.
+type node struct {
+	name  string
+	line  int
+	raw   []*argument
+	tests []*node
+	block []*node
+
+	// Set by compile
+	tags  map[string]*argument
+	args  []*argument // nil for omitted optional arguments
+	match *matchSpec
+	els   *node // elsif or else branch of an if command
+}
+
+type parser struct {
+	lexer *lexer
+}
+
+func (p *parser) errorf(tok *token, format string, v ...interface{}) error {
+	return &Error{Line: tok.line, Message: fmt.Sprintf(format, v...)}
+}
+
+func (p *parser) expectPunct(s string) error {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return err
+	}
+	if tok.kind != tokenPunct || tok.s != s {
+		return p.errorf(tok, "expected %q, got %v", s, tok)
+	}
+	return nil
+}
+
+func (p *parser) isPunct(s string) (bool, error) {
+	tok, err := p.lexer.peek()
+	if err != nil {
+		return false, err
+	}
+	return tok.kind == tokenPunct && tok.s == s, nil
+}
+
+// commands parses commands until the end of the script or of the block.
+func (p *parser) commands(inBlock bool) ([]*node, error) {
+	var l []*node
+	for {
+		tok, err := p.lexer.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == tokenEOF {
+			if inBlock {
+				return nil, p.errorf(tok, "unexpected end of script in block")
+			}
+			return l, nil
+		}
+		if inBlock && tok.kind == tokenPunct && tok.s == "}" {
+			return l, nil
+		}
+
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, cmd)
+	}
+}
+
+func (p *parser) command() (*node, error) {
+	cmd, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, err := p.lexer.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tok.kind == tokenPunct && tok.s == ";":
+		return cmd, nil
+	case tok.kind == tokenPunct && tok.s == "{":
+		cmd.block, err = p.commands(true)
+		if err != nil {
+			return nil, err
+		}
+		if cmd.block == nil {
+			cmd.block = []*node{}
+		}
+		return cmd, p.expectPunct("}")
+	default:
+		return nil, p.errorf(tok, "expected \";\" or \"{\", got %v", tok)
+	}
+}
+
+// node parses an identifier followed by arguments, tests or a test list.
+func (p *parser) node() (*node, error) {
+	tok, err := p.lexer.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind != tokenIdentifier {
+		return nil, p.errorf(tok, "expected identifier, got %v", tok)
+	}
+	n := &node{name: tok.s, line: tok.line}
+
+	for {
+		tok, err := p.lexer.peek()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case tok.kind == tokenTag:
+			p.lexer.next()
+			n.raw = append(n.raw, &argument{kind: argNone, line: tok.line, tag: tok.s})
+			continue
+		case tok.kind == tokenNumber:
+			p.lexer.next()
+			n.raw = append(n.raw, &argument{kind: argNumber, line: tok.line, num: tok.n})
+			continue
+		case tok.kind == tokenString:
+			p.lexer.next()
+			n.raw = append(n.raw, &argument{kind: argString, line: tok.line, strs: []string{tok.s}})
+			continue
+		case tok.kind == tokenPunct && tok.s == "[":
+			p.lexer.next()
+			arg, err := p.stringList(tok.line)
+			if err != nil {
+				return nil, err
+			}
+			n.raw = append(n.raw, arg)
+			continue
+		case tok.kind == tokenIdentifier:
+			test, err := p.node()
+			if err != nil {
+				return nil, err
+			}
+			n.tests = []*node{test}
+		case tok.kind == tokenPunct && tok.s == "(":
+			p.lexer.next()
+			for {
+				test, err := p.node()
+				if err != nil {
+					return nil, err
+				}
+				n.tests = append(n.tests, test)
+				if ok, err := p.isPunct(","); err != nil {
+					return nil, err
+				} else if !ok {
+					break
+				}
+				p.lexer.next()
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+		}
+		return n, nil
+	}
+}
+
+func (p *parser) stringList(line int) (*argument, error) {
+	arg := &argument{kind: argStringList, line: line}
+	for {
+		tok, err := p.lexer.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind != tokenString {
+			return nil, p.errorf(tok, "expected string in string list, got %v", tok)
+		}
+		arg.strs = append(arg.strs, tok.s)
+
+		tok, err = p.lexer.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == tokenPunct && tok.s == "]" {
+			return arg, nil
+		} else if tok.kind != tokenPunct || tok.s != "," {
+			return nil, p.errorf(tok, "expected \",\" or \"]\", got %v", tok)
+		}
+	}
+}
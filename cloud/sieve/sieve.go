@@ -0,0 +1,174 @@
+// Package sieve implements the Sieve mail filtering language (RFC 5228).
+//
+// The following extensions are supported: fileinto, envelope, imap4flags
+// (RFC 5232), variables (RFC 5229), body (RFC 5173), relational (RFC 5231),
+// vacation (RFC 5230), date and index (RFC 5260), copy (RFC 3894) and reject
+// (RFC 5429).
+//
+// A script is executed against a message and its envelope, and produces a
+// list of actions. Applying the actions is left to the delivery code: Keep
+// and FileInto actions map to IMAP APPEND commands, with their flags;
+// Redirect and Vacation actions require sending messages.
+package sieve
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Error is a syntax or runtime error in a script.
+type Error struct {
+	Line    int
+	Message string
+}
+
+// Error implements the error interface.
+func (err *Error) Error() string {
+	return fmt.Sprintf("sieve: line %v: %v", err.Line, err.Message)
+}
+
+// Extensions returns the list of supported extensions, for instance to be
+// advertised by a ManageSieve server.
+func Extensions() []string {
+	l := make([]string, 0, len(extensions))
+	for ext := range extensions {
+		l = append(l, ext)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Script is a parsed Sieve script.
+type Script struct {
+	commands []*node
+	exts     map[string]bool
+}
+
+// Parse parses a script.
+func Parse(r io.Reader) (*Script, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{lexer: newLexer(string(b))}
+	commands, err := p.commands(false)
+	if err != nil {
+		return nil, err
+	}
+
+	c := compiler{exts: make(map[string]bool)}
+	commands, err = c.commands(commands, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{commands: commands, exts: c.exts}, nil
+}
+
+// Envelope contains the SMTP envelope of a message.
+type Envelope struct {
+	From string // empty for the null reverse-path
+	To   string // recipient the message is delivered to
+}
+
+// Options contains options for Script.Execute.
+type Options struct {
+	// Tracks vacation responses. If nil, a response is sent for each
+	// message.
+	VacationTracker VacationTracker
+	// Additional addresses of the user, for the vacation command.
+	Addresses []string
+	// Maximum number of redirect actions. If zero, 4 is used.
+	MaxRedirects int
+	// Time zone used by date tests. If nil, time.Local is used.
+	Location *time.Location
+
+	// Returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// Execute runs the script against a message, and returns the actions to
+// apply. An empty list means that the message is discarded.
+//
+// On error, the message should be kept, as if the script only contained a
+// keep command.
+func (s *Script) Execute(msg *Message, env *Envelope, options *Options) ([]Action, error) {
+	if options == nil {
+		options = new(Options)
+	}
+	r := &runtime{
+		script:       s,
+		msg:          msg,
+		env:          env,
+		options:      options,
+		vars:         make(map[string]string),
+		implicitKeep: true,
+		now:          time.Now(),
+	}
+	if options.Now != nil {
+		r.now = options.Now()
+	}
+	if err := r.commands(s.commands); err != nil && err != errStop {
+		return nil, err
+	}
+	if r.implicitKeep {
+		r.actions = appendAction(r.actions, &Keep{Flags: r.imapFlags(r.flags)})
+	}
+	return r.actions, nil
+}
+
+func isVariableName(name string) bool {
+	if name == "" || !isAlpha(name[0]) {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isAlpha(name[i]) && !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandVariables substitutes the variables in a string, as defined in RFC
+// 5229 section 3.
+func expandVariables(s string, lookup func(name string) string) string {
+	var sb strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			sb.WriteString(s)
+			return sb.String()
+		}
+		sb.WriteString(s[:start])
+		s = s[start:]
+
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			sb.WriteString(s)
+			return sb.String()
+		}
+		name := s[2:end]
+		if isVariableName(name) || isMatchVariable(name) {
+			sb.WriteString(lookup(asciiLower(name)))
+			s = s[end+1:]
+		} else {
+			sb.WriteString("${")
+			s = s[2:]
+		}
+	}
+}
+
+func isMatchVariable(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isDigit(name[i]) {
+			return false
+		}
+	}
+	return true
+}
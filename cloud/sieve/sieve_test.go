@@ -0,0 +1,429 @@
+package sieve
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/imap"
+)
+
+const testMessage = "Return-Path: <bounces@lists.example.org>\r\n" +
+	"Received: from mx.example.org by mx.example.com; Fri, 01 Mar 2024 12:00:05 +0000\r\n" +
+	"Received: from client.example.org by mx.example.org; Fri, 01 Mar 2024 11:59:58 +0000\r\n" +
+	"From: \"Sender\" <sender@example.org>\r\n" +
+	"To: alice@example.com, Bob <bob@example.com>\r\n" +
+	"Cc: team@Example.COM\r\n" +
+	"Subject: [acme-users] [fwd] version 1.0\r\n" +
+	" is out\r\n" +
+	"X-Spam-Score: 12\r\n" +
+	"X-Encoded: =?utf-8?q?caf=C3=A9?=\r\n" +
+	"Date: Fri, 01 Mar 2024 13:59:50 +0200\r\n" +
+	"Message-ID: <1234@example.org>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Hello, the release is =\r\nready.\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/html\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PGI+SGVsbG88L2I+\r\n" +
+	"--b--\r\n"
+
+var testEnvelope = &Envelope{From: "sender@example.org", To: "alice@example.com"}
+
+func execute(t *testing.T, script string, options *Options) []Action {
+	t.Helper()
+	s, err := Parse(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	msg, err := ReadMessage(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatalf("ReadMessage() = %v", err)
+	}
+	actions, err := s.Execute(msg, testEnvelope, options)
+	if err != nil {
+		t.Fatalf("Execute() = %v", err)
+	}
+	return actions
+}
+
+var executeTests = []struct {
+	name   string
+	script string
+	want   []Action
+}{
+	{
+		name:   "implicit keep",
+		script: `if header :contains "subject" "nope" { discard; }`,
+		want:   []Action{&Keep{}},
+	},
+	{
+		name:   "discard",
+		script: `if size :over 100 { discard; stop; } keep;`,
+		want:   nil,
+	},
+	{
+		name: "fileinto",
+		script: `require "fileinto";
+			if address :domain :is ["to", "cc"] "example.com" {
+				fileinto "Work";
+				fileinto "Work";
+			}`,
+		want: []Action{&FileInto{Mailbox: "Work"}},
+	},
+	{
+		name: "elsif",
+		script: `require ["fileinto"];
+			if exists "X-Nope" { fileinto "A"; }
+			elsif allof (exists ["From", "To"], not header :is "X-Spam-Score" "0") { fileinto "B"; }
+			else { fileinto "C"; }`,
+		want: []Action{&FileInto{Mailbox: "B"}},
+	},
+	{
+		name: "copy and redirect",
+		script: `require ["copy", "fileinto"];
+			fileinto :copy "Archive";
+			redirect :copy "carol@example.net";
+			redirect "dave@example.net";`,
+		want: []Action{
+			&FileInto{Mailbox: "Archive"},
+			&Redirect{Address: "carol@example.net"},
+			&Redirect{Address: "dave@example.net"},
+		},
+	},
+	{
+		name:   "header decoding",
+		script: `if header :is "x-encoded" "café" { discard; }`,
+		want:   nil,
+	},
+	{
+		name: "variables and matches",
+		script: `require ["fileinto", "variables"];
+			if header :matches "Subject" "[*] *" {
+				set :lower "list" "${1}";
+				set "rest" "${2}";
+			}
+			if string :is "${rest}" "[fwd] version 1.0 is out" {
+				fileinto "lists.${list}";
+			}`,
+		want: []Action{&FileInto{Mailbox: "lists.acme-users"}},
+	},
+	{
+		name: "set modifiers",
+		script: `require ["fileinto", "variables"];
+			set :upperfirst "a" "hello";
+			set :length "b" "${a}";
+			set :quotewildcard "c" "a*b";
+			fileinto "${a}-${b}-${c}-${unknown}";`,
+		want: []Action{&FileInto{Mailbox: `Hello-5-a\*b-`}},
+	},
+	{
+		name: "relational",
+		script: `require ["fileinto", "relational", "comparator-i;ascii-numeric"];
+			if header :value "ge" :comparator "i;ascii-numeric" "X-Spam-Score" "10" {
+				fileinto "Junk";
+			}
+			if address :count "eq" :comparator "i;ascii-numeric" "to" "2" {
+				fileinto "Two";
+			}`,
+		want: []Action{&FileInto{Mailbox: "Junk"}, &FileInto{Mailbox: "Two"}},
+	},
+	{
+		name: "body",
+		script: `require ["body", "fileinto"];
+			if body :text :contains "release is ready" { fileinto "Text"; }
+			if body :content "text/html" :contains "<b>" { fileinto "HTML"; }
+			if body :raw :contains "release is =" { fileinto "Raw"; }
+			if body :text :contains "release is =" { fileinto "Nope"; }`,
+		want: []Action{&FileInto{Mailbox: "Text"}, &FileInto{Mailbox: "HTML"}, &FileInto{Mailbox: "Raw"}},
+	},
+	{
+		name: "imap4flags",
+		script: `require ["imap4flags", "fileinto"];
+			setflag "\\Seen";
+			addflag ["\\Flagged Work", "\\seen"];
+			removeflag "Work";
+			if hasflag :is "\\flagged" {
+				fileinto "Flagged";
+			}
+			fileinto :flags "\\Answered" "Answered";
+			addflag "myflags" "a b";
+			if hasflag "myflags" "b" { keep; }`,
+		want: []Action{
+			&FileInto{Mailbox: "Flagged", Flags: []imap.Flag{"\\Seen", "\\Flagged"}},
+			&FileInto{Mailbox: "Answered", Flags: []imap.Flag{"\\Answered"}},
+			&Keep{Flags: []imap.Flag{"\\Seen", "\\Flagged"}},
+		},
+	},
+	{
+		name: "envelope",
+		script: `require ["envelope", "fileinto"];
+			if envelope :localpart :is "from" "sender" { fileinto "A"; }
+			if envelope :domain :is "to" "example.net" { fileinto "B"; }`,
+		want: []Action{&FileInto{Mailbox: "A"}},
+	},
+	{
+		name: "date and index",
+		script: `require ["date", "index", "relational", "fileinto"];
+			if date :originalzone "date" "zone" "+0200" { fileinto "A"; }
+			if date :zone "+0000" "date" "time" "11:59:50" { fileinto "B"; }
+			if date :index 1 :last :zone "+0000" "received" "second" "58" { fileinto "C"; }
+			if currentdate :zone "+0100" :value "eq" "date" "2024-03-02" { fileinto "D"; }`,
+		want: []Action{&FileInto{Mailbox: "A"}, &FileInto{Mailbox: "B"}, &FileInto{Mailbox: "C"}, &FileInto{Mailbox: "D"}},
+	},
+	{
+		name:   "reject",
+		script: `require "reject"; if header :contains "subject" "acme" { reject "Go away"; }`,
+		want:   []Action{&Reject{Reason: "Go away"}},
+	},
+	{
+		name:   "multi-line string",
+		script: "require \"reject\";\r\nreject text:\r\nNo thanks.\r\n..\r\n.\r\n;",
+		want:   []Action{&Reject{Reason: "No thanks.\r\n.\r\n"}},
+	},
+}
+
+func TestExecute(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+	for _, tc := range executeTests {
+		t.Run(tc.name, func(t *testing.T) {
+			actions := execute(t, tc.script, &Options{Now: func() time.Time { return now }})
+			if !reflect.DeepEqual(actions, tc.want) {
+				t.Errorf("Execute() = %v, want %v", actionsString(actions), actionsString(tc.want))
+			}
+		})
+	}
+}
+
+func actionsString(l []Action) string {
+	var sb strings.Builder
+	for _, action := range l {
+		sb.WriteString(fmtAction(action))
+		sb.WriteString(" ")
+	}
+	return sb.String()
+}
+
+func fmtAction(action Action) string {
+	switch action := action.(type) {
+	case *Keep:
+		return "keep" + flagsString(action.Flags)
+	case *FileInto:
+		return "fileinto(" + action.Mailbox + ")" + flagsString(action.Flags)
+	case *Redirect:
+		return "redirect(" + action.Address + ")"
+	case *Reject:
+		return "reject(" + action.Reason + ")"
+	case *Vacation:
+		return "vacation(" + action.To + ")"
+	}
+	return "?"
+}
+
+func flagsString(flags []imap.Flag) string {
+	if len(flags) == 0 {
+		return ""
+	}
+	l := make([]string, len(flags))
+	for i, flag := range flags {
+		l[i] = string(flag)
+	}
+	return "[" + strings.Join(l, " ") + "]"
+}
+
+func TestParseError(t *testing.T) {
+	for _, script := range []string{
+		`fileinto "INBOX";`,
+		`keep`,
+		`if true keep;`,
+		`else { keep; }`,
+		`keep; require "fileinto";`,
+		`require "foo";`,
+		`if header :is :contains "a" "b" { keep; }`,
+		`if header :foo "a" "b" { keep; }`,
+		`if header "a" { keep; }`,
+		`if size 100 { keep; }`,
+		`require "relational"; if header :count "xx" "a" "b" { keep; }`,
+		`if header :comparator "i;ascii-numeric" "a" "b" { keep; }`,
+		`if header :last "a" "b" { keep; }`,
+		`redirect "a" /* unterminated`,
+		`require "variables"; set "1" "a";`,
+		`require "envelope"; if envelope "auth" "a" { keep; }`,
+	} {
+		_, err := Parse(strings.NewReader(script))
+		if err == nil {
+			t.Errorf("Parse(%q) = nil, want error", script)
+		} else if _, ok := err.(*Error); !ok {
+			t.Errorf("Parse(%q) = %T, want *Error", script, err)
+		}
+	}
+}
+
+func TestVacation(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	options := &Options{
+		VacationTracker: NewMemoryVacationTracker(),
+		Now:             func() time.Time { return now },
+	}
+	script := `require "vacation";
+		vacation :days 3 :addresses "team@example.com" "I'm away.";`
+
+	actions := execute(t, script, options)
+	if len(actions) != 2 {
+		t.Fatalf("Execute() = %v, want vacation and keep", actionsString(actions))
+	}
+	v, ok := actions[0].(*Vacation)
+	if !ok {
+		t.Fatalf("Execute() = %v, want vacation first", actionsString(actions))
+	}
+	want := &Vacation{
+		From:      "<alice@example.com>",
+		To:        "sender@example.org",
+		Subject:   "Auto: [acme-users] [fwd] version 1.0 is out",
+		Body:      "I'm away.",
+		InReplyTo: "<1234@example.org>",
+		Date:      now,
+	}
+	if !reflect.DeepEqual(v, want) {
+		t.Errorf("vacation = %+v, want %+v", v, want)
+	}
+
+	var sb strings.Builder
+	if err := v.Write(&sb); err != nil {
+		t.Fatalf("Vacation.Write() = %v", err)
+	}
+	for _, s := range []string{"To: <sender@example.org>\r\n", "Auto-Submitted: auto-replied", "In-Reply-To: <1234@example.org>\r\n", "\r\n\r\nI'm away."} {
+		if !strings.Contains(sb.String(), s) {
+			t.Errorf("vacation response doesn't contain %q:\n%v", s, sb.String())
+		}
+	}
+
+	// A second message within the period doesn't trigger a response
+	now = now.Add(48 * time.Hour)
+	if actions := execute(t, script, options); len(actions) != 1 {
+		t.Errorf("Execute() = %v, want keep only", actionsString(actions))
+	}
+	now = now.Add(48 * time.Hour)
+	if actions := execute(t, script, options); len(actions) != 2 {
+		t.Errorf("Execute() = %v, want vacation and keep", actionsString(actions))
+	}
+}
+
+func TestMemoryVacationTracker(t *testing.T) {
+	tracker := NewMemoryVacationTracker()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	track := func(rcpt, addr string) bool {
+		t.Helper()
+		ok, err := tracker.Track("h", rcpt, addr, now, 24*time.Hour)
+		if err != nil {
+			t.Fatalf("Track() = %v", err)
+		}
+		return ok
+	}
+
+	if !track("alice@example.com", "sender@example.org") {
+		t.Errorf("Track() = false for a first response")
+	}
+	if track("alice@example.com", "Sender@example.org") {
+		t.Errorf("Track() = true for a second response within the period")
+	}
+	if !track("bob@example.com", "sender@example.org") {
+		t.Errorf("Track() = false for a response from another recipient")
+	}
+
+	now = now.Add(25 * time.Hour)
+	if !track("alice@example.com", "other@example.org") {
+		t.Errorf("Track() = false for a first response")
+	}
+	if n := len(tracker.expires); n != 1 {
+		t.Errorf("got %v entries after the period, want 1", n)
+	}
+}
+
+func TestVacationSkipped(t *testing.T) {
+	script := `require "vacation"; vacation "I'm away.";`
+	s, err := Parse(strings.NewReader(script))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		msg  string
+		env  *Envelope
+	}{
+		{"list", "List-Id: <acme.example.org>\r\nTo: alice@example.com\r\n\r\n", testEnvelope},
+		{"auto-submitted", "Auto-Submitted: auto-generated\r\nTo: alice@example.com\r\n\r\n", testEnvelope},
+		{"not addressed", "To: other@example.com\r\n\r\n", testEnvelope},
+		{"null sender", "To: alice@example.com\r\n\r\n", &Envelope{To: "alice@example.com"}},
+		{"daemon", "To: alice@example.com\r\n\r\n", &Envelope{From: "MAILER-DAEMON@example.org", To: "alice@example.com"}},
+	} {
+		msg, err := ReadMessage(strings.NewReader(tc.msg))
+		if err != nil {
+			t.Fatalf("ReadMessage() = %v", err)
+		}
+		actions, err := s.Execute(msg, tc.env, nil)
+		if err != nil {
+			t.Fatalf("Execute() = %v", err)
+		}
+		if len(actions) != 1 {
+			t.Errorf("%v: Execute() = %v, want keep only", tc.name, actionsString(actions))
+		}
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, value string
+		want           []string
+	}{
+		{"*", "abc", []string{"abc", "abc"}},
+		{"a?c", "abc", []string{"abc", "b"}},
+		{"*<*@*>", "Bob <bob@example.com>", []string{"Bob <bob@example.com>", "Bob ", "bob", "example.com"}},
+		{"a\\*", "a*", []string{"a*"}},
+		{"a\\*", "ab", nil},
+		{"?", "é", []string{"é", "é"}},
+		{"*b", "abc", nil},
+		{"*a*b*", "xaxxbab", []string{"xaxxbab", "x", "xx", "ab"}},
+		{"a*", "", nil},
+		{"**", "", []string{"", "", ""}},
+		{"*?", "ab", []string{"ab", "a", "b"}},
+	} {
+		ok, captures := matchWildcard(tc.pattern, tc.value, tc.value)
+		if ok != (tc.want != nil) || !reflect.DeepEqual(captures, tc.want) {
+			t.Errorf("matchWildcard(%q, %q) = %v, %q, want %q", tc.pattern, tc.value, ok, captures, tc.want)
+		}
+	}
+}
+
+func TestMatchWildcardPathological(t *testing.T) {
+	pattern := "*a*a*a*a*a*a*a*b"
+	value := strings.Repeat("a", 400)
+
+	done := make(chan bool)
+	go func() {
+		ok, _ := matchWildcard(pattern, value, value)
+		done <- ok
+	}()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Errorf("matchWildcard(%q, %q) = true, want false", pattern, value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("matchWildcard(%q, %q) did not return", pattern, value)
+	}
+
+	value += "b"
+	if ok, captures := matchWildcard(pattern, value, value); !ok || len(captures) != 9 || captures[8] != strings.Repeat("a", 393) {
+		t.Errorf("matchWildcard(%q, %q) = %v, %q", pattern, value, ok, captures)
+	}
+}
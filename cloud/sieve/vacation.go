@@ -0,0 +1,155 @@
+package sieve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vacation sends an automatic response to the sender of the message, as
+// defined in RFC 5230.
+type Vacation struct {
+	From    string // address the response is sent from
+	To      string // original sender, recipient of the response
+	Subject string
+	// Body of the response. If MIME is set, it's a MIME entity including
+	// header fields, otherwise it's UTF-8 text.
+	Body      string
+	MIME      bool
+	InReplyTo string // message ID of the original message
+	Date      time.Time
+}
+
+// Write writes the response message.
+func (v *Vacation) Write(w io.Writer) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "From: %s\r\n", v.From)
+	fmt.Fprintf(&sb, "To: <%s>\r\n", v.To)
+	fmt.Fprintf(&sb, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", v.Subject))
+	fmt.Fprintf(&sb, "Date: %s\r\n", v.Date.Format(time.RFC1123Z))
+	sb.WriteString("Auto-Submitted: auto-replied (vacation)\r\n")
+	if v.InReplyTo != "" {
+		fmt.Fprintf(&sb, "In-Reply-To: %s\r\n", v.InReplyTo)
+		fmt.Fprintf(&sb, "References: %s\r\n", v.InReplyTo)
+	}
+	sb.WriteString("MIME-Version: 1.0\r\n")
+	if !v.MIME {
+		sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		sb.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+		sb.WriteString("\r\n")
+	}
+	sb.WriteString(v.Body)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// VacationTracker keeps track of the vacation responses sent, so that a
+// sender gets at most one response per period.
+type VacationTracker interface {
+	// Track reports whether a response identified by handle should be sent by
+	// the recipient rcpt to addr, and records it if so.
+	Track(handle, rcpt, addr string, now time.Time, period time.Duration) (bool, error)
+}
+
+// MemoryVacationTracker is an in-memory VacationTracker. Expired entries are
+// pruned periodically.
+type MemoryVacationTracker struct {
+	mutex     sync.Mutex
+	expires   map[[3]string]time.Time
+	lastPrune time.Time
+}
+
+var _ VacationTracker = (*MemoryVacationTracker)(nil)
+
+// NewMemoryVacationTracker creates a new in-memory vacation tracker.
+func NewMemoryVacationTracker() *MemoryVacationTracker {
+	return &MemoryVacationTracker{expires: make(map[[3]string]time.Time)}
+}
+
+// Track implements VacationTracker.
+func (t *MemoryVacationTracker) Track(handle, rcpt, addr string, now time.Time, period time.Duration) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if now.Sub(t.lastPrune) >= time.Hour {
+		for k, expires := range t.expires {
+			if !now.Before(expires) {
+				delete(t.expires, k)
+			}
+		}
+		t.lastPrune = now
+	}
+
+	k := [3]string{handle, asciiLower(rcpt), asciiLower(addr)}
+	if expires, ok := t.expires[k]; ok && now.Before(expires) {
+		return false, nil
+	}
+	t.expires[k] = now.Add(period)
+	return true, nil
+}
+
+// vacationHandle returns the default handle of a vacation command, derived
+// from its arguments.
+func vacationHandle(reason, subject, from string, mime bool) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q %q %v", reason, subject, from, mime)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// isAutomatedSender reports whether a response must not be sent to an
+// address, because it's used by mailing lists or mail daemons.
+func isAutomatedSender(addr string) bool {
+	localPart, _ := splitAddress(asciiLower(addr))
+	switch {
+	case localPart == "", localPart == "mailer-daemon", localPart == "postmaster", localPart == "listserv", localPart == "majordomo":
+		return true
+	case strings.HasPrefix(localPart, "owner-"), strings.HasSuffix(localPart, "-request"):
+		return true
+	}
+	return false
+}
+
+// isAutomatedMessage reports whether a message was sent automatically or by
+// a mailing list.
+func (msg *Message) isAutomatedMessage() bool {
+	for _, v := range msg.values("Auto-Submitted", 0, false) {
+		if !strings.EqualFold(strings.TrimSpace(v), "no") {
+			return true
+		}
+	}
+	for _, v := range msg.values("Precedence", 0, false) {
+		switch asciiLower(strings.TrimSpace(v)) {
+		case "bulk", "list", "junk":
+			return true
+		}
+	}
+	for _, k := range []string{"List-Id", "List-Help", "List-Post", "List-Unsubscribe", "List-Subscribe", "List-Owner", "List-Archive"} {
+		if len(msg.fields(k, 0, false)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// isAddressedTo reports whether one of the user's addresses appears in the
+// recipient header fields of the message.
+func (msg *Message) isAddressedTo(userAddrs []string) bool {
+	for _, k := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, v := range msg.fields(k, 0, false) {
+			l, _ := addresses(v)
+			for _, addr := range l {
+				for _, userAddr := range userAddrs {
+					if strings.EqualFold(addr, userAddr) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
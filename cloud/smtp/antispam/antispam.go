@@ -0,0 +1,103 @@
+// Package antispam provides smtp.Backend wrappers protecting backends from
+// abuse: greylisting and rate limiting.
+//
+// The wrappers are composable, e.g.:
+//
+//	be = antispam.NewLimiter(antispam.NewGreylist(be, antispam.NewMemoryStore()))
+//
+// Rejections are temporary failures (*smtp.SMTPError with a 4xx code), so
+// legitimate clients retry later.
+package antispam
+
+import (
+	"io"
+	"net"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// UserSession is an optional interface for sessions, reporting the
+// authenticated user. Sessions returned by the wrappers of this package
+// implement it by forwarding to the wrapped session.
+type UserSession interface {
+	smtp.Session
+
+	// User returns the authenticated user, or an empty string.
+	User() string
+}
+
+// session wraps a backend session. The optional AuthSession, LMTPSession and
+// UserSession interfaces are forwarded to the wrapped session.
+type session struct {
+	smtp.Session
+}
+
+var (
+	_ smtp.AuthSession = session{}
+	_ smtp.LMTPSession = session{}
+	_ UserSession      = session{}
+)
+
+func (s session) AuthMechanisms() []string {
+	if as, ok := s.Session.(smtp.AuthSession); ok {
+		return as.AuthMechanisms()
+	}
+	return nil
+}
+
+func (s session) Auth(mech string) (sasl.Server, error) {
+	if as, ok := s.Session.(smtp.AuthSession); ok {
+		return as.Auth(mech)
+	}
+	return nil, smtp.ErrAuthUnsupported
+}
+
+func (s session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	if ls, ok := s.Session.(smtp.LMTPSession); ok {
+		return ls.LMTPData(r, status)
+	}
+	// The server uses this error for all recipients
+	return s.Session.Data(r)
+}
+
+func (s session) User() string {
+	if us, ok := s.Session.(UserSession); ok {
+		return us.User()
+	}
+	return ""
+}
+
+// sessionUser returns the authenticated user of a session. The login name
+// sent by a proxy with XCLIENT is used as a fallback.
+func sessionUser(c *smtp.Conn, s smtp.Session) string {
+	if us, ok := s.(UserSession); ok {
+		if user := us.User(); user != "" {
+			return user
+		}
+	}
+	if info := c.XClient(); info != nil {
+		return info.Login
+	}
+	return ""
+}
+
+// clientIP returns the IP address of the client, or nil if the client isn't
+// connected over TCP.
+func clientIP(c *smtp.Conn) net.IP {
+	addr, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return addr.IP
+}
+
+// networkKey returns the network of an IP address: the /24 for IPv4 and the
+// /64 for IPv6, as clients may retry from a different address of the same
+// network.
+func networkKey(ip net.IP, v4Bits int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(v4Bits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -0,0 +1,152 @@
+package antispam
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type backend struct{}
+
+func (backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return testSession{}, nil
+}
+
+type testSession struct{}
+
+func (testSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (testSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (testSession) Data(r io.Reader) error                         { return nil }
+func (testSession) Reset()                                         {}
+func (testSession) Logout() error                                  { return nil }
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newLocalListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ln, err = net.Listen("tcp6", "[::1]:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func testServer(t *testing.T, be smtp.Backend) string {
+	l := newLocalListener(t)
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *smtp.Client {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestGreylist(t *testing.T) {
+	clk := &clock{now: time.Now()}
+	g := NewGreylist(backend{}, NewMemoryStore())
+	g.Now = clk.Now
+	c := dial(t, testServer(t, g))
+	var smtpErr *smtp.SMTPError
+
+	rcpt := func(from, to string) error {
+		defer c.Reset()
+		if err := c.Mail(from, nil); err != nil {
+			t.Fatalf("Mail() = %v", err)
+		}
+		return c.Rcpt(to, nil)
+	}
+
+	if err := rcpt("sender@example.org", "rcpt@example.com"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("first attempt: Rcpt() = %v, want 451", err)
+	}
+	clk.now = clk.now.Add(time.Minute)
+	if err := rcpt("sender@example.org", "rcpt@example.com"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("early retry: Rcpt() = %v, want 451", err)
+	}
+	clk.now = clk.now.Add(5 * time.Minute)
+	if err := rcpt("sender@example.org", "rcpt@example.com"); err != nil {
+		t.Fatalf("retry: Rcpt() = %v", err)
+	}
+	// The triplet is whitelisted
+	clk.now = clk.now.Add(7 * 24 * time.Hour)
+	if err := rcpt("Sender@example.org", "rcpt@example.com"); err != nil {
+		t.Fatalf("whitelisted: Rcpt() = %v", err)
+	}
+	if err := rcpt("sender@example.org", "other@example.com"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("other triplet: Rcpt() = %v, want 451", err)
+	}
+	// Retries after the retry window are greylisted again
+	clk.now = clk.now.Add(72 * time.Hour)
+	if err := rcpt("sender@example.org", "other@example.com"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatalf("late retry: Rcpt() = %v, want 451", err)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	clk := &clock{now: time.Now()}
+	l := NewLimiter(backend{})
+	l.Now = clk.Now
+	l.IPConnections = Limit{Interval: time.Minute, Burst: 2}
+	l.IP.Recipients = Limit{Interval: time.Minute, Burst: 3}
+	l.SenderDomain.Messages = Limit{Interval: time.Hour, Burst: 1}
+	addr := testServer(t, l)
+	var smtpErr *smtp.SMTPError
+
+	c := dial(t, addr)
+	if err := c.Mail("sender@example.org", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Rcpt("rcpt@example.com", nil); err != nil {
+			t.Fatalf("Rcpt() #%v = %v", i, err)
+		}
+	}
+	if err := c.Rcpt("rcpt@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 450 {
+		t.Errorf("Rcpt() = %v, want 450", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatalf("Reset() = %v", err)
+	}
+
+	if err := c.Mail("other@EXAMPLE.ORG", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 450 {
+		t.Errorf("Mail() = %v, want 450", err)
+	}
+	if err := c.Mail("sender@example.net", nil); err != nil {
+		t.Errorf("Mail() with other domain = %v", err)
+	}
+	// Tokens are refilled over time
+	clk.now = clk.now.Add(time.Minute)
+	if err := c.Rcpt("rcpt@example.com", nil); err != nil {
+		t.Errorf("Rcpt() after refill = %v", err)
+	}
+
+	// Sessions are counted with EHLO, the bucket has been refilled
+	for i := 0; i < 2; i++ {
+		if err := dial(t, addr).Hello("localhost"); err != nil {
+			t.Fatalf("Hello() #%v = %v", i, err)
+		}
+	}
+	if err := dial(t, addr).Hello("localhost"); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Errorf("Hello() = %v, want 421", err)
+	}
+}
@@ -0,0 +1,199 @@
+package antispam
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Entry is the greylisting state of a triplet.
+type Entry struct {
+	// Time of the first delivery attempt.
+	FirstSeen time.Time
+	// Whether a delivery attempt was accepted. The triplet is then
+	// whitelisted.
+	Passed bool
+	// The entry must be ignored after this time.
+	Expires time.Time
+}
+
+// Store stores greylisting entries. It must be safe for concurrent use.
+type Store interface {
+	// Get returns the entry for a key, or nil if there is none.
+	Get(key string) (*Entry, error)
+	// Put creates or replaces the entry for a key.
+	Put(key string, entry *Entry) error
+}
+
+// MemoryStore is an in-memory Store. Expired entries are pruned
+// periodically.
+type MemoryStore struct {
+	mutex     sync.Mutex
+	entries   map[string]*Entry
+	lastPrune time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates a new empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*Entry)}
+}
+
+// Get implements Store.
+func (s *MemoryStore) Get(key string) (*Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := *e
+	return &entry, nil
+}
+
+// Put implements Store.
+func (s *MemoryStore) Put(key string, entry *Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	e := *entry
+	s.entries[key] = &e
+
+	if now := time.Now(); now.Sub(s.lastPrune) >= time.Hour {
+		for k, e := range s.entries {
+			if now.After(e.Expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastPrune = now
+	}
+	return nil
+}
+
+// Greylist is a backend wrapper implementing greylisting: the first delivery
+// attempt for a (client network, sender, recipient) triplet is temporarily
+// rejected, and accepted when retried after a delay. Legitimate MTAs retry,
+// most spam software doesn't.
+//
+// Clients without an IP address (e.g. over a Unix socket) aren't greylisted.
+type Greylist struct {
+	Backend smtp.Backend
+	Store   Store
+
+	// Minimum delay before a retry is accepted.
+	Delay time.Duration
+	// Maximum delay for a retry. Later retries are greylisted again.
+	RetryWindow time.Duration
+	// How long a triplet stays whitelisted after an accepted delivery.
+	WhitelistTTL time.Duration
+	// If set, returns true for sessions which must not be greylisted, e.g.
+	// authenticated users.
+	Exempt func(c *smtp.Conn, s smtp.Session) bool
+
+	// Returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+var _ smtp.Backend = (*Greylist)(nil)
+
+// NewGreylist creates a new greylisting backend wrapper, with a delay of 5
+// minutes, a retry window of 2 days and a whitelist TTL of 35 days.
+func NewGreylist(be smtp.Backend, store Store) *Greylist {
+	return &Greylist{
+		Backend:      be,
+		Store:        store,
+		Delay:        5 * time.Minute,
+		RetryWindow:  48 * time.Hour,
+		WhitelistTTL: 35 * 24 * time.Hour,
+	}
+}
+
+func (g *Greylist) now() time.Time {
+	if g.Now != nil {
+		return g.Now()
+	}
+	return time.Now()
+}
+
+// NewSession implements smtp.Backend.
+func (g *Greylist) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := g.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &greylistSession{session: session{s}, greylist: g, conn: c}, nil
+}
+
+// check checks a triplet, and updates its entry.
+func (g *Greylist) check(network, from, to string) error {
+	key := strings.Join([]string{network, strings.ToLower(from), strings.ToLower(to)}, "\x00")
+	entry, err := g.Store.Get(key)
+	if err != nil {
+		return storeError(err)
+	}
+
+	now := g.now()
+	if entry == nil || now.After(entry.Expires) {
+		entry = &Entry{FirstSeen: now, Expires: now.Add(g.RetryWindow)}
+	} else if entry.Passed || now.Sub(entry.FirstSeen) >= g.Delay {
+		entry.Passed = true
+		entry.Expires = now.Add(g.WhitelistTTL)
+		if err := g.Store.Put(key, entry); err != nil {
+			return storeError(err)
+		}
+		return nil
+	}
+
+	if err := g.Store.Put(key, entry); err != nil {
+		return storeError(err)
+	}
+	wait := entry.FirstSeen.Add(g.Delay).Sub(now).Round(time.Second)
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      fmt.Sprintf("Greylisted, please try again in %v", wait),
+	}
+}
+
+func storeError(err error) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      fmt.Sprintf("Greylisting temporarily unavailable: %v", err),
+	}
+}
+
+type greylistSession struct {
+	session
+	greylist *Greylist
+	conn     *smtp.Conn
+	from     string
+}
+
+func (s *greylistSession) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.Session.Mail(from, opts); err != nil {
+		return err
+	}
+	s.from = from
+	return nil
+}
+
+func (s *greylistSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	ip := clientIP(s.conn)
+	exempt := s.greylist.Exempt != nil && s.greylist.Exempt(s.conn, s.Session)
+	if ip != nil && !exempt {
+		if err := s.greylist.check(networkKey(ip, 24), s.from, to); err != nil {
+			return err
+		}
+	}
+	return s.Session.Rcpt(to, opts)
+}
+
+func (s *greylistSession) Reset() {
+	s.from = ""
+	s.Session.Reset()
+}
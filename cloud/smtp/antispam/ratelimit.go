@@ -0,0 +1,226 @@
+package antispam
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Limit is a token bucket rate limit: up to Burst events are allowed at
+// once, and one more event is allowed every Interval. The zero value means
+// no limit.
+type Limit struct {
+	Interval time.Duration
+	Burst    int
+}
+
+func (l Limit) enabled() bool {
+	return l.Interval > 0 && l.Burst > 0
+}
+
+// Limits are the rate limits of a client, user or sender domain.
+type Limits struct {
+	// Messages, counted with the MAIL command.
+	Messages Limit
+	// Recipients, counted with the RCPT command.
+	Recipients Limit
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a backend wrapper rate limiting connections, messages and
+// recipients.
+//
+// Clients are identified by their IP address (the /64 network for IPv6).
+// Users are identified with the UserSession interface, or the XCLIENT login
+// name.
+type Limiter struct {
+	Backend smtp.Backend
+
+	// Connections per client IP address.
+	IPConnections Limit
+	// Messages and recipients per client IP address.
+	IP Limits
+	// Messages and recipients per authenticated user.
+	User Limits
+	// Messages and recipients per sender domain.
+	SenderDomain Limits
+
+	// Returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+var _ smtp.Backend = (*Limiter)(nil)
+
+// NewLimiter creates a new rate limiting backend wrapper, without any limit.
+func NewLimiter(be smtp.Backend) *Limiter {
+	return &Limiter{
+		Backend: be,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// limitKey identifies a bucket: subject is a client IP address, user or
+// sender domain, depending on kind.
+type limitKey struct {
+	kind, subject string
+	limit         Limit
+}
+
+// allow takes a token from each bucket counting what, if all of them have one.
+// Otherwise, no token is taken and the index of the first empty bucket is
+// returned.
+func (l *Limiter) allow(what string, keys []limitKey) (ok bool, i int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	buckets := make([]*bucket, len(keys))
+	for i, k := range keys {
+		key := strings.Join([]string{what, k.kind, k.subject}, "\x00")
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &bucket{tokens: float64(k.limit.Burst), last: now}
+			l.buckets[key] = b
+		}
+		b.tokens += float64(now.Sub(b.last)) / float64(k.limit.Interval)
+		if b.tokens > float64(k.limit.Burst) {
+			b.tokens = float64(k.limit.Burst)
+		}
+		b.last = now
+
+		if b.tokens < 1 {
+			return false, i
+		}
+		buckets[i] = b
+	}
+
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// prune deletes buckets which haven't been used for a while. A bucket is
+// full again after Burst*Interval, so deleting it doesn't change the limit
+// as long as this delay is below the pruning age.
+func (l *Limiter) prune(now time.Time) {
+	const maxAge = 24 * time.Hour
+	if now.Sub(l.lastPrune) < time.Hour {
+		return
+	}
+	for k, b := range l.buckets {
+		if now.Sub(b.last) >= maxAge {
+			delete(l.buckets, k)
+		}
+	}
+	l.lastPrune = now
+}
+
+// check applies limits, and returns an error if one is exceeded.
+func (l *Limiter) check(what string, keys []limitKey) error {
+	var enabled []limitKey
+	for _, k := range keys {
+		if k.limit.enabled() && k.subject != "" {
+			enabled = append(enabled, k)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+
+	ok, i := l.allow(what, enabled)
+	if ok {
+		return nil
+	}
+	return &smtp.SMTPError{
+		Code:         450,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      fmt.Sprintf("Too many %v from this %v, try again later", what, enabled[i].kind),
+	}
+}
+
+// NewSession implements smtp.Backend.
+func (l *Limiter) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	ip := clientIP(c)
+	var ipKey string
+	if ip != nil {
+		ipKey = networkKey(ip, 32)
+	}
+
+	if ipKey != "" && l.IPConnections.enabled() {
+		if ok, _ := l.allow("connections", []limitKey{{"client", ipKey, l.IPConnections}}); !ok {
+			return nil, &smtp.SMTPError{
+				Code:         421,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      "Too many connections from this client, try again later",
+			}
+		}
+	}
+
+	s, err := l.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &limiterSession{session: session{s}, limiter: l, conn: c, ip: ipKey}, nil
+}
+
+type limiterSession struct {
+	session
+	limiter *Limiter
+	conn    *smtp.Conn
+	ip      string
+	user    string
+	domain  string
+}
+
+// keys returns the keys of the buckets for a kind of limit.
+func (s *limiterSession) keys(limit func(Limits) Limit) []limitKey {
+	l := s.limiter
+	return []limitKey{
+		{"client", s.ip, limit(l.IP)},
+		{"user", s.user, limit(l.User)},
+		{"sender domain", s.domain, limit(l.SenderDomain)},
+	}
+}
+
+func (s *limiterSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.user = sessionUser(s.conn, s.Session)
+	s.domain = ""
+	if i := strings.LastIndexByte(from, '@'); i >= 0 {
+		s.domain = strings.ToLower(from[i+1:])
+	}
+
+	keys := s.keys(func(l Limits) Limit { return l.Messages })
+	if err := s.limiter.check("messages", keys); err != nil {
+		return err
+	}
+	return s.Session.Mail(from, opts)
+}
+
+func (s *limiterSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	keys := s.keys(func(l Limits) Limit { return l.Recipients })
+	if err := s.limiter.check("recipients", keys); err != nil {
+		return err
+	}
+	return s.Session.Rcpt(to, opts)
+}
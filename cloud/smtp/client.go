@@ -5,6 +5,7 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -35,13 +36,24 @@ type Client struct {
 	didHello   bool              // whether we've said HELO/EHLO/LHLO
 	helloError error             // the error from the hello
 	rcpts      []string          // recipients accumulated for the current session
+	binaryMIME bool              // whether the current transaction uses BODY=BINARYMIME
+	deadline   time.Time         // deadline of the context of the current call
 
 	// Time to wait for command responses (this includes 3xx reply to DATA).
 	CommandTimeout time.Duration
 	// Time to wait for responses after final dot.
 	SubmissionTimeout time.Duration
 
+	// Maximum size of BDAT chunks. If the server supports CHUNKING (RFC 3030),
+	// messages are sent with BDAT commands instead of DATA. If zero, DATA is
+	// used, unless the message is sent with BODY=BINARYMIME.
+	ChunkSize int
+
 	// Logger for all network activity.
+	//
+	// If DebugWriter also provides IngressWriter and EgressWriter methods
+	// (see mailtest.Recorder), data received from the server is written to
+	// the former and data sent to the server to the latter.
 	DebugWriter io.Writer
 }
 
@@ -55,7 +67,12 @@ var defaultDialer = net.Dialer{Timeout: 30 * time.Second}
 // This function returns a plaintext connection. To enable TLS, use
 // DialStartTLS.
 func Dial(addr string) (*Client, error) {
-	conn, err := defaultDialer.Dial("tcp", addr)
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is like Dial, but uses the provided context to connect.
+func DialContext(ctx context.Context, addr string) (*Client, error) {
+	conn, err := defaultDialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -140,6 +157,24 @@ func initStartTLS(c *Client, tlsConfig *tls.Config) error {
 	return nil
 }
 
+// StartTLS sends the STARTTLS command, encrypts all further communication and
+// sends a new EHLO. Only servers that advertise the STARTTLS extension support
+// this function.
+//
+// Unlike NewClientStartTLS, it allows Hello to be called first. TLS handshake
+// errors are reported by StartTLS itself rather than by the next command, so
+// that opportunistic clients can retry on a new connection without TLS.
+//
+// A nil config is equivalent to a zero tls.Config.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if err := initStartTLS(c, config); err != nil {
+		return err
+	}
+	return c.hello()
+}
+
 // NewClientLMTP returns a new LMTP Client (as defined in RFC 2033) using an
 // existing connection and host as a server name to be used when authenticating.
 func NewClientLMTP(conn net.Conn) *Client {
@@ -161,8 +196,8 @@ func (c *Client) setConn(conn net.Conn) {
 		LineLimit: 2000,
 	}
 
-	r = io.TeeReader(r, clientDebugWriter{c})
-	w = io.MultiWriter(w, clientDebugWriter{c})
+	r = io.TeeReader(r, clientDebugWriter{c, true})
+	w = io.MultiWriter(w, clientDebugWriter{c, false})
 
 	rwc := struct {
 		io.Reader
@@ -181,14 +216,61 @@ func (c *Client) Close() error {
 	return c.text.Close()
 }
 
+// setDeadline sets the connection deadline for an operation lasting at most
+// timeout. The deadline of the context of the current call takes precedence
+// if it's earlier.
+func (c *Client) setDeadline(timeout time.Duration) {
+	t := time.Now().Add(timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(t) {
+		t = c.deadline
+	}
+	c.conn.SetDeadline(t)
+}
+
+// resetDeadline resets the connection deadline at the end of an operation.
+func (c *Client) resetDeadline() {
+	c.conn.SetDeadline(c.deadline)
+}
+
+// withContext runs f, applying the deadline of ctx to the connection. If ctx
+// is done before f returns, the connection is closed, since the protocol state
+// is unknown, and the context error is returned.
+func (c *Client) withContext(ctx context.Context, stage string, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("smtp: %v: %w", stage, err)
+	}
+
+	c.deadline, _ = ctx.Deadline()
+	c.conn.SetDeadline(c.deadline)
+	defer func() {
+		c.deadline = time.Time{}
+		c.conn.SetDeadline(time.Time{})
+	}()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	err := f()
+	ctxErr := ctx.Err()
+	if err != nil && ctxErr == nil && !c.deadline.IsZero() && !time.Now().Before(c.deadline) {
+		// The connection deadline may expire before the context timer fires
+		ctxErr = context.DeadlineExceeded
+	}
+	if !stop() || (err != nil && ctxErr != nil) {
+		c.Close()
+		return fmt.Errorf("smtp: %v: %w", stage, ctxErr)
+	}
+	return err
+}
+
 func (c *Client) greet() error {
 	if c.didGreet {
 		return c.greetError
 	}
 
 	// Initial greeting timeout. RFC 5321 recommends 5 minutes.
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(c.CommandTimeout)
+	defer c.resetDeadline()
 
 	c.didGreet = true
 	_, _, err := c.readResponse(220)
@@ -241,6 +323,13 @@ func (c *Client) Hello(localName string) error {
 	return c.hello()
 }
 
+// HelloContext is like Hello, but aborts if ctx is done.
+func (c *Client) HelloContext(ctx context.Context, localName string) error {
+	return c.withContext(ctx, "hello", func() error {
+		return c.Hello(localName)
+	})
+}
+
 func (c *Client) readResponse(expectCode int) (int, string, error) {
 	code, msg, err := c.text.ReadResponse(expectCode)
 	if protoErr, ok := err.(*textproto.Error); ok {
@@ -252,8 +341,8 @@ func (c *Client) readResponse(expectCode int) (int, string, error) {
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setDeadline(c.CommandTimeout)
+	defer c.resetDeadline()
 
 	id, err := c.text.Cmd(format, args...)
 	if err != nil {
@@ -414,9 +503,17 @@ func (c *Client) Auth(a sasl.Client) error {
 	return err
 }
 
+// AuthContext is like Auth, but aborts if ctx is done.
+func (c *Client) AuthContext(ctx context.Context, a sasl.Client) error {
+	return c.withContext(ctx, "auth", func() error {
+		return c.Auth(a)
+	})
+}
+
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
+// parameter. If opts.Body is BodyBinaryMIME, the server must support the
+// BINARYMIME and CHUNKING extensions, and the message is sent with BDAT.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
 //
 // If opts is not nil, MAIL arguments provided in the structure will be added
@@ -424,18 +521,46 @@ func (c *Client) Auth(a sasl.Client) error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Mail(from string, opts *MailOptions) error {
-	if err := validateLine(from); err != nil {
+	cmd, err := c.mailCommand(from, opts)
+	if err != nil {
 		return err
 	}
-	if err := c.hello(); err != nil {
+	if _, _, err := c.cmd(250, "%s", cmd); err != nil {
 		return err
 	}
+	c.binaryMIME = opts != nil && opts.Body == BodyBinaryMIME
+	return nil
+}
+
+// MailContext is like Mail, but aborts if ctx is done.
+func (c *Client) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	return c.withContext(ctx, "mail", func() error {
+		return c.Mail(from, opts)
+	})
+}
+
+func (c *Client) mailCommand(from string, opts *MailOptions) (string, error) {
+	if err := validateLine(from); err != nil {
+		return "", err
+	}
+	if err := c.hello(); err != nil {
+		return "", err
+	}
 
 	var sb strings.Builder
 	// A high enough power of 2 than 510+14+26+11+9+9+39+500
 	sb.Grow(2048)
 	fmt.Fprintf(&sb, "MAIL FROM:<%s>", from)
-	if _, ok := c.ext["8BITMIME"]; ok {
+	binaryMIME := opts != nil && opts.Body == BodyBinaryMIME
+	if binaryMIME {
+		if _, ok := c.ext["BINARYMIME"]; !ok {
+			return "", errors.New("smtp: server does not support BINARYMIME")
+		}
+		if _, ok := c.ext["CHUNKING"]; !ok {
+			return "", errors.New("smtp: server does not support CHUNKING")
+		}
+		sb.WriteString(" BODY=BINARYMIME")
+	} else if _, ok := c.ext["8BITMIME"]; ok {
 		sb.WriteString(" BODY=8BITMIME")
 	}
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
@@ -445,14 +570,14 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		if _, ok := c.ext["REQUIRETLS"]; ok {
 			sb.WriteString(" REQUIRETLS")
 		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+			return "", errors.New("smtp: server does not support REQUIRETLS")
 		}
 	}
 	if opts != nil && opts.UTF8 {
 		if _, ok := c.ext["SMTPUTF8"]; ok {
 			sb.WriteString(" SMTPUTF8")
 		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return "", errors.New("smtp: server does not support SMTPUTF8")
 		}
 	}
 	if _, ok := c.ext["DSN"]; ok && opts != nil {
@@ -462,11 +587,11 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		case "":
 			// This space is intentionally left blank
 		default:
-			return errors.New("smtp: Unknown RET parameter value")
+			return "", errors.New("smtp: Unknown RET parameter value")
 		}
 		if opts.EnvelopeID != "" {
 			if !isPrintableASCII(opts.EnvelopeID) {
-				return errors.New("smtp: Malformed ENVID parameter value")
+				return "", errors.New("smtp: Malformed ENVID parameter value")
 			}
 			fmt.Fprintf(&sb, " ENVID=%s", encodeXtext(opts.EnvelopeID))
 		}
@@ -477,8 +602,7 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
-	_, _, err := c.cmd(250, "%s", sb.String())
-	return err
+	return sb.String(), nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -490,9 +614,28 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Rcpt(to string, opts *RcptOptions) error {
-	if err := validateLine(to); err != nil {
+	cmd, err := c.rcptCommand(to, opts)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(25, "%s", cmd); err != nil {
 		return err
 	}
+	c.rcpts = append(c.rcpts, to)
+	return nil
+}
+
+// RcptContext is like Rcpt, but aborts if ctx is done.
+func (c *Client) RcptContext(ctx context.Context, to string, opts *RcptOptions) error {
+	return c.withContext(ctx, "rcpt", func() error {
+		return c.Rcpt(to, opts)
+	})
+}
+
+func (c *Client) rcptCommand(to string, opts *RcptOptions) (string, error) {
+	if err := validateLine(to); err != nil {
+		return "", err
+	}
 
 	var sb strings.Builder
 	// A high enough power of 2 than 510+29+501
@@ -502,7 +645,7 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 		if len(opts.Notify) != 0 {
 			sb.WriteString(" NOTIFY=")
 			if err := checkNotifySet(opts.Notify); err != nil {
-				return errors.New("smtp: Malformed NOTIFY parameter value")
+				return "", errors.New("smtp: Malformed NOTIFY parameter value")
 			}
 			for i, v := range opts.Notify {
 				if i != 0 {
@@ -516,7 +659,7 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 			switch opts.OriginalRecipientType {
 			case DSNAddressTypeRFC822:
 				if !isPrintableASCII(opts.OriginalRecipient) {
-					return errors.New("smtp: Illegal address")
+					return "", errors.New("smtp: Illegal address")
 				}
 				enc = encodeXtext(opts.OriginalRecipient)
 			case DSNAddressTypeUTF8:
@@ -526,7 +669,7 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 					enc = encodeUTF8AddrXtext(opts.OriginalRecipient)
 				}
 			default:
-				return errors.New("smtp: Unknown address type")
+				return "", errors.New("smtp: Unknown address type")
 			}
 			fmt.Fprintf(&sb, " ORCPT=%s;%s", string(opts.OriginalRecipientType), enc)
 		}
@@ -536,7 +679,7 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 	}
 	if _, ok := c.ext["DELIVERBY"]; ok && opts != nil && opts.DeliverBy != nil {
 		if opts.DeliverBy.Mode == DeliverByReturn && opts.DeliverBy.Time < 1 {
-			return errors.New("smtp: DELIVERBY mode must be greater than zero with return mode")
+			return "", errors.New("smtp: DELIVERBY mode must be greater than zero with return mode")
 		}
 		arg := fmt.Sprintf(" BY=%d;%s", int(opts.DeliverBy.Time.Seconds()), opts.DeliverBy.Mode)
 		if opts.DeliverBy.Trace {
@@ -546,15 +689,11 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 	}
 	if _, ok := c.ext["MT-PRIORITY"]; ok && opts != nil && opts.MTPriority != nil {
 		if *opts.MTPriority < -9 || *opts.MTPriority > 9 {
-			return errors.New("smtp: MT-PRIORITY must be between -9 and 9")
+			return "", errors.New("smtp: MT-PRIORITY must be between -9 and 9")
 		}
 		sb.WriteString(fmt.Sprintf(" MT-PRIORITY=%d", *opts.MTPriority))
 	}
-	if _, _, err := c.cmd(25, "%s", sb.String()); err != nil {
-		return err
-	}
-	c.rcpts = append(c.rcpts, to)
-	return nil
+	return sb.String(), nil
 }
 
 // DataCommand is a pending DATA command. DataCommand is an io.WriteCloser.
@@ -562,6 +701,7 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 type DataCommand struct {
 	client *Client
 	wc     io.WriteCloser
+	ctx    context.Context // set by Client.DataContext
 
 	closeErr error
 }
@@ -570,7 +710,16 @@ var _ io.WriteCloser = (*DataCommand)(nil)
 
 // Write implements io.Writer.
 func (cmd *DataCommand) Write(b []byte) (int, error) {
-	return cmd.wc.Write(b)
+	if cmd.ctx == nil {
+		return cmd.wc.Write(b)
+	}
+	var n int
+	err := cmd.client.withContext(cmd.ctx, "data", func() error {
+		var err error
+		n, err = cmd.wc.Write(b)
+		return err
+	})
+	return n, err
 }
 
 // Close implements io.Closer.
@@ -589,6 +738,19 @@ func (cmd *DataCommand) Close() error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (cmd *DataCommand) CloseWithResponse() (*DataResponse, error) {
+	if cmd.ctx == nil {
+		return cmd.closeWithResponse()
+	}
+	var resp *DataResponse
+	err := cmd.client.withContext(cmd.ctx, "data", func() error {
+		var err error
+		resp, err = cmd.closeWithResponse()
+		return err
+	})
+	return resp, err
+}
+
+func (cmd *DataCommand) closeWithResponse() (*DataResponse, error) {
 	if cmd.client.lmtp {
 		return nil, errors.New("smtp: CloseWithResponse used with an LMTP client")
 	}
@@ -597,8 +759,8 @@ func (cmd *DataCommand) CloseWithResponse() (*DataResponse, error) {
 		return nil, err
 	}
 
-	cmd.client.conn.SetDeadline(time.Now().Add(cmd.client.SubmissionTimeout))
-	defer cmd.client.conn.SetDeadline(time.Time{})
+	cmd.client.setDeadline(cmd.client.SubmissionTimeout)
+	defer cmd.client.resetDeadline()
 
 	_, msg, err := cmd.client.readResponse(250)
 	if err != nil {
@@ -614,6 +776,19 @@ func (cmd *DataCommand) CloseWithResponse() (*DataResponse, error) {
 //
 // If server returns an error, it will be of type LMTPDataError.
 func (cmd *DataCommand) CloseWithLMTPResponse() (map[string]*DataResponse, error) {
+	if cmd.ctx == nil {
+		return cmd.closeWithLMTPResponse()
+	}
+	var resp map[string]*DataResponse
+	err := cmd.client.withContext(cmd.ctx, "data", func() error {
+		var err error
+		resp, err = cmd.closeWithLMTPResponse()
+		return err
+	})
+	return resp, err
+}
+
+func (cmd *DataCommand) closeWithLMTPResponse() (map[string]*DataResponse, error) {
 	if !cmd.client.lmtp {
 		return nil, errors.New("smtp: CloseWithLMTPResponse used without an LMTP client")
 	}
@@ -622,8 +797,8 @@ func (cmd *DataCommand) CloseWithLMTPResponse() (map[string]*DataResponse, error
 		return nil, err
 	}
 
-	cmd.client.conn.SetDeadline(time.Now().Add(cmd.client.SubmissionTimeout))
-	defer cmd.client.conn.SetDeadline(time.Time{})
+	cmd.client.setDeadline(cmd.client.SubmissionTimeout)
+	defer cmd.client.resetDeadline()
 
 	resp := make(map[string]*DataResponse, len(cmd.client.rcpts))
 	lmtpErr := make(LMTPDataError, len(cmd.client.rcpts))
@@ -693,11 +868,131 @@ func (lmtpErr LMTPDataError) Unwrap() []error {
 	return l
 }
 
+// defaultChunkSize is the default maximum size of BDAT chunks.
+const defaultChunkSize = 1024 * 1024
+
+// bdatWriter sends a message with BDAT commands (RFC 3030). Data is buffered
+// until a chunk is full. The response to the last chunk is read by
+// DataCommand.
+type bdatWriter struct {
+	client *Client
+	buf    []byte
+	// binary disables line ending normalization, for BINARYMIME messages
+	binary bool
+	// last byte written, used to normalize line endings
+	last byte
+	err  error
+}
+
+// Write implements io.Writer.
+func (w *bdatWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	if w.binary {
+		n := 0
+		for len(b) > 0 {
+			if err := w.makeRoom(); err != nil {
+				return n, err
+			}
+			m := copy(w.buf[len(w.buf):cap(w.buf)], b)
+			w.buf = w.buf[:len(w.buf)+m]
+			b = b[m:]
+			n += m
+		}
+		return n, nil
+	}
+
+	for i, ch := range b {
+		// Convert bare LF to CRLF, like textproto.Writer.DotWriter
+		if ch == '\n' && w.last != '\r' {
+			if err := w.writeByte('\r'); err != nil {
+				return i, err
+			}
+		}
+		if err := w.writeByte(ch); err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *bdatWriter) writeByte(ch byte) error {
+	if err := w.makeRoom(); err != nil {
+		return err
+	}
+	w.buf = append(w.buf, ch)
+	w.last = ch
+	return nil
+}
+
+// makeRoom sends the buffered chunk if it's full.
+func (w *bdatWriter) makeRoom() error {
+	if len(w.buf) < cap(w.buf) {
+		return nil
+	}
+	return w.sendChunk(false)
+}
+
+// Close sends the last chunk. It doesn't read the response.
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	// Like DATA, make sure the message ends with CRLF
+	if !w.binary && w.last != 0 && w.last != '\n' {
+		if w.last != '\r' {
+			if err := w.writeByte('\r'); err != nil {
+				return err
+			}
+		}
+		if err := w.writeByte('\n'); err != nil {
+			return err
+		}
+	}
+
+	return w.sendChunk(true)
+}
+
+func (w *bdatWriter) sendChunk(last bool) error {
+	c := w.client
+	c.setDeadline(c.CommandTimeout)
+	defer c.resetDeadline()
+
+	if last {
+		fmt.Fprintf(c.text.W, "BDAT %d LAST\r\n", len(w.buf))
+	} else {
+		fmt.Fprintf(c.text.W, "BDAT %d\r\n", len(w.buf))
+	}
+	c.text.W.Write(w.buf)
+	err := c.text.W.Flush()
+	w.buf = w.buf[:0]
+	if err == nil && !last {
+		_, _, err = c.readResponse(250)
+	}
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
 // Data issues a DATA command to the server and returns a writer that
 // can be used to write the mail headers and body. The caller should
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
+//
+// If the server supports CHUNKING and ChunkSize is set, or if the
+// transaction uses BODY=BINARYMIME, the message is sent with BDAT commands
+// instead. Errors for intermediate chunks are returned by Write.
 func (c *Client) Data() (*DataCommand, error) {
+	if c.useBDAT() {
+		return c.bdatCommand(), nil
+	} else if c.binaryMIME {
+		return nil, errors.New("smtp: BINARYMIME requires CHUNKING")
+	}
+
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
@@ -705,6 +1000,216 @@ func (c *Client) Data() (*DataCommand, error) {
 	return &DataCommand{client: c, wc: c.text.DotWriter()}, nil
 }
 
+// DataContext is like Data, but aborts if ctx is done. The context also
+// applies to the returned DataCommand.
+func (c *Client) DataContext(ctx context.Context) (*DataCommand, error) {
+	var cmd *DataCommand
+	err := c.withContext(ctx, "data", func() error {
+		var err error
+		cmd, err = c.Data()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	cmd.ctx = ctx
+	return cmd, nil
+}
+
+// useBDAT reports whether the message should be sent with BDAT instead of
+// DATA.
+func (c *Client) useBDAT() bool {
+	_, ok := c.ext["CHUNKING"]
+	return ok && (c.ChunkSize > 0 || c.binaryMIME)
+}
+
+func (c *Client) bdatCommand() *DataCommand {
+	size := c.ChunkSize
+	if size <= 0 {
+		size = defaultChunkSize
+	}
+	w := &bdatWriter{
+		client: c,
+		buf:    make([]byte, 0, size),
+		binary: c.binaryMIME,
+	}
+	return &DataCommand{client: c, wc: w}
+}
+
+// maxPipelinedCommands is the maximum number of commands sent at once by
+// Transaction. Responses are read before sending more commands, so that
+// neither side blocks on a full send buffer.
+const maxPipelinedCommands = 100
+
+// RcptErrors is a collection of errors returned by the server for RCPT
+// commands, see Client.Transaction. It maps recipients to errors.
+type RcptErrors map[string]*SMTPError
+
+// Error implements error.
+func (rcptErr RcptErrors) Error() string {
+	return errors.Join(rcptErr.Unwrap()...).Error()
+}
+
+// Unwrap returns all per-recipient errors returned by the server.
+func (rcptErr RcptErrors) Unwrap() []error {
+	return LMTPDataError(rcptErr).Unwrap()
+}
+
+// Transaction starts a mail transaction: it sends a MAIL command, a RCPT
+// command for each recipient, and a DATA command. It returns a DataCommand
+// to write the message to, like Data.
+//
+// If the server supports PIPELINING (RFC 2920), commands are sent in batches
+// without waiting for each reply. Otherwise, commands are sent one by one.
+//
+// Recipients rejected by the server are returned in rejected, and the message
+// is only delivered to the remaining ones. If all recipients are rejected,
+// the returned error is rejected itself.
+//
+// mailOpts and rcptOpts are used as in Mail and Rcpt. rcptOpts applies to
+// all recipients.
+func (c *Client) Transaction(from string, mailOpts *MailOptions, to []string, rcptOpts *RcptOptions) (cmd *DataCommand, rejected RcptErrors, err error) {
+	if len(to) == 0 {
+		return nil, nil, errors.New("smtp: no recipient")
+	}
+	if ok, _ := c.Extension("PIPELINING"); !ok {
+		return c.lockstepTransaction(from, mailOpts, to, rcptOpts)
+	}
+
+	mailCmd, err := c.mailCommand(from, mailOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmds := []pipelinedCmd{{mailCmd, 250}}
+	for _, addr := range to {
+		rcptCmd, err := c.rcptCommand(addr, rcptOpts)
+		if err != nil {
+			return nil, nil, err
+		}
+		cmds = append(cmds, pipelinedCmd{rcptCmd, 25})
+	}
+
+	// With BDAT, the message is sent once the caller writes it
+	binaryMIME := mailOpts != nil && mailOpts.Body == BodyBinaryMIME
+	_, chunking := c.ext["CHUNKING"]
+	useBDAT := chunking && (c.ChunkSize > 0 || binaryMIME)
+	if !useBDAT {
+		cmds = append(cmds, pipelinedCmd{"DATA", 354})
+	}
+
+	var errs []error
+	for i := 0; i < len(cmds); i += maxPipelinedCommands {
+		end := i + maxPipelinedCommands
+		if end > len(cmds) {
+			end = len(cmds)
+		}
+		batchErrs, err := c.pipeline(cmds[i:end])
+		if err != nil {
+			return nil, nil, err
+		}
+		errs = append(errs, batchErrs...)
+
+		if errs[0] != nil {
+			// No need to send more recipients if MAIL failed
+			break
+		}
+	}
+
+	if err := errs[0]; err != nil {
+		return nil, nil, err
+	}
+	c.binaryMIME = binaryMIME
+
+	rejected = make(RcptErrors)
+	for i, addr := range to {
+		if err := errs[i+1]; err != nil {
+			rejected[addr] = err.(*SMTPError)
+		} else {
+			c.rcpts = append(c.rcpts, addr)
+		}
+	}
+
+	if useBDAT {
+		if len(rejected) == len(to) {
+			return nil, rejected, rejected
+		}
+		return c.bdatCommand(), rejected, nil
+	}
+
+	dataErr := errs[len(to)+1]
+	if len(rejected) == len(to) {
+		if dataErr == nil {
+			// The server accepted DATA without any recipient, send an empty
+			// message (RFC 2920 section 3.1)
+			if _, _, err := c.cmd(0, "."); err != nil {
+				return nil, rejected, err
+			}
+		}
+		return nil, rejected, rejected
+	} else if dataErr != nil {
+		return nil, rejected, dataErr
+	}
+	return &DataCommand{client: c, wc: c.text.DotWriter()}, rejected, nil
+}
+
+func (c *Client) lockstepTransaction(from string, mailOpts *MailOptions, to []string, rcptOpts *RcptOptions) (*DataCommand, RcptErrors, error) {
+	if err := c.Mail(from, mailOpts); err != nil {
+		return nil, nil, err
+	}
+
+	rejected := make(RcptErrors)
+	for _, addr := range to {
+		if err := c.Rcpt(addr, rcptOpts); err != nil {
+			smtpErr, ok := err.(*SMTPError)
+			if !ok {
+				return nil, nil, err
+			}
+			rejected[addr] = smtpErr
+		}
+	}
+	if len(rejected) == len(to) {
+		return nil, rejected, rejected
+	}
+
+	cmd, err := c.Data()
+	if err != nil {
+		return nil, rejected, err
+	}
+	return cmd, rejected, nil
+}
+
+type pipelinedCmd struct {
+	text       string
+	expectCode int
+}
+
+// pipeline sends several commands at once, then reads their responses.
+// Server errors are returned per command, other errors are returned
+// immediately.
+func (c *Client) pipeline(cmds []pipelinedCmd) ([]error, error) {
+	c.setDeadline(c.CommandTimeout)
+	defer c.resetDeadline()
+
+	for _, cmd := range cmds {
+		if _, err := fmt.Fprintf(c.text.W, "%s\r\n", cmd.text); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.text.W.Flush(); err != nil {
+		return nil, err
+	}
+
+	errs := make([]error, len(cmds))
+	for i, cmd := range cmds {
+		_, _, err := c.readResponse(cmd.expectCode)
+		if _, ok := err.(*SMTPError); err != nil && !ok {
+			return nil, err
+		}
+		errs[i] = err
+	}
+	return errs, nil
+}
+
 // SendMail will use an existing connection to send an email from
 // address from, to addresses to, with message r.
 //
@@ -741,6 +1246,29 @@ func (c *Client) SendMail(from string, to []string, r io.Reader) error {
 	return w.Close()
 }
 
+// SendMailContext is like SendMail, but aborts if ctx is done.
+func (c *Client) SendMailContext(ctx context.Context, from string, to []string, r io.Reader) error {
+	var err error
+
+	if err = c.MailContext(ctx, from, nil); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err = c.RcptContext(ctx, addr, nil); err != nil {
+			return err
+		}
+	}
+	w, err := c.DataContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
 var testHookStartTLS func(*tls.Config) // nil, except for tests
 
 func sendMail(addr string, implicitTLS bool, a sasl.Client, from string, to []string, r io.Reader) error {
@@ -868,6 +1396,7 @@ func (c *Client) Reset() error {
 	c.helloError = nil
 
 	c.rcpts = nil
+	c.binaryMIME = false
 	return nil
 }
 
@@ -881,6 +1410,69 @@ func (c *Client) Noop() error {
 	return err
 }
 
+// XClient sends the XCLIENT command (a Postfix extension) to pass information
+// about the original client of a proxied connection. attrs maps attribute
+// names such as "ADDR" or "HELO" to their values, which may be
+// "[UNAVAILABLE]". The server must advertise all attributes.
+//
+// The server then restarts the session, EHLO is sent again with the next
+// command.
+func (c *Client) XClient(attrs map[string]string) error {
+	cmd, err := c.clientAttrsCommand("XCLIENT", attrs)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(220, "%s", cmd); err != nil {
+		return err
+	}
+
+	c.didHello = false
+	c.helloError = nil
+	c.rcpts = nil
+	c.binaryMIME = false
+	return nil
+}
+
+// XForward sends the XFORWARD command (a Postfix extension) to pass
+// information about the original client of the next mail transaction. See
+// XClient for the format of attrs.
+func (c *Client) XForward(attrs map[string]string) error {
+	cmd, err := c.clientAttrsCommand("XFORWARD", attrs)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.cmd(250, "%s", cmd)
+	return err
+}
+
+func (c *Client) clientAttrsCommand(name string, attrs map[string]string) (string, error) {
+	if err := c.hello(); err != nil {
+		return "", err
+	}
+	ok, params := c.Extension(name)
+	if !ok {
+		return "", fmt.Errorf("smtp: server doesn't support %v", name)
+	}
+	supported := strings.Fields(strings.ToUpper(params))
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	for _, k := range keys {
+		attr := strings.ToUpper(k)
+		if !containsString(supported, attr) {
+			return "", fmt.Errorf("smtp: server doesn't support %v attribute %v", name, attr)
+		}
+		fmt.Fprintf(&sb, " %v=%v", attr, encodeXtext(attrs[k]))
+	}
+	return sb.String(), nil
+}
+
 // Quit sends the QUIT command and closes the connection to the server.
 //
 // If Quit fails the connection is not closed, Close should be used
@@ -941,14 +1533,29 @@ func toSMTPErr(protoErr *textproto.Error) *SMTPError {
 	return smtpErr
 }
 
+// directionalDebugWriter is implemented by debug writers which need to tell
+// ingress data apart from egress data.
+type directionalDebugWriter interface {
+	io.Writer
+	IngressWriter() io.Writer
+	EgressWriter() io.Writer
+}
+
 type clientDebugWriter struct {
-	c *Client
+	c       *Client
+	ingress bool
 }
 
 func (cdw clientDebugWriter) Write(b []byte) (int, error) {
 	if cdw.c.DebugWriter == nil {
 		return len(b), nil
 	}
+	if dw, ok := cdw.c.DebugWriter.(directionalDebugWriter); ok {
+		if cdw.ingress {
+			return dw.IngressWriter().Write(b)
+		}
+		return dw.EgressWriter().Write(b)
+	}
 	return cdw.c.DebugWriter.Write(b)
 }
 
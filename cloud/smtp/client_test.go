@@ -7,11 +7,14 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"net/textproto"
 	"reflect"
 	"strings"
@@ -1148,3 +1151,696 @@ func TestClientMTPRIORITY(t *testing.T) {
 		t.Errorf("wrote %q; want %q", actualcmds, client)
 	}
 }
+
+var bdatServer = `250 Sender OK
+250 Receiver OK
+250 Chunk OK
+250 Message OK
+`
+
+var bdatClient = "MAIL FROM:<user@gmail.com> BODY=8BITMIME\r\n" +
+	"RCPT TO:<root@nsa.gov>\r\n" +
+	"BDAT 16\r\n" +
+	"Subject: Hi\r\n\r\nL" +
+	"BDAT 16 LAST\r\n" +
+	"ine 1\r\n.Line 2\r\n"
+
+func TestClientBDAT(t *testing.T) {
+	server := strings.Join(strings.Split(bdatServer, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"8BITMIME": "", "CHUNKING": ""}
+	c.ChunkSize = 16
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("root@nsa.gov", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	// Bare LFs are converted to CRLF and a final CRLF is added
+	if _, err := io.WriteString(w, "Subject: Hi\n\nLine 1\r\n.Line 2"); err != nil {
+		t.Fatalf("Data write failed: %s", err)
+	}
+	resp, err := w.CloseWithResponse()
+	if err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+	if resp.StatusText != "Message OK" {
+		t.Errorf("StatusText = %q, want %q", resp.StatusText, "Message OK")
+	}
+	c.Close()
+
+	if actualcmds := wrote.String(); bdatClient != actualcmds {
+		t.Errorf("wrote %q; want %q", actualcmds, bdatClient)
+	}
+}
+
+var chunkingDataServer = `250 Sender OK
+250 Receiver OK
+354 Go ahead
+250 Message OK
+`
+
+var chunkingDataClient = "MAIL FROM:<user@gmail.com>\r\n" +
+	"RCPT TO:<root@nsa.gov>\r\n" +
+	"DATA\r\n" +
+	"Subject: Hi\r\n\r\nLine 1\r\n" +
+	".\r\n"
+
+// BDAT is opt-in: DATA is used by default even if the server supports
+// CHUNKING.
+func TestClientChunkingDefault(t *testing.T) {
+	server := strings.Join(strings.Split(chunkingDataServer, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"CHUNKING": ""}
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("root@nsa.gov", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	if _, err := io.WriteString(w, "Subject: Hi\r\n\r\nLine 1\r\n"); err != nil {
+		t.Fatalf("Data write failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+	c.Close()
+
+	if actualcmds := wrote.String(); chunkingDataClient != actualcmds {
+		t.Errorf("wrote %q; want %q", actualcmds, chunkingDataClient)
+	}
+}
+
+var binaryMIMEServer = `250 Sender OK
+250 Receiver OK
+250 Message OK
+`
+
+var binaryMIMEClient = "MAIL FROM:<user@gmail.com> BODY=BINARYMIME\r\n" +
+	"RCPT TO:<root@nsa.gov>\r\n" +
+	"BDAT 7 LAST\r\n" +
+	"\x00\xff\n\r.\r\n"
+
+func TestClientBINARYMIME(t *testing.T) {
+	server := strings.Join(strings.Split(binaryMIMEServer, "\n"), "\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"8BITMIME": "", "BINARYMIME": ""}
+
+	if err := c.Mail("user@gmail.com", &MailOptions{Body: BodyBinaryMIME}); err == nil {
+		t.Fatalf("MAIL BODY=BINARYMIME succeeded without CHUNKING")
+	}
+
+	c.ext["CHUNKING"] = ""
+	c.ChunkSize = 0
+	if err := c.Mail("user@gmail.com", &MailOptions{Body: BodyBinaryMIME}); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("root@nsa.gov", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	// Binary data is sent as-is
+	if _, err := io.WriteString(w, "\x00\xff\n\r.\r\n"); err != nil {
+		t.Fatalf("Data write failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+	c.Close()
+
+	if actualcmds := wrote.String(); binaryMIMEClient != actualcmds {
+		t.Errorf("wrote %q; want %q", actualcmds, binaryMIMEClient)
+	}
+}
+
+func TestClientBDAT_chunkError(t *testing.T) {
+	server := "250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"552 5.3.4 Max message size exceeded\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"CHUNKING": ""}
+	c.ChunkSize = 4
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("root@nsa.gov", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	_, err = io.WriteString(w, "Subject: Hi\r\n")
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 552 {
+		t.Fatalf("Write() = %v, want 552 error", err)
+	}
+	if err := w.Close(); err == nil {
+		t.Fatalf("Close() succeeded after chunk error")
+	}
+	c.Close()
+
+	// No further chunk is sent after an error
+	if n := strings.Count(wrote.String(), "BDAT"); n != 1 {
+		t.Errorf("sent %v BDAT commands, want 1", n)
+	}
+}
+
+func TestLMTPBDAT(t *testing.T) {
+	server := "250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"250 This recipient is fine\r\n" +
+		"550 But not this one\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClientLMTP(fake)
+	c.didHello = true
+	c.ext = map[string]string{"CHUNKING": ""}
+	c.ChunkSize = 1024
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("golang-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if err := c.Rcpt("golang-not-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data failed: %s", err)
+	}
+	if _, err := io.WriteString(w, "Subject: Hi\r\n\r\nHello\r\n"); err != nil {
+		t.Fatalf("Data write failed: %s", err)
+	}
+	resp, err := w.CloseWithLMTPResponse()
+	lmtpErr, ok := err.(LMTPDataError)
+	if !ok || len(lmtpErr) != 1 || lmtpErr["golang-not-nuts@googlegroups.com"] == nil {
+		t.Fatalf("CloseWithLMTPResponse() = %v, want one LMTPDataError", err)
+	}
+	if resp["golang-nuts@googlegroups.com"] == nil {
+		t.Errorf("missing response for first recipient")
+	}
+	c.Close()
+
+	if !strings.Contains(wrote.String(), "BDAT 22 LAST\r\n") {
+		t.Errorf("wrote %q, want a single BDAT LAST chunk", wrote.String())
+	}
+}
+
+var pipeliningServer = `250 Sender OK
+250 Receiver OK
+550 5.1.1 No such user
+250 Receiver OK
+354 Go ahead
+250 Data OK
+`
+
+var pipeliningClient = `MAIL FROM:<user@gmail.com>
+RCPT TO:<a@example.org>
+RCPT TO:<b@example.org>
+RCPT TO:<c@example.org>
+DATA
+Subject: Hi
+.
+`
+
+func TestClientTransaction(t *testing.T) {
+	for _, pipelining := range []bool{true, false} {
+		server := strings.Join(strings.Split(pipeliningServer, "\n"), "\r\n")
+		client := strings.Join(strings.Split(pipeliningClient, "\n"), "\r\n")
+
+		var wrote bytes.Buffer
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			&wrote,
+		}
+		c := NewClient(fake)
+		c.didHello = true
+		c.ext = map[string]string{}
+		if pipelining {
+			c.ext["PIPELINING"] = ""
+		}
+
+		to := []string{"a@example.org", "b@example.org", "c@example.org"}
+		w, rejected, err := c.Transaction("user@gmail.com", nil, to, nil)
+		if err != nil {
+			t.Fatalf("Transaction() = %v", err)
+		}
+		if len(rejected) != 1 || rejected["b@example.org"] == nil || rejected["b@example.org"].Code != 550 {
+			t.Errorf("rejected = %v, want b@example.org", rejected)
+		}
+		if _, err := io.WriteString(w, "Subject: Hi\r\n"); err != nil {
+			t.Fatalf("Data write failed: %s", err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Bad data response: %s", err)
+		}
+		c.Close()
+
+		if actualcmds := wrote.String(); client != actualcmds {
+			t.Errorf("pipelining=%v: wrote %q; want %q", pipelining, actualcmds, client)
+		}
+	}
+}
+
+func TestClientTransaction_allRejected(t *testing.T) {
+	server := "250 Sender OK\r\n" +
+		"550 5.1.1 No such user\r\n" +
+		"550 5.1.1 No such user\r\n" +
+		"554 5.5.1 No valid recipients\r\n"
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"PIPELINING": ""}
+
+	to := []string{"a@example.org", "b@example.org"}
+	w, rejected, err := c.Transaction("user@gmail.com", nil, to, nil)
+	if w != nil {
+		t.Errorf("Transaction() returned a DataCommand")
+	}
+	if len(rejected) != 2 {
+		t.Errorf("rejected = %v, want 2 recipients", rejected)
+	}
+	if _, ok := err.(RcptErrors); !ok {
+		t.Errorf("Transaction() = %v, want RcptErrors", err)
+	}
+	c.Close()
+
+	// All commands are sent at once
+	if n := strings.Count(wrote.String(), "\r\n"); n != 4 {
+		t.Errorf("wrote %q, want 4 commands", wrote.String())
+	}
+}
+
+func TestClientTransaction_batches(t *testing.T) {
+	n := maxPipelinedCommands*2 + 10
+
+	var server strings.Builder
+	server.WriteString("250 Sender OK\r\n")
+	for i := 0; i < n; i++ {
+		server.WriteString("250 Receiver OK\r\n")
+	}
+	server.WriteString("354 Go ahead\r\n")
+
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server.String()),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.didHello = true
+	c.ext = map[string]string{"PIPELINING": ""}
+
+	var to []string
+	for i := 0; i < n; i++ {
+		to = append(to, "rcpt"+strings.Repeat("x", i)+"@example.org")
+	}
+	if _, rejected, err := c.Transaction("user@gmail.com", nil, to, nil); err != nil || len(rejected) != 0 {
+		t.Fatalf("Transaction() = %v, %v", rejected, err)
+	}
+	if len(c.rcpts) != n {
+		t.Errorf("got %v accepted recipients, want %v", len(c.rcpts), n)
+	}
+	c.Close()
+}
+
+type xclientSession struct{}
+
+func (xclientSession) Mail(from string, opts *MailOptions) error { return nil }
+func (xclientSession) Rcpt(to string, opts *RcptOptions) error   { return nil }
+func (xclientSession) Data(r io.Reader) error                    { return nil }
+func (xclientSession) Reset()                                    {}
+func (xclientSession) Logout() error                             { return nil }
+
+func TestClientXClient(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	conns := make(chan *Conn, 2)
+	s := NewServer(BackendFunc(func(c *Conn) (Session, error) {
+		conns <- c
+		return xclientSession{}, nil
+	}))
+	s.Domain = "mx.example.com"
+	s.EnableXCLIENT = true
+	s.EnableXFORWARD = true
+	s.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("proxy.example.com"); err != nil {
+		t.Fatalf("Hello() = %v", err)
+	}
+	if err := c.XClient(map[string]string{"addr": "IPV6:2001:db8::1", "PORT": "4242", "HELO": "client example", "NAME": "[UNAVAILABLE]"}); err != nil {
+		t.Fatalf("XClient() = %v", err)
+	}
+	if err := c.XForward(map[string]string{"SOURCE": "REMOTE", "IDENT": "1234"}); err != nil {
+		t.Fatalf("XForward() = %v", err)
+	}
+	if err := c.XClient(map[string]string{"REVERSE_NAME": "example.com"}); err == nil {
+		t.Errorf("XClient() succeeded with unsupported attribute")
+	}
+
+	<-conns // session of the proxy
+	conn := <-conns
+	if hostname := conn.Hostname(); hostname != "client example" {
+		t.Errorf("Hostname() = %q, want %q", hostname, "client example")
+	}
+	if addr := conn.RemoteAddr().String(); addr != "[2001:db8::1]:4242" {
+		t.Errorf("RemoteAddr() = %v, want [2001:db8::1]:4242", addr)
+	}
+	if info := conn.XClient(); info == nil || info.Name != "" {
+		t.Errorf("XClient() = %+v", info)
+	}
+	if info := conn.XForward(); info == nil || info.Source != "REMOTE" || info.Ident != "1234" {
+		t.Errorf("XForward() = %+v", info)
+	}
+
+	// The XFORWARD attributes only apply to the next transaction
+	if err := c.Reset(); err != nil {
+		t.Fatalf("Reset() = %v", err)
+	}
+	if err := c.Noop(); err != nil {
+		t.Fatalf("Noop() = %v", err)
+	}
+	if info := conn.XForward(); info != nil {
+		t.Errorf("XForward() = %+v after RSET, want nil", info)
+	}
+}
+
+func TestClientXClient_untrusted(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	s := NewServer(BackendFunc(func(c *Conn) (Session, error) {
+		return xclientSession{}, nil
+	}))
+	s.EnableXCLIENT = true
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("XCLIENT"); ok {
+		t.Errorf("XCLIENT advertised to untrusted peer")
+	}
+	if err := c.XClient(map[string]string{"ADDR": "192.0.2.1"}); err == nil {
+		t.Errorf("XClient() succeeded without XCLIENT support")
+	}
+	if _, _, err := c.cmd(550, "XCLIENT ADDR=192.0.2.1"); err != nil {
+		t.Errorf("XCLIENT from untrusted peer: %v", err)
+	}
+}
+
+type smugglingBackend struct {
+	messages chan string
+}
+
+func (be *smugglingBackend) NewSession(c *Conn) (Session, error) {
+	return &smugglingSession{be}, nil
+}
+
+type smugglingSession struct {
+	backend *smugglingBackend
+}
+
+func (s *smugglingSession) Mail(from string, opts *MailOptions) error { return nil }
+func (s *smugglingSession) Rcpt(to string, opts *RcptOptions) error   { return nil }
+func (s *smugglingSession) Reset()                                    {}
+func (s *smugglingSession) Logout() error                             { return nil }
+
+func (s *smugglingSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.backend.messages <- string(b)
+	return nil
+}
+
+func TestServerLineEnding(t *testing.T) {
+	const smuggled = "MAIL FROM:<admin@example.org>\r\n" +
+		"RCPT TO:<victim@example.com>\r\n" +
+		"DATA\r\n" +
+		"From: admin@example.org\r\n" +
+		"\r\n" +
+		"Smuggled\r\n"
+
+	payloads := map[string]string{
+		"\n.\n":   "\r\n.\r\n",
+		"\r.\r":   "\r\n.\r\n",
+		"\n.\r\n": "\r\n.\r\n",
+	}
+	for payload, normalized := range payloads {
+		for _, tc := range []struct {
+			name   string
+			policy LineEndingPolicy
+			code   int
+			want   string
+		}{
+			{"reject", LineEndingReject, 554, ""},
+			{"normalize", LineEndingNormalize, 250, normalized},
+			{"accept", LineEndingAccept, 250, payload},
+		} {
+			for _, bdat := range []bool{false, true} {
+				name := strings.NewReplacer("\r", "CR", "\n", "LF").Replace(payload) + "/" + tc.name
+				if bdat {
+					name += "/BDAT"
+				}
+				t.Run(name, func(t *testing.T) {
+					ln := newLocalListener(t)
+					defer ln.Close()
+
+					be := &smugglingBackend{messages: make(chan string, 2)}
+					s := NewServer(be)
+					s.Domain = "mx.example.com"
+					s.LineEnding = tc.policy
+					go s.Serve(ln)
+					defer s.Close()
+
+					nc, err := net.Dial("tcp", ln.Addr().String())
+					if err != nil {
+						t.Fatal(err)
+					}
+					c := textproto.NewConn(nc)
+					defer c.Close()
+
+					msg := "Subject: Hi\r\n\r\nHi" + payload + smuggled
+					cmds := []struct {
+						cmd  string
+						code int
+					}{
+						{"", 220},
+						{"EHLO localhost\r\n", 250},
+						{"MAIL FROM:<sender@example.org>\r\n", 250},
+						{"RCPT TO:<rcpt@example.com>\r\n", 250},
+						{"DATA\r\n", 354},
+						{msg + ".\r\n", tc.code},
+						{"QUIT\r\n", 221},
+					}
+					if bdat {
+						cmds[4].cmd = fmt.Sprintf("BDAT %v LAST\r\n%v", len(msg), msg)
+						cmds[4].code = tc.code
+						cmds = append(cmds[:5], cmds[6:]...)
+					}
+
+					for _, cmd := range cmds {
+						if _, err := io.WriteString(nc, cmd.cmd); err != nil {
+							t.Fatal(err)
+						}
+						if _, _, err := c.ReadResponse(cmd.code); err != nil {
+							t.Fatalf("after %q: %v", cmd.cmd, err)
+						}
+					}
+
+					close(be.messages)
+					var messages []string
+					for msg := range be.messages {
+						messages = append(messages, msg)
+					}
+					if tc.code != 250 {
+						if len(messages) != 0 {
+							t.Errorf("messages = %q, want none", messages)
+						}
+						return
+					}
+					want := "Subject: Hi\r\n\r\nHi" + tc.want + smuggled
+					if len(messages) != 1 || messages[0] != want {
+						t.Errorf("messages = %q, want %q", messages, []string{want})
+					}
+				})
+			}
+		}
+	}
+}
+
+type blockingSession struct {
+	unblock chan struct{}
+}
+
+func (s blockingSession) Mail(from string, opts *MailOptions) error { return nil }
+func (s blockingSession) Reset()                                    {}
+func (s blockingSession) Logout() error                             { return nil }
+
+func (s blockingSession) Rcpt(to string, opts *RcptOptions) error {
+	if to == "slow@example.com" {
+		<-s.unblock
+	}
+	return nil
+}
+
+func (s blockingSession) Data(r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+func TestClientContext(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	s := NewServer(BackendFunc(func(c *Conn) (Session, error) {
+		return blockingSession{unblock}, nil
+	}))
+	go s.Serve(ln)
+	defer s.Close()
+
+	c, err := DialContext(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatalf("DialContext() = %v", err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if err := c.HelloContext(ctx, "localhost"); err != nil {
+		t.Fatalf("HelloContext() = %v", err)
+	}
+	if err := c.SendMailContext(ctx, "sender@example.org", []string{"rcpt@example.com"}, strings.NewReader("Hi\r\n")); err != nil {
+		t.Fatalf("SendMailContext() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if err := c.MailContext(ctx, "sender@example.org", nil); err != nil {
+		t.Fatalf("MailContext() = %v", err)
+	}
+	err = c.RcptContext(ctx, "slow@example.com", nil)
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "rcpt") {
+		t.Fatalf("RcptContext() = %v, want canceled rcpt stage", err)
+	}
+	if err := c.Noop(); err == nil {
+		t.Errorf("Noop() succeeded after cancellation")
+	}
+
+	c, err = Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	defer c.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.SendMailContext(ctx, "sender@example.org", []string{"slow@example.com"}, strings.NewReader("Hi\r\n"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SendMailContext() = %v, want deadline exceeded", err)
+	}
+	if err := c.MailContext(ctx, "sender@example.org", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MailContext() = %v, want deadline exceeded", err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+// newHandler returns the HTTP handler serving the JSON API and the web UI.
+func newHandler(mbox *mailbox) http.Handler {
+	h := &handler{mbox: mbox}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/messages", h.apiList)
+	mux.HandleFunc("DELETE /api/messages", h.apiDeleteAll)
+	mux.HandleFunc("GET /api/messages/{id}", h.apiGet)
+	mux.HandleFunc("DELETE /api/messages/{id}", h.apiDelete)
+	mux.HandleFunc("GET /api/messages/{id}/raw", h.raw)
+	mux.HandleFunc("GET /{$}", h.uiList)
+	mux.HandleFunc("GET /messages/{id}", h.uiGet)
+	mux.HandleFunc("POST /messages/{id}/delete", h.uiDelete)
+	mux.HandleFunc("POST /messages/delete", h.uiDeleteAll)
+	return mux
+}
+
+type handler struct {
+	mbox *mailbox
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write JSON response: %v", err)
+	}
+}
+
+func (h *handler) deleteError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == errNotFound {
+		http.NotFound(w, r)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (h *handler) apiList(w http.ResponseWriter, r *http.Request) {
+	l := h.mbox.list(r.URL.Query().Get("q"))
+	summaries := make([]*message, len(l))
+	for i, msg := range l {
+		summaries[i] = msg.summary()
+	}
+	writeJSON(w, summaries)
+}
+
+func (h *handler) apiGet(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.mbox.get(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, msg)
+}
+
+func (h *handler) apiDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.mbox.delete(r.PathValue("id")); err != nil {
+		h.deleteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) apiDeleteAll(w http.ResponseWriter, r *http.Request) {
+	if err := h.mbox.deleteAll(); err != nil {
+		h.deleteError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) raw(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	b, err := h.mbox.raw(id)
+	if err == errNotFound {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	if r.URL.Query().Has("download") {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.eml"`)
+	}
+	w.Write(b)
+}
+
+func (h *handler) uiList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("q")
+	data := struct {
+		Query    string
+		Messages []*message
+	}{query, h.mbox.list(query)}
+	if err := listTemplate.Execute(w, data); err != nil {
+		log.Printf("failed to render message list: %v", err)
+	}
+}
+
+func (h *handler) uiGet(w http.ResponseWriter, r *http.Request) {
+	msg, ok := h.mbox.get(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := messageTemplate.Execute(w, msg); err != nil {
+		log.Printf("failed to render message: %v", err)
+	}
+}
+
+func (h *handler) uiDelete(w http.ResponseWriter, r *http.Request) {
+	if err := h.mbox.delete(r.PathValue("id")); err != nil {
+		h.deleteError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (h *handler) uiDeleteAll(w http.ResponseWriter, r *http.Request) {
+	if err := h.mbox.deleteAll(); err != nil {
+		h.deleteError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+const layout = `{{define "head"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>smtp-debug-server</title>
+<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #ddd; }
+pre { background: #f6f6f6; padding: 1em; white-space: pre-wrap; }
+form.inline { display: inline; }
+</style>
+</head>
+<body>
+<h1><a href="/">smtp-debug-server</a></h1>
+{{end}}`
+
+var listTemplate = template.Must(template.New("list").Parse(layout + `{{template "head"}}
+<form method="get" action="/">
+<input type="search" name="q" value="{{.Query}}" placeholder="Search">
+<button type="submit">Search</button>
+</form>
+<form class="inline" method="post" action="/messages/delete">
+<button type="submit">Delete all</button>
+</form>
+<table>
+<tr><th>Received</th><th>From</th><th>To</th><th>Subject</th><th>Size</th></tr>
+{{range .Messages}}
+<tr>
+<td>{{.ReceivedAt.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.From}}</td>
+<td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td>
+<td><a href="/messages/{{.ID}}">{{or .Subject "(no subject)"}}</a></td>
+<td>{{.Size}}</td>
+</tr>
+{{else}}
+<tr><td colspan="5">No messages</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`))
+
+var messageTemplate = template.Must(template.New("message").Parse(layout + `{{template "head"}}
+<h2>{{or .Subject "(no subject)"}}</h2>
+<p>
+<a href="/api/messages/{{.ID}}/raw">Source</a> |
+<a href="/api/messages/{{.ID}}/raw?download">Download</a> |
+<a href="/api/messages/{{.ID}}">JSON</a>
+<form class="inline" method="post" action="/messages/{{.ID}}/delete">
+<button type="submit">Delete</button>
+</form>
+</p>
+<table>
+<tr><th>Envelope from</th><td>{{.From}}</td></tr>
+<tr><th>Envelope to</th><td>{{range $i, $to := .To}}{{if $i}}, {{end}}{{$to}}{{end}}</td></tr>
+{{if .Auth}}<tr><th>Authenticated as</th><td>{{.Auth}}</td></tr>{{end}}
+<tr><th>Received</th><td>{{.ReceivedAt}}</td></tr>
+{{range $k, $v := .Header}}{{range $v}}<tr><th>{{$k}}</th><td>{{.}}</td></tr>{{end}}{{end}}
+</table>
+{{if .ParseError}}<p>Failed to parse message: {{.ParseError}}</p>{{end}}
+{{with .Attachments}}
+<h3>Attachments</h3>
+<ul>
+{{range .}}<li>{{or .Filename .ContentID}} ({{.ContentType}}, {{.Size}} bytes)</li>{{end}}
+</ul>
+{{end}}
+{{if .TextBody}}<h3>Text</h3><pre>{{.TextBody}}</pre>{{end}}
+{{if .HTMLBody}}<h3>HTML</h3><iframe sandbox srcdoc="{{.HTMLBody}}" style="width: 100%; height: 30em;"></iframe>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newTestHandler(t *testing.T) (http.Handler, *mailbox, []*message) {
+	mbox, err := newMailbox(newMemoryStore())
+	if err != nil {
+		t.Fatalf("newMailbox() = %v", err)
+	}
+	var msgs []*message
+	for _, data := range []string{
+		testMessage,
+		"From: other@example.org\r\nSubject: Invoice\r\n\r\nPlease pay.\r\n",
+	} {
+		msg, err := mbox.add(testEnvelope, []byte(data))
+		if err != nil {
+			t.Fatalf("add() = %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return newHandler(mbox), mbox, msgs
+}
+
+func doRequest(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode JSON response: %v", err)
+	}
+}
+
+func TestHandler_list(t *testing.T) {
+	h, _, msgs := newTestHandler(t)
+
+	var l []message
+	decodeJSON(t, doRequest(h, "GET", "/api/messages"), &l)
+	if len(l) != 2 {
+		t.Fatalf("got %v messages, want 2", len(l))
+	}
+	for _, msg := range l {
+		if msg.TextBody != "" || msg.Header != nil {
+			t.Errorf("message %v: list includes the message content", msg.ID)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"invoice", []string{msgs[1].ID}},
+		{"HI+THERE", []string{msgs[0].ID}},
+		{"rcpt%40example.com", []string{msgs[0].ID, msgs[1].ID}},
+		{"nothing", nil},
+	} {
+		var l []message
+		decodeJSON(t, doRequest(h, "GET", "/api/messages?q="+tc.query), &l)
+		var ids []string
+		for _, msg := range l {
+			ids = append(ids, msg.ID)
+		}
+		// Messages received in the same second are sorted by random ID
+		sort.Strings(ids)
+		sort.Strings(tc.want)
+		if strings.Join(ids, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("search %q = %v, want %v", tc.query, ids, tc.want)
+		}
+	}
+
+	if rec := doRequest(h, "GET", "/?q=invoice"); rec.Code != http.StatusOK {
+		t.Errorf("GET / status = %v, want 200", rec.Code)
+	} else if body := rec.Body.String(); !strings.Contains(body, "Invoice") || strings.Contains(body, "Hello") {
+		t.Errorf("GET / doesn't list the matching messages only: %s", body)
+	}
+}
+
+func TestHandler_get(t *testing.T) {
+	h, _, msgs := newTestHandler(t)
+
+	var msg message
+	decodeJSON(t, doRequest(h, "GET", "/api/messages/"+msgs[0].ID), &msg)
+	if msg.ID != msgs[0].ID || msg.Subject != "Hello" {
+		t.Errorf("message = %v %q, want %v Hello", msg.ID, msg.Subject, msgs[0].ID)
+	}
+	if !strings.Contains(msg.TextBody, "Hi there!") {
+		t.Errorf("TextBody = %q, want message text", msg.TextBody)
+	}
+	if len(msg.HeaderFrom) != 1 || !strings.Contains(msg.HeaderFrom[0], "sender@example.org") {
+		t.Errorf("HeaderFrom = %v, want sender@example.org", msg.HeaderFrom)
+	}
+
+	if rec := doRequest(h, "GET", "/messages/"+msgs[0].ID); rec.Code != http.StatusOK {
+		t.Errorf("GET /messages/{id} status = %v, want 200", rec.Code)
+	}
+	for _, target := range []string{"/api/messages/unknown", "/api/messages/unknown/raw", "/messages/unknown"} {
+		if rec := doRequest(h, "GET", target); rec.Code != http.StatusNotFound {
+			t.Errorf("GET %v status = %v, want 404", target, rec.Code)
+		}
+	}
+}
+
+func TestHandler_raw(t *testing.T) {
+	h, mbox, msgs := newTestHandler(t)
+	want, err := mbox.raw(msgs[0].ID)
+	if err != nil {
+		t.Fatalf("raw() = %v", err)
+	}
+
+	rec := doRequest(h, "GET", "/api/messages/"+msgs[0].ID+"/raw")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %v, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "message/rfc822" {
+		t.Errorf("Content-Type = %q, want message/rfc822", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != "" {
+		t.Errorf("Content-Disposition = %q, want none", cd)
+	}
+	if b, _ := io.ReadAll(rec.Body); string(b) != string(want) {
+		t.Errorf("body = %q, want %q", b, want)
+	}
+
+	rec = doRequest(h, "GET", "/api/messages/"+msgs[0].ID+"/raw?download")
+	wantCD := `attachment; filename="` + msgs[0].ID + `.eml"`
+	if cd := rec.Header().Get("Content-Disposition"); cd != wantCD {
+		t.Errorf("Content-Disposition = %q, want %q", cd, wantCD)
+	}
+	if b, _ := io.ReadAll(rec.Body); string(b) != string(want) {
+		t.Errorf("download body = %q, want %q", b, want)
+	}
+}
+
+func TestHandler_delete(t *testing.T) {
+	h, mbox, msgs := newTestHandler(t)
+
+	target := "/api/messages/" + msgs[0].ID
+	if rec := doRequest(h, "DELETE", target); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE status = %v, want 204", rec.Code)
+	}
+	if rec := doRequest(h, "GET", target); rec.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE status = %v, want 404", rec.Code)
+	}
+	if rec := doRequest(h, "DELETE", target); rec.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status = %v, want 404", rec.Code)
+	}
+	if _, err := mbox.store.get(msgs[0].ID); err != errNotFound {
+		t.Errorf("store.get() after DELETE = %v, want errNotFound", err)
+	}
+
+	rec := doRequest(h, "POST", "/messages/"+msgs[1].ID+"/delete")
+	if rec.Code != http.StatusSeeOther {
+		t.Errorf("POST delete status = %v, want 303", rec.Code)
+	}
+	if l := mbox.list(""); len(l) != 0 {
+		t.Errorf("got %v messages after delete, want 0", len(l))
+	}
+
+	mbox.add(testEnvelope, []byte(testMessage))
+	if rec := doRequest(h, "DELETE", "/api/messages"); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE all status = %v, want 204", rec.Code)
+	}
+	if l := mbox.list(""); len(l) != 0 {
+		t.Errorf("got %v messages after delete all, want 0", len(l))
+	}
+}
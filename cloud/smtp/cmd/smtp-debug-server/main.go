@@ -2,44 +2,159 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/unix-world/smartgoplus/cloud/sasl"
 	"github.com/unix-world/smartgoplus/cloud/smtp"
 )
 
-var addr = "127.0.0.1:1025"
+var (
+	addr     = "127.0.0.1:1025"
+	httpAddr = "127.0.0.1:8025"
+	maildir  string
+	debug    bool
+	failures = make(map[string]*smtp.SMTPError)
+)
 
 func init() {
 	flag.StringVar(&addr, "l", addr, "Listen address")
+	flag.StringVar(&httpAddr, "http", httpAddr, "HTTP listen address for the web UI and API, empty to disable")
+	flag.StringVar(&maildir, "maildir", "", "Store messages in a Maildir directory instead of memory")
+	flag.BoolVar(&debug, "debug", true, "Print SMTP transcripts")
+	flag.Func("fail", "Reject a recipient, as `address[=code [enhanced-code] [text]]` (can be repeated)", parseFailure)
+}
+
+// parseFailure parses a forced failure, e.g. "bad@example.com=550 5.1.1 No
+// such user".
+func parseFailure(s string) error {
+	rcpt, reply, _ := strings.Cut(s, "=")
+	if rcpt == "" {
+		return fmt.Errorf("missing address")
+	}
+	smtpErr := &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Forced failure",
+	}
+	if reply != "" {
+		codeStr, rest, _ := strings.Cut(reply, " ")
+		code, err := strconv.Atoi(codeStr)
+		if err != nil || code < 400 || code > 599 {
+			return fmt.Errorf("invalid reply code %q", codeStr)
+		}
+		smtpErr.Code = code
+		smtpErr.EnhancedCode = smtp.EnhancedCode{code / 100, 0, 0}
+
+		enhStr, text, _ := strings.Cut(rest, " ")
+		var enh smtp.EnhancedCode
+		if _, err := fmt.Sscanf(enhStr, "%d.%d.%d", &enh[0], &enh[1], &enh[2]); err == nil {
+			smtpErr.EnhancedCode = enh
+		} else {
+			text = rest
+		}
+		if text != "" {
+			smtpErr.Message = text
+		}
+	}
+	failures[strings.ToLower(rcpt)] = smtpErr
+	return nil
 }
 
-type backend struct{}
+type backend struct {
+	mailbox *mailbox
+	domain  string
+}
 
 func (bkd *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &session{}, nil
+	return &session{
+		backend: bkd,
+		helo:    c.Hostname(),
+		addr:    c.RemoteAddr().String(),
+	}, nil
 }
 
-type session struct{}
+type session struct {
+	backend *backend
+	helo    string
+	addr    string
+	auth    string
+	from    string
+	to      []string
+}
 
-func (s *session) AuthPlain(username, password string) error {
-	return nil
+var _ smtp.AuthSession = (*session)(nil)
+
+func (s *session) AuthMechanisms() []string {
+	return []string{sasl.Plain, sasl.Login}
+}
+
+// Auth accepts any credentials, and records the identity.
+func (s *session) Auth(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			s.auth = username
+			return nil
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(func(username, password string) error {
+			s.auth = username
+			return nil
+		}), nil
+	default:
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
 	return nil
 }
 
 func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err, ok := failures[strings.ToLower(to)]; ok {
+		return err
+	}
+	s.to = append(s.to, to)
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	env := &envelope{
+		From:       s.from,
+		To:         s.to,
+		Auth:       s.auth,
+		Helo:       s.helo,
+		RemoteAddr: s.addr,
+		Domain:     s.backend.domain,
+	}
+	msg, err := s.backend.mailbox.add(env, b)
+	if err != nil {
+		log.Printf("failed to store message: %v", err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to store message",
+		}
+	}
+	log.Printf("captured message %v from <%v> to %v", msg.ID, s.from, s.to)
 	return nil
 }
 
-func (s *session) Reset() {}
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
 
 func (s *session) Logout() error {
 	return nil
@@ -48,12 +163,34 @@ func (s *session) Logout() error {
 func main() {
 	flag.Parse()
 
-	s := smtp.NewServer(&backend{})
+	var st store = newMemoryStore()
+	if maildir != "" {
+		var err error
+		if st, err = newMaildirStore(maildir); err != nil {
+			log.Fatalf("failed to open Maildir: %v", err)
+		}
+	}
+	mbox, err := newMailbox(st)
+	if err != nil {
+		log.Fatalf("failed to load messages: %v", err)
+	}
+
+	be := &backend{mailbox: mbox, domain: "localhost"}
+	s := smtp.NewServer(be)
 
 	s.Addr = addr
-	s.Domain = "localhost"
+	s.Domain = be.domain
 	s.AllowInsecureAuth = true
-	s.Debug = os.Stdout
+	if debug {
+		s.Debug = os.Stdout
+	}
+
+	if httpAddr != "" {
+		go func() {
+			log.Println("Starting HTTP server at", httpAddr)
+			log.Fatal(http.ListenAndServe(httpAddr, newHandler(mbox)))
+		}()
+	}
 
 	log.Println("Starting SMTP server at", addr)
 	log.Fatal(s.ListenAndServe())
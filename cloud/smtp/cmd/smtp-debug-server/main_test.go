@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+func TestParseFailure(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		rcpt string
+		want smtp.SMTPError
+	}{
+		{"Bad@Example.com", "bad@example.com", smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "Forced failure"}},
+		{"bad@example.com=450", "bad@example.com", smtp.SMTPError{Code: 450, EnhancedCode: smtp.EnhancedCode{4, 0, 0}, Message: "Forced failure"}},
+		{"bad@example.com=552 5.2.2", "bad@example.com", smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Forced failure"}},
+		{"bad@example.com=550 5.1.1 No such user", "bad@example.com", smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "No such user"}},
+		{"bad@example.com=421 Try again later", "bad@example.com", smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 0, 0}, Message: "Try again later"}},
+	} {
+		failures = make(map[string]*smtp.SMTPError)
+		if err := parseFailure(tc.s); err != nil {
+			t.Errorf("parseFailure(%q) = %v", tc.s, err)
+			continue
+		}
+		got, ok := failures[tc.rcpt]
+		if !ok {
+			t.Errorf("parseFailure(%q): no failure for %q", tc.s, tc.rcpt)
+		} else if *got != tc.want {
+			t.Errorf("parseFailure(%q) = %+v, want %+v", tc.s, *got, tc.want)
+		}
+	}
+
+	for _, s := range []string{
+		"",
+		"=550",
+		"bad@example.com=abc",
+		"bad@example.com=250",
+		"bad@example.com=600 Nope",
+	} {
+		failures = make(map[string]*smtp.SMTPError)
+		if err := parseFailure(s); err == nil {
+			t.Errorf("parseFailure(%q) = nil, want error", s)
+		}
+		if len(failures) != 0 {
+			t.Errorf("parseFailure(%q) added a failure", s)
+		}
+	}
+	failures = make(map[string]*smtp.SMTPError)
+}
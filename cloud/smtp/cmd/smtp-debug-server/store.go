@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/unix-world/smartgoplus/email/parsemail"
+)
+
+var errNotFound = errors.New("message not found")
+
+// store keeps the raw captured messages.
+type store interface {
+	put(id string, b []byte) error
+	get(id string) ([]byte, error)
+	delete(id string) error
+	// ids returns the IDs of the stored messages, in no particular order.
+	ids() ([]string, error)
+}
+
+type memoryStore struct {
+	mutex    sync.Mutex
+	messages map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{messages: make(map[string][]byte)}
+}
+
+func (st *memoryStore) put(id string, b []byte) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.messages[id] = b
+	return nil
+}
+
+func (st *memoryStore) get(id string) ([]byte, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	b, ok := st.messages[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return b, nil
+}
+
+func (st *memoryStore) delete(id string) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if _, ok := st.messages[id]; !ok {
+		return errNotFound
+	}
+	delete(st.messages, id)
+	return nil
+}
+
+func (st *memoryStore) ids() ([]string, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	l := make([]string, 0, len(st.messages))
+	for id := range st.messages {
+		l = append(l, id)
+	}
+	return l, nil
+}
+
+// maildirStore stores messages in a Maildir directory. Messages are
+// delivered to "new", messages moved to "cur" by other clients are still
+// listed.
+type maildirStore struct {
+	dir string
+}
+
+func newMaildirStore(dir string) (*maildirStore, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &maildirStore{dir: dir}, nil
+}
+
+func (st *maildirStore) put(id string, b []byte) error {
+	tmp := filepath.Join(st.dir, "tmp", id)
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(st.dir, "new", id))
+}
+
+// path returns the path of a message, which may have an info suffix in
+// "cur".
+func (st *maildirStore) path(id string) (string, error) {
+	if strings.ContainsAny(id, "/:") {
+		return "", errNotFound
+	}
+	p := filepath.Join(st.dir, "new", id)
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	matches, _ := filepath.Glob(filepath.Join(st.dir, "cur", id+":*"))
+	if len(matches) == 0 {
+		return "", errNotFound
+	}
+	return matches[0], nil
+}
+
+func (st *maildirStore) get(id string) ([]byte, error) {
+	p, err := st.path(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (st *maildirStore) delete(id string) error {
+	p, err := st.path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (st *maildirStore) ids() ([]string, error) {
+	var l []string
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(st.dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			id, _, _ := strings.Cut(entry.Name(), ":")
+			l = append(l, id)
+		}
+	}
+	return l, nil
+}
+
+// envelope contains the SMTP transaction details of a captured message.
+type envelope struct {
+	From       string
+	To         []string
+	Auth       string
+	Helo       string
+	RemoteAddr string
+	Domain     string
+}
+
+// Trace header fields prepended to captured messages, so that the envelope
+// survives in Maildir directories.
+const (
+	fieldEnvelopeTo = "X-Envelope-To"
+	fieldAuthUser   = "X-Authenticated-User"
+)
+
+// deliver prepends trace header fields to the message data.
+func deliver(id string, env *envelope, now time.Time, data []byte) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", env.From)
+	fmt.Fprintf(&buf, "%s: <%s>\r\n", fieldEnvelopeTo, strings.Join(env.To, ">, <"))
+	if env.Auth != "" {
+		fmt.Fprintf(&buf, "%s: %s\r\n", fieldAuthUser, env.Auth)
+	}
+	fmt.Fprintf(&buf, "Received: from %s (%s)\r\n\tby %s with ESMTP id %s;\r\n\t%s\r\n",
+		env.Helo, env.RemoteAddr, env.Domain, id, now.Format(time.RFC1123Z))
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// attachment describes an attachment or embedded file of a message.
+type attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// message is a captured message, parsed with parsemail.
+type message struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	To         []string  `json:"to"`
+	Auth       string    `json:"auth,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	Size       int       `json:"size"`
+
+	Subject     string              `json:"subject"`
+	HeaderFrom  []string            `json:"header_from,omitempty"`
+	HeaderTo    []string            `json:"header_to,omitempty"`
+	Date        time.Time           `json:"date"`
+	MessageID   string              `json:"message_id,omitempty"`
+	Header      map[string][]string `json:"header,omitempty"`
+	TextBody    string              `json:"text_body,omitempty"`
+	HTMLBody    string              `json:"html_body,omitempty"`
+	Attachments []attachment        `json:"attachments,omitempty"`
+	ParseError  string              `json:"parse_error,omitempty"`
+}
+
+// summary returns a copy of the message without its content.
+func (msg *message) summary() *message {
+	return &message{
+		ID:         msg.ID,
+		From:       msg.From,
+		To:         msg.To,
+		Auth:       msg.Auth,
+		ReceivedAt: msg.ReceivedAt,
+		Size:       msg.Size,
+		Subject:    msg.Subject,
+		HeaderFrom: msg.HeaderFrom,
+		HeaderTo:   msg.HeaderTo,
+		Date:       msg.Date,
+		MessageID:  msg.MessageID,
+		ParseError: msg.ParseError,
+	}
+}
+
+// matches reports whether the message contains the lower-case query in its
+// addresses, subject or text.
+func (msg *message) matches(query string) bool {
+	fields := []string{msg.From, msg.Auth, msg.Subject, msg.TextBody}
+	fields = append(fields, msg.To...)
+	fields = append(fields, msg.HeaderFrom...)
+	fields = append(fields, msg.HeaderTo...)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), query) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatAddressList(l []*mail.Address) []string {
+	var out []string
+	for _, addr := range l {
+		out = append(out, addr.String())
+	}
+	return out
+}
+
+func parseMessage(id string, b []byte) *message {
+	msg := &message{ID: id, Size: len(b)}
+
+	email, err := parsemail.Parse(bytes.NewReader(b))
+	if err != nil {
+		msg.ParseError = err.Error()
+	}
+	h := email.Header
+	if h == nil {
+		if m, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+			h = m.Header
+		}
+	}
+
+	msg.From = strings.Trim(h.Get("Return-Path"), "<>")
+	if to := h.Get(fieldEnvelopeTo); to != "" {
+		for _, addr := range strings.Split(to, ",") {
+			msg.To = append(msg.To, strings.Trim(strings.TrimSpace(addr), "<>"))
+		}
+	}
+	msg.Auth = h.Get(fieldAuthUser)
+	if received := h.Get("Received"); received != "" {
+		if i := strings.LastIndexByte(received, ';'); i >= 0 {
+			msg.ReceivedAt, _ = mail.ParseDate(strings.TrimSpace(received[i+1:]))
+		}
+	}
+
+	msg.Header = h
+	msg.Subject = email.Subject
+	msg.HeaderFrom = formatAddressList(email.From)
+	msg.HeaderTo = formatAddressList(email.To)
+	msg.Date = email.Date
+	msg.MessageID = email.MessageID
+	msg.TextBody = email.TextBody
+	msg.HTMLBody = email.HTMLBody
+	for _, a := range email.Attachments {
+		n, _ := io.Copy(io.Discard, a.Data)
+		msg.Attachments = append(msg.Attachments, attachment{Filename: a.Filename, ContentType: a.ContentType, Size: n})
+	}
+	for _, f := range email.EmbeddedFiles {
+		n, _ := io.Copy(io.Discard, f.Data)
+		msg.Attachments = append(msg.Attachments, attachment{ContentID: f.CID, ContentType: f.ContentType, Size: n})
+	}
+	return msg
+}
+
+// mailbox contains the captured messages, parsed.
+type mailbox struct {
+	store store
+
+	mutex    sync.Mutex
+	messages map[string]*message
+}
+
+func newMailbox(st store) (*mailbox, error) {
+	mbox := &mailbox{store: st, messages: make(map[string]*message)}
+	ids, err := st.ids()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		b, err := st.get(id)
+		if err != nil {
+			return nil, err
+		}
+		mbox.messages[id] = parseMessage(id, b)
+	}
+	return mbox, nil
+}
+
+func newID(now time.Time) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d.%s", now.Unix(), hex.EncodeToString(b)), nil
+}
+
+func (mbox *mailbox) add(env *envelope, data []byte) (*message, error) {
+	now := time.Now()
+	id, err := newID(now)
+	if err != nil {
+		return nil, err
+	}
+	b := deliver(id, env, now, data)
+	if err := mbox.store.put(id, b); err != nil {
+		return nil, err
+	}
+
+	msg := parseMessage(id, b)
+	mbox.mutex.Lock()
+	mbox.messages[id] = msg
+	mbox.mutex.Unlock()
+	return msg, nil
+}
+
+// list returns the messages matching query, most recent first.
+func (mbox *mailbox) list(query string) []*message {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	mbox.mutex.Lock()
+	var l []*message
+	for _, msg := range mbox.messages {
+		if query == "" || msg.matches(query) {
+			l = append(l, msg)
+		}
+	}
+	mbox.mutex.Unlock()
+
+	sort.Slice(l, func(i, j int) bool {
+		if !l[i].ReceivedAt.Equal(l[j].ReceivedAt) {
+			return l[i].ReceivedAt.After(l[j].ReceivedAt)
+		}
+		return l[i].ID > l[j].ID
+	})
+	return l
+}
+
+func (mbox *mailbox) get(id string) (*message, bool) {
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+	msg, ok := mbox.messages[id]
+	return msg, ok
+}
+
+func (mbox *mailbox) raw(id string) ([]byte, error) {
+	if _, ok := mbox.get(id); !ok {
+		return nil, errNotFound
+	}
+	return mbox.store.get(id)
+}
+
+func (mbox *mailbox) delete(id string) error {
+	if _, ok := mbox.get(id); !ok {
+		return errNotFound
+	}
+	if err := mbox.store.delete(id); err != nil {
+		return err
+	}
+	mbox.mutex.Lock()
+	delete(mbox.messages, id)
+	mbox.mutex.Unlock()
+	return nil
+}
+
+func (mbox *mailbox) deleteAll() error {
+	for _, msg := range mbox.list("") {
+		if err := mbox.delete(msg.ID); err != nil && err != errNotFound {
+			return err
+		}
+	}
+	return nil
+}
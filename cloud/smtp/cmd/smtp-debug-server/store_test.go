@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMessage = "From: Sender <sender@example.org>\r\n" +
+	"To: rcpt@example.com\r\n" +
+	"Subject: Hello\r\n" +
+	"Message-Id: <hello@example.org>\r\n" +
+	"\r\n" +
+	"Hi there!\r\n"
+
+var testEnvelope = &envelope{
+	From:       "sender@example.org",
+	To:         []string{"rcpt@example.com", "other@example.com"},
+	Auth:       "sender",
+	Helo:       "client.example.org",
+	RemoteAddr: "127.0.0.1:1234",
+	Domain:     "localhost",
+}
+
+func TestMaildirStore(t *testing.T) {
+	dir := t.TempDir()
+	st, err := newMaildirStore(dir)
+	if err != nil {
+		t.Fatalf("newMaildirStore() = %v", err)
+	}
+
+	if err := st.put("1.a", []byte("first")); err != nil {
+		t.Fatalf("put() = %v", err)
+	}
+	if err := st.put("2.b", []byte("second")); err != nil {
+		t.Fatalf("put() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new", "1.a")); err != nil {
+		t.Errorf("message not delivered to new: %v", err)
+	}
+
+	// Another client moves a message to cur, with an info suffix
+	if err := os.Rename(filepath.Join(dir, "new", "2.b"), filepath.Join(dir, "cur", "2.b:2,S")); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := st.ids()
+	if err != nil {
+		t.Fatalf("ids() = %v", err)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, " ") != "1.a 2.b" {
+		t.Errorf("ids() = %v, want [1.a 2.b]", ids)
+	}
+
+	for id, want := range map[string]string{"1.a": "first", "2.b": "second"} {
+		if b, err := st.get(id); err != nil {
+			t.Errorf("get(%q) = %v", id, err)
+		} else if string(b) != want {
+			t.Errorf("get(%q) = %q, want %q", id, b, want)
+		}
+	}
+	for _, id := range []string{"3.c", "../new/1.a", "2.b:2,S"} {
+		if _, err := st.get(id); err != errNotFound {
+			t.Errorf("get(%q) = %v, want errNotFound", id, err)
+		}
+	}
+
+	for _, id := range []string{"1.a", "2.b"} {
+		if err := st.delete(id); err != nil {
+			t.Errorf("delete(%q) = %v", id, err)
+		}
+		if err := st.delete(id); err != errNotFound {
+			t.Errorf("delete(%q) again = %v, want errNotFound", id, err)
+		}
+	}
+	if ids, err := st.ids(); err != nil || len(ids) != 0 {
+		t.Errorf("ids() after delete = %v, %v, want none", ids, err)
+	}
+}
+
+func TestNewMailbox(t *testing.T) {
+	st, err := newMaildirStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newMaildirStore() = %v", err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := st.put("1.a", deliver("1.a", testEnvelope, now, []byte(testMessage))); err != nil {
+		t.Fatalf("put() = %v", err)
+	}
+
+	// Messages already stored are loaded on startup
+	mbox, err := newMailbox(st)
+	if err != nil {
+		t.Fatalf("newMailbox() = %v", err)
+	}
+	msg, ok := mbox.get("1.a")
+	if !ok {
+		t.Fatal("get() = false, want stored message")
+	}
+	if msg.From != testEnvelope.From {
+		t.Errorf("From = %q, want %q", msg.From, testEnvelope.From)
+	}
+	if strings.Join(msg.To, " ") != strings.Join(testEnvelope.To, " ") {
+		t.Errorf("To = %v, want %v", msg.To, testEnvelope.To)
+	}
+	if msg.Auth != testEnvelope.Auth {
+		t.Errorf("Auth = %q, want %q", msg.Auth, testEnvelope.Auth)
+	}
+	if !msg.ReceivedAt.Equal(now) {
+		t.Errorf("ReceivedAt = %v, want %v", msg.ReceivedAt, now)
+	}
+	if msg.Subject != "Hello" || msg.MessageID != "hello@example.org" {
+		t.Errorf("Subject, MessageID = %q, %q, want Hello, hello@example.org", msg.Subject, msg.MessageID)
+	}
+	if msg.ParseError != "" {
+		t.Errorf("ParseError = %q", msg.ParseError)
+	}
+}
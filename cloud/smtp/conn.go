@@ -37,6 +37,7 @@ type Conn struct {
 
 	lineLimitReader *lineLimitReader
 	bdatPipe        *io.PipeWriter
+	bdatWriter      *lineEndingWriter
 	bdatStatus      *statusCollector // used for BDAT on LMTP
 	dataResult      chan error
 	bytesReceived   int64 // counts total size of chunks when BDAT is used
@@ -44,6 +45,9 @@ type Conn struct {
 	fromReceived bool
 	recipients   []string
 	didAuth      bool
+
+	xclient  *ClientInfo
+	xforward *ClientInfo
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
@@ -144,6 +148,10 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.handleAuth(arg)
 	case "STARTTLS":
 		c.handleStartTLS()
+	case "XCLIENT":
+		c.handleXClient(arg)
+	case "XFORWARD":
+		c.handleXForward(arg)
 	default:
 		msg := fmt.Sprintf("Syntax errors, %v command unrecognized", cmd)
 		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
@@ -173,6 +181,7 @@ func (c *Conn) Close() error {
 	if c.bdatPipe != nil {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
+		c.bdatWriter = nil
 	}
 
 	if c.session != nil {
@@ -193,7 +202,12 @@ func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// Hostname returns the HELO or EHLO argument of the client. If a trusted
+// proxy sent the original HELO with XCLIENT, it's returned instead.
 func (c *Conn) Hostname() string {
+	if c.xclient != nil && c.xclient.Helo != "" {
+		return c.xclient.Helo
+	}
 	return c.helo
 }
 
@@ -308,6 +322,12 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 			caps = append(caps, fmt.Sprintf("MT-PRIORITY %s", c.server.MtPriorityProfile))
 		}
 	}
+	if c.server.EnableXCLIENT && c.proxyTrusted() {
+		caps = append(caps, "XCLIENT "+strings.Join(xclientAttrs, " "))
+	}
+	if c.server.EnableXFORWARD && c.proxyTrusted() {
+		caps = append(caps, "XFORWARD "+strings.Join(xforwardAttrs, " "))
+	}
 
 	args := []string{"Hello " + domain}
 	args = append(args, caps...)
@@ -984,10 +1004,14 @@ func (c *Conn) handleData(arg string) {
 	}
 
 	r := newDataReader(c)
-	code, enhancedCode, msg := dataErrorToStatus(c.Session().Data(r))
+	lr := newLineEndingReader(r, c.server.LineEnding)
+	err := c.Session().Data(lr)
 	r.limited = false
 	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
-	c.writeResponse(code, enhancedCode, msg)
+	if lr.err == ErrBareLineEnding {
+		err = lr.err
+	}
+	c.writeResponse(dataErrorToStatus(err))
 }
 
 func (c *Conn) handleBdat(arg string) {
@@ -1040,6 +1064,12 @@ func (c *Conn) handleBdat(arg string) {
 		var r *io.PipeReader
 		r, c.bdatPipe = io.Pipe()
 
+		policy := c.server.LineEnding
+		if c.binarymime {
+			policy = LineEndingAccept
+		}
+		c.bdatWriter = &lineEndingWriter{w: c.bdatPipe, filter: lineEndingFilter{policy: policy}}
+
 		c.dataResult = make(chan error, 1)
 
 		go func() {
@@ -1075,7 +1105,7 @@ func (c *Conn) handleBdat(arg string) {
 	c.lineLimitReader.LineLimit = 0
 
 	chunk := io.LimitReader(c.text.R, int64(size))
-	_, err = io.Copy(c.bdatPipe, chunk)
+	_, err = io.Copy(c.bdatWriter, chunk)
 	if err != nil {
 		// Backend might return an error early using CloseWithError without consuming
 		// the whole chunk.
@@ -1097,6 +1127,11 @@ func (c *Conn) handleBdat(arg string) {
 	if last {
 		c.lineLimitReader.LineLimit = c.server.MaxLineLength
 
+		if err := c.bdatWriter.flush(); err != nil {
+			c.writeResponse(dataErrorToStatus(err))
+			c.reset()
+			return
+		}
 		c.bdatPipe.Close()
 
 		err := <-c.dataResult
@@ -1207,6 +1242,7 @@ func (s *statusCollector) SetStatus(rcptTo string, err error) {
 
 func (c *Conn) handleDataLMTP() {
 	r := newDataReader(c)
+	lr := newLineEndingReader(r, c.server.LineEnding)
 	status := c.createStatusCollector()
 
 	done := make(chan bool, 1)
@@ -1214,8 +1250,11 @@ func (c *Conn) handleDataLMTP() {
 	lmtpSession, ok := c.Session().(LMTPSession)
 	if !ok {
 		// Fallback to using a single status for all recipients.
-		err := c.Session().Data(r)
+		err := c.Session().Data(lr)
 		io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+		if lr.err == ErrBareLineEnding {
+			err = lr.err
+		}
 		for _, rcpt := range c.recipients {
 			status.SetStatus(rcpt, err)
 		}
@@ -1236,8 +1275,12 @@ func (c *Conn) handleDataLMTP() {
 				}
 			}()
 
-			status.fillRemaining(lmtpSession.LMTPData(r, status))
+			err := lmtpSession.LMTPData(lr, status)
 			io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+			if lr.err == ErrBareLineEnding {
+				err = lr.err
+			}
+			status.fillRemaining(err)
 			done <- true
 		}()
 	}
@@ -1337,6 +1380,7 @@ func (c *Conn) reset() {
 	if c.bdatPipe != nil {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
+		c.bdatWriter = nil
 	}
 	c.bdatStatus = nil
 	c.bytesReceived = 0
@@ -1347,4 +1391,5 @@ func (c *Conn) reset() {
 
 	c.fromReceived = false
 	c.recipients = nil
+	c.xforward = nil
 }
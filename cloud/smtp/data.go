@@ -47,6 +47,32 @@ var ErrDataTooLarge = &SMTPError{
 	Message:      "Maximum message size exceeded",
 }
 
+// ErrBareLineEnding is returned by the Reader passed to the Data function if
+// the message contains a CR or LF character which isn't part of a CRLF
+// sequence, and the server uses the LineEndingReject policy.
+var ErrBareLineEnding = &SMTPError{
+	Code:         554,
+	EnhancedCode: EnhancedCode{5, 5, 2},
+	Message:      "Bare CR or LF characters are not allowed in message data",
+}
+
+// LineEndingPolicy specifies how the server handles CR and LF characters
+// which aren't part of a CRLF sequence in message data.
+//
+// Bare line endings are interpreted differently by mail servers, which can be
+// abused to smuggle messages through a server relaying to others (see
+// CVE-2023-51764).
+type LineEndingPolicy int
+
+const (
+	// Reject messages containing bare CR or LF characters.
+	LineEndingReject LineEndingPolicy = iota
+	// Replace bare CR and LF characters with CRLF.
+	LineEndingNormalize
+	// Pass bare CR and LF characters through untouched.
+	LineEndingAccept
+)
+
 type dataReader struct {
 	r     *bufio.Reader
 	state int
@@ -146,3 +172,120 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 	}
 	return
 }
+
+// lineEndingFilter applies a LineEndingPolicy to a stream of message data.
+// The stream can be split in several chunks.
+type lineEndingFilter struct {
+	policy LineEndingPolicy
+	cr     bool // previous chunk ended with a CR
+}
+
+// filter appends the filtered contents of b to dst.
+func (f *lineEndingFilter) filter(dst, b []byte) ([]byte, error) {
+	for _, c := range b {
+		if f.cr && c != '\n' {
+			// Bare CR
+			if f.policy == LineEndingReject {
+				return dst, ErrBareLineEnding
+			} else if f.policy == LineEndingNormalize {
+				dst = append(dst, '\n')
+			}
+		} else if !f.cr && c == '\n' {
+			// Bare LF
+			if f.policy == LineEndingReject {
+				return dst, ErrBareLineEnding
+			} else if f.policy == LineEndingNormalize {
+				dst = append(dst, '\r')
+			}
+		}
+		f.cr = c == '\r'
+		dst = append(dst, c)
+	}
+	return dst, nil
+}
+
+// end checks for a bare CR at the end of the stream.
+func (f *lineEndingFilter) end() ([]byte, error) {
+	if !f.cr {
+		return nil, nil
+	}
+	f.cr = false
+	switch f.policy {
+	case LineEndingReject:
+		return nil, ErrBareLineEnding
+	case LineEndingNormalize:
+		return []byte{'\n'}, nil
+	}
+	return nil, nil
+}
+
+// lineEndingReader applies a LineEndingPolicy to data read from r.
+type lineEndingReader struct {
+	r      io.Reader
+	filter lineEndingFilter
+
+	in  []byte
+	buf []byte // filtered data not yet returned
+	err error
+}
+
+func newLineEndingReader(r io.Reader, policy LineEndingPolicy) *lineEndingReader {
+	return &lineEndingReader{
+		r:      r,
+		filter: lineEndingFilter{policy: policy},
+		in:     make([]byte, 4096),
+	}
+}
+
+func (r *lineEndingReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 && r.err == nil {
+		n, err := r.r.Read(r.in)
+		r.buf, r.err = r.filter.filter(r.buf[:0], r.in[:n])
+		if r.err == nil && err != nil {
+			if err == io.EOF {
+				var tail []byte
+				tail, r.err = r.filter.end()
+				r.buf = append(r.buf, tail...)
+			}
+			if r.err == nil {
+				r.err = err
+			}
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	if len(r.buf) > 0 {
+		return n, nil
+	}
+	return n, r.err
+}
+
+// lineEndingWriter applies a LineEndingPolicy to data written to w.
+type lineEndingWriter struct {
+	w      io.Writer
+	filter lineEndingFilter
+	buf    []byte
+}
+
+func (w *lineEndingWriter) Write(b []byte) (int, error) {
+	var err error
+	w.buf, err = w.filter.filter(w.buf[:0], b)
+	if _, werr := w.w.Write(w.buf); werr != nil {
+		return 0, werr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// flush must be called at the end of the stream.
+func (w *lineEndingWriter) flush() error {
+	tail, err := w.filter.end()
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(tail)
+	return err
+}
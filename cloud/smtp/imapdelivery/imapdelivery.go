@@ -0,0 +1,266 @@
+// Package imapdelivery implements an LMTP backend delivering messages to IMAP
+// mailboxes.
+//
+// Recipients are resolved to IMAP users with a Directory. Messages are
+// appended to the INBOX of each recipient, or to the mailbox chosen by a Rule,
+// without flags and with the delivery date as internal date. Appending goes
+// through the same code path as the IMAP APPEND command, so IMAP backends such
+// as imapmemserver notify IDLE-ing sessions of the new messages. Whether the
+// messages are reported as recent is up to the backend.
+//
+// For instance, to deliver messages to the users of an imapmemserver.Server:
+//
+//	be := imapdelivery.New(imapdelivery.DirectoryFunc(func(rcpt string) (imapdelivery.User, error) {
+//		username, _, _ := strings.Cut(rcpt, "@")
+//		if u := memServer.User(username); u != nil {
+//			return u, nil
+//		}
+//		return nil, imapdelivery.ErrUnknownUser
+//	}))
+//	s := smtp.NewServer(be)
+//	s.LMTP = true
+package imapdelivery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/imap"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Inbox is the name of the mailbox messages are delivered to by default.
+const Inbox = "INBOX"
+
+// ErrUnknownUser is returned by a Directory if a recipient doesn't exist.
+var ErrUnknownUser = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user here",
+}
+
+// User is an IMAP user messages can be delivered to. imapmemserver.User
+// implements this interface.
+type User interface {
+	Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error)
+}
+
+// Directory resolves recipient addresses to users.
+type Directory interface {
+	// Lookup returns the user for a recipient address. ErrUnknownUser should
+	// be returned if there is no such user. Other SMTP errors are sent as-is
+	// to the client, any other error is reported as a temporary failure.
+	Lookup(rcpt string) (User, error)
+}
+
+// DirectoryFunc is an adapter to use a function as a Directory.
+type DirectoryFunc func(rcpt string) (User, error)
+
+var _ Directory = DirectoryFunc(nil)
+
+// Lookup implements Directory.
+func (f DirectoryFunc) Lookup(rcpt string) (User, error) {
+	return f(rcpt)
+}
+
+// Envelope describes a message being delivered to a recipient.
+type Envelope struct {
+	From   string
+	Rcpt   string
+	Header mail.Header
+}
+
+// Rule chooses the mailbox a message is delivered to. If it returns an empty
+// name, or if the mailbox doesn't exist, the message is delivered to the
+// INBOX.
+type Rule func(env *Envelope) string
+
+// Backend is an LMTP backend delivering messages to IMAP users.
+type Backend struct {
+	Directory Directory
+	// Optional rule to deliver messages to a mailbox other than the INBOX.
+	Rule Rule
+
+	// Returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+var _ smtp.Backend = (*Backend)(nil)
+
+// New creates a new backend delivering messages to the INBOX of the users
+// of a directory.
+func New(dir Directory) *Backend {
+	return &Backend{Directory: dir}
+}
+
+func (be *Backend) now() time.Time {
+	if be.Now != nil {
+		return be.Now()
+	}
+	return time.Now()
+}
+
+// NewSession implements smtp.Backend.
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{backend: be}, nil
+}
+
+type recipient struct {
+	addr string
+	user User
+}
+
+type session struct {
+	backend *Backend
+	from    string
+	rcpts   []recipient
+}
+
+var _ smtp.LMTPSession = (*session)(nil)
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	u, err := s.backend.Directory.Lookup(to)
+	if err != nil {
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr
+		}
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      fmt.Sprintf("Failed to look up recipient: %v", err),
+		}
+	}
+	s.rcpts = append(s.rcpts, recipient{addr: to, user: u})
+	return nil
+}
+
+type statusFunc func(rcpt string, err error)
+
+func (f statusFunc) SetStatus(rcpt string, err error) {
+	f(rcpt, err)
+}
+
+// Data delivers the message to all recipients. Since a single status can be
+// returned, the first delivery failure is reported.
+func (s *session) Data(r io.Reader) error {
+	var firstErr error
+	err := s.LMTPData(r, statusFunc(func(rcpt string, err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}))
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var header mail.Header
+	if msg, err := mail.ReadMessage(bytes.NewReader(b)); err == nil {
+		header = msg.Header
+	} else {
+		header = make(mail.Header)
+	}
+
+	now := s.backend.now()
+	delivered := make(map[string]error)
+	for _, rcpt := range s.rcpts {
+		err, ok := delivered[rcpt.addr]
+		if !ok {
+			err = s.deliver(rcpt, header, b, now)
+			delivered[rcpt.addr] = err
+		}
+		status.SetStatus(rcpt.addr, err)
+	}
+	return nil
+}
+
+func (s *session) deliver(rcpt recipient, header mail.Header, b []byte, now time.Time) error {
+	name := Inbox
+	if s.backend.Rule != nil {
+		env := &Envelope{From: s.from, Rcpt: rcpt.addr, Header: header}
+		if mbox := s.backend.Rule(env); mbox != "" {
+			name = mbox
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", s.from)
+	fmt.Fprintf(&buf, "Delivered-To: %s\r\n", rcpt.addr)
+	buf.Write(b)
+
+	options := &imap.AppendOptions{Time: now}
+	_, err := rcpt.user.Append(name, bytes.NewReader(buf.Bytes()), options)
+	if isNonExistent(err) && name != Inbox {
+		_, err = rcpt.user.Append(Inbox, bytes.NewReader(buf.Bytes()), options)
+	}
+	if err != nil {
+		return appendError(err)
+	}
+	return nil
+}
+
+func isNonExistent(err error) bool {
+	var imapErr *imap.Error
+	if !errors.As(err, &imapErr) {
+		return false
+	}
+	return imapErr.Code == imap.ResponseCodeTryCreate || imapErr.Code == imap.ResponseCodeNonExistent
+}
+
+// appendError converts an error returned by User.Append to an SMTP error.
+func appendError(err error) error {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr
+	}
+
+	var imapErr *imap.Error
+	if errors.As(err, &imapErr) {
+		switch imapErr.Code {
+		case imap.ResponseCodeOverQuota:
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+				Message:      "Mailbox full",
+			}
+		case imap.ResponseCodeTooBig, imap.ResponseCodeLimit:
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+				Message:      "Message too big for mailbox",
+			}
+		}
+	}
+
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 2, 0},
+		Message:      fmt.Sprintf("Failed to deliver message: %v", err),
+	}
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
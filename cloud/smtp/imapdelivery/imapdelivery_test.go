@@ -0,0 +1,188 @@
+package imapdelivery
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/imap"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type appended struct {
+	mailbox string
+	body    string
+	options *imap.AppendOptions
+}
+
+type testUser struct {
+	mutex     sync.Mutex
+	mailboxes map[string]bool
+	overQuota bool
+	messages  []appended
+}
+
+func newTestUser(mailboxes ...string) *testUser {
+	u := &testUser{mailboxes: map[string]bool{Inbox: true}}
+	for _, name := range mailboxes {
+		u.mailboxes[name] = true
+	}
+	return u
+}
+
+func (u *testUser) Append(mailbox string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !u.mailboxes[mailbox] {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTryCreate,
+			Text: "No such mailbox",
+		}
+	}
+	if u.overQuota {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeOverQuota,
+			Text: "Storage quota exceeded",
+		}
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != r.Size() {
+		return nil, errors.New("size mismatch")
+	}
+	u.messages = append(u.messages, appended{mailbox, string(b), options})
+	return &imap.AppendData{UID: imap.UID(len(u.messages))}, nil
+}
+
+const testMessage = "From: sender@example.org\r\n" +
+	"To: alice@example.com, bob@example.com\r\n" +
+	"Subject: [list] Hello\r\n" +
+	"\r\n" +
+	"Hi!\r\n"
+
+func TestBackend(t *testing.T) {
+	alice := newTestUser("Lists")
+	bob := newTestUser()
+	carol := newTestUser()
+	carol.overQuota = true
+	users := map[string]*testUser{
+		"alice@example.com": alice,
+		"bob@example.com":   bob,
+		"carol@example.com": carol,
+	}
+
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	be := New(DirectoryFunc(func(rcpt string) (User, error) {
+		if u, ok := users[rcpt]; ok {
+			return u, nil
+		}
+		return nil, ErrUnknownUser
+	}))
+	be.Rule = func(env *Envelope) string {
+		if strings.HasPrefix(env.Header.Get("Subject"), "[list]") {
+			return "Lists"
+		}
+		return ""
+	}
+	be.Now = func() time.Time { return now }
+
+	l := newLocalListener(t)
+	s := smtp.NewServer(be)
+	s.Domain = "mx.example.com"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClientLMTP(conn)
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello() = %v", err)
+	}
+	if err := c.Mail("sender@example.org", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := c.Rcpt("nobody@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("Rcpt(unknown user) = %v, want 550", err)
+	}
+	for _, rcpt := range []string{"alice@example.com", "bob@example.com", "carol@example.com"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%v) = %v", rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	if _, err := io.WriteString(w, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := w.CloseWithLMTPResponse()
+	var lmtpErr smtp.LMTPDataError
+	if !errors.As(err, &lmtpErr) {
+		t.Fatalf("CloseWithLMTPResponse() = %v, want LMTPDataError", err)
+	}
+	if len(resp) != 2 || len(lmtpErr) != 1 {
+		t.Errorf("CloseWithLMTPResponse() = %v, %v, want 2 successes and 1 failure", resp, err)
+	}
+	if rcptErr := lmtpErr["carol@example.com"]; rcptErr == nil || rcptErr.EnhancedCode != (smtp.EnhancedCode{5, 2, 2}) {
+		t.Errorf("status for carol = %v, want 5.2.2", rcptErr)
+	}
+
+	for _, tc := range []struct {
+		user    *testUser
+		rcpt    string
+		mailbox string
+	}{
+		{alice, "alice@example.com", "Lists"},
+		{bob, "bob@example.com", Inbox},
+	} {
+		if len(tc.user.messages) != 1 {
+			t.Fatalf("%v got %v messages, want 1", tc.rcpt, len(tc.user.messages))
+		}
+		msg := tc.user.messages[0]
+		if msg.mailbox != tc.mailbox {
+			t.Errorf("%v: delivered to %q, want %q", tc.rcpt, msg.mailbox, tc.mailbox)
+		}
+		wantBody := "Return-Path: <sender@example.org>\r\nDelivered-To: " + tc.rcpt + "\r\n" + testMessage
+		if msg.body != wantBody {
+			t.Errorf("%v: body = %q, want %q", tc.rcpt, msg.body, wantBody)
+		}
+		if len(msg.options.Flags) != 0 {
+			t.Errorf("%v: flags = %v, want none", tc.rcpt, msg.options.Flags)
+		}
+		if !msg.options.Time.Equal(now) {
+			t.Errorf("%v: time = %v, want %v", tc.rcpt, msg.options.Time, now)
+		}
+	}
+	if len(carol.messages) != 0 {
+		t.Errorf("carol got %v messages, want 0", len(carol.messages))
+	}
+}
+
+func newLocalListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ln, err = net.Listen("tcp6", "[::1]:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
@@ -0,0 +1,372 @@
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Protocol version.
+const protocolVersion = 6
+
+// Commands sent to milters.
+const (
+	cmdAbort   = 'A'
+	cmdBody    = 'B'
+	cmdConnect = 'C'
+	cmdMacro   = 'D'
+	cmdEOB     = 'E'
+	cmdHelo    = 'H'
+	cmdHeader  = 'L'
+	cmdMail    = 'M'
+	cmdEOH     = 'N'
+	cmdOptNeg  = 'O'
+	cmdQuit    = 'Q'
+	cmdRcpt    = 'R'
+	cmdData    = 'T'
+)
+
+// Responses sent by milters.
+const (
+	respAddRcpt    = '+'
+	respDelRcpt    = '-'
+	respAccept     = 'a'
+	respReplBody   = 'b'
+	respContinue   = 'c'
+	respDiscard    = 'd'
+	respChgFrom    = 'e'
+	respAddHeader  = 'h'
+	respInsHeader  = 'i'
+	respChgHeader  = 'm'
+	respProgress   = 'p'
+	respQuarantine = 'q'
+	respReject     = 'r'
+	respSkip       = 's'
+	respTempfail   = 't'
+	respReplyCode  = 'y'
+)
+
+// Actions milters may perform.
+const (
+	actAddHeaders = 1 << 0
+	actChgBody    = 1 << 1
+	actChgHeaders = 1 << 4
+	actQuarantine = 1 << 5
+
+	supportedActions = actAddHeaders | actChgBody | actChgHeaders | actQuarantine
+)
+
+// Protocol flags, set by milters to skip events or replies.
+const (
+	protoNoConnect  = 1 << 0
+	protoNoHelo     = 1 << 1
+	protoNoMail     = 1 << 2
+	protoNoRcpt     = 1 << 3
+	protoNoBody     = 1 << 4
+	protoNoHeaders  = 1 << 5
+	protoNoEOH      = 1 << 6
+	protoNRHeader   = 1 << 7
+	protoNoUnknown  = 1 << 8
+	protoNoData     = 1 << 9
+	protoSkip       = 1 << 10
+	protoNRConnect  = 1 << 12
+	protoNRHelo     = 1 << 13
+	protoNRMail     = 1 << 14
+	protoNRRcpt     = 1 << 15
+	protoNRData     = 1 << 16
+	protoNREOH      = 1 << 18
+	protoNRBody     = 1 << 19
+	protoHdrLeadSpc = 1 << 20
+
+	supportedProtocol = protoNoConnect | protoNoHelo | protoNoMail | protoNoRcpt |
+		protoNoBody | protoNoHeaders | protoNoEOH | protoNRHeader | protoNoUnknown |
+		protoNoData | protoSkip | protoNRConnect | protoNRHelo | protoNRMail |
+		protoNRRcpt | protoNRData | protoNREOH | protoNRBody | protoHdrLeadSpc
+)
+
+// Maximum size of a body chunk, as defined by libmilter.
+const maxChunkSize = 65535
+
+// Maximum size of a packet sent by a milter.
+const maxPacketSize = 1024 * 1024
+
+// response is a milter response.
+type response struct {
+	code byte
+	data []byte
+}
+
+var continueResponse = &response{code: respContinue}
+
+// error returns the SMTP error for reject, tempfail and reply code
+// responses, or nil for other responses.
+func (resp *response) error() error {
+	switch resp.code {
+	case respReject:
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Command rejected",
+		}
+	case respTempfail:
+		return errTempfail
+	case respReplyCode:
+		return parseReplyCode(string(trimNUL(resp.data)))
+	}
+	return nil
+}
+
+var errTempfail = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+	Message:      "Service unavailable - try again later",
+}
+
+// parseReplyCode parses a custom SMTP reply set by a milter, e.g.
+// "550 5.7.1 Message rejected". Multi-line replies are supported.
+func parseReplyCode(s string) error {
+	lines := strings.Split(strings.ReplaceAll(strings.TrimRight(s, "\r\n"), "\r\n", "\n"), "\n")
+	if len(lines[0]) < 3 {
+		return errTempfail
+	}
+	code, err := strconv.Atoi(lines[0][:3])
+	if err != nil || code < 400 || code >= 600 {
+		return errTempfail
+	}
+
+	smtpErr := &smtp.SMTPError{Code: code, EnhancedCode: smtp.EnhancedCodeNotSet}
+	var msgs []string
+	for i, l := range lines {
+		if len(l) >= 4 && (l[3] == ' ' || l[3] == '-') {
+			l = l[4:]
+		} else {
+			l = strings.TrimPrefix(l, lines[0][:3])
+		}
+		if enh, rest, ok := parseEnhancedCode(l); ok {
+			if i == 0 {
+				smtpErr.EnhancedCode = enh
+			}
+			l = rest
+		}
+		msgs = append(msgs, l)
+	}
+	smtpErr.Message = strings.Join(msgs, "\n")
+	return smtpErr
+}
+
+func parseEnhancedCode(s string) (code smtp.EnhancedCode, rest string, ok bool) {
+	word, rest, _ := strings.Cut(s, " ")
+	parts := strings.Split(word, ".")
+	if len(parts) != 3 {
+		return code, s, false
+	}
+	for i, part := range parts {
+		v, err := strconv.Atoi(part)
+		if err != nil || v < 0 {
+			return code, s, false
+		}
+		code[i] = v
+	}
+	return code, rest, true
+}
+
+// conn is a connection to a milter.
+type conn struct {
+	milter *Milter
+	nc     net.Conn
+	br     *bufio.Reader
+
+	// Negotiated actions and protocol flags
+	actions  uint32
+	protocol uint32
+
+	// The milter accepted the connection or the current message: no more
+	// events are sent
+	acceptedConn, acceptedMsg bool
+	// The current message has been sent
+	inMessage bool
+	// Communication error
+	err error
+}
+
+func dial(ctx context.Context, dialer func(ctx context.Context, network, addr string) (net.Conn, error), m *Milter) (*conn, error) {
+	if m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+	nc, err := dialer(ctx, m.Network, m.Address)
+	if err != nil {
+		return nil, fmt.Errorf("milter: failed to connect to %v: %v", m.Address, err)
+	}
+
+	c := &conn{milter: m, nc: nc, br: bufio.NewReader(nc)}
+	if err := c.negotiate(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *conn) setDeadline() {
+	if c.milter.Timeout > 0 {
+		c.nc.SetDeadline(time.Now().Add(c.milter.Timeout))
+	}
+}
+
+func (c *conn) writePacket(cmd byte, data []byte) error {
+	c.setDeadline()
+	buf := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)+1))
+	buf[4] = cmd
+	copy(buf[5:], data)
+	_, err := c.nc.Write(buf)
+	return err
+}
+
+func (c *conn) readPacket() (*response, error) {
+	c.setDeadline()
+	var header [4]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > maxPacketSize {
+		return nil, fmt.Errorf("milter: invalid packet size %v", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(c.br, buf); err != nil {
+		return nil, err
+	}
+	return &response{code: buf[0], data: buf[1:]}, nil
+}
+
+// readResponse reads a response, skipping progress notifications.
+func (c *conn) readResponse() (*response, error) {
+	for {
+		resp, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if resp.code != respProgress {
+			return resp, nil
+		}
+	}
+}
+
+func (c *conn) negotiate() error {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], protocolVersion)
+	binary.BigEndian.PutUint32(data[4:], supportedActions)
+	binary.BigEndian.PutUint32(data[8:], supportedProtocol)
+	if err := c.writePacket(cmdOptNeg, data); err != nil {
+		return err
+	}
+
+	resp, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if resp.code != cmdOptNeg || len(resp.data) < 12 {
+		return fmt.Errorf("milter: invalid option negotiation response")
+	}
+	if version := binary.BigEndian.Uint32(resp.data[0:]); version < 2 || version > protocolVersion {
+		return fmt.Errorf("milter: unsupported protocol version %v", version)
+	}
+	c.actions = binary.BigEndian.Uint32(resp.data[4:]) & supportedActions
+	c.protocol = binary.BigEndian.Uint32(resp.data[8:]) & supportedProtocol
+	// The rest of the response is the list of requested macros, which is
+	// ignored
+	return nil
+}
+
+// modificationActions maps modification responses to the action milters must
+// negotiate to send them.
+var modificationActions = map[byte]uint32{
+	respAddHeader:  actAddHeaders,
+	respInsHeader:  actAddHeaders,
+	respChgHeader:  actChgHeaders,
+	respReplBody:   actChgBody,
+	respQuarantine: actQuarantine,
+}
+
+// can checks whether the action needed by a modification response has been
+// negotiated.
+func (c *conn) can(code byte) bool {
+	return c.actions&modificationActions[code] != 0
+}
+
+// has checks whether a protocol flag has been negotiated.
+func (c *conn) has(flag uint32) bool {
+	return c.protocol&flag != 0
+}
+
+// macros sends macros for a command. kv contains names and values.
+func (c *conn) macros(cmd byte, kv ...string) error {
+	if len(kv) == 0 {
+		return nil
+	}
+	data := []byte{cmd}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] == "" {
+			continue
+		}
+		data = appendCString(data, kv[i])
+		data = appendCString(data, kv[i+1])
+	}
+	return c.writePacket(cmdMacro, data)
+}
+
+// send sends a command and reads the response. If noReply is set, the
+// milter doesn't reply and the continue response is returned.
+func (c *conn) send(cmd byte, data []byte, noReply bool) (*response, error) {
+	if err := c.writePacket(cmd, data); err != nil {
+		return nil, err
+	}
+	if noReply {
+		return continueResponse, nil
+	}
+	return c.readResponse()
+}
+
+func (c *conn) close() {
+	if c.err == nil {
+		c.writePacket(cmdQuit, nil)
+	}
+	c.nc.Close()
+}
+
+func appendCString(b []byte, s string) []byte {
+	b = append(b, s...)
+	return append(b, 0)
+}
+
+func trimNUL(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// readCStrings reads n NUL-terminated strings.
+func readCStrings(b []byte, n int) ([]string, error) {
+	l := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		j := strings.IndexByte(string(b), 0)
+		if j < 0 {
+			return nil, errors.New("milter: malformed response")
+		}
+		l = append(l, string(b[:j]))
+		b = b[j+1:]
+	}
+	return l, nil
+}
@@ -0,0 +1,165 @@
+package milter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// headerField is a raw header field. The value contains everything after
+// the colon, including the leading space and folding CRLFs.
+type headerField struct {
+	name, value string
+}
+
+// message is a message being filtered.
+type message struct {
+	header []headerField
+	body   []byte
+}
+
+// parseMessage splits a message into its header fields and body.
+func parseMessage(b []byte) *message {
+	var msg message
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			i = len(b) - 1
+		}
+		line := b[:i+1]
+		trimmed := strings.TrimRight(string(line), "\r\n")
+
+		if trimmed == "" {
+			b = b[i+1:]
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(msg.header) > 0 {
+			msg.header[len(msg.header)-1].value += "\r\n" + trimmed
+			b = b[i+1:]
+			continue
+		}
+		name, value, ok := strings.Cut(trimmed, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			// Not a header field: no header
+			if len(msg.header) == 0 {
+				break
+			}
+			return &message{header: msg.header, body: b}
+		}
+		msg.header = append(msg.header, headerField{name, value})
+		b = b[i+1:]
+	}
+	msg.body = b
+	return &msg
+}
+
+// bytes formats the message.
+func (msg *message) bytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range msg.header {
+		buf.WriteString(f.name)
+		buf.WriteString(":")
+		buf.WriteString(f.value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(msg.body)
+	return buf.Bytes()
+}
+
+// toMilter converts a header value to the format sent to milters: the
+// leading whitespace is removed unless the milter asked for it, and
+// folding uses LF as in libmilter.
+func toMilter(value string, leadSpace bool) string {
+	if !leadSpace {
+		value = strings.TrimLeft(value, " \t")
+	}
+	return strings.ReplaceAll(value, "\r\n", "\n")
+}
+
+// fromMilter converts a header value sent by a milter.
+func fromMilter(value string, leadSpace bool) string {
+	value = strings.ReplaceAll(strings.ReplaceAll(value, "\r\n", "\n"), "\n", "\r\n")
+	if !leadSpace {
+		value = " " + value
+	}
+	return value
+}
+
+// modification is a message modification requested by a milter.
+type modification struct {
+	code  byte
+	index int
+	name  string
+	value string
+	body  []byte
+}
+
+func parseModification(resp *response) (*modification, error) {
+	mod := &modification{code: resp.code}
+	data := resp.data
+	switch resp.code {
+	case respInsHeader, respChgHeader:
+		if len(data) < 4 {
+			return nil, errors.New("milter: malformed response")
+		}
+		mod.index = int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		fallthrough
+	case respAddHeader:
+		l, err := readCStrings(data, 2)
+		if err != nil {
+			return nil, err
+		}
+		mod.name, mod.value = l[0], l[1]
+	case respReplBody:
+		mod.body = data
+	case respQuarantine:
+		mod.value = string(trimNUL(data))
+	}
+	return mod, nil
+}
+
+// apply applies modifications to a message. replBody is true if the body
+// has been replaced by a previous modification of the same milter.
+func (msg *message) apply(mod *modification, leadSpace bool, replBody *bool) {
+	switch mod.code {
+	case respAddHeader:
+		msg.header = append(msg.header, headerField{mod.name, fromMilter(mod.value, leadSpace)})
+	case respInsHeader:
+		i := mod.index
+		if i > len(msg.header) {
+			i = len(msg.header)
+		}
+		f := headerField{mod.name, fromMilter(mod.value, leadSpace)}
+		msg.header = append(msg.header[:i], append([]headerField{f}, msg.header[i:]...)...)
+	case respChgHeader:
+		// The index is the 1-based occurrence of the field name
+		n := 0
+		for i, f := range msg.header {
+			if !strings.EqualFold(f.name, mod.name) {
+				continue
+			}
+			n++
+			if n != mod.index {
+				continue
+			}
+			if mod.value == "" {
+				msg.header = append(msg.header[:i], msg.header[i+1:]...)
+			} else {
+				msg.header[i].value = fromMilter(mod.value, leadSpace)
+			}
+			return
+		}
+		if mod.value != "" {
+			msg.header = append(msg.header, headerField{mod.name, fromMilter(mod.value, leadSpace)})
+		}
+	case respReplBody:
+		if !*replBody {
+			msg.body = nil
+			*replBody = true
+		}
+		msg.body = append(msg.body, mod.body...)
+	}
+}
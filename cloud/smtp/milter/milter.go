@@ -0,0 +1,514 @@
+// Package milter implements the MTA side of the Sendmail milter protocol
+// (version 6), to filter messages received by an smtp.Server with external
+// filters such as rspamd, OpenDKIM or clamav-milter.
+//
+// Filter is an smtp.Backend wrapper forwarding SMTP events to milters, and
+// applying their actions: accept, reject, tempfail, discard, header changes,
+// body replacement and quarantine. Envelope changes aren't supported.
+package milter
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Milter is the address of a milter.
+type Milter struct {
+	// The type of network, "tcp" or "unix".
+	Network string
+	// TCP or Unix address of the milter.
+	Address string
+	// Timeout for connecting and for each command. Zero means no timeout.
+	Timeout time.Duration
+	// If true, the milter is skipped when it fails. Otherwise, messages are
+	// temporarily rejected.
+	FailOpen bool
+}
+
+// QuarantineSession is an optional interface for sessions. It's used when a
+// milter quarantines a message: Quarantine is called before Data.
+//
+// If the session doesn't implement this interface, quarantined messages are
+// rejected.
+type QuarantineSession interface {
+	smtp.Session
+
+	Quarantine(reason string) error
+}
+
+// Filter is a backend wrapper filtering sessions with milters. Milters are
+// called in order, and each one sees the message as modified by the
+// previous ones.
+type Filter struct {
+	Backend smtp.Backend
+	Milters []*Milter
+
+	// Hostname of the server, sent to milters with the "j" macro.
+	Hostname string
+	// Dial connects to milters. If nil, net.Dialer is used.
+	Dial     func(ctx context.Context, network, addr string) (net.Conn, error)
+	ErrorLog smtp.Logger
+}
+
+var _ smtp.Backend = (*Filter)(nil)
+
+// NewFilter creates a new milter backend wrapper.
+func NewFilter(be smtp.Backend, milters ...*Milter) *Filter {
+	return &Filter{
+		Backend:  be,
+		Milters:  milters,
+		Hostname: "localhost",
+		Dial:     (&net.Dialer{}).DialContext,
+		ErrorLog: log.New(os.Stderr, "smtp/milter ", log.LstdFlags),
+	}
+}
+
+// NewSession implements smtp.Backend.
+func (f *Filter) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s := &session{filter: f, conn: c}
+	for _, m := range f.Milters {
+		mc, err := dial(context.Background(), f.Dial, m)
+		if err != nil {
+			f.ErrorLog.Printf("%v", err)
+			if m.FailOpen {
+				continue
+			}
+			s.close()
+			return nil, errTempfail
+		}
+		s.milters = append(s.milters, mc)
+	}
+
+	if err := s.connect(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	inner, err := f.Backend.NewSession(c)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.Session = inner
+	return s, nil
+}
+
+type session struct {
+	smtp.Session
+	filter  *Filter
+	conn    *smtp.Conn
+	milters []*conn
+
+	queueID    string
+	discard    bool
+	quarantine string
+}
+
+var (
+	_ smtp.AuthSession = (*session)(nil)
+	_ smtp.LMTPSession = (*session)(nil)
+)
+
+func (s *session) close() {
+	for _, mc := range s.milters {
+		mc.close()
+	}
+	s.milters = nil
+}
+
+// fail handles a communication failure with a milter.
+func (s *session) fail(mc *conn, err error) error {
+	if mc.err == nil {
+		s.filter.ErrorLog.Printf("milter %v failed: %v", mc.milter.Address, err)
+		mc.err = err
+		mc.nc.Close()
+	}
+	if mc.milter.FailOpen {
+		return nil
+	}
+	return errTempfail
+}
+
+// event sends an event to all milters. Milters which negotiated the noFlag
+// protocol flag don't get the event, milters which negotiated the nrFlag
+// protocol flag don't reply. message indicates whether the event is part of
+// a mail transaction.
+func (s *session) event(message bool, cmd byte, data []byte, noFlag, nrFlag uint32, macros ...string) error {
+	for _, mc := range s.milters {
+		if mc.err != nil {
+			if err := s.fail(mc, mc.err); err != nil {
+				return err
+			}
+			continue
+		}
+		if mc.acceptedConn || (message && mc.acceptedMsg) || mc.has(noFlag) {
+			continue
+		}
+		if message {
+			mc.inMessage = true
+		}
+
+		if err := mc.macros(cmd, macros...); err != nil {
+			if err := s.fail(mc, err); err != nil {
+				return err
+			}
+			continue
+		}
+		resp, err := mc.send(cmd, data, mc.has(nrFlag))
+		if err != nil {
+			if err := s.fail(mc, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch resp.code {
+		case respContinue:
+		case respAccept:
+			if message {
+				mc.acceptedMsg = true
+			} else {
+				mc.acceptedConn = true
+			}
+		case respDiscard:
+			if message {
+				s.discard = true
+			} else {
+				mc.acceptedConn = true
+			}
+		case respReject, respTempfail, respReplyCode:
+			return resp.error()
+		default:
+			err := fmt.Errorf("milter: unexpected response %q", resp.code)
+			if err := s.fail(mc, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *session) connect() error {
+	hostname, family, port, addr := "localhost", byte('U'), uint16(0), ""
+	if tcpAddr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		family, port, addr = '4', uint16(tcpAddr.Port), tcpAddr.IP.String()
+		if tcpAddr.IP.To4() == nil {
+			family = '6'
+		}
+		hostname = "[" + addr + "]"
+	}
+	if info := s.conn.XClient(); info != nil && info.Name != "" {
+		hostname = info.Name
+	}
+
+	data := appendCString(nil, hostname)
+	data = append(data, family)
+	if family != 'U' {
+		data = append(data, byte(port>>8), byte(port))
+		data = appendCString(data, addr)
+	}
+	err := s.event(false, cmdConnect, data, protoNoConnect, protoNRConnect,
+		"j", s.filter.Hostname,
+		"{daemon_name}", s.filter.Hostname,
+		"{client_addr}", addr,
+		"{client_name}", hostname)
+	if err != nil {
+		return err
+	}
+
+	var tlsMacros []string
+	if cs, ok := s.conn.TLSConnectionState(); ok {
+		tlsMacros = []string{"{tls_version}", tls.VersionName(cs.Version), "{cipher}", tls.CipherSuiteName(cs.CipherSuite)}
+	}
+	helo := appendCString(nil, s.conn.Hostname())
+	return s.event(false, cmdHelo, helo, protoNoHelo, protoNRHelo, tlsMacros...)
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	s.resetMessage()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	s.queueID = hex.EncodeToString(b)
+
+	data := appendCString(nil, "<"+from+">")
+	if opts != nil {
+		if opts.Size > 0 {
+			data = appendCString(data, "SIZE="+strconv.FormatInt(opts.Size, 10))
+		}
+		if opts.Body != "" {
+			data = appendCString(data, "BODY="+string(opts.Body))
+		}
+	}
+	if err := s.event(true, cmdMail, data, protoNoMail, protoNRMail, "i", s.queueID, "{mail_addr}", from); err != nil {
+		return err
+	}
+	return s.Session.Mail(from, opts)
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	data := appendCString(nil, "<"+to+">")
+	if err := s.event(true, cmdRcpt, data, protoNoRcpt, protoNRRcpt, "{rcpt_addr}", to); err != nil {
+		return err
+	}
+	return s.Session.Rcpt(to, opts)
+}
+
+// runFilters runs the milters on a message. It returns a nil message if the
+// message must be discarded.
+func (s *session) runFilters(r io.Reader) (io.Reader, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.discard {
+		if err := s.event(true, cmdData, nil, protoNoData, protoNRData); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := parseMessage(b)
+	for _, mc := range s.milters {
+		if s.discard {
+			break
+		}
+		if mc.err != nil || mc.acceptedConn || mc.acceptedMsg {
+			continue
+		}
+		if err := s.filterMessage(mc, msg); err != nil {
+			if mc.err == nil {
+				return nil, err
+			}
+			if err := s.fail(mc, err); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.discard {
+		return nil, nil
+	}
+	if s.quarantine != "" {
+		qs, ok := s.Session.(QuarantineSession)
+		if !ok {
+			return nil, &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Message quarantined: " + s.quarantine,
+			}
+		}
+		if err := qs.Quarantine(s.quarantine); err != nil {
+			return nil, err
+		}
+	}
+	return bytes.NewReader(msg.bytes()), nil
+}
+
+// filterMessage sends the header and body of a message to a milter, and
+// applies the requested modifications. A communication error is recorded in
+// mc.err.
+func (s *session) filterMessage(mc *conn, msg *message) error {
+	mc.inMessage = true
+	leadSpace := mc.has(protoHdrLeadSpc)
+
+	// handle handles a response. done is set if the milter doesn't need the
+	// rest of the message.
+	handle := func(resp *response) (done bool, err error) {
+		switch resp.code {
+		case respContinue:
+			return false, nil
+		case respAccept:
+			mc.acceptedMsg = true
+			return true, nil
+		case respDiscard:
+			s.discard = true
+			return true, nil
+		case respReject, respTempfail, respReplyCode:
+			return true, resp.error()
+		default:
+			mc.err = fmt.Errorf("milter: unexpected response %q", resp.code)
+			return true, mc.err
+		}
+	}
+	send := func(cmd byte, data []byte, nrFlag uint32) (done bool, err error) {
+		resp, err := mc.send(cmd, data, mc.has(nrFlag))
+		if err != nil {
+			mc.err = err
+			return true, err
+		}
+		return handle(resp)
+	}
+
+	if !mc.has(protoNoHeaders) {
+		for _, f := range msg.header {
+			data := appendCString(nil, f.name)
+			data = appendCString(data, toMilter(f.value, leadSpace))
+			if done, err := send(cmdHeader, data, protoNRHeader); done || err != nil {
+				return err
+			}
+		}
+	}
+	if !mc.has(protoNoEOH) {
+		if done, err := send(cmdEOH, nil, protoNREOH); done || err != nil {
+			return err
+		}
+	}
+	if !mc.has(protoNoBody) {
+		for body := msg.body; len(body) > 0; {
+			n := len(body)
+			if n > maxChunkSize {
+				n = maxChunkSize
+			}
+			resp, err := mc.send(cmdBody, body[:n], mc.has(protoNRBody))
+			if err != nil {
+				mc.err = err
+				return err
+			}
+			body = body[n:]
+			if resp.code == respSkip {
+				// The milter doesn't need the rest of the body
+				break
+			}
+			if done, err := handle(resp); done || err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.endOfMessage(mc, msg)
+}
+
+// endOfMessage sends the end of message command, reads the modifications
+// and applies them if the message is accepted.
+func (s *session) endOfMessage(mc *conn, msg *message) error {
+	mc.inMessage = false
+	if err := mc.macros(cmdEOB, "i", s.queueID); err != nil {
+		mc.err = err
+		return err
+	}
+	if err := mc.writePacket(cmdEOB, nil); err != nil {
+		mc.err = err
+		return err
+	}
+
+	var mods []*modification
+	for {
+		resp, err := mc.readResponse()
+		if err != nil {
+			mc.err = err
+			return err
+		}
+
+		switch resp.code {
+		case respAddHeader, respInsHeader, respChgHeader, respReplBody, respQuarantine:
+			if !mc.can(resp.code) {
+				mc.err = fmt.Errorf("milter: modification %q without negotiated action", resp.code)
+				return mc.err
+			}
+			mod, err := parseModification(resp)
+			if err != nil {
+				mc.err = err
+				return err
+			}
+			mods = append(mods, mod)
+			continue
+		case respAddRcpt, respDelRcpt, respChgFrom:
+			s.filter.ErrorLog.Printf("milter %v: ignoring unsupported envelope change %q", mc.milter.Address, resp.code)
+			continue
+		case respAccept, respContinue:
+		case respDiscard:
+			s.discard = true
+			return nil
+		case respReject, respTempfail, respReplyCode:
+			return resp.error()
+		default:
+			mc.err = fmt.Errorf("milter: unexpected response %q", resp.code)
+			return mc.err
+		}
+		break
+	}
+
+	replBody := false
+	for _, mod := range mods {
+		if mod.code == respQuarantine {
+			s.quarantine = mod.value
+			continue
+		}
+		msg.apply(mod, mc.has(protoHdrLeadSpc), &replBody)
+	}
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	fr, err := s.runFilters(r)
+	if err != nil || fr == nil {
+		return err
+	}
+	return s.Session.Data(fr)
+}
+
+func (s *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	fr, err := s.runFilters(r)
+	if err != nil || fr == nil {
+		return err
+	}
+	if ls, ok := s.Session.(smtp.LMTPSession); ok {
+		return ls.LMTPData(fr, status)
+	}
+	return s.Session.Data(fr)
+}
+
+func (s *session) AuthMechanisms() []string {
+	if as, ok := s.Session.(smtp.AuthSession); ok {
+		return as.AuthMechanisms()
+	}
+	return nil
+}
+
+func (s *session) Auth(mech string) (sasl.Server, error) {
+	if as, ok := s.Session.(smtp.AuthSession); ok {
+		return as.Auth(mech)
+	}
+	return nil, smtp.ErrAuthUnsupported
+}
+
+// resetMessage aborts the current message for all milters.
+func (s *session) resetMessage() {
+	for _, mc := range s.milters {
+		if mc.inMessage && mc.err == nil {
+			if err := mc.writePacket(cmdAbort, nil); err != nil {
+				s.fail(mc, err)
+			}
+		}
+		mc.inMessage = false
+		mc.acceptedMsg = false
+	}
+	s.discard = false
+	s.quarantine = ""
+}
+
+func (s *session) Reset() {
+	s.resetMessage()
+	s.Session.Reset()
+}
+
+func (s *session) Logout() error {
+	s.close()
+	return s.Session.Logout()
+}
@@ -0,0 +1,316 @@
+package milter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type backend struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (be *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &testSession{backend: be}, nil
+}
+
+type testSession struct {
+	backend *backend
+}
+
+func (s *testSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *testSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (s *testSession) Reset()                                         {}
+func (s *testSession) Logout() error                                  { return nil }
+
+func (s *testSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.backend.mutex.Lock()
+	s.backend.messages = append(s.backend.messages, string(b))
+	s.backend.mutex.Unlock()
+	return nil
+}
+
+// fakeMilter is an in-process milter.
+type fakeMilter struct {
+	protocol uint32
+	// Negotiated actions, supportedActions if zero
+	actions uint32
+	// handle returns the responses to a command. Macros, aborts and
+	// commands without reply aren't passed to handle.
+	handle func(cmd byte, data []byte) []*response
+
+	mutex   sync.Mutex
+	headers []string
+}
+
+func (m *fakeMilter) serve(nc net.Conn) {
+	c := &conn{milter: &Milter{}, nc: nc, br: bufio.NewReader(nc)}
+	defer nc.Close()
+	for {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return
+		}
+
+		var resps []*response
+		switch pkt.code {
+		case cmdOptNeg:
+			data := make([]byte, 12)
+			binary.BigEndian.PutUint32(data[0:], protocolVersion)
+			actions := m.actions
+			if actions == 0 {
+				actions = supportedActions
+			}
+			binary.BigEndian.PutUint32(data[4:], actions)
+			binary.BigEndian.PutUint32(data[8:], m.protocol)
+			resps = []*response{{code: cmdOptNeg, data: data}}
+		case cmdMacro, cmdAbort:
+			continue
+		case cmdQuit:
+			return
+		case cmdHeader:
+			l, _ := readCStrings(pkt.data, 2)
+			m.mutex.Lock()
+			m.headers = append(m.headers, l[0]+": "+l[1])
+			m.mutex.Unlock()
+			if m.protocol&protoNRHeader != 0 {
+				continue
+			}
+			fallthrough
+		default:
+			resps = m.handle(pkt.code, pkt.data)
+			if len(resps) == 0 {
+				resps = []*response{continueResponse}
+			}
+		}
+
+		for _, resp := range resps {
+			if err := c.writePacket(resp.code, resp.data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func newLocalListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ln, err = net.Listen("tcp6", "[::1]:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func testServer(t *testing.T, be smtp.Backend, milters ...*fakeMilter) (*smtp.Client, *Filter) {
+	var addrs []*Milter
+	for i := range milters {
+		addrs = append(addrs, &Milter{Network: "tcp", Address: string(rune('0' + i))})
+	}
+	f := NewFilter(be, addrs...)
+	f.ErrorLog = log.New(io.Discard, "", 0)
+	f.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		i := int(addr[0] - '0')
+		if i >= len(milters) || milters[i] == nil {
+			return nil, errors.New("connection refused")
+		}
+		c1, c2 := net.Pipe()
+		go milters[i].serve(c2)
+		return c1, nil
+	}
+
+	l := newLocalListener(t)
+	s := smtp.NewServer(f)
+	s.Domain = "mx.example.com"
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, f
+}
+
+const testMsg = "From: sender@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"X-Folded: a\r\n" +
+	"\tb\r\n" +
+	"\r\n" +
+	"Hi!\r\n"
+
+func modResponse(code byte, index int, kv ...string) *response {
+	var data []byte
+	if code == respInsHeader || code == respChgHeader {
+		data = binary.BigEndian.AppendUint32(data, uint32(index))
+	}
+	for _, s := range kv {
+		data = appendCString(data, s)
+	}
+	return &response{code: code, data: data}
+}
+
+func TestFilter(t *testing.T) {
+	m := &fakeMilter{
+		protocol: protoNRHeader,
+		handle: func(cmd byte, data []byte) []*response {
+			switch cmd {
+			case cmdRcpt:
+				if strings.Contains(string(data), "bad@") {
+					return []*response{{code: respReplyCode, data: appendCString(nil, "550 5.1.1 No such user")}}
+				}
+			case cmdEOB:
+				return []*response{
+					modResponse(respAddHeader, 0, "X-Spam", "yes"),
+					modResponse(respChgHeader, 1, "Subject", "[SPAM] Hello"),
+					modResponse(respChgHeader, 1, "X-Folded", ""),
+					modResponse(respInsHeader, 0, "Received", "by milter"),
+					{code: respReplBody, data: []byte("Filtered\r\n")},
+					{code: respAccept},
+				}
+			}
+			return nil
+		},
+	}
+	be := &backend{}
+	c, _ := testServer(t, be, m)
+
+	var smtpErr *smtp.SMTPError
+	if err := c.SendMail("sender@example.org", []string{"bad@example.com"}, strings.NewReader(testMsg)); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("SendMail() = %v, want 550", err)
+	} else if smtpErr.Message != "No such user" {
+		t.Errorf("SendMail() = %v, want custom reply", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatalf("Reset() = %v", err)
+	}
+	if err := c.SendMail("sender@example.org", []string{"rcpt@example.com"}, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	want := "Received: by milter\r\n" +
+		"From: sender@example.org\r\n" +
+		"Subject: [SPAM] Hello\r\n" +
+		"X-Spam: yes\r\n" +
+		"\r\n" +
+		"Filtered\r\n"
+	if len(be.messages) != 1 || be.messages[0] != want {
+		t.Errorf("messages = %q, want %q", be.messages, want)
+	}
+
+	wantHeaders := []string{"From: sender@example.org", "Subject: Hello", "X-Folded: a\n\tb"}
+	if strings.Join(m.headers, "|") != strings.Join(wantHeaders, "|") {
+		t.Errorf("milter got headers %q, want %q", m.headers, wantHeaders)
+	}
+}
+
+func TestFilter_actions(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		cmd       byte
+		resp      *response
+		wantCode  int
+		delivered bool
+	}{
+		{"discard", cmdMail, &response{code: respDiscard}, 0, false},
+		{"accept", cmdRcpt, &response{code: respAccept}, 0, true},
+		{"tempfail", cmdEOH, &response{code: respTempfail}, 451, false},
+		{"reject", cmdBody, &response{code: respReject}, 550, false},
+		{"quarantine", cmdEOB, modResponse(respQuarantine, 0, "virus"), 554, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &fakeMilter{handle: func(cmd byte, data []byte) []*response {
+				if cmd == tc.cmd {
+					if tc.resp.code == respQuarantine {
+						return []*response{tc.resp, continueResponse}
+					}
+					return []*response{tc.resp}
+				}
+				return nil
+			}}
+			be := &backend{}
+			c, _ := testServer(t, be, m)
+
+			err := c.SendMail("sender@example.org", []string{"rcpt@example.com"}, strings.NewReader(testMsg))
+			var smtpErr *smtp.SMTPError
+			if tc.wantCode == 0 {
+				if err != nil {
+					t.Fatalf("SendMail() = %v", err)
+				}
+			} else if !errors.As(err, &smtpErr) || smtpErr.Code != tc.wantCode {
+				t.Fatalf("SendMail() = %v, want code %v", err, tc.wantCode)
+			}
+			if delivered := len(be.messages) == 1; delivered != tc.delivered {
+				t.Errorf("delivered = %v, want %v", delivered, tc.delivered)
+			}
+		})
+	}
+}
+
+func TestFilter_failure(t *testing.T) {
+	be := &backend{}
+	c, _ := testServer(t, be, nil)
+	var smtpErr *smtp.SMTPError
+	if err := c.Hello("localhost"); !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Errorf("Hello() = %v, want 451", err)
+	}
+
+	c, f := testServer(t, be, nil)
+	f.Milters[0].FailOpen = true
+	if err := c.SendMail("sender@example.org", []string{"rcpt@example.com"}, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+	if len(be.messages) != 1 || be.messages[0] != testMsg {
+		t.Errorf("messages = %q, want %q", be.messages, []string{testMsg})
+	}
+}
+
+func TestFilter_unnegotiatedAction(t *testing.T) {
+	for _, failOpen := range []bool{false, true} {
+		m := &fakeMilter{
+			actions: actAddHeaders,
+			handle: func(cmd byte, data []byte) []*response {
+				if cmd == cmdEOB {
+					return []*response{
+						modResponse(respAddHeader, 0, "X-Spam", "yes"),
+						{code: respReplBody, data: []byte("Filtered\r\n")},
+						{code: respAccept},
+					}
+				}
+				return nil
+			},
+		}
+		be := &backend{}
+		c, f := testServer(t, be, m)
+		f.Milters[0].FailOpen = failOpen
+
+		err := c.SendMail("sender@example.org", []string{"rcpt@example.com"}, strings.NewReader(testMsg))
+		var smtpErr *smtp.SMTPError
+		if failOpen {
+			if err != nil {
+				t.Fatalf("SendMail() = %v", err)
+			}
+			if len(be.messages) != 1 || be.messages[0] != testMsg {
+				t.Errorf("messages = %q, want %q", be.messages, []string{testMsg})
+			}
+		} else if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+			t.Errorf("SendMail() = %v, want 451", err)
+		}
+	}
+}
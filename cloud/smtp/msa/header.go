@@ -0,0 +1,80 @@
+package msa
+
+import (
+	"bytes"
+	"strings"
+)
+
+// headerField is a raw header field, without the final CRLF.
+type headerField struct {
+	name string
+	raw  string
+}
+
+// value returns the unfolded value of the field.
+func (f headerField) value() string {
+	_, v, _ := strings.Cut(f.raw, ":")
+	v = strings.ReplaceAll(v, "\r\n", "")
+	return strings.TrimSpace(v)
+}
+
+// splitMessage splits a message into its header fields and body. Lines are
+// normalized to CRLF in the header.
+func splitMessage(b []byte) (header []headerField, body []byte) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			i = len(b) - 1
+		}
+		line := strings.TrimRight(string(b[:i+1]), "\r\n")
+		if line == "" {
+			return header, b[i+1:]
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(header) > 0 {
+			header[len(header)-1].raw += "\r\n" + line
+		} else {
+			name, _, ok := strings.Cut(line, ":")
+			if !ok {
+				// Malformed header, consider the rest as the body
+				return header, b
+			}
+			header = append(header, headerField{strings.TrimSpace(name), line})
+		}
+		b = b[i+1:]
+	}
+	return header, nil
+}
+
+func joinMessage(header []headerField, body []byte) []byte {
+	var buf bytes.Buffer
+	for _, f := range header {
+		buf.WriteString(f.raw)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// headerValues returns the values of all fields with the specified name.
+func headerValues(header []headerField, name string) []string {
+	var l []string
+	for _, f := range header {
+		if strings.EqualFold(f.name, name) {
+			l = append(l, f.value())
+		}
+	}
+	return l
+}
+
+// removeHeader removes all fields with the specified name.
+func removeHeader(header []headerField, name string) []headerField {
+	out := header[:0]
+	for _, f := range header {
+		if !strings.EqualFold(f.name, name) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
@@ -0,0 +1,268 @@
+// Package msa implements a message submission agent (RFC 6409) on top of
+// smtp.Server.
+//
+// Submission is an smtp.Backend wrapper enforcing the stricter rules of the
+// submission port (587): clients must authenticate before sending, and can
+// only send messages from their own addresses. Messages are fixed up (missing
+// Message-ID and Date fields are added, Bcc fields are removed) and DKIM
+// signed before being handed to the backend.
+package msa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/unix-world/smartgoplus/cloud/msgauth/dkim"
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+// Authenticator checks user credentials. credstore.Authenticator implements
+// this interface.
+type Authenticator interface {
+	// Authenticate checks the password of a user. smtp.ErrAuthFailed should
+	// be returned for invalid credentials, other errors are reported as
+	// temporary failures.
+	Authenticate(username, password string) error
+}
+
+// KeyProvider provides DKIM keys.
+type KeyProvider interface {
+	// SignOptions returns the DKIM signing options for a domain, or nil if
+	// messages from this domain must not be signed.
+	SignOptions(domain string) (*dkim.SignOptions, error)
+}
+
+// KeyMap is a KeyProvider with static signing options, indexed by
+// lower-case domain.
+type KeyMap map[string]*dkim.SignOptions
+
+var _ KeyProvider = KeyMap(nil)
+
+// SignOptions implements KeyProvider.
+func (m KeyMap) SignOptions(domain string) (*dkim.SignOptions, error) {
+	return m[strings.ToLower(domain)], nil
+}
+
+// LoginSession is an optional interface for sessions. If implemented, Login
+// is called once the client is authenticated. An error aborts the
+// authentication.
+type LoginSession interface {
+	smtp.Session
+
+	Login(username string) error
+}
+
+// Submission is a backend wrapper implementing a message submission agent.
+type Submission struct {
+	Backend       smtp.Backend
+	Authenticator Authenticator
+
+	// AllowSender checks whether a user can send messages from an address,
+	// both in MAIL FROM and in the From header field. By default, the
+	// address must be the username.
+	AllowSender func(username, addr string) bool
+	// DKIM keys used to sign messages, by From domain. Optional.
+	Keys KeyProvider
+	// Domain used in generated Message-ID fields.
+	Hostname string
+
+	// Returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+var _ smtp.Backend = (*Submission)(nil)
+
+// NewSubmission creates a new message submission backend wrapper.
+func NewSubmission(be smtp.Backend, auth Authenticator) *Submission {
+	return &Submission{
+		Backend:       be,
+		Authenticator: auth,
+		Hostname:      "localhost",
+	}
+}
+
+func (sub *Submission) now() time.Time {
+	if sub.Now != nil {
+		return sub.Now()
+	}
+	return time.Now()
+}
+
+func (sub *Submission) allowSender(username, addr string) bool {
+	if sub.AllowSender != nil {
+		return sub.AllowSender(username, addr)
+	}
+	return addr != "" && strings.EqualFold(username, addr)
+}
+
+// NewSession implements smtp.Backend.
+func (sub *Submission) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := sub.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &session{Session: s, submission: sub}, nil
+}
+
+var (
+	errSenderNotAllowed = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not allowed for this user",
+	}
+	errFromNotAllowed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "From header field not allowed for this user",
+	}
+	errInvalidFrom = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Missing or malformed From header field",
+	}
+)
+
+type session struct {
+	smtp.Session
+	submission *Submission
+	username   string
+}
+
+var _ smtp.AuthSession = (*session)(nil)
+
+func (s *session) AuthMechanisms() []string {
+	return []string{sasl.Plain, sasl.Login}
+}
+
+func (s *session) Auth(mech string) (sasl.Server, error) {
+	if s.username != "" {
+		return nil, &smtp.SMTPError{
+			Code:         503,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Already authenticated",
+		}
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return smtp.ErrAuthFailed
+			}
+			return s.authenticate(username, password)
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(s.authenticate), nil
+	default:
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+}
+
+func (s *session) authenticate(username, password string) error {
+	if err := s.submission.Authenticator.Authenticate(username, password); err != nil {
+		return err
+	}
+	if ls, ok := s.Session.(LoginSession); ok {
+		if err := ls.Login(username); err != nil {
+			return err
+		}
+	}
+	s.username = username
+	return nil
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.username == "" {
+		return smtp.ErrAuthRequired
+	}
+	if !s.submission.allowSender(s.username, from) {
+		return errSenderNotAllowed
+	}
+	return s.Session.Mail(from, opts)
+}
+
+func (s *session) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b, err = s.prepare(b)
+	if err != nil {
+		return err
+	}
+	return s.Session.Data(bytes.NewReader(b))
+}
+
+// prepare checks and fixes up a submitted message, and signs it.
+func (s *session) prepare(b []byte) ([]byte, error) {
+	sub := s.submission
+	header, body := splitMessage(b)
+
+	from := headerValues(header, "From")
+	if len(from) != 1 {
+		return nil, errInvalidFrom
+	}
+	addrs, err := mail.ParseAddressList(from[0])
+	if err != nil || len(addrs) == 0 {
+		return nil, errInvalidFrom
+	}
+	for _, addr := range addrs {
+		if !sub.allowSender(s.username, addr.Address) {
+			return nil, errFromNotAllowed
+		}
+	}
+
+	header = removeHeader(header, "Bcc")
+	if len(headerValues(header, "Date")) == 0 {
+		date := sub.now().Format("Mon, 02 Jan 2006 15:04:05 -0700")
+		header = append(header, headerField{"Date", "Date: " + date})
+	}
+	if len(headerValues(header, "Message-Id")) == 0 {
+		id, err := messageID(sub.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, headerField{"Message-Id", "Message-Id: " + id})
+	}
+	b = joinMessage(header, body)
+
+	if sub.Keys == nil {
+		return b, nil
+	}
+	domain := addrs[0].Address[strings.LastIndexByte(addrs[0].Address, '@')+1:]
+	options, err := sub.Keys.SignOptions(domain)
+	if err != nil {
+		return nil, signError(err)
+	} else if options == nil {
+		return b, nil
+	}
+
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(b), options); err != nil {
+		return nil, signError(err)
+	}
+	return signed.Bytes(), nil
+}
+
+func signError(err error) error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      fmt.Sprintf("DKIM signing failed: %v", err),
+	}
+}
+
+func messageID(hostname string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "<" + hex.EncodeToString(b) + "@" + hostname + ">", nil
+}
@@ -0,0 +1,154 @@
+package msa
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/unix-world/smartgoplus/cloud/msgauth/dkim"
+	"github.com/unix-world/smartgoplus/cloud/sasl"
+	"github.com/unix-world/smartgoplus/cloud/smtp"
+)
+
+type backend struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (be *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &testSession{backend: be}, nil
+}
+
+type testSession struct {
+	backend *backend
+}
+
+func (s *testSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *testSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+func (s *testSession) Reset()                                         {}
+func (s *testSession) Logout() error                                  { return nil }
+
+func (s *testSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.backend.mutex.Lock()
+	s.backend.messages = append(s.backend.messages, string(b))
+	s.backend.mutex.Unlock()
+	return nil
+}
+
+type authenticator map[string]string
+
+func (a authenticator) Authenticate(username, password string) error {
+	if pass, ok := a[username]; !ok || pass != password {
+		return smtp.ErrAuthFailed
+	}
+	return nil
+}
+
+func newLocalListener(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ln, err = net.Listen("tcp6", "[::1]:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func testServer(t *testing.T, sub *Submission) *smtp.Client {
+	l := newLocalListener(t)
+	s := smtp.NewServer(sub)
+	s.Domain = "mx.example.org"
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+const testMsg = "From: Alice <alice@example.org>\r\n" +
+	"To: rcpt@example.com\r\n" +
+	"Bcc: hidden@example.net\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi!\r\n"
+
+func TestSubmission(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	be := &backend{}
+	sub := NewSubmission(be, authenticator{"alice@example.org": "secret"})
+	sub.Hostname = "mx.example.org"
+	sub.Keys = KeyMap{"example.org": {
+		Domain:   "example.org",
+		Selector: "test",
+		Signer:   priv,
+	}}
+	c := testServer(t, sub)
+	to := []string{"rcpt@example.com"}
+
+	var smtpErr *smtp.SMTPError
+	if err := c.SendMail("alice@example.org", to, strings.NewReader(testMsg)); !errors.As(err, &smtpErr) || smtpErr.Code != 502 {
+		t.Fatalf("SendMail() without AUTH = %v, want 502", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "alice@example.org", "wrong")); !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+		t.Fatalf("Auth() = %v, want 535", err)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "alice@example.org", "secret")); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+
+	if err := c.SendMail("bob@example.org", to, strings.NewReader(testMsg)); !errors.As(err, &smtpErr) || smtpErr.Code != 553 {
+		t.Errorf("SendMail() with other sender = %v, want 553", err)
+	}
+	c.Reset()
+	if err := c.SendMail("alice@example.org", to, strings.NewReader(strings.Replace(testMsg, "alice@", "bob@", 1))); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("SendMail() with other From = %v, want 550", err)
+	}
+	if err := c.SendMail("alice@example.org", to, strings.NewReader(testMsg)); err != nil {
+		t.Fatalf("SendMail() = %v", err)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatalf("got %v messages, want 1", len(be.messages))
+	}
+	msg := be.messages[0]
+	if strings.Contains(msg, "Bcc:") || strings.Contains(msg, "hidden@") {
+		t.Errorf("Bcc field not removed:\n%v", msg)
+	}
+	for _, field := range []string{"\r\nDate: ", "\r\nMessage-Id: <", "@mx.example.org>\r\n", "DKIM-Signature: "} {
+		if !strings.Contains(msg, field) {
+			t.Errorf("message doesn't contain %q:\n%v", field, msg)
+		}
+	}
+
+	verifs, err := dkim.VerifyWithOptions(strings.NewReader(msg), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify() = %v", err)
+	}
+	if len(verifs) != 1 || verifs[0].Err != nil || verifs[0].Domain != "example.org" {
+		t.Errorf("unexpected DKIM verifications: %+v", verifs)
+	}
+}
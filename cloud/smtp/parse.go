@@ -33,6 +33,13 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 		return "", "", fmt.Errorf("mangled command: %q", line)
 	}
 
+	// Postfix extension commands are longer than 4 characters
+	for _, ext := range []string{"XCLIENT", "XFORWARD"} {
+		if len(line) > len(ext) && line[len(ext)] == ' ' && strings.EqualFold(line[:len(ext)], ext) {
+			return ext, strings.TrimSpace(line[len(ext)+1:]), nil
+		}
+	}
+
 	// If we made it here, command is long enough to have args
 	if line[4] != ' ' {
 		// There wasn't a space after the command?
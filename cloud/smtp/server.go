@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"sync"
 	"time"
@@ -79,6 +80,18 @@ type Server struct {
 	// Default value of NONE to advertise no specific profile.
 	MtPriorityProfile PriorityProfile
 
+	// Advertise the XCLIENT and XFORWARD (Postfix) extensions to trusted
+	// proxies, allowing them to send information about the original client.
+	EnableXCLIENT  bool
+	EnableXFORWARD bool
+	// Networks of the proxies allowed to use XCLIENT and XFORWARD.
+	TrustedProxies []netip.Prefix
+
+	// How CR and LF characters which aren't part of a CRLF sequence are
+	// handled in message data. Defaults to LineEndingReject. Not applied to
+	// BINARYMIME messages.
+	LineEnding LineEndingPolicy
+
 	// The server backend.
 	Backend Backend
 
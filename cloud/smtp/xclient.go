@@ -0,0 +1,244 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Attributes supported by the XCLIENT and XFORWARD extensions. See
+// https://www.postfix.org/XCLIENT_README.html and
+// https://www.postfix.org/XFORWARD_README.html.
+var (
+	xclientAttrs  = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "LOGIN", "DESTADDR"}
+	xforwardAttrs = []string{"NAME", "ADDR", "PORT", "PROTO", "HELO", "IDENT", "SOURCE"}
+)
+
+// ClientInfo contains information about the original client of a proxied
+// connection, as sent by a proxy with the XCLIENT or XFORWARD extensions.
+// Attributes which weren't sent or are unavailable are left empty.
+type ClientInfo struct {
+	// Verified reverse DNS name of the client.
+	Name string
+	Addr net.IP
+	Port int
+	// "SMTP" or "ESMTP".
+	Proto string
+	// HELO or EHLO argument sent by the client.
+	Helo string
+	// SASL login name. XCLIENT only.
+	Login string
+	// Address the client connected to. XCLIENT only.
+	DestAddr net.IP
+	// Local message identifier on the proxy. XFORWARD only.
+	Ident string
+	// "LOCAL" or "REMOTE". XFORWARD only.
+	Source string
+}
+
+func isUnavailable(value string) bool {
+	return value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]"
+}
+
+func parseClientIP(value string) (net.IP, error) {
+	if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+		value = value[5:]
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	return ip, nil
+}
+
+func (info *ClientInfo) set(name, value string) error {
+	if isUnavailable(value) {
+		value = ""
+	}
+
+	var err error
+	switch name {
+	case "NAME":
+		info.Name = value
+	case "ADDR", "DESTADDR":
+		var ip net.IP
+		if value != "" {
+			if ip, err = parseClientIP(value); err != nil {
+				return err
+			}
+		}
+		if name == "ADDR" {
+			info.Addr = ip
+		} else {
+			info.DestAddr = ip
+		}
+	case "PORT":
+		info.Port = 0
+		if value != "" {
+			info.Port, err = strconv.Atoi(value)
+			if err != nil || info.Port < 0 || info.Port > 65535 {
+				return fmt.Errorf("invalid port %q", value)
+			}
+		}
+	case "PROTO":
+		info.Proto = strings.ToUpper(value)
+	case "HELO":
+		info.Helo = value
+	case "LOGIN":
+		info.Login = value
+	case "IDENT":
+		info.Ident = value
+	case "SOURCE":
+		info.Source = strings.ToUpper(value)
+		if info.Source != "" && info.Source != "LOCAL" && info.Source != "REMOTE" {
+			return fmt.Errorf("invalid source %q", value)
+		}
+	}
+	return nil
+}
+
+// parseClientAttrs parses the arguments of the XCLIENT and XFORWARD commands
+// into info.
+func parseClientAttrs(info *ClientInfo, arg string, supported []string) error {
+	fields := strings.Fields(arg)
+	if len(fields) == 0 {
+		return fmt.Errorf("missing attributes")
+	}
+	for _, field := range fields {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("malformed attribute %q", field)
+		}
+		name = strings.ToUpper(name)
+		if !containsString(supported, name) {
+			return fmt.Errorf("unsupported attribute %q", name)
+		}
+		value, err := decodeXtext(value)
+		if err != nil {
+			return err
+		}
+		if err := info.set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyTrusted checks whether the peer is allowed to use the XCLIENT and
+// XFORWARD extensions.
+func (c *Conn) proxyTrusted() bool {
+	addr, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	if !ok {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range c.server.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// XClient returns the client information sent with XCLIENT, or nil if
+// XCLIENT wasn't used.
+func (c *Conn) XClient() *ClientInfo {
+	return c.xclient
+}
+
+// XForward returns the client information sent with XFORWARD for the current
+// mail transaction, or nil if XFORWARD wasn't used.
+func (c *Conn) XForward() *ClientInfo {
+	return c.xforward
+}
+
+// RemoteAddr returns the address of the client. If a trusted proxy sent the
+// original client address with XCLIENT, this address is returned instead of
+// the address of the proxy.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.xclient != nil && c.xclient.Addr != nil {
+		return &net.TCPAddr{IP: c.xclient.Addr, Port: c.xclient.Port}
+	}
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) handleXClient(arg string) {
+	if !c.server.EnableXCLIENT {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "XCLIENT command not implemented")
+		return
+	}
+	if !c.proxyTrusted() {
+		c.writeResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Mail transaction in progress")
+		return
+	}
+
+	var info ClientInfo
+	if c.xclient != nil {
+		info = *c.xclient
+	}
+	if err := parseClientAttrs(&info, arg, xclientAttrs); err != nil {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, fmt.Sprintf("Bad XCLIENT syntax: %v", err))
+		return
+	}
+
+	// The session restarts as if the original client had connected: the
+	// backend gets a new session with the next EHLO.
+	c.reset()
+	c.locker.Lock()
+	if c.session != nil {
+		c.session.Logout()
+		c.session = nil
+	}
+	c.locker.Unlock()
+	c.helo = ""
+	c.didAuth = info.Login != ""
+	c.xclient = &info
+
+	c.greet()
+}
+
+func (c *Conn) handleXForward(arg string) {
+	if !c.server.EnableXFORWARD {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "XFORWARD command not implemented")
+		return
+	}
+	if !c.proxyTrusted() {
+		c.writeResponse(550, EnhancedCode{5, 7, 0}, "Insufficient authorization")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Mail transaction in progress")
+		return
+	}
+
+	var info ClientInfo
+	if c.xforward != nil {
+		info = *c.xforward
+	}
+	if err := parseClientAttrs(&info, arg, xforwardAttrs); err != nil {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, fmt.Sprintf("Bad XFORWARD syntax: %v", err))
+		return
+	}
+	c.xforward = &info
+
+	c.writeResponse(250, EnhancedCode{2, 0, 0}, "Ok")
+}
@@ -0,0 +1,286 @@
+// Package composemail writes email messages, complementing parsemail.
+//
+// A Message is written as an RFC 5322 message with MIME (RFC 2045) bodies:
+// non-ASCII header fields are encoded as specified in RFC 2047, attachment
+// file names as specified in RFC 2231. Text and HTML bodies are sent as
+// multipart/alternative, HTML bodies with embedded files as
+// multipart/related, and attachments as multipart/mixed.
+package composemail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attachment is a file attached to a message.
+type Attachment struct {
+	Filename    string
+	ContentType string // if empty, derived from the file name
+	Data        io.Reader
+}
+
+// EmbeddedFile is a file referenced by the HTML body with a "cid:" URL, for
+// instance an inline image.
+type EmbeddedFile struct {
+	CID         string // without angle brackets
+	ContentType string
+	Data        io.Reader
+}
+
+// Message is a message to be written.
+type Message struct {
+	// Additional header fields. Non-ASCII values are encoded.
+	Header mail.Header
+
+	Subject    string
+	Sender     *mail.Address
+	From       []*mail.Address
+	ReplyTo    []*mail.Address
+	To         []*mail.Address
+	Cc         []*mail.Address
+	Bcc        []*mail.Address // not written, see Recipients
+	Date       time.Time       // if zero, the current time is used
+	MessageID  string          // without angle brackets, generated if empty
+	InReplyTo  []string
+	References []string
+
+	TextBody string
+	HTMLBody string
+
+	Attachments   []Attachment
+	EmbeddedFiles []EmbeddedFile
+
+	// Prefix of the multipart boundaries. If empty, a random prefix is
+	// used. Setting it makes the output deterministic, e.g. for tests.
+	Boundary string
+}
+
+// Recipients returns the addresses of all recipients, including Bcc, to be
+// used in the SMTP envelope.
+func (m *Message) Recipients() []string {
+	var l []string
+	for _, list := range [][]*mail.Address{m.To, m.Cc, m.Bcc} {
+		for _, addr := range list {
+			l = append(l, addr.Address)
+		}
+	}
+	return l
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WriteTo writes the message. Data of attachments and embedded files is
+// consumed.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	if err := m.write(&buf); err != nil {
+		return 0, err
+	}
+	return buf.WriteTo(w)
+}
+
+func (m *Message) write(buf *bytes.Buffer) error {
+	date := m.Date
+	if date.IsZero() {
+		date = time.Now()
+	}
+	messageID := m.MessageID
+	if messageID == "" {
+		id, err := randomHex(16)
+		if err != nil {
+			return err
+		}
+		domain := "localhost"
+		if len(m.From) > 0 {
+			if i := strings.LastIndexByte(m.From[0].Address, '@'); i >= 0 {
+				domain = m.From[0].Address[i+1:]
+			}
+		}
+		messageID = id + "@" + domain
+	}
+	boundary := m.Boundary
+	if boundary == "" {
+		var err error
+		if boundary, err = randomHex(12); err != nil {
+			return err
+		}
+	}
+
+	writeField(buf, "Date", date.Format(time.RFC1123Z))
+	writeField(buf, "Message-ID", "<"+messageID+">")
+	if len(m.From) > 0 {
+		writeField(buf, "From", formatAddressList(m.From))
+	}
+	if m.Sender != nil {
+		writeField(buf, "Sender", m.Sender.String())
+	}
+	if len(m.ReplyTo) > 0 {
+		writeField(buf, "Reply-To", formatAddressList(m.ReplyTo))
+	}
+	if len(m.To) > 0 {
+		writeField(buf, "To", formatAddressList(m.To))
+	}
+	if len(m.Cc) > 0 {
+		writeField(buf, "Cc", formatAddressList(m.Cc))
+	}
+	if m.Subject != "" {
+		writeField(buf, "Subject", encodeWord(m.Subject))
+	}
+	if len(m.InReplyTo) > 0 {
+		writeField(buf, "In-Reply-To", formatMessageIDList(m.InReplyTo))
+	}
+	if len(m.References) > 0 {
+		writeField(buf, "References", formatMessageIDList(m.References))
+	}
+
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			writeField(buf, k, encodeWord(v))
+		}
+	}
+	writeField(buf, "MIME-Version", "1.0")
+
+	root, err := m.body()
+	if err != nil {
+		return err
+	}
+	root.write(buf, boundary)
+	return nil
+}
+
+// body builds the MIME tree of the message.
+func (m *Message) body() (*part, error) {
+	var text, html *part
+	if m.TextBody != "" || m.HTMLBody == "" {
+		text = textPart("text/plain", m.TextBody)
+	}
+	if m.HTMLBody != "" {
+		html = textPart("text/html", m.HTMLBody)
+	}
+
+	if len(m.EmbeddedFiles) > 0 {
+		root := html
+		if root == nil {
+			root, text = text, nil
+		}
+		related := &part{mediaType: "multipart/related", children: []*part{root}}
+		for _, ef := range m.EmbeddedFiles {
+			p, err := embeddedFilePart(&ef)
+			if err != nil {
+				return nil, err
+			}
+			related.children = append(related.children, p)
+		}
+		if html != nil {
+			html = related
+		} else {
+			text = related
+		}
+	}
+
+	var body *part
+	switch {
+	case text != nil && html != nil:
+		body = &part{mediaType: "multipart/alternative", children: []*part{text, html}}
+	case html != nil:
+		body = html
+	default:
+		body = text
+	}
+
+	if len(m.Attachments) == 0 {
+		return body, nil
+	}
+	mixed := &part{mediaType: "multipart/mixed", children: []*part{body}}
+	for _, at := range m.Attachments {
+		p, err := attachmentPart(&at)
+		if err != nil {
+			return nil, err
+		}
+		mixed.children = append(mixed.children, p)
+	}
+	return mixed, nil
+}
+
+func formatAddressList(l []*mail.Address) string {
+	s := make([]string, len(l))
+	for i, addr := range l {
+		s[i] = addr.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatMessageIDList(l []string) string {
+	s := make([]string, len(l))
+	for i, id := range l {
+		s[i] = "<" + strings.Trim(id, "<>") + ">"
+	}
+	return strings.Join(s, " ")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeWord encodes an unstructured header field value as specified in RFC
+// 2047, if necessary.
+func encodeWord(s string) string {
+	if isASCII(s) && !strings.Contains(s, "=?") {
+		return s
+	}
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+const maxLineLen = 76
+
+// writeField writes a header field, folding it at whitespace.
+func writeField(buf *bytes.Buffer, k, v string) {
+	v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+	line := k + ": "
+	for _, word := range strings.Split(v, " ") {
+		if len(line)+len(word) > maxLineLen && line != " " {
+			buf.WriteString(strings.TrimSuffix(line, " "))
+			buf.WriteString("\r\n")
+			line = " "
+		}
+		line += word + " "
+	}
+	buf.WriteString(strings.TrimSuffix(line, " "))
+	buf.WriteString("\r\n")
+}
+
+func writeFields(buf *bytes.Buffer, fields [][2]string) {
+	for _, f := range fields {
+		writeField(buf, f[0], f[1])
+	}
+}
+
+// boundaryFor returns the boundary of a multipart part at the specified
+// position in the tree.
+func boundaryFor(prefix string, n int) string {
+	return fmt.Sprintf("%s-%d", prefix, n)
+}
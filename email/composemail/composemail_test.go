@@ -0,0 +1,218 @@
+package composemail
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/unix-world/smartgoplus/email/parsemail"
+)
+
+var testDate = time.Date(2024, 3, 1, 12, 0, 0, 0, time.FixedZone("", 3600))
+
+func compose(t *testing.T, m *Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func parse(t *testing.T, b []byte) parsemail.Email {
+	t.Helper()
+	email, err := parsemail.Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("parsemail.Parse() = %v\n%s", err, b)
+	}
+	return email
+}
+
+func readAll(t *testing.T, r io.Reader) string {
+	t.Helper()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRoundTrip(t *testing.T) {
+	longName := "Résumé de la réunion trimestrielle avec les équipes de production 2024.csv"
+	png := string([]byte{0x89, 'P', 'N', 'G', 0, 1, 2, 3, 0xff})
+	m := &Message{
+		From:       []*mail.Address{{Name: "Zoë Bernard", Address: "zoe@example.org"}},
+		To:         []*mail.Address{{Address: "alice@example.com"}, {Name: "Bob, Jr.", Address: "bob@example.com"}},
+		Cc:         []*mail.Address{{Address: "carol@example.com"}},
+		Bcc:        []*mail.Address{{Address: "secret@example.com"}},
+		Subject:    "Café meeting — a rather long subject line that needs to be folded over multiple lines",
+		Date:       testDate,
+		MessageID:  "1234@example.org",
+		InReplyTo:  []string{"1233@example.org"},
+		References: []string{"1232@example.org", "1233@example.org"},
+		Header:     mail.Header{"X-Mailer": {"composemail"}},
+		TextBody:   "Hello,\nsee the café menu attached.\n",
+		HTMLBody:   "<p>Hello,</p><img src=\"cid:logo@example.org\">",
+		EmbeddedFiles: []EmbeddedFile{
+			{CID: "logo@example.org", ContentType: "image/png", Data: strings.NewReader(png)},
+		},
+		Attachments: []Attachment{
+			{Filename: longName, ContentType: "text/csv", Data: strings.NewReader("jour;menu\r\nlundi;soupe\r\n")},
+			{Filename: "data.bin", Data: strings.NewReader(png)},
+		},
+		Boundary: "test",
+	}
+	b := compose(t, m)
+
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if len(line) > 78 {
+			t.Errorf("line too long: %q", line)
+		}
+	}
+	if bytes.Contains(b, []byte("secret@example.com")) {
+		t.Errorf("message contains Bcc recipient")
+	}
+	if got, want := strings.Join(m.Recipients(), " "), "alice@example.com bob@example.com carol@example.com secret@example.com"; got != want {
+		t.Errorf("Recipients() = %q, want %q", got, want)
+	}
+
+	email := parse(t, b)
+	if email.Subject != m.Subject {
+		t.Errorf("Subject = %q, want %q", email.Subject, m.Subject)
+	}
+	if len(email.From) != 1 || email.From[0].String() != m.From[0].String() {
+		t.Errorf("From = %v, want %v", email.From, m.From)
+	}
+	if len(email.To) != 2 || email.To[1].Name != "Bob, Jr." {
+		t.Errorf("To = %v, want %v", email.To, m.To)
+	}
+	if len(email.Cc) != 1 || len(email.Bcc) != 0 {
+		t.Errorf("Cc = %v, Bcc = %v", email.Cc, email.Bcc)
+	}
+	if !email.Date.Equal(testDate) {
+		t.Errorf("Date = %v, want %v", email.Date, testDate)
+	}
+	if email.MessageID != m.MessageID {
+		t.Errorf("MessageID = %q, want %q", email.MessageID, m.MessageID)
+	}
+	if strings.Join(email.References, " ") != "1232@example.org 1233@example.org" {
+		t.Errorf("References = %v", email.References)
+	}
+	if email.Header.Get("X-Mailer") != "composemail" {
+		t.Errorf("X-Mailer = %q", email.Header.Get("X-Mailer"))
+	}
+
+	// parsemail only trims the final LF
+	if got := strings.ReplaceAll(email.TextBody+"\n", "\r\n", "\n"); got != m.TextBody {
+		t.Errorf("TextBody = %q, want %q", got, m.TextBody)
+	}
+	if email.HTMLBody != m.HTMLBody {
+		t.Errorf("HTMLBody = %q, want %q", email.HTMLBody, m.HTMLBody)
+	}
+
+	if len(email.EmbeddedFiles) != 1 {
+		t.Fatalf("got %v embedded files, want 1", len(email.EmbeddedFiles))
+	}
+	ef := email.EmbeddedFiles[0]
+	if ef.CID != "logo@example.org" || ef.ContentType != "image/png" || readAll(t, ef.Data) != png {
+		t.Errorf("embedded file = %+v", ef)
+	}
+
+	if len(email.Attachments) != 2 {
+		t.Fatalf("got %v attachments, want 2", len(email.Attachments))
+	}
+	at := email.Attachments[0]
+	if at.Filename != longName || at.ContentType != "text/csv" {
+		t.Errorf("attachment = %q (%v), want %q", at.Filename, at.ContentType, longName)
+	}
+	if got := readAll(t, at.Data); got != "jour;menu\r\nlundi;soupe\r\n" {
+		t.Errorf("attachment data = %q", got)
+	}
+	at = email.Attachments[1]
+	if at.Filename != "data.bin" || at.ContentType != "application/octet-stream" || readAll(t, at.Data) != png {
+		t.Errorf("attachment = %+v", at)
+	}
+}
+
+func TestTextOnly(t *testing.T) {
+	m := &Message{
+		From:      []*mail.Address{{Address: "zoe@example.org"}},
+		To:        []*mail.Address{{Address: "alice@example.com"}},
+		Subject:   "Hi",
+		Date:      testDate,
+		MessageID: "1234@example.org",
+		TextBody:  "Hi!\n",
+	}
+	want := "Date: Fri, 01 Mar 2024 12:00:00 +0100\r\n" +
+		"Message-ID: <1234@example.org>\r\n" +
+		"From: <zoe@example.org>\r\n" +
+		"To: <alice@example.com>\r\n" +
+		"Subject: Hi\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=us-ascii\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"Hi!\r\n"
+	if got := string(compose(t, m)); got != want {
+		t.Errorf("WriteTo() = \n%v\nwant:\n%v", got, want)
+	}
+	if email := parse(t, []byte(want)); email.TextBody != "Hi!\r" {
+		t.Errorf("TextBody = %q", email.TextBody)
+	}
+}
+
+func TestDeterministicBoundary(t *testing.T) {
+	newMessage := func() *Message {
+		return &Message{
+			Date:      testDate,
+			MessageID: "1234@example.org",
+			TextBody:  "text",
+			HTMLBody:  "<p>html</p>",
+			Boundary:  "b",
+		}
+	}
+	a, b := compose(t, newMessage()), compose(t, newMessage())
+	if !bytes.Equal(a, b) {
+		t.Errorf("output differs:\n%s\n%s", a, b)
+	}
+	if !bytes.Contains(a, []byte("Content-Type: multipart/alternative; boundary=b-1\r\n")) {
+		t.Errorf("unexpected boundary:\n%s", a)
+	}
+}
+
+func TestChooseEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want string
+	}{
+		{"Hello\r\nworld\r\n", encoding7Bit},
+		{"Café\r\n", encodingQuotedPrintable},
+		{strings.Repeat("a", 100), encodingQuotedPrintable},
+		{"日本語のテキスト", encodingBase64},
+		{"bare\nLF", encodingBase64},
+		{"\x00\x01", encodingBase64},
+		{"\xff\xfe", encodingBase64},
+	} {
+		if got := chooseEncoding([]byte(tc.s)); got != tc.want {
+			t.Errorf("chooseEncoding(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestFormatMediaType(t *testing.T) {
+	for _, tc := range []struct {
+		params [][2]string
+		want   string
+	}{
+		{[][2]string{{"filename", "a.txt"}}, "attachment; filename=a.txt"},
+		{[][2]string{{"filename", "a b.txt"}}, `attachment; filename="a b.txt"`},
+		{[][2]string{{"filename", "é.txt"}}, "attachment; filename*0*=utf-8''%C3%A9.txt"},
+	} {
+		if got := formatMediaType("attachment", tc.params); got != tc.want {
+			t.Errorf("formatMediaType(%v) = %q, want %q", tc.params, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package composemail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	encoding7Bit            = "7bit"
+	encodingQuotedPrintable = "quoted-printable"
+	encodingBase64          = "base64"
+)
+
+// part is a MIME entity.
+type part struct {
+	mediaType string
+	params    [][2]string
+	header    [][2]string // additional fields, before Content-Transfer-Encoding
+	encoding  string
+	body      []byte
+	children  []*part // for multipart types
+}
+
+// normalizeNewlines converts bare LF and CR to CRLF.
+func normalizeNewlines(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func textPart(mediaType, text string) *part {
+	body := []byte(normalizeNewlines(text))
+	params := [][2]string{{"charset", "utf-8"}}
+	if isASCII(text) {
+		params = [][2]string{{"charset", "us-ascii"}}
+	}
+	return &part{
+		mediaType: mediaType,
+		params:    params,
+		encoding:  chooseEncoding(body),
+		body:      body,
+	}
+}
+
+func attachmentPart(at *Attachment) (*part, error) {
+	body, err := io.ReadAll(at.Data)
+	if err != nil {
+		return nil, fmt.Errorf("composemail: failed to read attachment %q: %v", at.Filename, err)
+	}
+
+	mediaType := at.ContentType
+	if mediaType == "" {
+		mediaType = mime.TypeByExtension(path.Ext(at.Filename))
+	}
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("composemail: invalid content type for attachment %q: %v", at.Filename, err)
+	}
+
+	p := &part{mediaType: mediaType, body: body}
+	for _, k := range sortedKeys(params) {
+		p.params = append(p.params, [2]string{k, params[k]})
+	}
+	if at.Filename != "" {
+		p.params = append(p.params, [2]string{"name", at.Filename})
+	}
+
+	disposition := [][2]string{}
+	if at.Filename != "" {
+		disposition = append(disposition, [2]string{"filename", at.Filename})
+	}
+	p.header = append(p.header, [2]string{"Content-Disposition", formatMediaType("attachment", disposition)})
+
+	if strings.HasPrefix(mediaType, "text/") {
+		p.encoding = chooseEncoding(body)
+	} else {
+		p.encoding = encodingBase64
+	}
+	return p, nil
+}
+
+func embeddedFilePart(ef *EmbeddedFile) (*part, error) {
+	body, err := io.ReadAll(ef.Data)
+	if err != nil {
+		return nil, fmt.Errorf("composemail: failed to read embedded file %q: %v", ef.CID, err)
+	}
+
+	mediaType := ef.ContentType
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	mediaType, params, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, fmt.Errorf("composemail: invalid content type for embedded file %q: %v", ef.CID, err)
+	}
+
+	p := &part{mediaType: mediaType, body: body, encoding: encodingBase64}
+	for _, k := range sortedKeys(params) {
+		p.params = append(p.params, [2]string{k, params[k]})
+	}
+	p.header = [][2]string{
+		{"Content-ID", "<" + strings.Trim(ef.CID, "<>") + ">"},
+		{"Content-Disposition", "inline"},
+	}
+	return p, nil
+}
+
+// chooseEncoding selects a Content-Transfer-Encoding for text: 7bit if
+// possible, quoted-printable if the text is mostly ASCII, and base64
+// otherwise.
+func chooseEncoding(b []byte) string {
+	var nonASCII int
+	lineLen := 0
+	longLines := false
+	for i, ch := range b {
+		switch {
+		case ch == '\n':
+			if i == 0 || b[i-1] != '\r' {
+				return encodingBase64
+			}
+			lineLen = 0
+			continue
+		case ch == '\r':
+			if i+1 >= len(b) || b[i+1] != '\n' {
+				return encodingBase64
+			}
+			continue
+		case ch == 0:
+			return encodingBase64
+		case ch >= 0x80:
+			nonASCII++
+		}
+		lineLen++
+		if lineLen > maxLineLen {
+			longLines = true
+		}
+	}
+
+	switch {
+	case nonASCII == 0 && !longLines:
+		return encoding7Bit
+	case !utf8.Valid(b) || nonASCII*3 > len(b):
+		return encodingBase64
+	default:
+		return encodingQuotedPrintable
+	}
+}
+
+// formatMediaType formats a media type with parameters. Non-ASCII parameter
+// values are encoded and split as specified in RFC 2231.
+func formatMediaType(mediaType string, params [][2]string) string {
+	var sb strings.Builder
+	sb.WriteString(mediaType)
+	for _, param := range params {
+		k, v := param[0], param[1]
+		if isASCII(v) && !strings.ContainsAny(v, "\r\n") {
+			if s := mime.FormatMediaType("x/x", map[string]string{k: v}); s != "" {
+				sb.WriteString("; ")
+				sb.WriteString(strings.TrimPrefix(s, "x/x; "))
+				continue
+			}
+		}
+		for i, chunk := range rfc2231Chunks(v) {
+			if i == 0 {
+				chunk = "utf-8''" + chunk
+			}
+			fmt.Fprintf(&sb, "; %s*%d*=%s", k, i, chunk)
+		}
+	}
+	return sb.String()
+}
+
+const maxParamChunkLen = 48
+
+// rfc2231Chunks percent-encodes a parameter value and splits it into
+// chunks, without splitting encoded characters.
+func rfc2231Chunks(v string) []string {
+	var chunks []string
+	var sb strings.Builder
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		var enc string
+		if ch < 0x80 && ch > 0x20 && !strings.ContainsRune("*'%()<>@,;:\\\"/[]?=", rune(ch)) {
+			enc = string(ch)
+		} else {
+			enc = fmt.Sprintf("%%%02X", ch)
+		}
+		if sb.Len()+len(enc) > maxParamChunkLen {
+			chunks = append(chunks, sb.String())
+			sb.Reset()
+		}
+		sb.WriteString(enc)
+	}
+	return append(chunks, sb.String())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// write writes the part header and body. Multipart boundaries are derived
+// from prefix.
+func (p *part) write(buf *bytes.Buffer, prefix string) {
+	n := 0
+	p.writeNested(buf, prefix, &n)
+}
+
+func (p *part) writeNested(buf *bytes.Buffer, prefix string, n *int) {
+	if len(p.children) > 0 {
+		*n++
+		boundary := boundaryFor(prefix, *n)
+		params := append([][2]string{{"boundary", boundary}}, p.params...)
+		writeField(buf, "Content-Type", formatMediaType(p.mediaType, params))
+		writeFields(buf, p.header)
+		buf.WriteString("\r\n")
+		for _, child := range p.children {
+			fmt.Fprintf(buf, "--%s\r\n", boundary)
+			child.writeNested(buf, prefix, n)
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(buf, "--%s--\r\n", boundary)
+		return
+	}
+
+	writeField(buf, "Content-Type", formatMediaType(p.mediaType, p.params))
+	writeFields(buf, p.header)
+	writeField(buf, "Content-Transfer-Encoding", p.encoding)
+	buf.WriteString("\r\n")
+
+	switch p.encoding {
+	case encodingQuotedPrintable:
+		w := quotedprintable.NewWriter(buf)
+		w.Write(p.body)
+		w.Close()
+	case encodingBase64:
+		enc := base64.StdEncoding.EncodeToString(p.body)
+		for len(enc) > maxLineLen {
+			buf.WriteString(enc[:maxLineLen])
+			buf.WriteString("\r\n")
+			enc = enc[maxLineLen:]
+		}
+		buf.WriteString(enc)
+	default:
+		buf.Write(p.body)
+	}
+}
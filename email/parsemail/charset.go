@@ -0,0 +1,78 @@
+package parsemail
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Labels missing from the WHATWG encoding index used by htmlindex, but found
+// in mail.
+var charsetAliases = map[string]string{
+	"latin9":  "iso-8859-15",
+	"latin-9": "iso-8859-15",
+}
+
+func isUTF8Charset(charset string) bool {
+	switch charset {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return true
+	}
+	return false
+}
+
+// lookupCharset returns the encoding of a charset label.
+func lookupCharset(charset string) (encoding.Encoding, error) {
+	if alias, ok := charsetAliases[charset]; ok {
+		charset = alias
+	}
+
+	// The index maps some dangerous labels, e.g. ISO-2022-KR, to the
+	// replacement encoding, which decodes to a single error rune
+	enc, err := htmlindex.Get(charset)
+	if err != nil || enc == encoding.Replacement {
+		return nil, fmt.Errorf("unsupported charset: %s", charset)
+	}
+
+	return enc, nil
+}
+
+// toUTF8 converts b from charset to UTF-8. Invalid byte sequences are
+// replaced with utf8.RuneError.
+func toUTF8(charset string, b []byte) (string, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if isUTF8Charset(charset) {
+		return string(b), nil
+	}
+
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return "", err
+	}
+
+	out, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// charsetReader is used by mime.WordDecoder to decode RFC 2047 encoded-words
+// in legacy charsets.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if isUTF8Charset(charset) {
+		return input, nil
+	}
+
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+
+	return enc.NewDecoder().Reader(input), nil
+}
@@ -0,0 +1,238 @@
+package parsemail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// Options contains options for ParseWithOptions. A zero limit means no
+// limit.
+type Options struct {
+	MaxHeaderBytes int64 // size of the message header and of each part header
+	MaxParts       int   // number of parts, including those of encapsulated messages
+	MaxDepth       int   // nesting depth of parts, the root part being at depth 0
+	MaxPartSize    int64 // decoded size of the body of each part
+	MaxSize        int64 // decoded size of the bodies of all parts
+
+	// Spool, if set, stores the bodies of attachments and embedded files
+	// instead of keeping them in memory. Text bodies are always kept in
+	// memory.
+	Spool SpoolFunc
+}
+
+// SpoolFunc stores the decoded body of a part, read from r. It returns an
+// io.ReaderAt to read the body back through Part.Body, or nil if the body is
+// consumed by the caller. If the io.ReaderAt also implements io.Closer, it is
+// closed by Email.Close.
+//
+// Errors returned by r, including *LimitError, must be returned as is.
+type SpoolFunc func(part *Part, r io.Reader) (io.ReaderAt, error)
+
+// TempFileSpool returns a SpoolFunc storing bodies in temporary files in dir,
+// or in the default directory for temporary files if dir is empty. The
+// files are removed by Email.Close.
+func TempFileSpool(dir string) SpoolFunc {
+	return func(part *Part, r io.Reader) (io.ReaderAt, error) {
+		f, err := os.CreateTemp(dir, "parsemail-")
+		if err != nil {
+			return nil, err
+		}
+
+		tf := &tempFile{f}
+		if _, err := io.Copy(f, r); err != nil {
+			tf.Close()
+			return nil, err
+		}
+
+		return tf, nil
+	}
+}
+
+type tempFile struct {
+	*os.File
+}
+
+func (tf *tempFile) Close() error {
+	err := tf.File.Close()
+	if rmErr := os.Remove(tf.Name()); err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+// LimitError is returned by ParseWithOptions when a message exceeds one of
+// the limits of Options.
+type LimitError struct {
+	Name  string // name of the Options field, e.g. "MaxParts"
+	Limit int64
+}
+
+func (err *LimitError) Error() string {
+	return fmt.Sprintf("parsemail: message exceeds %v (%v)", err.Name, err.Limit)
+}
+
+// ParseWithOptions parses an email message like Parse, enforcing the limits
+// of options. Part bodies are read as a stream, so that memory usage is
+// bounded by the limits, or by the size of the text bodies if attachments
+// are spooled.
+//
+// If options.Spool is set, the caller must call Email.Close once done with
+// the message.
+func ParseWithOptions(r io.Reader, options *Options) (email Email, err error) {
+	if options == nil {
+		options = new(Options)
+	}
+
+	p := &parser{options: options}
+	email, err = p.parseMessage(r, 0)
+	if err != nil {
+		for _, ra := range p.spooled {
+			if c, ok := ra.(io.Closer); ok {
+				c.Close()
+			}
+		}
+	}
+
+	return
+}
+
+// Close releases the bodies stored by Options.Spool. Part and attachment
+// bodies can't be read afterwards.
+func (email *Email) Close() error {
+	if email.Root == nil {
+		return nil
+	}
+
+	var err error
+	email.Root.Walk(func(part *Part, depth int) error {
+		if c, ok := part.spooled.(io.Closer); ok {
+			if closeErr := c.Close(); err == nil {
+				err = closeErr
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+type parser struct {
+	options *Options
+	parts   int
+	size    int64
+	spooled []io.ReaderAt
+}
+
+func (p *parser) parseMessage(r io.Reader, depth int) (email Email, err error) {
+	br := bufio.NewReader(r)
+	header, err := p.readHeader(br)
+	if err != nil {
+		return
+	}
+
+	email, err = createEmailFromHeader(header)
+	if err != nil {
+		return
+	}
+
+	email.ContentType = header.Get("Content-Type")
+	email.Root, err = p.parsePart(header, br, contentTypeTextPlain, depth)
+	if err != nil {
+		return
+	}
+
+	switch {
+	case isMultipart(email.Root.ContentType):
+		email.addPart(email.Root, false)
+	case email.Root.ContentType == contentTypeTextPlain:
+		email.TextBody = strings.TrimSuffix(email.Root.Text(), "\n")
+	case email.Root.ContentType == contentTypeTextHtml:
+		email.HTMLBody = strings.TrimSuffix(email.Root.Text(), "\n")
+	default:
+		email.Content = email.Root.Body()
+	}
+
+	return
+}
+
+// readHeader reads a message header, up to and including the blank line
+// ending it, without reading more than Options.MaxHeaderBytes.
+func (p *parser) readHeader(br *bufio.Reader) (mail.Header, error) {
+	var b []byte
+	lineStart := 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		b = append(b, chunk...)
+		if max := p.options.MaxHeaderBytes; max > 0 && int64(len(b)) > max {
+			return nil, &LimitError{Name: "MaxHeaderBytes", Limit: max}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimRight(b[lineStart:], "\r\n")) == 0 {
+			break
+		}
+
+		lineStart = len(b)
+	}
+
+	if len(b) == 0 {
+		return nil, io.EOF
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("\r\n"))))
+	header, err := tp.ReadMIMEHeader()
+	// Like net/mail, accept a header-only message without a final line break
+	if err != nil && (err != io.EOF || len(header) == 0) {
+		return nil, err
+	}
+
+	return mail.Header(header), nil
+}
+
+func headerSize(header mail.Header) int64 {
+	var n int64
+	for k, values := range header {
+		for _, v := range values {
+			n += int64(len(k) + len(": ") + len(v) + len("\r\n"))
+		}
+	}
+
+	return n
+}
+
+// limitReader enforces Options.MaxPartSize and Options.MaxSize.
+type limitReader struct {
+	r io.Reader
+	p *parser
+	n int64
+}
+
+func (lr *limitReader) Read(b []byte) (int, error) {
+	n, err := lr.r.Read(b)
+	lr.n += int64(n)
+	lr.p.size += int64(n)
+
+	if max := lr.p.options.MaxPartSize; max > 0 && lr.n > max {
+		return n, &LimitError{Name: "MaxPartSize", Limit: max}
+	}
+	if max := lr.p.options.MaxSize; max > 0 && lr.p.size > max {
+		return n, &LimitError{Name: "MaxSize", Limit: max}
+	}
+
+	return n, err
+}
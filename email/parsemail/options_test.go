@@ -0,0 +1,165 @@
+package parsemail
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseWithOptionsLimits(t *testing.T) {
+	for _, tc := range []struct {
+		msg     string
+		options Options
+		want    string
+	}{
+		{mixedMessage, Options{MaxHeaderBytes: 16}, "MaxHeaderBytes"},
+		{mixedMessage, Options{MaxHeaderBytes: 60}, "MaxHeaderBytes"},
+		{forwardedMessage, Options{MaxParts: 3}, "MaxParts"},
+		{forwardedMessage, Options{MaxDepth: 2}, "MaxDepth"},
+		{mixedMessage, Options{MaxPartSize: 8}, "MaxPartSize"},
+		{mixedMessage, Options{MaxSize: 40}, "MaxSize"},
+		{forwardedMessage, Options{MaxHeaderBytes: 128, MaxParts: 9, MaxDepth: 4, MaxPartSize: 512, MaxSize: 1024}, ""},
+	} {
+		_, err := ParseWithOptions(strings.NewReader(tc.msg), &tc.options)
+		var limitErr *LimitError
+		if tc.want == "" {
+			if err != nil {
+				t.Errorf("ParseWithOptions(%+v) = %v", tc.options, err)
+			}
+		} else if !errors.As(err, &limitErr) || limitErr.Name != tc.want {
+			t.Errorf("ParseWithOptions(%+v) = %v, want %v error", tc.options, err, tc.want)
+		}
+	}
+}
+
+func TestParseWithOptionsHeaderOnly(t *testing.T) {
+	for _, msg := range []string{"Subject: x", "Subject: x\r\n", "Subject: x\r\nFrom: a@example.org"} {
+		email, err := ParseWithOptions(strings.NewReader(msg), &Options{})
+		if err != nil {
+			t.Errorf("ParseWithOptions(%q) = %v", msg, err)
+		} else if email.Subject != "x" {
+			t.Errorf("ParseWithOptions(%q): Subject = %q, want %q", msg, email.Subject, "x")
+		}
+	}
+
+	if _, err := ParseWithOptions(strings.NewReader(""), &Options{}); err == nil {
+		t.Errorf("ParseWithOptions(\"\") succeeded, want error")
+	}
+}
+
+func TestTempFileSpool(t *testing.T) {
+	dir := t.TempDir()
+	countFiles := func() int {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	email, err := ParseWithOptions(strings.NewReader(mixedMessage), &Options{Spool: TempFileSpool(dir)})
+	if err != nil {
+		t.Fatalf("ParseWithOptions() = %v", err)
+	}
+	if n := countFiles(); n != 4 {
+		t.Errorf("got %v spooled files, want 4", n)
+	}
+	if want := `<p>“Hi”</p><img src="cid:logo">`; email.HTMLBody != want {
+		t.Errorf("HTMLBody = %q, want %q", email.HTMLBody, want)
+	}
+	if b, _ := ioutil.ReadAll(email.Attachments[1].Data); string(b) != "%PDF-" {
+		t.Errorf("attachment data = %q", b)
+	}
+	if err := email.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if n := countFiles(); n != 0 {
+		t.Errorf("got %v files after Close, want 0", n)
+	}
+
+	_, err = ParseWithOptions(strings.NewReader(mixedMessage), &Options{Spool: TempFileSpool(dir), MaxSize: 40})
+	if err == nil {
+		t.Errorf("ParseWithOptions() succeeded, want MaxSize error")
+	}
+	if n := countFiles(); n != 0 {
+		t.Errorf("got %v files after failed parse, want 0", n)
+	}
+}
+
+// repeatReader reads s n times.
+type repeatReader struct {
+	s   string
+	n   int
+	off int
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	var n int
+	for n < len(b) && r.n > 0 {
+		m := copy(b[n:], r.s[r.off:])
+		n += m
+		r.off += m
+		if r.off == len(r.s) {
+			r.off = 0
+			r.n--
+		}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// bigMessage returns a message with a base64 attachment of about size bytes,
+// generated as it is read.
+func bigMessage(size int) io.Reader {
+	line := strings.Repeat("QUJD", 19) + "\r\n" // 57 decoded bytes
+	return io.MultiReader(
+		strings.NewReader("Subject: big\r\n"+
+			"Content-Type: multipart/mixed; boundary=b\r\n"+
+			"\r\n"+
+			"--b\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"\r\n"+
+			"See attachment.\r\n"+
+			"--b\r\n"+
+			"Content-Type: application/octet-stream\r\n"+
+			"Content-Disposition: attachment; filename=big.bin\r\n"+
+			"Content-Transfer-Encoding: base64\r\n"+
+			"\r\n"),
+		&repeatReader{s: line, n: size / 57},
+		strings.NewReader("--b--\r\n"),
+	)
+}
+
+const benchmarkSize = 32 << 20
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(benchmarkSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(bigMessage(benchmarkSize)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseWithOptionsSpool(b *testing.B) {
+	options := &Options{
+		Spool: func(part *Part, r io.Reader) (io.ReaderAt, error) {
+			_, err := io.Copy(ioutil.Discard, r)
+			return nil, err
+		},
+	}
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkSize)
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseWithOptions(bigMessage(benchmarkSize), options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
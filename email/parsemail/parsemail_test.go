@@ -0,0 +1,286 @@
+package parsemail
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseQuotedPrintable(t *testing.T) {
+	msg := "Subject: =?iso-8859-1?q?Caf=E9?=\r\n" +
+		"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: Quoted-Printable\r\n" +
+		"\r\n" +
+		"Un caf=E9 tr=E8s =\r\nlong.\r\n"
+
+	email, err := Parse(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+	if email.Subject != "Café" {
+		t.Errorf("Subject = %q, want %q", email.Subject, "Café")
+	}
+	if want := "Un café très long.\r"; email.TextBody != want {
+		t.Errorf("TextBody = %q, want %q", email.TextBody, want)
+	}
+}
+
+func TestParseCharsets(t *testing.T) {
+	for _, tc := range []struct {
+		charset string
+		body    string
+		want    string
+	}{
+		{"utf-8", "caf\xc3\xa9", "café"},
+		{"ISO-8859-1", "caf\xe9", "café"},
+		{"iso-8859-15", "\xa4 5", "€ 5"},
+		{"windows-1252", "\x93quoted\x94 \x80", "“quoted” €"},
+		{"latin9", "\xa4 5", "€ 5"},
+		{"iso-8859-2", "Za\xbf\xf3\xb3\xe6 g\xea\xb6l\xb1", "Zażółć gęślą"},
+		{"windows-1251", "\xcf\xf0\xe8\xe2\xe5\xf2", "Привет"},
+		{"KOI8-R", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"Shift_JIS", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "こんにちは"},
+		{"iso-2022-jp", "\x1b$B$3$s$K$A$O\x1b(B", "こんにちは"},
+		{"gb2312", "\xc4\xe3\xba\xc3", "你好"},
+		{"big5", "\xa7A\xa6n", "你好"},
+		{"iso-2022-kr", "caf\xe9", "caf\xe9"},
+		{"x-unknown", "caf\xe9", "caf\xe9"},
+	} {
+		msg := "Content-Type: text/html; charset=" + tc.charset + "\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			tc.body
+		email, err := Parse(strings.NewReader(msg))
+		if err != nil {
+			t.Fatalf("Parse(%v) = %v", tc.charset, err)
+		}
+		if email.HTMLBody != tc.want {
+			t.Errorf("Parse(%v): HTMLBody = %q, want %q", tc.charset, email.HTMLBody, tc.want)
+		}
+	}
+}
+
+func TestParseEncodedWordCharsets(t *testing.T) {
+	for _, tc := range []struct {
+		subject string
+		want    string
+	}{
+		{"=?koi8-r?B?8NLJ18XU?=", "Привет"},
+		{"=?ISO-2022-JP?B?GyRCJDMkcyRLJEEkTxsoQg==?=", "こんにちは"},
+		{"=?iso-8859-2?q?Za=BF=F3=B3=E6?=", "Zażółć"},
+	} {
+		email, err := Parse(strings.NewReader("Subject: " + tc.subject + "\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("Parse(%v) = %v", tc.subject, err)
+		}
+		if email.Subject != tc.want {
+			t.Errorf("Parse(%v): Subject = %q, want %q", tc.subject, email.Subject, tc.want)
+		}
+	}
+}
+
+const mixedMessage = "Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/related; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=windows-1252\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>=93Hi=94</p><img src=3D\"cid:logo\">\r\n" +
+	"--inner\r\n" +
+	"Content-Type: image/svg+xml\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"Content-ID: <logo>\r\n" +
+	"\r\n" +
+	"<svg a=3D\"b\"/>\r\n" +
+	"--inner\r\n" +
+	"Content-Type: image/png; name=\"photo.png\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: inline; filename=\"photo.png\"\r\n" +
+	"Content-ID: <photo>\r\n" +
+	"\r\n" +
+	"iVBORw0K\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: binary\r\n" +
+	"Content-Disposition: attachment;\r\n" +
+	" filename*0*=iso-8859-1''R%E9sum%E9%20de%20la;\r\n" +
+	" filename*1=\" r\\\"union.txt\"\r\n" +
+	"\r\n" +
+	"\x00\x01\xff\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name*=utf-8''%C3%A9t%C3%A9.pdf\r\n" +
+	"Content-Transfer-Encoding: Base64\r\n" +
+	"\r\n" +
+	"JVBERi0=\r\n" +
+	"--outer--\r\n"
+
+func TestParseMultipart(t *testing.T) {
+	email, err := Parse(strings.NewReader(mixedMessage))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+
+	if want := `<p>“Hi”</p><img src="cid:logo">`; email.HTMLBody != want {
+		t.Errorf("HTMLBody = %q, want %q", email.HTMLBody, want)
+	}
+
+	if len(email.EmbeddedFiles) != 2 {
+		t.Fatalf("got %v embedded files, want 2", len(email.EmbeddedFiles))
+	}
+	for i, want := range []struct {
+		cid, data string
+	}{
+		{"logo", `<svg a="b"/>`},
+		{"photo", "\x89PNG\r\n"},
+	} {
+		ef := email.EmbeddedFiles[i]
+		if b, _ := ioutil.ReadAll(ef.Data); ef.CID != want.cid || string(b) != want.data {
+			t.Errorf("embedded file %q = %q, want %q = %q", ef.CID, b, want.cid, want.data)
+		}
+	}
+
+	if len(email.Attachments) != 2 {
+		t.Fatalf("got %v attachments, want 2", len(email.Attachments))
+	}
+	for i, want := range []struct {
+		filename, data string
+	}{
+		{`Résumé de la r"union.txt`, "\x00\x01\xff"},
+		{"été.pdf", "%PDF-"},
+	} {
+		at := email.Attachments[i]
+		if at.Filename != want.filename {
+			t.Errorf("attachment %v: Filename = %q, want %q", i, at.Filename, want.filename)
+		}
+		if b, _ := ioutil.ReadAll(at.Data); string(b) != want.data {
+			t.Errorf("attachment %v: Data = %q, want %q", i, b, want.data)
+		}
+	}
+}
+
+func TestDecodeParam(t *testing.T) {
+	for _, tc := range []struct {
+		field, key, want string
+	}{
+		{`attachment; filename="a b.txt"`, "filename", "a b.txt"},
+		{`attachment; filename*=utf-8''%C3%A9.txt`, "filename", "é.txt"},
+		{`attachment; filename*=iso-8859-1'fr'%E9.txt`, "filename", "é.txt"},
+		{`attachment; filename*0="a;b"; filename*1*=%E9; x="y"`, "filename", "a;b\xe9"},
+		{`attachment; filename*=unknown''%E9`, "filename", ""},
+		{`attachment`, "filename", ""},
+	} {
+		if got := decodeParam(tc.field, tc.key); got != tc.want {
+			t.Errorf("decodeParam(%q) = %q, want %q", tc.field, got, tc.want)
+		}
+	}
+}
+
+const forwardedMessage = "Subject: Fwd: report\r\n" +
+	"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; boundary=signed\r\n" +
+	"\r\n" +
+	"--signed\r\n" +
+	"Content-Type: multipart/mixed; boundary=mixed\r\n" +
+	"\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See below.\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: text/plain; name=notes.txt\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"\r\n" +
+	"notes\r\n" +
+	"--mixed\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: Delivery report\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=report\r\n" +
+	"\r\n" +
+	"--report\r\n" +
+	"\r\n" +
+	"Delivery failed.\r\n" +
+	"--report\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"--report--\r\n" +
+	"--mixed--\r\n" +
+	"--signed\r\n" +
+	"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"c2lnbmF0dXJl\r\n" +
+	"--signed--\r\n"
+
+func TestParseTree(t *testing.T) {
+	email, err := Parse(strings.NewReader(forwardedMessage))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+
+	var types []string
+	err = email.Root.Walk(func(part *Part, depth int) error {
+		types = append(types, strings.Repeat(" ", depth)+part.ContentType)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() = %v", err)
+	}
+	want := []string{
+		"multipart/signed",
+		" multipart/mixed",
+		"  text/plain",
+		"  text/plain",
+		"  message/rfc822",
+		"   multipart/report",
+		"    text/plain",
+		"    message/delivery-status",
+		" application/pkcs7-signature",
+	}
+	if strings.Join(types, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Walk() visited:\n%v\nwant:\n%v", strings.Join(types, "\n"), strings.Join(want, "\n"))
+	}
+
+	fwd := email.Root.Children[0].Children[2]
+	if fwd.Message == nil || fwd.Message.Subject != "Delivery report" || fwd.Message.TextBody != "Delivery failed." {
+		t.Errorf("encapsulated message = %+v", fwd.Message)
+	}
+	status := fwd.Children[0].Children[1]
+	if b, _ := ioutil.ReadAll(status.Body()); string(b) != "Reporting-MTA: dns; mx.example.org" {
+		t.Errorf("delivery status = %q", b)
+	}
+
+	if email.TextBody != "See below." {
+		t.Errorf("TextBody = %q", email.TextBody)
+	}
+	var filenames []string
+	for _, at := range email.Attachments {
+		filenames = append(filenames, at.Filename+" "+at.ContentType)
+	}
+	if got, want := strings.Join(filenames, ", "), "notes.txt text/plain,  message/rfc822, smime.p7s application/pkcs7-signature"; got != want {
+		t.Errorf("attachments = %q, want %q", got, want)
+	}
+}
+
+func TestWalkSkipChildren(t *testing.T) {
+	email, err := Parse(strings.NewReader(forwardedMessage))
+	if err != nil {
+		t.Fatalf("Parse() = %v", err)
+	}
+
+	n := 0
+	err = email.Root.Walk(func(part *Part, depth int) error {
+		n++
+		if part.ContentType == "multipart/mixed" {
+			return SkipChildren
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Errorf("Walk() = %v, visited %v parts, want 3", err, n)
+	}
+}
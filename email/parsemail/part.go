@@ -0,0 +1,280 @@
+package parsemail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+const contentTypeMessageRFC822 = "message/rfc822"
+const contentTypeMessageGlobal = "message/global"
+const contentTypeMultipartDigest = "multipart/digest"
+const contentTypeMultipartRelated = "multipart/related"
+
+// SkipChildren is used as a return value from WalkFunc to indicate that the
+// children of the part are to be skipped.
+var SkipChildren = errors.New("skip children")
+
+// WalkFunc is the type of the function called by Part.Walk for each part.
+// depth is 0 for the part Walk is called on.
+type WalkFunc func(part *Part, depth int) error
+
+// Part is a MIME entity of a message. Multipart entities have children,
+// encapsulated messages (message/rfc822) have the encapsulated message's
+// root part as their only child.
+type Part struct {
+	Header      mail.Header       // as is, not decoded
+	ContentType string            // media type, lower-case, e.g. "text/plain"
+	Params      map[string]string // Content-Type parameters
+	Disposition string            // lower-case, e.g. "attachment", or empty
+	Filename    string            // decoded
+
+	Children []*Part
+
+	// Message is the encapsulated message of message/rfc822 parts. It is nil
+	// for other parts and if the message could not be parsed.
+	Message *Email
+
+	body    []byte
+	spooled io.ReaderAt
+	size    int64
+}
+
+// Body returns the body of the part, with the Content-Transfer-Encoding
+// decoded. For multipart parts, the body is empty. Each call returns a new
+// reader.
+func (p *Part) Body() io.Reader {
+	if p.spooled != nil {
+		return io.NewSectionReader(p.spooled, 0, p.size)
+	}
+
+	return bytes.NewReader(p.body)
+}
+
+// Text returns the body of the part converted from its charset to UTF-8.
+// Bodies in an unsupported charset are returned as is.
+func (p *Part) Text() string {
+	b, _ := ioutil.ReadAll(p.Body())
+	text, err := toUTF8(p.Params["charset"], b)
+	if err != nil {
+		return string(b)
+	}
+
+	return text
+}
+
+// Walk calls fn for the part and its descendants, depth-first. If fn returns
+// SkipChildren, the children of the part are not visited; any other error
+// stops the walk and is returned.
+func (p *Part) Walk(fn WalkFunc) error {
+	err := p.walk(fn, 0)
+	if err == SkipChildren {
+		return nil
+	}
+
+	return err
+}
+
+func (p *Part) walk(fn WalkFunc, depth int) error {
+	if err := fn(p, depth); err != nil {
+		return err
+	}
+
+	for _, child := range p.Children {
+		if err := child.walk(fn, depth+1); err != nil && err != SkipChildren {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func isMultipart(contentType string) bool {
+	return strings.HasPrefix(contentType, "multipart/")
+}
+
+func isMessage(contentType string) bool {
+	return contentType == contentTypeMessageRFC822 || contentType == contentTypeMessageGlobal
+}
+
+// parsePart reads a MIME entity. defaultType is used if the header has no
+// Content-Type field.
+func (p *parser) parsePart(header mail.Header, body io.Reader, defaultType string, depth int) (*Part, error) {
+	p.parts++
+	if max := p.options.MaxParts; max > 0 && p.parts > max {
+		return nil, &LimitError{Name: "MaxParts", Limit: int64(max)}
+	}
+	if max := p.options.MaxDepth; max > 0 && depth > max {
+		return nil, &LimitError{Name: "MaxDepth", Limit: int64(max)}
+	}
+	if max := p.options.MaxHeaderBytes; max > 0 && headerSize(header) > max {
+		return nil, &LimitError{Name: "MaxHeaderBytes", Limit: max}
+	}
+
+	part := &Part{Header: header}
+
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultType
+	}
+
+	var err error
+	part.ContentType, part.Params, err = mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	if disposition := header.Get("Content-Disposition"); disposition != "" {
+		part.Disposition, _, _ = mime.ParseMediaType(disposition)
+	}
+
+	part.Filename = decodeMimeSentence(fileName(header))
+
+	if isMultipart(part.ContentType) {
+		childType := contentTypeTextPlain
+		if part.ContentType == contentTypeMultipartDigest {
+			childType = contentTypeMessageRFC822
+		}
+
+		mr := multipart.NewReader(body, part.Params["boundary"])
+		for {
+			mp, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			child, err := p.parsePart(mail.Header(mp.Header), mp, childType, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			part.Children = append(part.Children, child)
+		}
+
+		return part, nil
+	}
+
+	decoded, err := decodeContent(body, header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+
+	lr := &limitReader{r: decoded, p: p}
+	if p.options.Spool != nil && !isTextBody(part) {
+		part.spooled, err = p.options.Spool(part, lr)
+		if part.spooled != nil {
+			p.spooled = append(p.spooled, part.spooled)
+		}
+	} else {
+		part.body, err = ioutil.ReadAll(lr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	part.size = lr.n
+
+	if isMessage(part.ContentType) {
+		// The encapsulated message is already accounted for in
+		// Options.MaxSize
+		size := p.size
+		msg, err := p.parseMessage(part.Body(), depth+1)
+		p.size = size
+
+		var limitErr *LimitError
+		if errors.As(err, &limitErr) {
+			return nil, err
+		} else if err == nil {
+			part.Message = &msg
+			part.Children = []*Part{msg.Root}
+		}
+	}
+
+	return part, nil
+}
+
+// fileName returns the file name of a part, from the Content-Disposition
+// filename parameter or else the Content-Type name parameter.
+func fileName(header mail.Header) string {
+	filename := decodeParam(header.Get("Content-Disposition"), "filename")
+	if filename == "" {
+		filename = decodeParam(header.Get("Content-Type"), "name")
+	}
+
+	return filename
+}
+
+func isAttachment(p *Part) bool {
+	if p.Disposition == "attachment" || isMessage(p.ContentType) {
+		return true
+	}
+
+	return p.Filename != "" && p.ContentType != contentTypeTextPlain && p.ContentType != contentTypeTextHtml
+}
+
+// isTextBody reports whether a part is a candidate for Email.TextBody or
+// Email.HTMLBody.
+func isTextBody(p *Part) bool {
+	return (p.ContentType == contentTypeTextPlain || p.ContentType == contentTypeTextHtml) && !isAttachment(p)
+}
+
+// isEmbeddedFile reports whether a part is a file referenced by another part,
+// i.e. it has a Content-ID or it is part of a multipart/related, such as an
+// inline image, even if it has a file name.
+func isEmbeddedFile(p *Part, related bool) bool {
+	if p.Disposition == "attachment" || isMessage(p.ContentType) {
+		return false
+	}
+	if (p.ContentType == contentTypeTextPlain || p.ContentType == contentTypeTextHtml) && p.Filename == "" {
+		return false
+	}
+
+	return related || p.Header.Get("Content-Id") != ""
+}
+
+// addPart adds the bodies, attachments and embedded files of a part of a
+// multipart message to the flat fields of email. Encapsulated messages are
+// added as attachments and not descended into. related is true for the
+// children of a multipart/related part.
+func (email *Email) addPart(p *Part, related bool) {
+	switch {
+	case isMultipart(p.ContentType):
+		for _, child := range p.Children {
+			email.addPart(child, p.ContentType == contentTypeMultipartRelated)
+		}
+	case isEmbeddedFile(p, related):
+		email.addEmbeddedFile(p)
+	case isAttachment(p):
+		contentType := strings.Split(p.Header.Get("Content-Type"), ";")[0]
+		if contentType == "" {
+			contentType = p.ContentType
+		}
+
+		email.Attachments = append(email.Attachments, Attachment{
+			Filename:    p.Filename,
+			ContentType: contentType,
+			Data:        p.Body(),
+		})
+	case p.ContentType == contentTypeTextPlain:
+		email.TextBody += strings.TrimSuffix(p.Text(), "\n")
+	case p.ContentType == contentTypeTextHtml:
+		email.HTMLBody += strings.TrimSuffix(p.Text(), "\n")
+	case p.Header.Get("Content-Transfer-Encoding") != "":
+		email.addEmbeddedFile(p)
+	}
+}
+
+func (email *Email) addEmbeddedFile(p *Part) {
+	email.EmbeddedFiles = append(email.EmbeddedFiles, EmbeddedFile{
+		CID:         strings.Trim(decodeMimeSentence(p.Header.Get("Content-Id")), "<>"),
+		ContentType: p.Header.Get("Content-Type"),
+		Data:        p.Body(),
+	})
+}
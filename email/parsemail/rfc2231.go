@@ -0,0 +1,143 @@
+package parsemail
+
+import (
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// decodeParam returns the value of a parameter of a Content-Type or
+// Content-Disposition header field. RFC 2231 continuations and extended
+// values are decoded, including values in the legacy charsets supported by
+// toUTF8, which package mime drops.
+func decodeParam(field, key string) string {
+	if field == "" {
+		return ""
+	}
+
+	if v := decodeExtendedParam(field, key); v != "" {
+		return v
+	}
+
+	_, params, _ := mime.ParseMediaType(field)
+	return params[key]
+}
+
+type paramSegment struct {
+	value    string
+	extended bool
+}
+
+func decodeExtendedParam(field, key string) string {
+	segments := map[int]paramSegment{}
+	for _, param := range splitParams(field) {
+		k, v, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = strings.ReplaceAll(v[1:len(v)-1], `\"`, `"`)
+		}
+
+		if k == key {
+			segments[0] = paramSegment{value: v}
+			continue
+		}
+
+		rest, ok := strings.CutPrefix(k, key+"*")
+		if !ok {
+			continue
+		}
+
+		rest, extended := strings.CutSuffix(rest, "*")
+		n := 0
+		if rest == "" {
+			extended = true
+		} else if i, err := strconv.Atoi(rest); err == nil && i >= 0 {
+			n = i
+		} else {
+			continue
+		}
+
+		segments[n] = paramSegment{value: v, extended: extended}
+	}
+
+	first, ok := segments[0]
+	if !ok {
+		return ""
+	}
+
+	charset := ""
+	if first.extended {
+		parts := strings.SplitN(first.value, "'", 3)
+		if len(parts) != 3 {
+			return ""
+		}
+
+		charset = parts[0]
+		first.value = parts[2]
+		segments[0] = first
+	}
+
+	var b []byte
+	for i := 0; ; i++ {
+		segment, ok := segments[i]
+		if !ok {
+			break
+		}
+
+		if segment.extended {
+			v, err := url.PathUnescape(segment.value)
+			if err != nil {
+				return ""
+			}
+
+			segment.value = v
+		}
+
+		b = append(b, segment.value...)
+	}
+
+	s, err := toUTF8(charset, b)
+	if err != nil {
+		return ""
+	}
+
+	return s
+}
+
+// splitParams splits the parameters of a header field value at semicolons
+// outside quoted strings. The media type is not included.
+func splitParams(field string) []string {
+	var params []string
+	quoted := false
+	start := -1
+	for i := 0; i < len(field); i++ {
+		switch field[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				if start >= 0 {
+					params = append(params, field[start:i])
+				}
+
+				start = i + 1
+			}
+		}
+	}
+
+	if start >= 0 {
+		params = append(params, field[start:])
+	}
+
+	return params
+}